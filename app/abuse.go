@@ -0,0 +1,176 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gofipe/pkg/fipe"
+)
+
+// --- Label poisoning detection ---
+//
+// /api/price receives brandName and modelName from the client and uses them
+// as metric labels. A client sending made-up names could flood Prometheus
+// with junk series. Names are therefore checked against the names returned
+// by the upstream for the requested IDs: mismatches are replaced by the
+// upstream names and count as a strike for the client IP. After
+// labelAbuseMaxStrikes strikes within labelAbuseWindow the IP is flagged and
+// its searches stop contributing labels for labelAbuseCooldown.
+
+const (
+	labelAbuseMaxStrikes = 5
+	labelAbuseWindow     = 10 * time.Minute
+	labelAbuseCooldown   = time.Hour
+	maxLoggedLabelLength = 80
+)
+
+var (
+	// labelPoisoningCounter counts rejected client label values by action taken.
+	labelPoisoningCounter = newBudgetedCounterVec(
+		prometheus.CounterOpts{
+			Name: "fipe_label_poisoning_total",
+			Help: "Searches whose client-supplied labels did not match the upstream data, by action (corrected, ignored)",
+		},
+		[]string{"action"},
+	)
+
+	// labelAbuseFlaggedGauge reports how many client IPs are currently flagged.
+	labelAbuseFlaggedGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "fipe_label_abuse_flagged_clients",
+		Help: "Client IPs whose searches are currently ignored for metric labels",
+	})
+)
+
+func init() {
+	registerBudgeted(labelPoisoningCounter)
+	prometheus.MustRegister(labelAbuseFlaggedGauge)
+}
+
+// abuseRecord tracks the strikes of one client IP.
+type abuseRecord struct {
+	strikes      int
+	windowStart  time.Time
+	flaggedUntil time.Time
+}
+
+// labelAbuseTracker keeps strike records per client IP.
+type labelAbuseTracker struct {
+	mu      sync.Mutex
+	clients map[string]*abuseRecord
+}
+
+var labelAbuse = &labelAbuseTracker{clients: map[string]*abuseRecord{}}
+
+// flagged reports whether ip is currently ignored.
+func (t *labelAbuseTracker) flagged(ip string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rec, ok := t.clients[ip]
+	if !ok || rec.flaggedUntil.IsZero() {
+		return false
+	}
+	if now.Before(rec.flaggedUntil) {
+		return true
+	}
+	rec.flaggedUntil = time.Time{}
+	t.updateFlaggedGauge(now)
+	return false
+}
+
+// strike records a mismatch for ip and reports whether it just got flagged.
+func (t *labelAbuseTracker) strike(ip string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.prune(now)
+	rec, ok := t.clients[ip]
+	if !ok {
+		rec = &abuseRecord{windowStart: now}
+		t.clients[ip] = rec
+	} else if now.Sub(rec.windowStart) > labelAbuseWindow {
+		rec.strikes, rec.windowStart = 0, now
+	}
+	rec.strikes++
+	if rec.strikes >= labelAbuseMaxStrikes && !now.Before(rec.flaggedUntil) {
+		rec.flaggedUntil = now.Add(labelAbuseCooldown)
+		t.updateFlaggedGauge(now)
+		return true
+	}
+	return false
+}
+
+// prune drops records that are neither flagged nor inside a strike window.
+// Callers must hold t.mu.
+func (t *labelAbuseTracker) prune(now time.Time) {
+	if len(t.clients) < 1000 {
+		return
+	}
+	for ip, rec := range t.clients {
+		if now.Sub(rec.windowStart) > labelAbuseWindow && !now.Before(rec.flaggedUntil) {
+			delete(t.clients, ip)
+		}
+	}
+	t.updateFlaggedGauge(now)
+}
+
+// updateFlaggedGauge recounts flagged clients. Callers must hold t.mu.
+func (t *labelAbuseTracker) updateFlaggedGauge(now time.Time) {
+	n := 0
+	for _, rec := range t.clients {
+		if now.Before(rec.flaggedUntil) {
+			n++
+		}
+	}
+	labelAbuseFlaggedGauge.Set(float64(n))
+}
+
+// sameLabel compares a client-supplied name with the upstream one.
+func sameLabel(client, upstream string) bool {
+	return strings.EqualFold(strings.TrimSpace(client), strings.TrimSpace(upstream))
+}
+
+// truncateForLog shortens attacker-controlled values before logging them.
+func truncateForLog(s string) string {
+	if len(s) > maxLoggedLabelLength {
+		return s[:maxLoggedLabelLength] + "..."
+	}
+	return s
+}
+
+// maskKey keeps only the first characters of an API key for logging.
+func maskKey(key string) string {
+	if key == "" {
+		return "-"
+	}
+	if len(key) <= 4 {
+		return "****"
+	}
+	return key[:4] + "****"
+}
+
+// recordSearchLabels updates the search metrics for a successful price
+// lookup, guarding them against label poisoning.
+func recordSearchLabels(r *http.Request, brandName, modelName, yearId string, pr fipe.Price) {
+	ip := clientIP(r)
+	now := time.Now()
+	if labelAbuse.flagged(ip, now) {
+		labelPoisoningCounter.Inc("ignored")
+		return
+	}
+
+	if !sameLabel(brandName, pr.Brand) || !sameLabel(modelName, pr.Model) {
+		labelPoisoningCounter.Inc("corrected")
+		flagged := labelAbuse.strike(ip, now)
+		slog.WarnContext(r.Context(), "label mismatch", "ip", ip, "class", classifyClient(r), "key", maskKey(r.Header.Get("X-API-Key")),
+			"brand_name", truncateForLog(brandName), "model_name", truncateForLog(modelName),
+			"upstream_brand", pr.Brand, "upstream_model", pr.Model, "flagged", flagged)
+		brandName, modelName = pr.Brand, pr.Model
+	}
+
+	vehicleSearchCounter.Inc(brandName, modelName, yearId)
+	brandSearchCounter.Inc(brandName)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"log/slog"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// --- Price-change alert emails ---
+//
+// With GOFIPE_SMTP_ADDR (host:port) and GOFIPE_SMTP_FROM set, /api/alerts
+// also accepts "mailto:" URLs. Instead of one message per vehicle, each
+// history collector run sends every address a single summary, rendered from
+// templates/alert_email.txt, of the watched vehicles whose price changed past
+// its threshold, with the previous price, the new one and the change.
+// GOFIPE_SMTP_USERNAME and GOFIPE_SMTP_PASSWORD enable PLAIN authentication,
+// which net/smtp only performs over TLS (STARTTLS) or to localhost. Sends are
+// retried like webhook deliveries and counted in
+// fipe_price_alerts_total{channel="email"}.
+
+// alertMailer is nil unless GOFIPE_SMTP_ADDR is set.
+var alertMailer = mustLoadAlertMailer()
+
+// smtpMailer sends alert emails through an SMTP server.
+type smtpMailer struct {
+	addr string
+	from *mail.Address
+	auth smtp.Auth
+	tmpl *template.Template
+}
+
+// mustLoadAlertMailer reads the GOFIPE_SMTP_* settings.
+func mustLoadAlertMailer() *smtpMailer {
+	addr := os.Getenv("GOFIPE_SMTP_ADDR")
+	if addr == "" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		log.Fatalf("Invalid GOFIPE_SMTP_ADDR: %v", err)
+	}
+	from, err := mail.ParseAddress(os.Getenv("GOFIPE_SMTP_FROM"))
+	if err != nil {
+		log.Fatalf("Invalid GOFIPE_SMTP_FROM: %v", err)
+	}
+	m := &smtpMailer{
+		addr: addr,
+		from: from,
+		tmpl: template.Must(template.New("alert_email.txt").Funcs(alertEmailFuncs).ParseFiles("templates/alert_email.txt")),
+	}
+	if user := os.Getenv("GOFIPE_SMTP_USERNAME"); user != "" {
+		m.auth = smtp.PlainAuth("", user, os.Getenv("GOFIPE_SMTP_PASSWORD"), host)
+	}
+	return m
+}
+
+// alertEmailFuncs are the helpers available to templates/alert_email.txt.
+var alertEmailFuncs = template.FuncMap{
+	"brl":     formatBRL,
+	"percent": formatChangePercent,
+}
+
+// formatChangePercent formats a signed change such as "+2,27%".
+func formatChangePercent(v float64) string {
+	s := locales[defaultLocale].FormatNumber(v) + "%"
+	if v > 0 {
+		s = "+" + s
+	}
+	return s
+}
+
+// alertEmailRecipient returns the address of a mailto: alert URL.
+func alertEmailRecipient(u string) (string, bool) {
+	rest, ok := strings.CutPrefix(u, "mailto:")
+	if !ok {
+		return "", false
+	}
+	a, err := mail.ParseAddress(rest)
+	if err != nil || a.Name != "" {
+		return "", false
+	}
+	return a.Address, true
+}
+
+// alertDigest gathers the price changes to summarize at the end of a
+// collector run, by email address or Telegram chat URL.
+type alertDigest map[string][]PriceChangeEvent
+
+// add queues ev for the mailto: URL u, or the Telegram chat URL u.
+func (d alertDigest) add(u string, ev PriceChangeEvent) {
+	if to, ok := alertEmailRecipient(u); ok {
+		d[to] = append(d[to], ev)
+	} else if _, ok := telegramAlertChat(u); ok {
+		d[u] = append(d[u], ev)
+	}
+}
+
+// send delivers every recipient its summary in the background.
+func (d alertDigest) send() {
+	for to, events := range d {
+		sort.Slice(events, func(i, j int) bool {
+			return events[i].Brand+events[i].Model < events[j].Brand+events[j].Model
+		})
+		if chat, ok := telegramAlertChat(to); ok {
+			if telegramSubscriptionsEnabled() {
+				go telegramNotify(chat, events)
+			}
+		} else if alertMailer != nil {
+			go alertMailer.deliver(to, events)
+		}
+	}
+}
+
+// deliver emails events to to, retrying with exponential backoff.
+func (m *smtpMailer) deliver(to string, events []PriceChangeEvent) {
+	msg, err := m.render(to, events)
+	if err != nil {
+		alertDeliveriesCounter.Inc("email", "failed")
+		slog.Error("price alert email failed", "to", to, "error", err)
+		return
+	}
+	for attempt := 0; attempt < alertDeliveryAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(1<<attempt) * time.Second)
+		}
+		if err = smtp.SendMail(m.addr, m.auth, m.from.Address, []string{to}, msg); err == nil {
+			alertDeliveriesCounter.Inc("email", "delivered")
+			return
+		}
+	}
+	alertDeliveriesCounter.Inc("email", "failed")
+	slog.Error("price alert email failed", "to", to, "attempts", alertDeliveryAttempts, "error", err)
+}
+
+// render builds the email message with headers.
+func (m *smtpMailer) render(to string, events []PriceChangeEvent) ([]byte, error) {
+	var body bytes.Buffer
+	if err := m.tmpl.Execute(&body, events); err != nil {
+		return nil, err
+	}
+	subject := fmt.Sprintf("FIPE: %d watched vehicle price changes", len(events))
+	if len(events) == 1 {
+		subject = fmt.Sprintf("FIPE: %s %s price changed %s", events[0].Brand, events[0].Model, formatChangePercent(events[0].ChangePercent))
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", m.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(strings.ReplaceAll(body.String(), "\r\n", "\n"), "\n", "\r\n"))
+	return msg.Bytes(), nil
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gofipe/pkg/fipe"
+)
+
+// --- Price-change alerts ---
+//
+// API key holders register webhooks under /api/alerts, each with a
+// threshold percentage:
+//
+//   - POST   /api/alerts with {"url", "thresholdPercent"} adds a webhook or
+//     updates its threshold.
+//   - GET    /api/alerts lists the caller's webhooks.
+//   - DELETE /api/alerts?url= removes one (204, or 404 when not listed).
+//
+// When the history collector stores a newly published reference table for
+// a vehicle whose previous table is already stored, it compares the two
+// prices and POSTs a price_changed event to the webhooks of every key
+// watching the vehicle (see /api/watchlist) whose threshold the change
+// reaches. Backfilled tables never alert. Deliveries are tried up to
+// alertDeliveryAttempts times with exponential backoff.
+//
+// Webhook hosts must resolve to public addresses, checked when the webhook
+// is registered and again when each delivery connects, so a key holder
+// cannot make gofipe call loopback, private or link-local services (cloud
+// metadata included); redirects are not followed. Each webhook gets a
+// secret, returned when it is registered and listed, and deliveries carry
+// X-Gofipe-Request-Timestamp and X-Gofipe-Signature, "v0=" and the hex
+// HMAC-SHA256 of "v0:<timestamp>:<body>" with that secret, as Slack signs
+// its requests. "mailto:" URLs get
+// an email summary instead when SMTP is configured (see alertmail.go). The
+// routes are registered with the watchlist.
+
+const (
+	maxAlertWebhooks      = 10
+	alertDeliveryAttempts = 4
+	alertDeliveryTimeout  = 10 * time.Second
+)
+
+// alertDeliveriesCounter counts alert deliveries by channel and result.
+var alertDeliveriesCounter = newBudgetedCounterVec(
+	prometheus.CounterOpts{
+		Name: "fipe_price_alerts_total",
+		Help: "Price-change alert deliveries by channel (webhook, email, telegram) and result (delivered, failed)",
+	},
+	[]string{"channel", "result"},
+)
+
+func init() {
+	registerBudgeted(alertDeliveriesCounter)
+}
+
+// alertClient posts to the services operators configure (Telegram, the
+// quality alert webhook).
+var alertClient = &http.Client{Timeout: alertDeliveryTimeout}
+
+// alertWebhookClient posts to the webhooks of API key holders: it only
+// connects to public addresses, without a proxy, and does not follow
+// redirects.
+var alertWebhookClient = &http.Client{
+	Timeout: alertDeliveryTimeout,
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 5 * time.Second, Control: checkWebhookDial}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+// cgnatPrefix is the shared address space of carrier-grade NAT, which
+// netip does not count as private.
+var cgnatPrefix = netip.MustParsePrefix("100.64.0.0/10")
+
+// publicWebhookAddr reports whether a webhook may be delivered to addr.
+func publicWebhookAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsGlobalUnicast() && !addr.IsPrivate() && !cgnatPrefix.Contains(addr)
+}
+
+// checkWebhookDial refuses connections to non-public addresses; it runs on
+// the resolved address of every connection, so DNS answers that change
+// after registration are caught too.
+func checkWebhookDial(network, address string, _ syscall.RawConn) error {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil || !publicWebhookAddr(ap.Addr()) {
+		return fmt.Errorf("webhook address %s is not public", address)
+	}
+	return nil
+}
+
+// AlertWebhook is a webhook of /api/alerts.
+type AlertWebhook struct {
+	URL              string    `json:"url"`
+	ThresholdPercent float64   `json:"thresholdPercent"`
+	AddedAt          time.Time `json:"addedAt"`
+	// Secret signs the deliveries; it is not read from requests.
+	Secret string `json:"secret,omitempty"`
+}
+
+// PriceChangeEvent is the body POSTed to alert webhooks.
+type PriceChangeEvent struct {
+	Event                  string         `json:"event"`
+	Vehicle                watchedVehicle `json:"vehicle"`
+	Brand                  string         `json:"brand"`
+	Model                  string         `json:"model"`
+	CodeFipe               string         `json:"codeFipe"`
+	ReferenceMonth         string         `json:"referenceMonth"`
+	Price                  float64        `json:"price"`
+	PreviousReferenceMonth string         `json:"previousReferenceMonth"`
+	PreviousPrice          float64        `json:"previousPrice"`
+	ChangePercent          float64        `json:"changePercent"`
+	ThresholdPercent       float64        `json:"thresholdPercent"`
+}
+
+// addAlertWebhook adds the webhook of owner with a new secret, or updates
+// its threshold and keeps its secret.
+func (s *historyStore) addAlertWebhook(ctx context.Context, owner, u string, threshold float64) error {
+	_, err := s.db.ExecContext(ctx, s.rebind(`INSERT INTO alert_webhooks (owner, url, threshold_percent, added_at, secret)
+		VALUES (?, ?, ?, ?, ?) ON CONFLICT (owner, url) DO UPDATE SET threshold_percent = excluded.threshold_percent`),
+		owner, u, threshold, appClock.Now().Unix(), newWebhookSecret())
+	return err
+}
+
+// newWebhookSecret returns a random webhook signing secret.
+func newWebhookSecret() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// removeAlertWebhook removes a webhook of owner, reporting whether it was listed.
+func (s *historyStore) removeAlertWebhook(ctx context.Context, owner, u string) (bool, error) {
+	res, err := s.db.ExecContext(ctx, s.rebind(`DELETE FROM alert_webhooks WHERE owner = ? AND url = ?`), owner, u)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// alertWebhooks lists the webhooks of owner, oldest first.
+func (s *historyStore) alertWebhooks(ctx context.Context, owner string) ([]AlertWebhook, error) {
+	rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT url, threshold_percent, added_at, secret FROM alert_webhooks
+		WHERE owner = ? ORDER BY added_at, url`), owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []AlertWebhook{}
+	for rows.Next() {
+		var h AlertWebhook
+		var added int64
+		if err := rows.Scan(&h.URL, &h.ThresholdPercent, &added, &h.Secret); err != nil {
+			return nil, err
+		}
+		h.AddedAt = time.Unix(added, 0).UTC()
+		out = append(out, h)
+	}
+	return out, rows.Err()
+}
+
+// watcherWebhooks lists the webhooks of the keys watching v.
+func (s *historyStore) watcherWebhooks(ctx context.Context, v watchedVehicle) ([]AlertWebhook, error) {
+	rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT a.url, a.threshold_percent, a.secret FROM alert_webhooks a
+		JOIN watchlist w ON w.owner = a.owner
+		WHERE w.vehicle_type = ? AND w.brand_id = ? AND w.model_id = ? AND w.year_id = ?`),
+		v.Type, v.BrandID, v.ModelID, v.YearID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []AlertWebhook
+	for rows.Next() {
+		var h AlertWebhook
+		if err := rows.Scan(&h.URL, &h.ThresholdPercent, &h.Secret); err != nil {
+			return nil, err
+		}
+		out = append(out, h)
+	}
+	return out, rows.Err()
+}
+
+// alertPriceChange compares the new price of v with its stored previous
+// snapshot and notifies the webhooks whose threshold the change reaches.
+// Email recipients, and Telegram chats subscribed to v when the price
+// changed, are added to digest.
+func (s *historyStore) alertPriceChange(ctx context.Context, v watchedVehicle, previousPayload string, current fipe.Price, digest alertDigest) {
+	var previous fipe.Price
+	if err := json.Unmarshal([]byte(previousPayload), &previous); err != nil {
+		return
+	}
+	prev, err1 := previous.Value()
+	cur, err2 := current.Value()
+	if err1 != nil || err2 != nil || prev <= 0 {
+		return
+	}
+	change := (cur - prev) / prev * 100
+	ev := PriceChangeEvent{
+		Event:                  "price_changed",
+		Vehicle:                v,
+		Brand:                  current.Brand,
+		Model:                  current.Model,
+		CodeFipe:               current.CodeFipe,
+		ReferenceMonth:         current.ReferenceMonth,
+		Price:                  cur,
+		PreviousReferenceMonth: previous.ReferenceMonth,
+		PreviousPrice:          prev,
+		ChangePercent:          math.Round(change*100) / 100,
+	}
+	hooks, err := s.watcherWebhooks(ctx, v)
+	if err != nil {
+		slog.ErrorContext(ctx, "price alerts query failed", "error", err)
+	}
+	for _, h := range hooks {
+		if math.Abs(change) < h.ThresholdPercent {
+			continue
+		}
+		ev.ThresholdPercent = h.ThresholdPercent
+		if strings.HasPrefix(h.URL, "mailto:") {
+			digest.add(h.URL, ev)
+			continue
+		}
+		go deliverAlert(h, ev)
+	}
+
+	if !telegramSubscriptionsEnabled() || ev.ChangePercent == 0 {
+		return
+	}
+	chats, err := s.telegramSubscribers(ctx, v)
+	if err != nil {
+		slog.ErrorContext(ctx, "price alerts query failed", "error", err)
+	}
+	ev.ThresholdPercent = 0
+	for _, chat := range chats {
+		digest.add(telegramAlertURL(chat), ev)
+	}
+}
+
+// deliverAlert POSTs ev to the webhook h, signed with its secret.
+func deliverAlert(h AlertWebhook, ev PriceChangeEvent) {
+	body, _ := json.Marshal(ev)
+	if err := postWebhook(alertWebhookClient, h.URL, body, h.Secret); err != nil {
+		alertDeliveriesCounter.Inc("webhook", "failed")
+		slog.Error("price alert delivery failed", "url", h.URL, "attempts", alertDeliveryAttempts, "error", err)
+		return
+	}
+	alertDeliveriesCounter.Inc("webhook", "delivered")
+}
+
+// postWebhook POSTs the JSON body to u with client, signed with secret
+// unless it is empty, retrying with exponential backoff until a 2xx
+// answer.
+func postWebhook(client *http.Client, u string, body []byte, secret string) error {
+	var err error
+	for attempt := 0; attempt < alertDeliveryAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(1<<attempt) * time.Second)
+		}
+		var req *http.Request
+		if req, err = http.NewRequest(http.MethodPost, u, bytes.NewReader(body)); err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if secret != "" {
+			ts := time.Now().Unix()
+			req.Header.Set("X-Gofipe-Request-Timestamp", strconv.FormatInt(ts, 10))
+			req.Header.Set("X-Gofipe-Signature", webhookSignature(secret, ts, body))
+		}
+		var resp *http.Response
+		resp, err = client.Do(req)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 == 2 {
+			return nil
+		}
+		err = fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return err
+}
+
+// webhookSignature is the X-Gofipe-Signature of body sent at ts.
+func webhookSignature(secret string, ts int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%d:%s", ts, body)
+	return "v0=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// handleAlerts serves /api/alerts for the caller's API key.
+func handleAlerts(w http.ResponseWriter, r *http.Request) {
+	recordHTTPRequest("/api/alerts", r.Method)
+	owner, _ := apiKeyName(r)
+	switch r.Method {
+	case http.MethodGet:
+		hooks, err := historyDB.alertWebhooks(r.Context(), owner)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "price alerts query failed", "error", err)
+			http.Error(w, "alerts unavailable", http.StatusInternalServerError)
+			return
+		}
+		b, _ := json.Marshal(map[string]interface{}{"webhooks": hooks})
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	case http.MethodPost:
+		var h AlertWebhook
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16<<10)).Decode(&h); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if err := validateAlertURL(r.Context(), h.URL); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if h.ThresholdPercent < 0 || math.IsNaN(h.ThresholdPercent) {
+			http.Error(w, "thresholdPercent must be 0 or positive", http.StatusBadRequest)
+			return
+		}
+		hooks, err := historyDB.alertWebhooks(r.Context(), owner)
+		if err == nil && len(hooks) >= maxAlertWebhooks && !hasWebhook(hooks, h.URL) {
+			http.Error(w, fmt.Sprintf("alerts are limited to %d webhooks", maxAlertWebhooks), http.StatusConflict)
+			return
+		}
+		if err == nil {
+			err = historyDB.addAlertWebhook(r.Context(), owner, h.URL, h.ThresholdPercent)
+		}
+		if err == nil {
+			hooks, err = historyDB.alertWebhooks(r.Context(), owner)
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "price alerts query failed", "error", err)
+			http.Error(w, "alerts unavailable", http.StatusInternalServerError)
+			return
+		}
+		// Answer the stored webhook, with its secret.
+		for _, stored := range hooks {
+			if stored.URL == h.URL {
+				h = stored
+			}
+		}
+		b, _ := json.Marshal(h)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	case http.MethodDelete:
+		removed, err := historyDB.removeAlertWebhook(r.Context(), owner, r.URL.Query().Get("url"))
+		switch {
+		case err != nil:
+			slog.ErrorContext(r.Context(), "price alerts query failed", "error", err)
+			http.Error(w, "alerts unavailable", http.StatusInternalServerError)
+		case !removed:
+			http.Error(w, "webhook not registered", http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
+
+// validateAlertURL checks that u is an absolute http(s) URL whose host
+// only resolves to public addresses, or a mailto: address when alert
+// emails are configured.
+func validateAlertURL(ctx context.Context, u string) error {
+	if strings.HasPrefix(u, "mailto:") {
+		if alertMailer == nil {
+			return errors.New("email alerts are not configured on this server")
+		}
+		if _, ok := alertEmailRecipient(u); !ok {
+			return errors.New("url must be mailto: followed by a single email address")
+		}
+		return nil
+	}
+	p, err := url.Parse(u)
+	if err != nil || (p.Scheme != "http" && p.Scheme != "https") || p.Hostname() == "" {
+		return errors.New("url must be an absolute http(s) URL")
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", p.Hostname())
+	if err != nil || len(addrs) == 0 {
+		return fmt.Errorf("url host %s does not resolve", p.Hostname())
+	}
+	for _, addr := range addrs {
+		if !publicWebhookAddr(addr) {
+			return errors.New("url must point to a public address, not a loopback, private or link-local one")
+		}
+	}
+	return nil
+}
+
+// hasWebhook reports whether hooks lists u.
+func hasWebhook(hooks []AlertWebhook, u string) bool {
+	for _, h := range hooks {
+		if h.URL == u {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gofipe/pkg/fipe"
+)
+
+// --- Price anomalies ---
+//
+// After collecting a vehicle, the history collector checks its stored
+// series for implausible jumps: a price that differs by more than
+// GOFIPE_ANOMALY_THRESHOLD percent (default 40) from the last plausible
+// price before it and, when a newer table is stored, from that one too. A
+// one-month spike is flagged, while a lasting change stops being suspect
+// once the next table confirms it. Suspect snapshots are kept but left out of /api/priceHistory
+// (unless includeSuspect=true), the vehicle pages, projections, baskets and
+// price alerts. GET /admin/anomalies lists them and
+// fipe_price_anomalies_total counts each one flagged.
+
+const defaultAnomalyThreshold = 40.0
+
+// anomalyThreshold is the month-over-month change, in percent, above which
+// a stored price is suspect.
+var anomalyThreshold = mustLoadAnomalyThreshold()
+
+// anomaliesCounter counts newly flagged snapshots.
+var anomaliesCounter = newBudgetedCounterVec(
+	prometheus.CounterOpts{
+		Name: "fipe_price_anomalies_total",
+		Help: "Stored prices flagged as suspect by the history collector, by vehicle type",
+	},
+	[]string{"type"},
+)
+
+func init() {
+	registerBudgeted(anomaliesCounter)
+}
+
+// mustLoadAnomalyThreshold reads GOFIPE_ANOMALY_THRESHOLD.
+func mustLoadAnomalyThreshold() float64 {
+	v := os.Getenv("GOFIPE_ANOMALY_THRESHOLD")
+	if v == "" {
+		return defaultAnomalyThreshold
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f <= 0 || math.IsInf(f, 0) {
+		log.Fatalf("Invalid GOFIPE_ANOMALY_THRESHOLD: %q is not a positive percentage", v)
+	}
+	return f
+}
+
+// PriceAnomaly is a stored price flagged as suspect.
+type PriceAnomaly struct {
+	Vehicle                watchedVehicle `json:"vehicle"`
+	ReferenceCode          string         `json:"referenceCode"`
+	ReferenceMonth         string         `json:"referenceMonth"`
+	Price                  float64        `json:"price"`
+	PreviousReferenceMonth string         `json:"previousReferenceMonth"`
+	PreviousPrice          float64        `json:"previousPrice"`
+	ChangePercent          float64        `json:"changePercent"`
+	DetectedAt             time.Time      `json:"detectedAt"`
+}
+
+// detectAnomalies flags the prices of v in tables, newest first, that jump
+// past threshold percent from the last plausible price before them and from
+// the next price, if any. stored holds the snapshots by table code.
+func detectAnomalies(v watchedVehicle, tables []fipe.ReferenceTable, stored map[string]string, threshold float64) []PriceAnomaly {
+	type point struct {
+		code, month string
+		value       float64
+	}
+	var series []point // oldest first
+	for i := len(tables) - 1; i >= 0; i-- {
+		var pr fipe.Price
+		if payload := stored[tables[i].Code]; payload == "" || json.Unmarshal([]byte(payload), &pr) != nil {
+			continue
+		}
+		if f, err := pr.Value(); err == nil && f > 0 {
+			series = append(series, point{tables[i].Code, pr.ReferenceMonth, f})
+		}
+	}
+	jump := func(a, b float64) bool { return math.Abs(a-b)/b*100 > threshold }
+	var out []PriceAnomaly
+	for i, base := 1, 0; i < len(series); i++ {
+		p, prev := series[i], series[base]
+		// A jump the next table keeps is a real change of level.
+		if !jump(p.value, prev.value) || (i+1 < len(series) && !jump(p.value, series[i+1].value)) {
+			base = i
+			continue
+		}
+		out = append(out, PriceAnomaly{
+			Vehicle:                v,
+			ReferenceCode:          p.code,
+			ReferenceMonth:         p.month,
+			Price:                  p.value,
+			PreviousReferenceMonth: prev.month,
+			PreviousPrice:          prev.value,
+			ChangePercent:          math.Round((p.value-prev.value)/prev.value*1e4) / 100,
+		})
+	}
+	return out
+}
+
+// refreshAnomalies replaces the flagged snapshots of v with found,
+// keeping when the still suspect ones were first detected. It returns how
+// many were newly flagged.
+func (s *historyStore) refreshAnomalies(ctx context.Context, v watchedVehicle, found []PriceAnomaly) (int, error) {
+	known, err := s.suspectCodes(ctx, v)
+	if err != nil {
+		return 0, err
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	flagged := 0
+	for _, a := range found {
+		if known[a.ReferenceCode] {
+			delete(known, a.ReferenceCode)
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO price_anomalies
+			(vehicle_type, brand_id, model_id, year_id, reference_code, reference_month,
+			 price, previous_reference_month, previous_price, change_percent, detected_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+			v.Type, v.BrandID, v.ModelID, v.YearID, a.ReferenceCode, a.ReferenceMonth,
+			a.Price, a.PreviousReferenceMonth, a.PreviousPrice, a.ChangePercent, appClock.Now().Unix()); err != nil {
+			return 0, err
+		}
+		flagged++
+		slog.WarnContext(ctx, "suspect price", "vehicle", v.String(), "reference_code", a.ReferenceCode,
+			"change_percent", a.ChangePercent, "previous_reference_month", a.PreviousReferenceMonth)
+	}
+	// What is left was confirmed by a newer table.
+	for code := range known {
+		if _, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM price_anomalies
+			WHERE vehicle_type = ? AND brand_id = ? AND model_id = ? AND year_id = ? AND reference_code = ?`),
+			v.Type, v.BrandID, v.ModelID, v.YearID, code); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	if flagged > 0 {
+		anomaliesCounter.Add(float64(flagged), v.Type)
+	}
+	return flagged, nil
+}
+
+// notSuspectSQL restricts a query on price_snapshots, aliased p, to the
+// snapshots not flagged as suspect.
+const notSuspectSQL = `NOT EXISTS (SELECT 1 FROM price_anomalies a
+	WHERE a.vehicle_type = p.vehicle_type AND a.brand_id = p.brand_id AND a.model_id = p.model_id
+	AND a.year_id = p.year_id AND a.reference_code = p.reference_code)`
+
+// suspectCodePrices returns the flagged snapshots keyed by
+// suspectCodePriceKey, for lookups by FIPE code.
+func (s *historyStore) suspectCodePrices(ctx context.Context) (map[string]bool, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT p.vehicle_type, p.year_id, p.reference_code, p.payload
+		FROM price_snapshots p JOIN price_anomalies a
+		ON a.vehicle_type = p.vehicle_type AND a.brand_id = p.brand_id AND a.model_id = p.model_id
+		AND a.year_id = p.year_id AND a.reference_code = p.reference_code`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := map[string]bool{}
+	for rows.Next() {
+		var vehicleType, yearID, code, payload string
+		if err := rows.Scan(&vehicleType, &yearID, &code, &payload); err != nil {
+			return nil, err
+		}
+		var pr fipe.Price
+		if json.Unmarshal([]byte(payload), &pr) == nil {
+			out[suspectCodePriceKey(vehicleType, pr.CodeFipe, yearID, code)] = true
+		}
+	}
+	return out, rows.Err()
+}
+
+// suspectCodePriceKey keys the price of a FIPE code and model year in
+// reference table code.
+func suspectCodePriceKey(vehicleType, fipeCode, yearID, code string) string {
+	return vehicleType + "/" + fipeCode + "/" + yearID + "@" + code
+}
+
+// suspectCodes returns the reference codes of the flagged snapshots of v.
+func (s *historyStore) suspectCodes(ctx context.Context, v watchedVehicle) (map[string]bool, error) {
+	rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT reference_code FROM price_anomalies
+		WHERE vehicle_type = ? AND brand_id = ? AND model_id = ? AND year_id = ?`),
+		v.Type, v.BrandID, v.ModelID, v.YearID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := map[string]bool{}
+	for rows.Next() {
+		var code string
+		if err := rows.Scan(&code); err != nil {
+			return nil, err
+		}
+		out[code] = true
+	}
+	return out, rows.Err()
+}
+
+// anomalies lists up to limit flagged snapshots, newest first.
+func (s *historyStore) anomalies(ctx context.Context, limit int) ([]PriceAnomaly, error) {
+	rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT vehicle_type, brand_id, model_id, year_id, reference_code,
+		reference_month, price, previous_reference_month, previous_price, change_percent, detected_at
+		FROM price_anomalies ORDER BY detected_at DESC, reference_code DESC LIMIT ?`), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []PriceAnomaly{}
+	for rows.Next() {
+		var a PriceAnomaly
+		var detected int64
+		if err := rows.Scan(&a.Vehicle.Type, &a.Vehicle.BrandID, &a.Vehicle.ModelID, &a.Vehicle.YearID, &a.ReferenceCode,
+			&a.ReferenceMonth, &a.Price, &a.PreviousReferenceMonth, &a.PreviousPrice, &a.ChangePercent, &detected); err != nil {
+			return nil, err
+		}
+		a.DetectedAt = time.Unix(detected, 0).UTC()
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+// handleAnomalies serves GET /admin/anomalies.
+func handleAnomalies(w http.ResponseWriter, r *http.Request) {
+	recordHTTPRequest("/admin/anomalies", r.Method)
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 100
+	}
+	limit = min(limit, 1000)
+	found, err := historyDB.anomalies(r.Context(), limit)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "price anomalies query failed", "error", err)
+		http.Error(w, "anomalies unavailable", http.StatusInternalServerError)
+		return
+	}
+	b, _ := json.Marshal(map[string]interface{}{"thresholdPercent": anomalyThreshold, "anomalies": found})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
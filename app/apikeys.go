@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// --- API keys ---
+//
+// GOFIPE_API_KEYS lists the keys accepted by the integration endpoints as
+// comma-separated "<name>:<key>" pairs, e.g. "sheets:abc123,zapier:def456".
+// Clients send the key in the X-API-Key header. The name only identifies the
+// key in logs and metrics. Endpoints wrapped with requireAPIKey are not
+// registered when no keys are configured.
+
+// apiKey is one configured key.
+type apiKey struct {
+	Name string
+	Key  string
+}
+
+var apiKeys = parseAPIKeys(os.Getenv("GOFIPE_API_KEYS"))
+
+// apiKeyRequestsCounter counts authenticated requests per key name.
+var apiKeyRequestsCounter = newBudgetedCounterVec(
+	prometheus.CounterOpts{
+		Name: "fipe_api_key_requests_total",
+		Help: "Requests to key-protected endpoints by key name (\"invalid\" for rejected keys)",
+	},
+	[]string{"key_name"},
+)
+
+func init() {
+	registerBudgeted(apiKeyRequestsCounter)
+}
+
+// parseAPIKeys parses GOFIPE_API_KEYS, skipping malformed entries.
+func parseAPIKeys(s string) []apiKey {
+	var keys []apiKey
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, key, ok := strings.Cut(entry, ":")
+		if !ok || name == "" || key == "" {
+			slog.Warn("ignoring malformed GOFIPE_API_KEYS entry", "key", maskKey(entry))
+			continue
+		}
+		keys = append(keys, apiKey{Name: name, Key: key})
+	}
+	return keys
+}
+
+// apiKeyHeader is X-API-Key in canonical form, so reading it on every
+// request, cache hits included, does not allocate.
+const apiKeyHeader = "X-Api-Key"
+
+// apiKeyName returns the name of the key sent with r, if it is valid.
+func apiKeyName(r *http.Request) (string, bool) {
+	sent := r.Header.Get(apiKeyHeader)
+	if sent == "" {
+		return "", false
+	}
+	for _, k := range apiKeys {
+		if subtle.ConstantTimeCompare([]byte(sent), []byte(k.Key)) == 1 {
+			return k.Name, true
+		}
+	}
+	return "", false
+}
+
+// requireAPIKey rejects requests without a valid X-API-Key with 401.
+func requireAPIKey(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name, ok := apiKeyName(r)
+		if !ok {
+			apiKeyRequestsCounter.Inc("invalid")
+			http.Error(w, "missing or invalid X-API-Key", http.StatusUnauthorized)
+			return
+		}
+		apiKeyRequestsCounter.Inc(name)
+		next(w, r)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sort"
+	"time"
+
+	"gofipe/pkg/fipe"
+)
+
+// --- Reference-month archive ---
+//
+// With GOFIPE_HISTORY_DB set, /archive browses the prices the history store
+// holds for past reference months (all but the current table), without
+// calling FIPE for them. /archive lists the months, and
+// /archive/{month}/{type}/{brandId}/{modelId}/{yearId} (month as YYYY-MM,
+// e.g. /archive/2023-03/cars/59/5940/2014-3) narrows down to a vehicle, one
+// level at a time. Only the watched vehicles are
+// stored, so the archive is not a full FIPE table, and prices flagged as
+// suspect (see Price anomalies) are left out. Every page is marked as
+// historical and links to the current price of the vehicle.
+
+// archiveMonthRe matches the month segment of archive routes.
+var archiveMonthRe = regexp.MustCompile(`^\d{4}-(0[1-9]|1[0-2])$`)
+
+// ArchivePage is the view model rendered by templates/archive.html.
+type ArchivePage struct {
+	// Month is the archived month as YYYY-MM, empty on the month list.
+	Month      string
+	MonthLabel string
+	Heading    string
+	Crumbs     []VehicleLink
+	Links      []VehicleLink
+	// Price is set on the vehicle page.
+	Price       *fipe.Price
+	CurrentURL  string
+	OtherMonths []VehicleLink
+}
+
+// archivedMonth is a reference table the store holds prices of.
+type archivedMonth struct {
+	Key   string // YYYY-MM
+	Label string
+	Code  string
+	Count int
+}
+
+// archivedPrice is a stored price of a vehicle.
+type archivedPrice struct {
+	Vehicle watchedVehicle
+	Price   fipe.Price
+}
+
+// archiveMonthKey formats a reference month as YYYY-MM.
+func archiveMonthKey(month time.Month, year int) string {
+	return fmt.Sprintf("%04d-%02d", year, int(month))
+}
+
+// archivePath returns the archive path of month narrowed by segments.
+func archivePath(month string, segments ...string) string {
+	p := "/archive/" + month
+	for _, s := range segments {
+		p += "/" + s
+	}
+	return p
+}
+
+// archivedMonths lists the past reference tables with stored prices,
+// newest first.
+func (s *historyStore) archivedMonths(ctx context.Context) ([]archivedMonth, error) {
+	tables, err := fipeClient.References(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT p.reference_code, COUNT(*) FROM price_snapshots p
+		WHERE p.payload <> '' AND `+notSuspectSQL+` GROUP BY p.reference_code`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := map[string]int{}
+	for rows.Next() {
+		var code string
+		var n int
+		if err := rows.Scan(&code, &n); err != nil {
+			return nil, err
+		}
+		counts[code] = n
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	var out []archivedMonth
+	for i, t := range tables {
+		month, year, ok := parseReferenceMonth(t.Month)
+		if i == 0 {
+			// The current table is browsed through the vehicle pages.
+			continue
+		}
+		if !ok || counts[t.Code] == 0 {
+			continue
+		}
+		out = append(out, archivedMonth{
+			Key:   archiveMonthKey(month, year),
+			Label: locales["en-US"].FormatMonth(month, year),
+			Code:  t.Code,
+			Count: counts[t.Code],
+		})
+	}
+	return out, nil
+}
+
+// archivedPrices lists the prices stored for table code, only those of the
+// vehicles matching the non-empty filters of v.
+func (s *historyStore) archivedPrices(ctx context.Context, code string, v watchedVehicle) ([]archivedPrice, error) {
+	query := `SELECT p.vehicle_type, p.brand_id, p.model_id, p.year_id, p.payload FROM price_snapshots p
+		WHERE p.reference_code = ? AND p.payload <> '' AND ` + notSuspectSQL
+	args := []interface{}{code}
+	for _, f := range []struct{ column, value string }{
+		{"p.vehicle_type", v.Type}, {"p.brand_id", v.BrandID}, {"p.model_id", v.ModelID}, {"p.year_id", v.YearID},
+	} {
+		if f.value != "" {
+			query, args = query+` AND `+f.column+` = ?`, append(args, f.value)
+		}
+	}
+	rows, err := s.db.QueryContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []archivedPrice
+	for rows.Next() {
+		var p archivedPrice
+		var payload string
+		if err := rows.Scan(&p.Vehicle.Type, &p.Vehicle.BrandID, &p.Vehicle.ModelID, &p.Vehicle.YearID, &payload); err != nil {
+			return nil, err
+		}
+		if json.Unmarshal([]byte(payload), &p.Price) != nil {
+			continue
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+// archiveLinks lists one link per distinct key of prices, sorted by label.
+func archiveLinks(prices []archivedPrice, key func(archivedPrice) (id, label string), path func(id string) string) []VehicleLink {
+	seen := map[string]bool{}
+	var links []VehicleLink
+	for _, p := range prices {
+		id, label := key(p)
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		links = append(links, VehicleLink{Label: label, URL: path(id)})
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].Label < links[j].Label })
+	return links
+}
+
+// registerArchivePages adds the /archive routes when the history store is
+// enabled.
+func registerArchivePages(mux *http.ServeMux) {
+	if historyDB == nil {
+		return
+	}
+	tmpl := template.Must(template.New("archive.html").Funcs(pageFuncs).ParseFiles("templates/archive.html"))
+	h := archivePageHandler(tmpl)
+	mux.HandleFunc("GET /archive", h)
+	mux.HandleFunc("GET /archive/{month}", h)
+	mux.HandleFunc("GET /archive/{month}/{type}", h)
+	mux.HandleFunc("GET /archive/{month}/{type}/{brandId}", h)
+	mux.HandleFunc("GET /archive/{month}/{type}/{brandId}/{modelId}", h)
+	mux.HandleFunc("GET /archive/{month}/{type}/{brandId}/{modelId}/{yearId}", h)
+}
+
+// archivePageHandler renders the /archive routes.
+func archivePageHandler(tmpl *template.Template) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		recordHTTPRequest("/archive", r.Method)
+		ctx := r.Context()
+		v := watchedVehicle{Type: r.PathValue("type"), BrandID: r.PathValue("brandId"), ModelID: r.PathValue("modelId"), YearID: r.PathValue("yearId")}
+		key := r.PathValue("month")
+		if key != "" && !archiveMonthRe.MatchString(key) {
+			http.NotFound(w, r)
+			return
+		}
+		if _, ok := vehicleTypes[v.Type]; v.Type != "" && !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		months, err := historyDB.archivedMonths(ctx)
+		if err != nil {
+			slog.ErrorContext(ctx, "archive months query failed", "error", err)
+			http.Error(w, "archive unavailable", http.StatusBadGateway)
+			return
+		}
+		page := &ArchivePage{Heading: "Archived reference months"}
+		if key == "" {
+			for _, m := range months {
+				label := fmt.Sprintf("%s (%d prices)", m.Label, m.Count)
+				if m.Count == 1 {
+					label = m.Label + " (1 price)"
+				}
+				page.Links = append(page.Links, VehicleLink{Label: label, URL: archivePath(m.Key)})
+			}
+			renderArchivePage(w, r, tmpl, page)
+			return
+		}
+
+		var month archivedMonth
+		for _, m := range months {
+			if m.Key == key {
+				month = m
+			}
+		}
+		if month.Code == "" {
+			http.NotFound(w, r)
+			return
+		}
+		prices, err := historyDB.archivedPrices(ctx, month.Code, v)
+		if err != nil {
+			slog.ErrorContext(ctx, "archive prices query failed", "error", err)
+			http.Error(w, "archive unavailable", http.StatusInternalServerError)
+			return
+		}
+		if len(prices) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+
+		page.Month, page.MonthLabel = month.Key, month.Label
+		page.Heading = "FIPE prices of " + month.Label
+		page.Crumbs = []VehicleLink{{Label: "Archive", URL: "/archive"}, {Label: month.Label, URL: archivePath(month.Key)}}
+		first := prices[0].Price
+		switch {
+		case v.Type == "":
+			page.Links = archiveLinks(prices, func(p archivedPrice) (string, string) {
+				return p.Vehicle.Type, vehicleTypes[p.Vehicle.Type]
+			}, func(id string) string { return archivePath(month.Key, id) })
+		case v.BrandID == "":
+			page.Heading = vehicleTypes[v.Type] + " in " + month.Label
+			page.Links = archiveLinks(prices, func(p archivedPrice) (string, string) {
+				return p.Vehicle.BrandID, p.Price.Brand
+			}, func(id string) string { return archivePath(month.Key, v.Type, id) })
+		case v.ModelID == "":
+			page.Heading = first.Brand + " in " + month.Label
+			page.Links = archiveLinks(prices, func(p archivedPrice) (string, string) {
+				return p.Vehicle.ModelID, p.Price.Model
+			}, func(id string) string { return archivePath(month.Key, v.Type, v.BrandID, id) })
+		case v.YearID == "":
+			page.Heading = first.Brand + " " + first.Model + " in " + month.Label
+			page.Links = archiveLinks(prices, func(p archivedPrice) (string, string) {
+				return p.Vehicle.YearID, fmt.Sprintf("%d %s", p.Price.ModelYear, p.Price.Fuel)
+			}, func(id string) string { return archivePath(month.Key, v.Type, v.BrandID, v.ModelID, id) })
+		default:
+			page.Heading = fmt.Sprintf("%s %s (%d) in %s", first.Brand, first.Model, first.ModelYear, month.Label)
+			page.Price = &first
+			page.CurrentURL = vehiclePath(v.Type, v.BrandID, v.ModelID, v.YearID)
+			stored, err := historyDB.snapshots(ctx, v)
+			var suspect map[string]bool
+			if err == nil {
+				suspect, err = historyDB.suspectCodes(ctx, v)
+			}
+			if err == nil {
+				for _, m := range months {
+					if stored[m.Code] != "" && !suspect[m.Code] {
+						page.OtherMonths = append(page.OtherMonths, VehicleLink{
+							Label:   m.Label,
+							URL:     archivePath(m.Key, v.Type, v.BrandID, v.ModelID, v.YearID),
+							Current: m.Key == month.Key,
+						})
+					}
+				}
+			} else {
+				slog.ErrorContext(ctx, "archive months query failed", "error", err)
+			}
+		}
+		if v.Type != "" {
+			page.Crumbs = append(page.Crumbs, VehicleLink{Label: vehicleTypes[v.Type], URL: archivePath(month.Key, v.Type)})
+		}
+		if v.BrandID != "" {
+			page.Crumbs = append(page.Crumbs, VehicleLink{Label: first.Brand, URL: archivePath(month.Key, v.Type, v.BrandID)})
+		}
+		if v.ModelID != "" {
+			page.Crumbs = append(page.Crumbs, VehicleLink{Label: first.Model, URL: archivePath(month.Key, v.Type, v.BrandID, v.ModelID)})
+		}
+		renderArchivePage(w, r, tmpl, page)
+	}
+}
+
+// renderArchivePage writes page, telling crawlers not to index it as a
+// current price.
+func renderArchivePage(w http.ResponseWriter, r *http.Request, tmpl *template.Template, page *ArchivePage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Robots-Tag", "noindex")
+	if err := tmpl.Execute(w, page); err != nil {
+		slog.ErrorContext(r.Context(), "render archive page failed", "error", err)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// --- Referrer / UTM attribution ---
+//
+// Enabled with GOFIPE_ATTRIBUTION=true. When a visitor lands on a page with
+// utm_source/utm_medium/utm_campaign parameters or from an external site,
+// the campaign (and only the referrer host, never its path) is kept in a
+// short-lived first-party cookie. Visits and the price lookups that follow
+// are counted per campaign, so operators can see which campaigns drive FIPE
+// lookups. Nothing is recorded for clients sending DNT: 1 or Sec-GPC: 1.
+
+const (
+	attributionCookie   = "fipe_attr"
+	attributionTTL      = 30 * time.Minute
+	maxAttributionValue = 40
+	attributionDirect   = "direct"
+)
+
+var attributionEnabled = os.Getenv("GOFIPE_ATTRIBUTION") == "true"
+
+var (
+	// attributedVisitsCounter counts landings per referrer and campaign.
+	attributedVisitsCounter = newBudgetedCounterVec(
+		prometheus.CounterOpts{
+			Name: "fipe_attributed_visits_total",
+			Help: "Page visits by referrer host and UTM campaign parameters",
+		},
+		[]string{"referrer", "utm_source", "utm_medium", "utm_campaign"},
+	)
+
+	// attributedLookupsCounter counts price lookups per referrer and campaign.
+	attributedLookupsCounter = newBudgetedCounterVec(
+		prometheus.CounterOpts{
+			Name: "fipe_attributed_lookups_total",
+			Help: "Price lookups by the referrer host and UTM campaign the visitor arrived with",
+		},
+		[]string{"referrer", "utm_source", "utm_medium", "utm_campaign"},
+	)
+)
+
+func init() {
+	registerBudgeted(attributedVisitsCounter, attributedLookupsCounter)
+}
+
+// attribution is the campaign a visitor arrived with.
+type attribution struct {
+	Referrer, Source, Medium, Campaign string
+}
+
+func (a attribution) labels() []string {
+	return []string{a.Referrer, a.Source, a.Medium, a.Campaign}
+}
+
+// trackingAllowed reports whether the client opted out of tracking.
+func trackingAllowed(r *http.Request) bool {
+	return attributionEnabled && r.Header.Get("DNT") != "1" && r.Header.Get("Sec-GPC") != "1"
+}
+
+// sanitizeAttribution lowercases v and keeps a bounded set of characters,
+// since both query parameters and cookies are client-controlled.
+func sanitizeAttribution(v string) string {
+	v = strings.ToLower(strings.TrimSpace(v))
+	var b strings.Builder
+	for _, c := range v {
+		if b.Len() >= maxAttributionValue {
+			break
+		}
+		if c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// landingAttribution extracts the campaign from the landing request, if any.
+func landingAttribution(r *http.Request) (attribution, bool) {
+	q := r.URL.Query()
+	a := attribution{
+		Source:   sanitizeAttribution(q.Get("utm_source")),
+		Medium:   sanitizeAttribution(q.Get("utm_medium")),
+		Campaign: sanitizeAttribution(q.Get("utm_campaign")),
+	}
+	if ref, err := url.Parse(r.Referer()); err == nil && ref.Hostname() != "" && ref.Host != r.Host {
+		a.Referrer = sanitizeAttribution(ref.Hostname())
+	}
+	if a == (attribution{}) {
+		return a, false
+	}
+	return a, true
+}
+
+// captureAttribution records a page visit and remembers its campaign in a cookie.
+// Internal navigation keeps the campaign stored by the original landing.
+func captureAttribution(w http.ResponseWriter, r *http.Request) {
+	if !trackingAllowed(r) {
+		return
+	}
+	a, ok := landingAttribution(r)
+	if !ok {
+		return
+	}
+	attributedVisitsCounter.Inc(a.labels()...)
+	v := url.Values{"r": {a.Referrer}, "s": {a.Source}, "m": {a.Medium}, "c": {a.Campaign}}
+	http.SetCookie(w, &http.Cookie{
+		Name:     attributionCookie,
+		Value:    v.Encode(),
+		Path:     "/",
+		MaxAge:   int(attributionTTL.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// recordAttributedLookup counts a price lookup under the visitor's campaign.
+func recordAttributedLookup(r *http.Request) {
+	if !trackingAllowed(r) {
+		return
+	}
+	a := attribution{Referrer: attributionDirect}
+	if c, err := r.Cookie(attributionCookie); err == nil {
+		if v, err := url.ParseQuery(c.Value); err == nil {
+			a = attribution{
+				Referrer: sanitizeAttribution(v.Get("r")),
+				Source:   sanitizeAttribution(v.Get("s")),
+				Medium:   sanitizeAttribution(v.Get("m")),
+				Campaign: sanitizeAttribution(v.Get("c")),
+			}
+		}
+	}
+	attributedLookupsCounter.Inc(a.labels()...)
+}
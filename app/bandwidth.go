@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// --- Bandwidth metrics ---
+
+var (
+	// upstreamBytesCounter counts bytes downloaded from the FIPE API.
+	upstreamBytesCounter = newBudgetedCounterVec(
+		prometheus.CounterOpts{
+			Name: "fipe_upstream_bytes_total",
+			Help: "Bytes downloaded from the upstream FIPE API by endpoint",
+		},
+		[]string{"endpoint"},
+	)
+
+	// upstreamPayloadSize tracks the size distribution of upstream payloads.
+	upstreamPayloadSize = newBudgetedHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "fipe_upstream_response_size_bytes",
+			Help:    "Size of upstream FIPE API payloads by endpoint",
+			Buckets: prometheus.ExponentialBuckets(256, 4, 8), // 256B .. 4MiB
+		},
+		[]string{"endpoint"},
+	)
+
+	// responseBytesCounter counts bytes served to clients by route.
+	responseBytesCounter = newBudgetedCounterVec(
+		prometheus.CounterOpts{
+			Name: "fipe_http_response_bytes_total",
+			Help: "Bytes written to clients by route pattern",
+		},
+		[]string{"route"},
+	)
+
+	// cacheServedBytesCounter counts bytes answered from the cache instead of the upstream.
+	cacheServedBytesCounter = newBudgetedCounterVec(
+		prometheus.CounterOpts{
+			Name: "fipe_cache_served_bytes_total",
+			Help: "Bytes served from the cache (upstream traffic saved) by cache key prefix",
+		},
+		[]string{"prefix"},
+	)
+)
+
+func init() {
+	registerBudgeted(upstreamBytesCounter, upstreamPayloadSize, responseBytesCounter, cacheServedBytesCounter)
+}
+
+// recordUpstreamBytes records the size of a payload downloaded from rawURL.
+func recordUpstreamBytes(rawURL string, n int) {
+	endpoint := upstreamEndpoint(rawURL)
+	upstreamBytesCounter.Add(float64(n), endpoint)
+	upstreamPayloadSize.Observe(float64(n), endpoint)
+}
+
+// recordCacheServedBytes records a cache hit of n bytes for key.
+func recordCacheServedBytes(key string, n int) {
+	prefix, _, _ := strings.Cut(key, ":")
+	cacheServedBytesCounter.Add(float64(n), prefix)
+	cacheHitsCounter.Inc(prefix)
+	cacheCountersFor(key).hits.Add(1)
+}
+
+// upstreamEndpoint classifies an upstream URL into a low-cardinality label:
+// brands, models, years, price, history, references or other.
+func upstreamEndpoint(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "other"
+	}
+	segs := strings.Split(strings.Trim(u.Path, "/"), "/")
+	for i := len(segs) - 1; i >= 0; i-- {
+		switch segs[i] {
+		case "brands", "models", "years", "references":
+			if i == len(segs)-1 {
+				return segs[i]
+			}
+			if segs[i] == "years" {
+				return "price"
+			}
+		case "history", "historico":
+			return "history"
+		}
+	}
+	return "other"
+}
+
+// byteCountingWriter counts the bytes written to the client.
+type byteCountingWriter struct {
+	http.ResponseWriter
+	n int
+}
+
+func (b *byteCountingWriter) Write(p []byte) (int, error) {
+	n, err := b.ResponseWriter.Write(p)
+	b.n += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (b *byteCountingWriter) Unwrap() http.ResponseWriter { return b.ResponseWriter }
+
+// byteCountingWriters recycles writers across requests.
+var byteCountingWriters = sync.Pool{New: func() any { return new(byteCountingWriter) }}
+
+// withBandwidthMetrics counts response bytes per matched route pattern.
+// It must wrap the ServeMux so r.Pattern is populated after dispatch.
+func withBandwidthMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bw := byteCountingWriters.Get().(*byteCountingWriter)
+		bw.ResponseWriter, bw.n = w, 0
+		next.ServeHTTP(bw, r)
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		responseBytesCounter.Add(float64(bw.n), route)
+		bw.ResponseWriter = nil
+		byteCountingWriters.Put(bw)
+	})
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gofipe/pkg/fipe"
+)
+
+// --- Custom baskets ---
+//
+// API key holders define their own indices under /api/baskets, kept in the
+// history store per key name like the watchlist:
+//
+//   - PUT    /api/baskets/{name} with {"vehicles": [{"type", "brandId",
+//     "modelId", "yearId"}, ...]} creates a basket or replaces its vehicles
+//     (201, or 200 when replaced). Vehicles unknown to FIPE get 404.
+//   - GET    /api/baskets lists the caller's baskets.
+//   - GET    /api/baskets/{name} returns the basket's average price in each
+//     stored reference table with its change from the previous month, in
+//     the segment index format (see indices.go).
+//   - DELETE /api/baskets/{name} removes it (204, or 404).
+//
+// Basket vehicles join the history collector like watched ones, and the
+// series is built from their snapshots only: a month is published once every
+// vehicle has its snapshot, so a new basket fills in after its first
+// collection, which starts right away.
+
+// maxBaskets bounds the baskets per API key; each holds up to
+// maxIndexMembers vehicles.
+const maxBaskets = 20
+
+// Basket is a basket of /api/baskets.
+type Basket struct {
+	Name     string           `json:"name"`
+	Vehicles []watchedVehicle `json:"vehicles"`
+	AddedAt  time.Time        `json:"addedAt"`
+}
+
+// putBasket stores the basket of owner, replacing its vehicles, and reports
+// whether it is new.
+func (s *historyStore) putBasket(ctx context.Context, owner, name string, vehicles []watchedVehicle) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO baskets (owner, name, added_at)
+		VALUES (?, ?, ?) ON CONFLICT DO NOTHING`), owner, name, appClock.Now().Unix())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if _, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM basket_vehicles WHERE owner = ? AND name = ?`), owner, name); err != nil {
+		return false, err
+	}
+	for _, v := range vehicles {
+		if _, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO basket_vehicles
+			(owner, name, vehicle_type, brand_id, model_id, year_id)
+			VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING`),
+			owner, name, v.Type, v.BrandID, v.ModelID, v.YearID); err != nil {
+			return false, err
+		}
+	}
+	return n > 0, tx.Commit()
+}
+
+// removeBasket removes a basket of owner, reporting whether it existed.
+func (s *historyStore) removeBasket(ctx context.Context, owner, name string) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM baskets WHERE owner = ? AND name = ?`), owner, name)
+	if err != nil {
+		return false, err
+	}
+	if _, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM basket_vehicles WHERE owner = ? AND name = ?`), owner, name); err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, tx.Commit()
+}
+
+// baskets lists the baskets of owner by name.
+func (s *historyStore) baskets(ctx context.Context, owner string) ([]Basket, error) {
+	rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT b.name, b.added_at, v.vehicle_type, v.brand_id, v.model_id, v.year_id
+		FROM baskets b JOIN basket_vehicles v ON v.owner = b.owner AND v.name = b.name
+		WHERE b.owner = ? ORDER BY b.name, v.vehicle_type, v.brand_id, v.model_id, v.year_id`), owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Basket{}
+	for rows.Next() {
+		var name string
+		var added int64
+		var v watchedVehicle
+		if err := rows.Scan(&name, &added, &v.Type, &v.BrandID, &v.ModelID, &v.YearID); err != nil {
+			return nil, err
+		}
+		if len(out) == 0 || out[len(out)-1].Name != name {
+			out = append(out, Basket{Name: name, AddedAt: time.Unix(added, 0).UTC()})
+		}
+		out[len(out)-1].Vehicles = append(out[len(out)-1].Vehicles, v)
+	}
+	return out, rows.Err()
+}
+
+// basketSeries averages the stored snapshots of vehicles in each of tables,
+// newest first. Tables in which a vehicle has no snapshot yet are left out,
+// and suspect prices are not averaged.
+func (s *historyStore) basketSeries(ctx context.Context, vehicles []watchedVehicle, tables []fipe.ReferenceTable) ([]IndexPoint, error) {
+	stored := make([]map[string]string, len(vehicles))
+	suspect := make([]map[string]bool, len(vehicles))
+	for i, v := range vehicles {
+		var err error
+		if stored[i], err = s.snapshots(ctx, v); err != nil {
+			return nil, err
+		}
+		if suspect[i], err = s.suspectCodes(ctx, v); err != nil {
+			return nil, err
+		}
+	}
+	points := make([]IndexPoint, 0, len(tables))
+tables:
+	for _, t := range tables {
+		p := IndexPoint{ReferenceCode: t.Code, ReferenceMonth: strings.TrimSpace(t.Month)}
+		sum := 0.0
+		for i := range vehicles {
+			payload, ok := stored[i][t.Code]
+			if !ok {
+				continue tables
+			}
+			if payload == "" || suspect[i][t.Code] {
+				continue
+			}
+			var pr fipe.Price
+			if err := json.Unmarshal([]byte(payload), &pr); err != nil {
+				continue tables
+			}
+			v, err := pr.Value()
+			if err != nil {
+				continue tables
+			}
+			if m := strings.TrimSpace(pr.ReferenceMonth); m != "" {
+				p.ReferenceMonth = m
+			}
+			sum += v
+			p.Members++
+		}
+		if p.Members == 0 {
+			continue
+		}
+		p.Value = math.Round(sum/float64(p.Members)*100) / 100
+		points = append(points, p)
+	}
+	setIndexChanges(points)
+	return points, nil
+}
+
+// basketVehicles lists the vehicles in any basket.
+func (s *historyStore) basketVehicles(ctx context.Context) ([]watchedVehicle, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT DISTINCT vehicle_type, brand_id, model_id, year_id FROM basket_vehicles`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []watchedVehicle
+	for rows.Next() {
+		var v watchedVehicle
+		if err := rows.Scan(&v.Type, &v.BrandID, &v.ModelID, &v.YearID); err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, rows.Err()
+}
+
+// findBasket returns the basket named name.
+func findBasket(baskets []Basket, name string) (Basket, bool) {
+	for _, b := range baskets {
+		if b.Name == name {
+			return b, true
+		}
+	}
+	return Basket{}, false
+}
+
+// handleBaskets serves GET /api/baskets.
+func handleBaskets(w http.ResponseWriter, r *http.Request) {
+	recordHTTPRequest("/api/baskets", r.Method)
+	owner, _ := apiKeyName(r)
+	baskets, err := historyDB.baskets(r.Context(), owner)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "baskets query failed", "error", err)
+		http.Error(w, "baskets unavailable", http.StatusInternalServerError)
+		return
+	}
+	writeIndexJSON(w, map[string]interface{}{"baskets": baskets})
+}
+
+// handleBasket serves /api/baskets/{name}.
+func handleBasket(w http.ResponseWriter, r *http.Request) {
+	recordHTTPRequest("/api/baskets/{name}", r.Method)
+	owner, _ := apiKeyName(r)
+	name := r.PathValue("name")
+	switch r.Method {
+	case http.MethodGet:
+		basketHistory(w, r, owner, name)
+	case http.MethodPut:
+		putBasket(w, r, owner, name)
+	case http.MethodDelete:
+		removed, err := historyDB.removeBasket(r.Context(), owner, name)
+		switch {
+		case err != nil:
+			slog.ErrorContext(r.Context(), "baskets query failed", "error", err)
+			http.Error(w, "baskets unavailable", http.StatusInternalServerError)
+		case !removed:
+			http.Error(w, "basket not found", http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
+
+// basketHistory serves GET /api/baskets/{name}.
+func basketHistory(w http.ResponseWriter, r *http.Request, owner, name string) {
+	q := r.URL.Query()
+	months, err := strconv.Atoi(q.Get("months"))
+	if err != nil || months <= 0 {
+		months = defaultHistoryMonths
+	}
+	months = min(months, maxHistoryMonths)
+	loc, err := lookupLocale(q.Get("locale"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	baskets, err := historyDB.baskets(r.Context(), owner)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "baskets query failed", "error", err)
+		http.Error(w, "baskets unavailable", http.StatusInternalServerError)
+		return
+	}
+	b, ok := findBasket(baskets, name)
+	if !ok {
+		http.Error(w, "basket not found", http.StatusNotFound)
+		return
+	}
+	tables, err := fipeClient.References(r.Context())
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	// One more table than shown gives the oldest point its change.
+	points, err := historyDB.basketSeries(r.Context(), b.Vehicles, tables[:min(months+1, len(tables))])
+	if err != nil {
+		slog.ErrorContext(r.Context(), "baskets query failed", "error", err)
+		http.Error(w, "baskets unavailable", http.StatusInternalServerError)
+		return
+	}
+	writeIndexJSON(w, map[string]interface{}{
+		"name":     b.Name,
+		"vehicles": b.Vehicles,
+		"series":   localizedPoints(points[:min(months, len(points))], loc),
+	})
+}
+
+// putBasket serves PUT /api/baskets/{name}.
+func putBasket(w http.ResponseWriter, r *http.Request, owner, name string) {
+	if !indexNameRe.MatchString(name) {
+		http.Error(w, "basket names use a-z, 0-9, _ and - (up to 32)", http.StatusBadRequest)
+		return
+	}
+	var body struct {
+		Vehicles []watchedVehicle `json:"vehicles"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&body); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	vehicles := mergeWatched(body.Vehicles, nil)
+	if len(vehicles) == 0 || len(vehicles) > maxIndexMembers {
+		http.Error(w, fmt.Sprintf("baskets need 1 to %d vehicles", maxIndexMembers), http.StatusBadRequest)
+		return
+	}
+	for i, v := range vehicles {
+		if err := v.validate(); err != nil {
+			http.Error(w, fmt.Sprintf("vehicles[%d]: %v", i, err), http.StatusBadRequest)
+			return
+		}
+	}
+	baskets, err := historyDB.baskets(r.Context(), owner)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "baskets query failed", "error", err)
+		http.Error(w, "baskets unavailable", http.StatusInternalServerError)
+		return
+	}
+	if _, ok := findBasket(baskets, name); !ok && len(baskets) >= maxBaskets {
+		http.Error(w, fmt.Sprintf("baskets are limited to %d per key", maxBaskets), http.StatusConflict)
+		return
+	}
+
+	// Only vehicles FIPE knows are accepted, as in the watchlist.
+	for _, v := range vehicles {
+		years, err := fipeClient.Years(r.Context(), v.Type, v.BrandID, v.ModelID)
+		var se *fipe.StatusError
+		switch {
+		case errors.As(err, &se) && se.StatusCode == http.StatusNotFound, err == nil && !yearListed(years, v.YearID):
+			http.Error(w, fmt.Sprintf("vehicle %s/%s/%s/%s not found", v.Type, v.BrandID, v.ModelID, v.YearID), http.StatusNotFound)
+			return
+		case err != nil:
+			writeUpstreamError(w, err)
+			return
+		}
+	}
+
+	created, err := historyDB.putBasket(r.Context(), owner, name, vehicles)
+	if err == nil {
+		baskets, err = historyDB.baskets(r.Context(), owner)
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "baskets query failed", "error", err)
+		http.Error(w, "baskets unavailable", http.StatusInternalServerError)
+		return
+	}
+	saved, _ := findBasket(baskets, name)
+	go func() {
+		ctx := withUpstreamPriority(context.Background(), upstreamBackground)
+		if err := historyDB.collect(ctx, vehicles, nil); err != nil {
+			slog.Error("history collector failed", "error", err)
+		}
+	}()
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	b, _ := json.Marshal(saved)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
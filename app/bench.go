@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gofipe/pkg/fipe"
+)
+
+// --- Benchmark and profiling harness ---
+//
+// Admin endpoints for capacity planning, registered only when
+// GOFIPE_ADMIN_TOKEN is set. Requests must send
+// "Authorization: Bearer <token>"; /admin/* is also covered by the admin
+// scope of GOFIPE_IP_ACCESS_FILE.
+//
+//   - POST /admin/bench?scenario=cache|parser&duration=5s&concurrency=8 runs
+//     synthetic load in-process and reports throughput and allocations.
+//     The cache scenario reads and writes "bench:*" keys in the live cache
+//     (90% reads), so it contends with real traffic; the keys are
+//     removed afterwards. The parser scenario decodes a FIPE price payload,
+//     parses the price and a free-text query. Only one run at a time.
+//   - GET /admin/profile?type=cpu&seconds=30 captures a pprof profile
+//     (cpu, heap, allocs, goroutine, block, mutex, threadcreate) for
+//     `go tool pprof`.
+//
+// Allocation figures come from process-wide counters, so concurrent real
+// traffic is included; benchmark an idle instance for clean numbers.
+
+const (
+	defaultBenchDuration    = 5 * time.Second
+	maxBenchDuration        = 60 * time.Second
+	defaultBenchConcurrency = 8
+	maxBenchConcurrency     = 256
+	benchCacheKeys          = 1000
+	defaultProfileSeconds   = 30
+	maxProfileSeconds       = 120
+)
+
+// benchRunsCounter counts benchmark runs per scenario.
+var benchRunsCounter = newBudgetedCounterVec(
+	prometheus.CounterOpts{
+		Name: "fipe_admin_bench_runs_total",
+		Help: "Benchmark runs started from /admin/bench by scenario",
+	},
+	[]string{"scenario"},
+)
+
+func init() {
+	registerBudgeted(benchRunsCounter)
+}
+
+// benchPricePayload is a representative FIPE price response.
+var benchPricePayload = []byte(`{"vehicleType":1,"price":"R$ 45.123,00","brand":"VW - VolksWagen","model":"Gol 1.0","modelYear":2014,"fuel":"Gasolina","codeFipe":"005340-6","referenceMonth":"outubro de 2026","acronymFuel":"G"}`)
+
+// benchListPayload is a brands-sized reference list.
+var benchListPayload = func() []byte {
+	items := make([]fipe.Reference, 100)
+	for i := range items {
+		items[i] = fipe.Reference{Code: strconv.Itoa(i + 1), Name: fmt.Sprintf("Brand %d", i+1)}
+	}
+	b, _ := json.Marshal(items)
+	return b
+}()
+
+// benchScenarios maps scenario names to one operation by worker w at iteration i.
+var benchScenarios = map[string]func(w, i int) error{
+	"cache": func(w, i int) error {
+		key := "bench:" + strconv.Itoa((w*7919+i)%benchCacheKeys)
+		if i%10 == 0 {
+			setToCache(key, benchListPayload, time.Minute)
+			return nil
+		}
+		getFromCache(key)
+		return nil
+	},
+	"parser": func(w, i int) error {
+		var pr fipe.Price
+		if err := json.Unmarshal(benchPricePayload, &pr); err != nil {
+			return err
+		}
+		if _, err := pr.Value(); err != nil {
+			return err
+		}
+		parseReferenceMonth(pr.ReferenceMonth)
+		parseVehicleQuery("gol 1.0 2014 gasolina")
+		return nil
+	},
+}
+
+// BenchResult is the report of one /admin/bench run.
+type BenchResult struct {
+	Scenario    string  `json:"scenario"`
+	Concurrency int     `json:"concurrency"`
+	Duration    string  `json:"duration"`
+	Ops         int64   `json:"ops"`
+	Errors      int64   `json:"errors"`
+	OpsPerSec   float64 `json:"opsPerSec"`
+	NsPerOp     float64 `json:"nsPerOp"`
+	AllocsPerOp float64 `json:"allocsPerOp"`
+	BytesPerOp  float64 `json:"bytesPerOp"`
+	GCCycles    uint32  `json:"gcCycles"`
+	GOMAXPROCS  int     `json:"gomaxprocs"`
+	HeapAlloc   uint64  `json:"heapAllocBytes"`
+}
+
+// benchRunning guards against overlapping runs.
+var benchRunning atomic.Bool
+
+// runBench runs op from concurrency workers for d.
+func runBench(scenario string, op func(w, i int) error, concurrency int, d time.Duration) BenchResult {
+	var before, after runtime.MemStats
+	var ops, errs atomic.Int64
+	var wg sync.WaitGroup
+
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	deadline := start.Add(d)
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			var n, failed int64
+			for i := 0; time.Now().Before(deadline); i++ {
+				if err := op(w, i); err != nil {
+					failed++
+				}
+				n++
+			}
+			ops.Add(n)
+			errs.Add(failed)
+		}(w)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+
+	res := BenchResult{
+		Scenario:    scenario,
+		Concurrency: concurrency,
+		Duration:    elapsed.Round(time.Millisecond).String(),
+		Ops:         ops.Load(),
+		Errors:      errs.Load(),
+		GCCycles:    after.NumGC - before.NumGC,
+		GOMAXPROCS:  runtime.GOMAXPROCS(0),
+		HeapAlloc:   after.HeapAlloc,
+	}
+	if res.Ops > 0 {
+		n := float64(res.Ops)
+		res.OpsPerSec = n / elapsed.Seconds()
+		res.NsPerOp = float64(elapsed.Nanoseconds()) * float64(concurrency) / n
+		res.AllocsPerOp = float64(after.Mallocs-before.Mallocs) / n
+		res.BytesPerOp = float64(after.TotalAlloc-before.TotalAlloc) / n
+	}
+	return res
+}
+
+// handleBench serves POST /admin/bench.
+func handleBench(w http.ResponseWriter, r *http.Request) {
+	recordHTTPRequest("/admin/bench", r.Method)
+	q := r.URL.Query()
+	scenario := q.Get("scenario")
+	if scenario == "" {
+		scenario = "cache"
+	}
+	op, ok := benchScenarios[scenario]
+	if !ok {
+		http.Error(w, "scenario must be cache or parser", http.StatusBadRequest)
+		return
+	}
+	d := defaultBenchDuration
+	if v := q.Get("duration"); v != "" {
+		parsed, err := time.ParseDuration(v)
+		if err != nil || parsed <= 0 || parsed > maxBenchDuration {
+			http.Error(w, fmt.Sprintf("duration must be a positive duration up to %s", maxBenchDuration), http.StatusBadRequest)
+			return
+		}
+		d = parsed
+	}
+	concurrency := defaultBenchConcurrency
+	if v := q.Get("concurrency"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxBenchConcurrency {
+			http.Error(w, fmt.Sprintf("concurrency must be between 1 and %d", maxBenchConcurrency), http.StatusBadRequest)
+			return
+		}
+		concurrency = n
+	}
+
+	if !benchRunning.CompareAndSwap(false, true) {
+		http.Error(w, "a benchmark is already running", http.StatusConflict)
+		return
+	}
+	defer benchRunning.Store(false)
+
+	benchRunsCounter.Inc(scenario)
+	res := runBench(scenario, op, concurrency, d)
+	if scenario == "cache" {
+		cache.deletePrefix("bench:")
+	}
+	b, _ := json.Marshal(res)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(b)
+}
+
+// handleProfile serves GET /admin/profile.
+func handleProfile(w http.ResponseWriter, r *http.Request) {
+	recordHTTPRequest("/admin/profile", r.Method)
+	kind := r.URL.Query().Get("type")
+	if kind == "" {
+		kind = "cpu"
+	}
+	w.Header().Set("Cache-Control", "no-store")
+
+	if kind == "cpu" {
+		seconds := defaultProfileSeconds
+		if v := r.URL.Query().Get("seconds"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 || n > maxProfileSeconds {
+				http.Error(w, fmt.Sprintf("seconds must be between 1 and %d", maxProfileSeconds), http.StatusBadRequest)
+				return
+			}
+			seconds = n
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", `attachment; filename="cpu.pprof"`)
+		// Fails when another CPU profile is already being captured.
+		if err := pprof.StartCPUProfile(w); err != nil {
+			w.Header().Del("Content-Disposition")
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		select {
+		case <-time.After(time.Duration(seconds) * time.Second):
+		case <-r.Context().Done():
+		}
+		pprof.StopCPUProfile()
+		return
+	}
+
+	p := pprof.Lookup(kind)
+	if p == nil {
+		http.Error(w, "unknown profile type", http.StatusBadRequest)
+		return
+	}
+	if kind == "heap" || kind == "allocs" {
+		runtime.GC()
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.pprof"`, kind))
+	p.WriteTo(w, 0)
+}
+
+// requireAdminToken rejects requests without the admin bearer token.
+func requireAdminToken(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sent, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+			http.Error(w, "missing or invalid admin token", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// registerAdminEndpoints adds the benchmark, profiling, log level, cache
+// stats, cache purge, reference pin and incident note routes, and the /admin/anomalies,
+// /admin/quality and /admin/snapshot-retries routes with the history store,
+// when GOFIPE_ADMIN_TOKEN is set.
+func registerAdminEndpoints(mux *http.ServeMux) {
+	token := os.Getenv("GOFIPE_ADMIN_TOKEN")
+	if token == "" {
+		return
+	}
+	mux.HandleFunc("POST /admin/bench", requireAdminToken(token, handleBench))
+	mux.HandleFunc("GET /admin/profile", requireAdminToken(token, handleProfile))
+	mux.HandleFunc("GET /admin/loglevel", requireAdminToken(token, handleLogLevel))
+	mux.HandleFunc("PUT /admin/loglevel", requireAdminToken(token, handleLogLevel))
+	mux.HandleFunc("GET /api/cache/stats", requireAdminToken(token, handleCacheStats))
+	mux.HandleFunc("DELETE /admin/cache", requireAdminToken(token, handleCachePurge))
+	mux.HandleFunc("GET /admin/reference", requireAdminToken(token, handleReferencePin))
+	mux.HandleFunc("PUT /admin/reference", requireAdminToken(token, handleReferencePin))
+	mux.HandleFunc("DELETE /admin/reference", requireAdminToken(token, handleReferencePin))
+	mux.HandleFunc("GET /admin/incidents", requireAdminToken(token, handleIncidentNotes))
+	mux.HandleFunc("POST /admin/incidents", requireAdminToken(token, handleIncidentNotes))
+	mux.HandleFunc("DELETE /admin/incidents/{id}", requireAdminToken(token, handleIncidentNotes))
+	if historyDB != nil {
+		mux.HandleFunc("GET /admin/anomalies", requireAdminToken(token, handleAnomalies))
+		mux.HandleFunc("GET /admin/quality", requireAdminToken(token, handleQuality))
+		mux.HandleFunc("GET /admin/snapshot-retries", requireAdminToken(token, handleSnapshotRetries))
+	}
+}
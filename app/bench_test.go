@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"gofipe/pkg/fipe"
+)
+
+// benchHitHandler serves the list endpoints through the middleware that
+// runs on every cache hit: IP access, client policy and bandwidth metrics.
+func benchHitHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/brands", handleBrands)
+	mux.HandleFunc("/api/years", handleYears)
+	return withIPAccess(withClientPolicy(withBandwidthMetrics(mux)))
+}
+
+// benchHit serves target from the cache, filled at key, b.N times.
+func benchHit(b *testing.B, key, target string) {
+	setToCache(key, benchListPayload, time.Hour)
+	h := benchHitHandler()
+	req := httptest.NewRequest("GET", target, nil)
+	req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64)")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.Len() != len(benchListPayload) {
+		b.Fatalf("GET %s = %d, %d bytes", target, rec.Code, rec.Body.Len())
+	}
+	w := &discardResponse{header: http.Header{}}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		clear(w.header)
+		h.ServeHTTP(w, req)
+	}
+}
+
+// discardResponse is an http.ResponseWriter dropping the response, so
+// benchmarks only count the handler's own work.
+type discardResponse struct {
+	header http.Header
+}
+
+func (d *discardResponse) Header() http.Header         { return d.header }
+func (d *discardResponse) Write(b []byte) (int, error) { return len(b), nil }
+func (d *discardResponse) WriteHeader(int)             {}
+
+func BenchmarkBrandsHit(b *testing.B) {
+	benchHit(b, fipe.BrandsKey("cars"), "/api/brands?type=cars")
+}
+
+func BenchmarkYearsHit(b *testing.B) {
+	benchHit(b, fipe.YearsKey("cars", "21", "4420"), "/api/years?type=cars&brandId=21&modelId=4420")
+}
+
+// benchCacheParallel reads 1000 cache keys from parallel goroutines, with
+// one write in every writeEvery operations when writeEvery is positive.
+func benchCacheParallel(b *testing.B, writeEvery int) {
+	const keys = 1000
+	names := make([]string, keys)
+	for i := range names {
+		names[i] = "bench:" + strconv.Itoa(i)
+		setToCache(names[i], benchListPayload, time.Hour)
+	}
+	b.Cleanup(func() { cache.deletePrefix("bench:") })
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			name := names[i%keys]
+			if writeEvery > 0 && i%writeEvery == 0 {
+				setToCache(name, benchListPayload, time.Hour)
+				continue
+			}
+			getFromCache(name)
+		}
+	})
+}
+
+func BenchmarkCacheParallelRead(b *testing.B) {
+	benchCacheParallel(b, 0)
+}
+
+func BenchmarkCacheParallelMixed(b *testing.B) {
+	benchCacheParallel(b, 10)
+}
+
+// TestQueryValue checks queryValue against url.Values.Get, which the
+// handlers used before it.
+func TestQueryValue(t *testing.T) {
+	queries := []string{
+		"",
+		"type=cars",
+		"brandId=21&type=motorcycles",
+		"type=cars&type=trucks",
+		"type=",
+		"type",
+		"&&type=cars&",
+		"type=%63ars",
+		"type=a+b",
+		"type=a%2Bb",
+		"ty%70e=cars",
+		"ty+pe=cars",
+		"type=%zz&type=cars",
+		"type=a;b&type=cars",
+		"x=1;type=trucks&type=cars",
+		"type=a%26b",
+		"reference=308&type=cars&brandId=%2021",
+	}
+	names := []string{"type", "brandId", "reference", "ty pe", "x"}
+	for _, q := range queries {
+		r := httptest.NewRequest("GET", "/api/brands?"+q, nil)
+		want, _ := url.ParseQuery(q)
+		for _, name := range names {
+			if got := queryValue(r, name); got != want.Get(name) {
+				t.Errorf("queryValue(%q, %q) = %q, want %q", q, name, got, want.Get(name))
+			}
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gofipe/pkg/fipe"
+)
+
+// --- Upstream circuit breaker ---
+//
+// When FIPE is down, waiting out GOFIPE_HTTP_TIMEOUT on every request only
+// piles them up. After GOFIPE_BREAKER_FAILURES (-breaker-failures, default
+// 5; 0 disables) consecutive failed requests to an upstream host (network
+// errors, timeouts, 429 and 5xx answers, after retries), its breaker opens:
+// requests to that host fail at once, and the API answers 503 with a JSON
+// error and a Retry-After header. After GOFIPE_BREAKER_COOLDOWN
+// (-breaker-cooldown, default 30s) the breaker half-opens and lets one
+// request through: success closes it, failure opens it for another
+// cooldown. fipe_upstream_breaker_state reports each host's state (0
+// closed, 1 open, 2 half-open). Cached answers are still served while the
+// breaker is open. With several upstream providers each provider's host
+// has its own breaker, checked inside the fallback chain: a provider whose
+// breaker is open is skipped at once, and requests only fail fast when
+// every provider's breaker is open.
+
+// breakerState is the state of an upstream host's breaker.
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+var breakerStateNames = [...]string{"closed", "open", "half-open"}
+
+// upstreamBreakerGauge reports the breaker state by host.
+var upstreamBreakerGauge = newBudgetedGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "fipe_upstream_breaker_state",
+		Help: "Circuit breaker state of each upstream FIPE host (0 closed, 1 open, 2 half-open)",
+	},
+	[]string{"host"},
+)
+
+func init() {
+	registerBudgeted(upstreamBreakerGauge)
+}
+
+// fipeBreaker is the breaker of the FIPE client, nil when disabled.
+var fipeBreaker *upstreamBreaker
+
+// breakerOpenError is returned for requests refused by an open breaker.
+type breakerOpenError struct {
+	host       string
+	retryAfter time.Duration
+}
+
+func (e *breakerOpenError) Error() string {
+	return fmt.Sprintf("FIPE upstream %s is unavailable, retry in %s", e.host, e.retryAfter.Round(time.Second))
+}
+
+// hostBreaker tracks the recent failures of one upstream host.
+type hostBreaker struct {
+	state    breakerState
+	failures int
+	// openedAt is when the breaker last opened.
+	openedAt time.Time
+	// probing is set while the half-open trial request is in flight.
+	probing bool
+}
+
+// upstreamBreaker is an http.RoundTripper failing fast for hosts whose
+// breaker is open.
+type upstreamBreaker struct {
+	next      http.RoundTripper
+	threshold int
+	cooldown  time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*hostBreaker
+}
+
+func newUpstreamBreaker(next http.RoundTripper, threshold int, cooldown time.Duration) *upstreamBreaker {
+	return &upstreamBreaker{next: next, threshold: threshold, cooldown: cooldown, hosts: map[string]*hostBreaker{}}
+}
+
+func (b *upstreamBreaker) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	if err := b.allow(host); err != nil {
+		return nil, err
+	}
+	resp, err := b.next.RoundTrip(req)
+	b.done(req, host, resp, err)
+	return resp, err
+}
+
+// done records the answer to req, admitted by allow for host.
+func (b *upstreamBreaker) done(req *http.Request, host string, resp *http.Response, err error) {
+	failed := err != nil || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	var throttled *upstreamThrottledError
+	var tooLarge *upstreamTooLargeError
+	if err != nil && (req.Context().Err() != nil || errors.As(err, &throttled) || errors.As(err, &tooLarge)) {
+		// The caller gave up, or the rate limit or size limit refused the
+		// request; that says nothing about FIPE being down.
+		b.release(host)
+		return
+	}
+	b.record(host, failed)
+}
+
+// allow admits a request to host, or returns a *breakerOpenError.
+func (b *upstreamBreaker) allow(host string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	h := b.hosts[host]
+	if h == nil {
+		h = &hostBreaker{}
+		b.hosts[host] = h
+	}
+	switch h.state {
+	case breakerOpen:
+		if wait := h.openedAt.Add(b.cooldown).Sub(appClock.Now()); wait > 0 {
+			return &breakerOpenError{host: host, retryAfter: wait}
+		}
+		b.set(host, h, breakerHalfOpen)
+		fallthrough
+	case breakerHalfOpen:
+		if h.probing {
+			return &breakerOpenError{host: host, retryAfter: time.Second}
+		}
+		h.probing = true
+	}
+	return nil
+}
+
+// release returns the half-open trial of host without an outcome.
+func (b *upstreamBreaker) release(host string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.hosts[host].probing = false
+}
+
+// record counts the outcome of a request to host.
+func (b *upstreamBreaker) record(host string, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	h := b.hosts[host]
+	h.probing = false
+	switch {
+	case !failed:
+		h.failures = 0
+		b.set(host, h, breakerClosed)
+	case h.state == breakerHalfOpen:
+		h.openedAt = appClock.Now()
+		b.set(host, h, breakerOpen)
+	default:
+		h.failures++
+		if h.state == breakerClosed && h.failures >= b.threshold {
+			h.openedAt = appClock.Now()
+			b.set(host, h, breakerOpen)
+		}
+	}
+}
+
+// set moves the breaker of host to state, which b.mu guards.
+func (b *upstreamBreaker) set(host string, h *hostBreaker, state breakerState) {
+	if h.state != state {
+		level := slog.LevelWarn
+		if state == breakerClosed {
+			level = slog.LevelInfo
+		}
+		slog.Log(context.Background(), level, "upstream circuit breaker "+breakerStateNames[state], "host", host, "failures", h.failures)
+	}
+	h.state = state
+	upstreamBreakerGauge.Set(float64(state), host)
+}
+
+// states returns the breaker state of every host requested so far.
+func (b *upstreamBreaker) states() map[string]breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := make(map[string]breakerState, len(b.hosts))
+	for host, h := range b.hosts {
+		out[host] = h.state
+	}
+	return out
+}
+
+// writeUpstreamError answers a failed FIPE lookup: 503 with a JSON error,
+// and the active incident notes, when the breaker or a rate limit refused
+// it, 502 otherwise. The 502 body names the kind of failure only; upstream
+// URLs stay in the log.
+func writeUpstreamError(w http.ResponseWriter, err error) {
+	msg, wait, ok := upstreamRefusal(err)
+	if !ok {
+		slog.Error("FIPE request failed", "error", err)
+		http.Error(w, upstreamErrorMessage(err), http.StatusBadGateway)
+		return
+	}
+	writeRetryLater(w, http.StatusServiceUnavailable, msg, wait, listIncidentNotes(appClock.Now(), true))
+}
+
+// upstreamErrorMessage describes err to clients without its URL.
+func upstreamErrorMessage(err error) string {
+	var se *fipe.StatusError
+	var pe *fipe.PayloadError
+	switch {
+	case errors.As(err, &se):
+		return fmt.Sprintf("external API returned status: %d", se.StatusCode)
+	case errors.As(err, &pe):
+		return "unexpected payload from FIPE"
+	default:
+		return "FIPE request failed"
+	}
+}
+
+// writeRetryLater answers status with a JSON error telling clients to retry
+// after wait, in retryAfterSeconds and a Retry-After header, with notes as
+// incidents when there are any. retryAfter is kept for clients written
+// before retryAfterSeconds.
+func writeRetryLater(w http.ResponseWriter, status int, msg string, wait time.Duration, notes []IncidentNote) {
+	seconds := max(int(math.Ceil(wait.Seconds())), 1)
+	body := map[string]interface{}{
+		"error":             msg,
+		"retryAfter":        seconds,
+		"retryAfterSeconds": seconds,
+	}
+	if len(notes) > 0 {
+		body["incidents"] = notes
+	}
+	b, _ := json.Marshal(body)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// upstreamErrorStatus is the status writeUpstreamError answers err with.
+func upstreamErrorStatus(err error) int {
+	if _, _, ok := upstreamRefusal(err); ok {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadGateway
+}
+
+// upstreamRateLimitedWait is how long clients are told to wait when FIPE
+// answers 429 without a Retry-After header.
+const upstreamRateLimitedWait = 30 * time.Second
+
+// upstreamRefusal describes an error of a FIPE request that gofipe did not
+// send or FIPE refused to answer, with when to retry it.
+func upstreamRefusal(err error) (string, time.Duration, bool) {
+	var open *breakerOpenError
+	if errors.As(err, &open) {
+		return "FIPE is unavailable; requests fail fast until it recovers", open.retryAfter, true
+	}
+	var throttled *upstreamThrottledError
+	if errors.As(err, &throttled) {
+		return "too many FIPE requests; retry later", throttled.retryAfter, true
+	}
+	var status *fipe.StatusError
+	if errors.As(err, &status) && status.StatusCode == http.StatusTooManyRequests {
+		wait := retryAfter(status.RetryAfter)
+		if wait <= 0 {
+			wait = upstreamRateLimitedWait
+		}
+		return "FIPE is rate limiting requests; retry later", wait, true
+	}
+	return "", 0, false
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --- Cache ---
+//
+// FIPE payloads are cached through a cacheBackend: the in-memory map by
+// default, or Redis (GOFIPE_CACHE_BACKEND=redis) so replicas share one cache
+// that survives restarts. Adaptive TTLs and content-change detection run on
+// top of either backend; the change log is kept per replica. Both backends
+// keep an entry for cacheRetention times its effective TTL, so a refresh can
+// still be compared with the previous copy, and then drop it: Redis expires
+// it, the memory backend evicts it every GOFIPE_CACHE_SWEEP_INTERVAL. The
+// memory backend is also bounded by GOFIPE_CACHE_MAX_ENTRIES and
+// GOFIPE_CACHE_MAX_BYTES, evicting the least recently used entries first.
+
+// cacheItem stores a cached payload and its expiration time.
+type cacheItem struct {
+	data      []byte
+	expiresAt time.Time
+	// hash is the SHA-256 of data, used to detect whether a refresh changed anything.
+	hash string
+	// streak counts consecutive unchanged refreshes (positive) or changed refreshes (negative).
+	streak int
+	// changedAt is when the content behind this key was first seen or last changed.
+	changedAt time.Time
+	// gz is data gzip-compressed once at store time, or nil when compressing
+	// does not pay off.
+	gz []byte
+	// length and gzLength are the Content-Length header values of data and
+	// gz, kept as header slices so hits set them without allocating.
+	length, gzLength []string
+}
+
+// withLengths fills in the Content-Length values of data and gz.
+func (it cacheItem) withLengths() cacheItem {
+	it.length = []string{strconv.Itoa(len(it.data))}
+	if it.gz != nil {
+		it.gzLength = []string{strconv.Itoa(len(it.gz))}
+	}
+	return it
+}
+
+// ContentChange records a cache refresh whose upstream content differed from the previous copy.
+type ContentChange struct {
+	Resource     string    `json:"resource"`
+	PreviousHash string    `json:"previousHash"`
+	Hash         string    `json:"hash"`
+	ChangedAt    time.Time `json:"changedAt"`
+}
+
+// maxContentChanges bounds the in-memory change log.
+const maxContentChanges = 500
+
+// Adaptive TTL bounds: stable payloads may live up to base<<maxTTLShift,
+// volatile ones down to base>>minTTLShift.
+const (
+	maxTTLShift = 3
+	minTTLShift = 2
+)
+
+// cacheRetention is how many times its effective TTL an entry is kept.
+const cacheRetention = 2
+
+// cacheBackend stores cache entries. Backends keep entries past expiresAt
+// (for as long as they can afford) so a refresh can be compared with the
+// previous copy.
+type cacheBackend interface {
+	get(key string) (cacheItem, bool)
+	set(key string, it cacheItem)
+	// deletePrefix removes the keys starting with prefix and returns how
+	// many it removed.
+	deletePrefix(prefix string) (int, error)
+	// entries counts the stored entries by key prefix.
+	entries() (map[string]cacheEntryStats, error)
+}
+
+// cacheShards is the number of independently locked memory cache shards
+// (a power of two). Keys are spread by FNV-1a, so concurrent hits on
+// different keys rarely touch the same lock.
+const cacheShards = 64
+
+// memoryTrimTarget is the share of its limits a full memory cache is
+// trimmed down to, so trims do not run on every store.
+const memoryTrimTarget = 0.9
+
+// memoryEntry is a stored item with what the memory backend needs to evict it.
+type memoryEntry struct {
+	item cacheItem
+	size int64
+	// keepUntil is when the sweep evicts the entry.
+	keepUntil time.Time
+	// lastUsed is the Unix time in nanoseconds of the last get or set.
+	lastUsed atomic.Int64
+}
+
+// memoryShard is one lock and its slice of the keys.
+type memoryShard struct {
+	mu    sync.RWMutex
+	items map[string]*memoryEntry
+	// Keeps neighbouring shard locks off the same CPU cache line.
+	_ [32]byte
+}
+
+// memoryBackend is the default, process-local backend. With maxEntries or
+// maxBytes set (0 is unlimited), storing past either limit evicts the least
+// recently used entries.
+type memoryBackend struct {
+	shards [cacheShards]memoryShard
+	// count and bytes are the number and size of the entries held.
+	count, bytes         atomic.Int64
+	maxEntries, maxBytes int64
+	// trimming lets one store at a time run the LRU eviction.
+	trimming sync.Mutex
+}
+
+func newMemoryBackend() *memoryBackend {
+	m := &memoryBackend{}
+	for i := range m.shards {
+		m.shards[i].items = map[string]*memoryEntry{}
+	}
+	return m
+}
+
+// shardIndex maps key to a shard with FNV-1a, without allocating.
+func shardIndex(key string) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return int(h & (cacheShards - 1))
+}
+
+func (m *memoryBackend) get(key string) (cacheItem, bool) {
+	sh := &m.shards[shardIndex(key)]
+	sh.mu.RLock()
+	e, ok := sh.items[key]
+	if ok {
+		e.lastUsed.Store(appClock.Now().UnixNano())
+	}
+	sh.mu.RUnlock()
+	if !ok {
+		return cacheItem{}, false
+	}
+	return e.item, true
+}
+
+func (m *memoryBackend) set(key string, it cacheItem) {
+	now := appClock.Now()
+	e := &memoryEntry{
+		item:      it,
+		size:      int64(len(key) + len(it.data) + len(it.gz)),
+		keepUntil: now.Add(max(it.expiresAt.Sub(now)*cacheRetention, time.Second)),
+	}
+	if it.hash == "" {
+		// Seeded entries are kept until FIPE replaces them.
+		e.keepUntil = seedKeepUntil
+	}
+	e.lastUsed.Store(now.UnixNano())
+	sh := &m.shards[shardIndex(key)]
+	sh.mu.Lock()
+	if prev, ok := sh.items[key]; ok {
+		m.bytes.Add(-prev.size)
+	} else {
+		m.count.Add(1)
+	}
+	m.bytes.Add(e.size)
+	sh.items[key] = e
+	sh.mu.Unlock()
+	if m.over(1) {
+		m.trim()
+	}
+}
+
+// remove deletes key from sh, which must be locked.
+func (m *memoryBackend) remove(sh *memoryShard, key string, e *memoryEntry) {
+	delete(sh.items, key)
+	m.count.Add(-1)
+	m.bytes.Add(-e.size)
+}
+
+func (m *memoryBackend) deletePrefix(prefix string) (int, error) {
+	n := 0
+	for i := range m.shards {
+		sh := &m.shards[i]
+		sh.mu.Lock()
+		for key, e := range sh.items {
+			if strings.HasPrefix(key, prefix) {
+				m.remove(sh, key, e)
+				n++
+			}
+		}
+		sh.mu.Unlock()
+	}
+	return n, nil
+}
+
+func (m *memoryBackend) entries() (map[string]cacheEntryStats, error) {
+	out := map[string]cacheEntryStats{}
+	for i := range m.shards {
+		sh := &m.shards[i]
+		sh.mu.RLock()
+		for key, e := range sh.items {
+			prefix, _, _ := strings.Cut(key, ":")
+			st := out[prefix]
+			st.Entries++
+			st.Bytes += e.size
+			out[prefix] = st
+		}
+		sh.mu.RUnlock()
+	}
+	return out, nil
+}
+
+// over reports whether the cache holds more than fraction of a limit.
+func (m *memoryBackend) over(fraction float64) bool {
+	return m.maxEntries > 0 && float64(m.count.Load()) > float64(m.maxEntries)*fraction ||
+		m.maxBytes > 0 && float64(m.bytes.Load()) > float64(m.maxBytes)*fraction
+}
+
+// trim evicts the least recently used entries until the cache is within
+// memoryTrimTarget of its limits. A store finding a trim under way leaves
+// it to finish.
+func (m *memoryBackend) trim() {
+	if !m.trimming.TryLock() {
+		return
+	}
+	defer m.trimming.Unlock()
+	type candidate struct {
+		key      string
+		lastUsed int64
+	}
+	var candidates []candidate
+	for i := range m.shards {
+		sh := &m.shards[i]
+		sh.mu.RLock()
+		for key, e := range sh.items {
+			candidates = append(candidates, candidate{key, e.lastUsed.Load()})
+		}
+		sh.mu.RUnlock()
+	}
+	slices.SortFunc(candidates, func(a, b candidate) int { return cmp.Compare(a.lastUsed, b.lastUsed) })
+	for _, c := range candidates {
+		if !m.over(memoryTrimTarget) {
+			return
+		}
+		sh := &m.shards[shardIndex(c.key)]
+		sh.mu.Lock()
+		// Skip the entries used since the scan.
+		if e, ok := sh.items[c.key]; ok && e.lastUsed.Load() == c.lastUsed {
+			m.remove(sh, c.key, e)
+			recordCacheEviction(c.key, "capacity")
+		}
+		sh.mu.Unlock()
+	}
+}
+
+// sweep evicts the entries kept past their keepUntil.
+func (m *memoryBackend) sweep(now time.Time) {
+	for i := range m.shards {
+		sh := &m.shards[i]
+		sh.mu.Lock()
+		for key, e := range sh.items {
+			if now.After(e.keepUntil) {
+				m.remove(sh, key, e)
+				recordCacheEviction(key, "expired")
+			}
+		}
+		sh.mu.Unlock()
+	}
+}
+
+// sweepEvery runs sweep every interval, forever.
+func (m *memoryBackend) sweepEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		m.sweep(appClock.Now())
+	}
+}
+
+var (
+	// cache is replaced at startup when another backend is configured.
+	cache cacheBackend = newMemoryBackend()
+	// refreshLocks serialize refreshes of the same key (striped like the
+	// memory shards) so the previous copy read in setToCache is not stale.
+	refreshLocks [cacheShards]sync.Mutex
+	// changesMu guards contentChanges.
+	changesMu sync.RWMutex
+	// contentChanges is the change log, oldest first. Guarded by changesMu.
+	contentChanges []ContentChange
+)
+
+// getFromCache returns cached data and a boolean indicating presence and freshness.
+func getFromCache(key string) ([]byte, bool) {
+	it, ok := getCachedResponse(key)
+	return it.data, ok
+}
+
+// getCachedResponse returns the fresh cache entry at key with its
+// pre-serialized variants.
+func getCachedResponse(key string) (cacheItem, bool) {
+	it, ok := cache.get(key)
+	if !ok || appClock.Now().After(it.expiresAt) {
+		return cacheItem{}, false
+	}
+	return it, true
+}
+
+// setToCache stores bytes at key. The effective TTL starts at baseTTL and is
+// stretched for payloads that keep coming back unchanged, or shortened for
+// payloads that change on every refresh.
+func setToCache(key string, data []byte, baseTTL time.Duration) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	gz := gzipPayload(data)
+
+	now := appClock.Now()
+	lock := &refreshLocks[shardIndex(key)]
+	lock.Lock()
+	defer lock.Unlock()
+	streak := 0
+	changedAt := now
+	// Seeded entries have no hash and count as no previous copy.
+	if prev, ok := cache.get(key); ok && prev.hash != "" {
+		streak = nextStreak(prev.streak, prev.hash == hash)
+		if prev.hash == hash {
+			changedAt = prev.changedAt
+		} else {
+			recordContentChange(ContentChange{Resource: key, PreviousHash: prev.hash, Hash: hash, ChangedAt: now})
+		}
+	}
+	cache.set(key, cacheItem{
+		data:      data,
+		expiresAt: now.Add(adaptiveTTL(baseTTL, streak)),
+		hash:      hash,
+		streak:    streak,
+		changedAt: changedAt,
+		gz:        gz,
+	}.withLengths())
+}
+
+// recordContentChange appends to the change log, dropping the oldest entries
+// past maxContentChanges.
+func recordContentChange(c ContentChange) {
+	changesMu.Lock()
+	defer changesMu.Unlock()
+	contentChanges = append(contentChanges, c)
+	if n := len(contentChanges); n > maxContentChanges {
+		contentChanges = append(contentChanges[:0:0], contentChanges[n-maxContentChanges:]...)
+	}
+}
+
+// recentContentChanges returns up to limit changes newer than since, newest first.
+func recentContentChanges(since time.Time, limit int) []ContentChange {
+	changesMu.RLock()
+	defer changesMu.RUnlock()
+	out := []ContentChange{}
+	for i := len(contentChanges) - 1; i >= 0 && len(out) < limit; i-- {
+		if !contentChanges[i].ChangedAt.After(since) {
+			break
+		}
+		out = append(out, contentChanges[i])
+	}
+	return out
+}
+
+// nextStreak advances a stability streak after a refresh.
+func nextStreak(streak int, unchanged bool) int {
+	if unchanged {
+		if streak < 0 {
+			return 1
+		}
+		return streak + 1
+	}
+	if streak > 0 {
+		return -1
+	}
+	return streak - 1
+}
+
+// adaptiveTTL scales baseTTL by the stability streak of a cached payload.
+func adaptiveTTL(baseTTL time.Duration, streak int) time.Duration {
+	switch {
+	case streak > 0:
+		return baseTTL << min(streak, maxTTLShift)
+	case streak < 0:
+		return baseTTL >> min(-streak, minTTLShift)
+	}
+	return baseTTL
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+// --- Redis cache backend ---
+//
+// GOFIPE_CACHE_BACKEND=redis stores cached FIPE payloads in Redis at
+// GOFIPE_REDIS_URL (e.g. "redis://:password@redis:6379/0", "rediss://" for
+// TLS) under GOFIPE_REDIS_KEY_PREFIX (default "gofipe:"), so every replica
+// shares one cache that survives restarts. Entries expire after
+// cacheRetention times their effective TTL (see *Cache*). Redis errors are treated as misses and
+// counted in fipe_cache_backend_errors_total; requests are then served from
+// FIPE directly.
+
+const (
+	redisOpTimeout    = 300 * time.Millisecond
+	redisStartTimeout = 5 * time.Second
+)
+
+// cacheBackendErrorsCounter counts failed cache backend operations.
+var cacheBackendErrorsCounter = newBudgetedCounterVec(
+	prometheus.CounterOpts{
+		Name: "fipe_cache_backend_errors_total",
+		Help: "Failed cache backend operations by operation (get, set, delete)",
+	},
+	[]string{"op"},
+)
+
+func init() {
+	registerBudgeted(cacheBackendErrorsCounter)
+}
+
+// redisEntryHeader is the metadata stored in front of the payload.
+type redisEntryHeader struct {
+	ExpiresAt int64  `json:"e"` // Unix milliseconds
+	Hash      string `json:"h"`
+	Streak    int    `json:"s"`
+	ChangedAt int64  `json:"c"` // Unix milliseconds
+	GzipLen   int    `json:"z,omitempty"`
+}
+
+// redisBackend stores entries as "<header JSON>\n<payload><gzip payload>".
+type redisBackend struct {
+	client *redis.Client
+	prefix string
+}
+
+// newRedisBackend connects to rawURL. An unreachable server is logged, not
+// fatal, so replicas keep starting while Redis recovers.
+func newRedisBackend(rawURL, prefix string) (*redisBackend, error) {
+	opts, err := redis.ParseURL(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Redis URL: %v", err)
+	}
+	opts.ReadTimeout = redisOpTimeout
+	opts.WriteTimeout = redisOpTimeout
+	b := &redisBackend{client: redis.NewClient(opts), prefix: prefix}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisStartTimeout)
+	defer cancel()
+	if err := b.client.Ping(ctx).Err(); err != nil {
+		slog.Warn("Redis cache is not reachable yet, serving misses from FIPE", "addr", opts.Addr, "error", err)
+	}
+	return b, nil
+}
+
+func (b *redisBackend) get(key string) (cacheItem, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+	raw, err := b.client.Get(ctx, b.prefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return cacheItem{}, false
+	}
+	if err != nil {
+		cacheBackendErrorsCounter.Inc("get")
+		return cacheItem{}, false
+	}
+	head, data, ok := bytes.Cut(raw, []byte("\n"))
+	var h redisEntryHeader
+	if !ok || json.Unmarshal(head, &h) != nil || h.GzipLen > len(data) {
+		cacheBackendErrorsCounter.Inc("get")
+		return cacheItem{}, false
+	}
+	var gz []byte
+	if h.GzipLen > 0 {
+		n := len(data) - h.GzipLen
+		data, gz = data[:n:n], data[n:]
+	}
+	return cacheItem{
+		data:      data,
+		expiresAt: time.UnixMilli(h.ExpiresAt),
+		hash:      h.Hash,
+		streak:    h.Streak,
+		changedAt: time.UnixMilli(h.ChangedAt),
+		gz:        gz,
+	}.withLengths(), true
+}
+
+func (b *redisBackend) set(key string, it cacheItem) {
+	head, _ := json.Marshal(redisEntryHeader{
+		ExpiresAt: it.expiresAt.UnixMilli(),
+		Hash:      it.hash,
+		Streak:    it.streak,
+		ChangedAt: it.changedAt.UnixMilli(),
+		GzipLen:   len(it.gz),
+	})
+	value := make([]byte, 0, len(head)+1+len(it.data)+len(it.gz))
+	value = append(append(append(value, head...), '\n'), it.data...)
+	value = append(value, it.gz...)
+
+	keep := max(it.expiresAt.Sub(appClock.Now())*cacheRetention, time.Second)
+	if it.hash == "" {
+		// Seeded entries are kept until FIPE replaces them.
+		keep = 0
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+	if err := b.client.Set(ctx, b.prefix+key, value, keep).Err(); err != nil {
+		cacheBackendErrorsCounter.Inc("set")
+	}
+}
+
+func (b *redisBackend) deletePrefix(prefix string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisStartTimeout)
+	defer cancel()
+	iter := b.client.Scan(ctx, 0, redisGlobEscaper.Replace(b.prefix+prefix)+"*", 500).Iterator()
+	var keys []string
+	n := 0
+	del := func() error {
+		removed, err := b.client.Del(ctx, keys...).Result()
+		n += int(removed)
+		keys = keys[:0]
+		return err
+	}
+	var err error
+	for err == nil && iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+		if len(keys) == 500 {
+			err = del()
+		}
+	}
+	if err == nil && len(keys) > 0 {
+		err = del()
+	}
+	if err == nil {
+		err = iter.Err()
+	}
+	if err != nil {
+		cacheBackendErrorsCounter.Inc("delete")
+	}
+	return n, err
+}
+
+// redisGlobEscaper quotes the SCAN MATCH metacharacters of a literal prefix.
+var redisGlobEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// entries scans the keys under the backend prefix, which every replica
+// shares, with their stored size.
+func (b *redisBackend) entries() (map[string]cacheEntryStats, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisStartTimeout)
+	defer cancel()
+	out := map[string]cacheEntryStats{}
+	count := func(keys []string) error {
+		pipe := b.client.Pipeline()
+		lens := make([]*redis.IntCmd, len(keys))
+		for i, k := range keys {
+			lens[i] = pipe.StrLen(ctx, k)
+		}
+		if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+			return err
+		}
+		for i, k := range keys {
+			prefix, _, _ := strings.Cut(strings.TrimPrefix(k, b.prefix), ":")
+			st := out[prefix]
+			st.Entries++
+			st.Bytes += lens[i].Val()
+			out[prefix] = st
+		}
+		return nil
+	}
+	iter := b.client.Scan(ctx, 0, b.prefix+"*", 500).Iterator()
+	var keys []string
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+		if len(keys) == 500 {
+			if err := count(keys); err != nil {
+				return nil, err
+			}
+			keys = keys[:0]
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) > 0 {
+		if err := count(keys); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// configureCache switches to the backend selected in cfg.
+func configureCache(cfg Config) {
+	if cfg.CacheBackend != "redis" {
+		if m, ok := cache.(*memoryBackend); ok {
+			m.maxEntries, m.maxBytes = cfg.CacheMaxEntries, cfg.CacheMaxBytes
+			go m.sweepEvery(cfg.CacheSweepInterval)
+		}
+		return
+	}
+	b, err := newRedisBackend(cfg.RedisURL, cfg.RedisKeyPrefix)
+	if err != nil {
+		log.Fatalf("Invalid Redis settings: %v", err)
+	}
+	cache = b
+	// Redis expires entries itself; only the memory backend reports them.
+	prometheus.Unregister(cacheEntriesGauge)
+	prometheus.Unregister(cacheBytesGauge)
+	onShutdown("redis", func(context.Context) error { return b.client.Close() })
+}
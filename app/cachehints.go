@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// --- Browser caching hints ---
+//
+// GOFIPE_CACHE_CONTROL maps routes to the Cache-Control header sent with
+// their successful (200) responses, so browsers and CDNs can reuse
+// static-ish lists without calling gofipe again:
+//
+//	GOFIPE_CACHE_CONTROL="/api/brands=public, max-age=3600; /api/models=public, max-age=3600"
+//
+// Entries are separated by ";". A route matches the request path exactly,
+// or as a prefix when it ends with "/" (e.g. "/static/"). The longest
+// matching route wins. Handlers that set their own Cache-Control keep it,
+// and error responses are never marked cacheable. Invalid settings stop the
+// server at startup.
+
+// cacheHint is one route of GOFIPE_CACHE_CONTROL.
+type cacheHint struct {
+	route string
+	value []string
+}
+
+// cacheDirectives are the accepted Cache-Control response directives and
+// whether they take a number of seconds.
+var cacheDirectives = map[string]bool{
+	"public":                 false,
+	"private":                false,
+	"no-cache":               false,
+	"no-store":               false,
+	"no-transform":           false,
+	"must-revalidate":        false,
+	"proxy-revalidate":       false,
+	"immutable":              false,
+	"max-age":                true,
+	"s-maxage":               true,
+	"stale-while-revalidate": true,
+	"stale-if-error":         true,
+}
+
+// parseCacheHints parses the GOFIPE_CACHE_CONTROL format, longest route first.
+func parseCacheHints(spec string) ([]cacheHint, error) {
+	var hints []cacheHint
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		route, value, ok := strings.Cut(entry, "=")
+		route, value = strings.TrimSpace(route), strings.TrimSpace(value)
+		if !ok || !strings.HasPrefix(route, "/") || value == "" {
+			return nil, fmt.Errorf("%q: expected /route=directives", entry)
+		}
+		for _, d := range strings.Split(value, ",") {
+			name, arg, hasArg := strings.Cut(strings.TrimSpace(d), "=")
+			takesArg, known := cacheDirectives[strings.ToLower(name)]
+			if !known {
+				return nil, fmt.Errorf("%s: unknown directive %q", route, name)
+			}
+			if n, err := strconv.Atoi(arg); takesArg != hasArg || takesArg && (err != nil || n < 0) {
+				return nil, fmt.Errorf("%s: invalid directive %q", route, strings.TrimSpace(d))
+			}
+		}
+		hints = append(hints, cacheHint{route: route, value: []string{value}})
+	}
+	// Longest first, so the first match is the most specific.
+	sort.SliceStable(hints, func(i, j int) bool { return len(hints[i].route) > len(hints[j].route) })
+	return hints, nil
+}
+
+// cacheHintFor returns the Cache-Control value for path, or nil.
+func cacheHintFor(hints []cacheHint, path string) []string {
+	for _, h := range hints {
+		if path == h.route || strings.HasSuffix(h.route, "/") && strings.HasPrefix(path, h.route) {
+			return h.value
+		}
+	}
+	return nil
+}
+
+// cacheHintWriter adds Cache-Control to 200 responses that do not set one.
+type cacheHintWriter struct {
+	http.ResponseWriter
+	value       []string
+	wroteHeader bool
+}
+
+func (c *cacheHintWriter) WriteHeader(code int) {
+	if !c.wroteHeader {
+		c.wroteHeader = true
+		h := c.ResponseWriter.Header()
+		if code == http.StatusOK && h["Cache-Control"] == nil {
+			h["Cache-Control"] = c.value
+		}
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *cacheHintWriter) Write(b []byte) (int, error) {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+// withCacheHints applies GOFIPE_CACHE_CONTROL.
+func withCacheHints(next http.Handler) http.Handler {
+	spec := os.Getenv("GOFIPE_CACHE_CONTROL")
+	if spec == "" {
+		return next
+	}
+	hints, err := parseCacheHints(spec)
+	if err != nil {
+		log.Fatalf("Invalid GOFIPE_CACHE_CONTROL: %v", err)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value := cacheHintFor(hints, r.URL.Path)
+		if value == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(&cacheHintWriter{ResponseWriter: w, value: value}, r)
+	})
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// --- Cache purge ---
+//
+// With GOFIPE_ADMIN_TOKEN set, DELETE /admin/cache?prefix=models: removes
+// the cached FIPE payloads whose key starts with prefix (e.g. brands:,
+// models:cars:59, price:, or * for everything), so the next request fetches
+// them from FIPE again. Purged keys also lose the previous copy used to
+// detect content changes, so their adaptive TTL starts over. With the memory
+// backend only the replica receiving the request is purged; with Redis the
+// purge applies to every replica sharing it.
+
+// handleCachePurge serves DELETE /admin/cache.
+func handleCachePurge(w http.ResponseWriter, r *http.Request) {
+	recordHTTPRequest("/admin/cache", r.Method)
+	prefix := r.URL.Query().Get("prefix")
+	if prefix == "" {
+		http.Error(w, "prefix is required, e.g. prefix=models: (or prefix=* to purge everything)", http.StatusBadRequest)
+		return
+	}
+	match := prefix
+	if prefix == "*" {
+		match = ""
+	}
+	removed, err := cache.deletePrefix(match)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "cache purge failed", "prefix", prefix, "removed", removed, "error", err)
+		http.Error(w, "cache purge failed", http.StatusBadGateway)
+		return
+	}
+	slog.InfoContext(r.Context(), "cache purged", "prefix", prefix, "removed", removed)
+	b, _ := json.Marshal(map[string]interface{}{
+		"backend": cacheBackendName(),
+		"prefix":  prefix,
+		"removed": removed,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// --- Cache statistics ---
+//
+// Besides fipe_cache_hits_total and fipe_cache_misses_total,
+// fipe_cache_evictions_total counts the entries the memory backend drops,
+// after their retention or to stay within its limits, and
+// fipe_cache_entries and fipe_cache_bytes what it holds (Redis expires
+// entries on its own, so none of them is exported with that backend).
+// With GOFIPE_ADMIN_TOKEN set, GET /api/cache/stats breaks the cache down by
+// key prefix for debugging: the entries and bytes stored (across replicas
+// with Redis) and this replica's hits, misses, hit ratio and evictions
+// since it started.
+
+var (
+	// cacheEvictionsCounter counts entries dropped by the memory backend.
+	cacheEvictionsCounter = newBudgetedCounterVec(
+		prometheus.CounterOpts{
+			Name: "fipe_cache_evictions_total",
+			Help: "Entries evicted from the in-memory cache by cache key prefix and reason (expired, capacity)",
+		},
+		[]string{"prefix", "reason"},
+	)
+
+	// cacheEntriesGauge is the number of entries in the memory backend.
+	cacheEntriesGauge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "fipe_cache_entries",
+		Help: "Entries held by the in-memory cache, expired ones included until evicted",
+	}, func() float64 {
+		if m, ok := cache.(*memoryBackend); ok {
+			return float64(m.count.Load())
+		}
+		return 0
+	})
+
+	// cacheBytesGauge is the size of the entries in the memory backend.
+	cacheBytesGauge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "fipe_cache_bytes",
+		Help: "Size of the keys and payloads held by the in-memory cache",
+	}, func() float64 {
+		if m, ok := cache.(*memoryBackend); ok {
+			return float64(m.bytes.Load())
+		}
+		return 0
+	})
+)
+
+func init() {
+	registerBudgeted(cacheEvictionsCounter)
+	prometheus.MustRegister(cacheEntriesGauge, cacheBytesGauge)
+}
+
+// cacheEntryStats describes the entries stored under a key prefix.
+type cacheEntryStats struct {
+	Entries int   `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// cachePrefixCounters are the lookups of a key prefix on this replica.
+type cachePrefixCounters struct {
+	hits, misses, evictions atomic.Int64
+}
+
+// cacheCounters holds a *cachePrefixCounters per key prefix. Unlike the
+// Prometheus series, they are neither budgeted nor disabled.
+var cacheCounters sync.Map
+
+// cacheCountersFor returns the counters of the prefix of key.
+func cacheCountersFor(key string) *cachePrefixCounters {
+	prefix, _, _ := strings.Cut(key, ":")
+	if c, ok := cacheCounters.Load(prefix); ok {
+		return c.(*cachePrefixCounters)
+	}
+	c, _ := cacheCounters.LoadOrStore(prefix, new(cachePrefixCounters))
+	return c.(*cachePrefixCounters)
+}
+
+// recordCacheEviction counts an entry at key evicted for reason.
+func recordCacheEviction(key, reason string) {
+	prefix, _, _ := strings.Cut(key, ":")
+	cacheEvictionsCounter.Inc(prefix, reason)
+	cacheCountersFor(key).evictions.Add(1)
+}
+
+// CachePrefixStats is a key prefix in the /api/cache/stats response.
+type CachePrefixStats struct {
+	cacheEntryStats
+	Hits      int64   `json:"hits"`
+	Misses    int64   `json:"misses"`
+	HitRatio  float64 `json:"hitRatio"` // hits / (hits + misses), 0 without lookups
+	Evictions int64   `json:"evictions"`
+}
+
+// cacheBackendName names the configured backend.
+func cacheBackendName() string {
+	if _, ok := cache.(*memoryBackend); ok {
+		return "memory"
+	}
+	return "redis"
+}
+
+// handleCacheStats serves GET /api/cache/stats.
+func handleCacheStats(w http.ResponseWriter, r *http.Request) {
+	recordHTTPRequest("/api/cache/stats", r.Method)
+	entries, err := cache.entries()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "cache stats failed", "error", err)
+		http.Error(w, "cache stats unavailable", http.StatusBadGateway)
+		return
+	}
+	prefixes := map[string]CachePrefixStats{}
+	total := cacheEntryStats{}
+	for prefix, e := range entries {
+		prefixes[prefix] = CachePrefixStats{cacheEntryStats: e}
+		total.Entries += e.Entries
+		total.Bytes += e.Bytes
+	}
+	cacheCounters.Range(func(k, v any) bool {
+		c := v.(*cachePrefixCounters)
+		st := prefixes[k.(string)]
+		st.Hits, st.Misses, st.Evictions = c.hits.Load(), c.misses.Load(), c.evictions.Load()
+		if n := st.Hits + st.Misses; n > 0 {
+			st.HitRatio = math.Round(float64(st.Hits)/float64(n)*1e4) / 1e4
+		}
+		prefixes[k.(string)] = st
+		return true
+	})
+	b, _ := json.Marshal(map[string]interface{}{
+		"backend":  cacheBackendName(),
+		"entries":  total.Entries,
+		"bytes":    total.Bytes,
+		"prefixes": prefixes,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
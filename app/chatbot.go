@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gofipe/pkg/fipe"
+)
+
+// --- Chatbot webhooks ---
+//
+// Inbound webhooks that answer free-text price questions ("preço do Onix
+// 2019") in the webhook response itself, so a FIPE chatbot needs no extra
+// service or outbound credentials:
+//
+//   - POST /webhooks/telegram, enabled by GOFIPE_TELEGRAM_SECRET. Register
+//     the webhook with the same value as secret_token; updates without the
+//     matching X-Telegram-Bot-Api-Secret-Token header are rejected. The
+//     reply is a sendMessage call returned in the response body. Price
+//     subscriptions are handled in telegram.go.
+//   - POST /webhooks/whatsapp, enabled by GOFIPE_TWILIO_AUTH_TOKEN, for the
+//     Twilio WhatsApp API. Requests must carry a valid X-Twilio-Signature and
+//     the reply is returned as TwiML.
+//
+// Queries are resolved with resolveVehicle and answered in pt-BR.
+
+const chatbotHelp = "Envie o modelo e o ano do veículo, por exemplo: \"preço do Onix 2019\" ou \"moto CG 160 2020\"."
+
+// chatbotMessagesCounter counts inbound chatbot messages by channel and result.
+var chatbotMessagesCounter = newBudgetedCounterVec(
+	prometheus.CounterOpts{
+		Name: "fipe_chatbot_messages_total",
+		Help: "Inbound chatbot messages by channel (telegram, whatsapp, slack) and result (answered, help, subscription, not_found, error)",
+	},
+	[]string{"channel", "result"},
+)
+
+func init() {
+	registerBudgeted(chatbotMessagesCounter)
+}
+
+// chatbotReply answers a free-text message and returns the result label.
+func chatbotReply(ctx context.Context, text string) (string, string) {
+	text = strings.TrimSpace(text)
+	if text == "" || strings.HasPrefix(text, "/start") || strings.HasPrefix(text, "/help") {
+		return chatbotHelp, "help"
+	}
+	q := parseVehicleQuery(text)
+	v, pr, err := lookupVehiclePrice(ctx, q)
+	switch {
+	case errors.Is(err, errVehicleNotFound):
+		return "Não encontrei esse veículo na tabela FIPE. " + chatbotHelp, "not_found"
+	case errors.Is(err, errYearNotFound):
+		return fmt.Sprintf("O %s não tem preço FIPE para %s. Tente outro ano.", v.ModelName, q.Year), "not_found"
+	case err != nil:
+		slog.ErrorContext(ctx, "chatbot lookup failed", "query", truncateForLog(text), "error", err)
+		return "A tabela FIPE está indisponível no momento. Tente novamente mais tarde.", "error"
+	}
+	return formatPriceMessage(pr, v), "answered"
+}
+
+// formatPriceMessage renders a price as a chat message.
+func formatPriceMessage(pr fipe.Price, v resolvedVehicle) string {
+	l := locales[defaultLocale]
+	price := pr.Price
+	if f, err := pr.Value(); err == nil {
+		price = l.FormatBRL(f)
+	}
+	ref := pr.ReferenceMonth
+	if month, year, ok := parseReferenceMonth(ref); ok {
+		ref = l.FormatMonth(month, year)
+	}
+	return fmt.Sprintf("%s %s (%s)\nPreço FIPE: %s\nReferência: %s\nCódigo FIPE: %s",
+		pr.Brand, pr.Model, v.YearName, price, ref, pr.CodeFipe)
+}
+
+// handleTelegramWebhook answers Telegram bot updates.
+func handleTelegramWebhook(secret string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		recordHTTPRequest("/webhooks/telegram", r.Method)
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Telegram-Bot-Api-Secret-Token")), []byte(secret)) != 1 {
+			http.Error(w, "invalid secret token", http.StatusUnauthorized)
+			return
+		}
+		var update struct {
+			Message *struct {
+				Chat struct {
+					ID int64 `json:"id"`
+				} `json:"chat"`
+				Text string `json:"text"`
+			} `json:"message"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&update); err != nil {
+			http.Error(w, "invalid update", http.StatusBadRequest)
+			return
+		}
+		// Only text messages are answered; other updates are acknowledged.
+		if update.Message == nil || update.Message.Text == "" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		reply, result := telegramReply(r.Context(), update.Message.Chat.ID, update.Message.Text)
+		chatbotMessagesCounter.Inc("telegram", result)
+		b, _ := json.Marshal(map[string]interface{}{
+			"method":  "sendMessage",
+			"chat_id": update.Message.Chat.ID,
+			"text":    reply,
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	}
+}
+
+// twilioSignature computes the X-Twilio-Signature of a form POST to url.
+func twilioSignature(authToken, url string, form map[string][]string) string {
+	keys := make([]string, 0, len(form))
+	for k := range form {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	var b strings.Builder
+	b.WriteString(url)
+	for _, k := range keys {
+		for _, v := range form[k] {
+			b.WriteString(k + v)
+		}
+	}
+	mac := hmac.New(sha1.New, []byte(authToken))
+	mac.Write([]byte(b.String()))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// handleWhatsAppWebhook answers WhatsApp messages delivered by Twilio.
+func handleWhatsAppWebhook(authToken string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		recordHTTPRequest("/webhooks/whatsapp", r.Method)
+		r.Body = http.MaxBytesReader(w, r.Body, 64<<10)
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "invalid form", http.StatusBadRequest)
+			return
+		}
+		expected := twilioSignature(authToken, absoluteURL(r.URL.RequestURI()), r.PostForm)
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Twilio-Signature")), []byte(expected)) != 1 {
+			http.Error(w, "invalid signature", http.StatusUnauthorized)
+			return
+		}
+		reply, result := chatbotReply(r.Context(), r.PostForm.Get("Body"))
+		chatbotMessagesCounter.Inc("whatsapp", result)
+		// html.EscapeString is valid XML escaping and keeps line breaks readable.
+		w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+		fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<Response><Message>%s</Message></Response>", html.EscapeString(reply))
+	}
+}
+
+// registerChatbotWebhooks adds the webhooks whose credentials are configured.
+func registerChatbotWebhooks(mux *http.ServeMux) {
+	if secret := os.Getenv("GOFIPE_TELEGRAM_SECRET"); secret != "" {
+		mux.HandleFunc("POST /webhooks/telegram", handleTelegramWebhook(secret))
+	}
+	if token := os.Getenv("GOFIPE_TWILIO_AUTH_TOKEN"); token != "" {
+		mux.HandleFunc("POST /webhooks/whatsapp", handleWhatsAppWebhook(token))
+	}
+}
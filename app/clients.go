@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// --- Client classification and scraper policy ---
+//
+// Every request is tagged with a client class derived from its headers:
+//
+//   - api_key: sends one of the GOFIPE_API_KEYS in X-API-Key
+//   - bot:     User-Agent of a known crawler (googlebot, bingbot, ...)
+//   - script:  User-Agent of an HTTP library or CLI tool, or no User-Agent
+//   - browser: any other Mozilla-compatible User-Agent
+//   - other:   everything else
+//
+// GOFIPE_CLIENT_POLICY optionally maps classes to an action, e.g.
+// "bot=block,script=limit". Blocked classes get 403; limited classes are
+// allowed GOFIPE_CLIENT_LIMIT_RPM requests per minute per client IP
+// (default 60) and get 429 beyond that. /health, /metrics and the shard
+// peer endpoint /internal/cache are exempt.
+//
+// GOFIPE_TRUST_PROXY_HEADERS=true makes the client IP come from
+// X-Forwarded-For; only enable it behind a proxy that sets the header.
+// Clients can send the header with any entries, so only the last
+// GOFIPE_TRUSTED_PROXY_HOPS entries (default 1), appended by the proxies in
+// front of gofipe, are trusted: the client IP is the leftmost of them.
+
+const (
+	clientAPIKey  = "api_key"
+	clientBot     = "bot"
+	clientScript  = "script"
+	clientBrowser = "browser"
+	clientOther   = "other"
+
+	defaultClientLimitRPM = 60
+)
+
+var (
+	botUserAgents = []string{
+		"googlebot", "bingbot", "yandex", "baiduspider", "duckduckbot", "slurp",
+		"facebookexternalhit", "twitterbot", "linkedinbot", "applebot", "ahrefsbot",
+		"semrushbot", "mj12bot", "petalbot", "gptbot", "ccbot", "claudebot", "bytespider",
+		"crawler", "spider", "bot/", "bot;",
+	}
+	scriptUserAgents = []string{
+		"curl/", "wget/", "python-requests", "python-urllib", "aiohttp", "httpx",
+		"go-http-client", "java/", "okhttp", "apache-httpclient", "axios/", "node-fetch",
+		"undici", "httpie", "postmanruntime", "libwww-perl", "scrapy", "php/", "ruby",
+		"powershell",
+	}
+)
+
+// clientRequestsCounter counts requests by client class and policy action.
+var clientRequestsCounter = newBudgetedCounterVec(
+	prometheus.CounterOpts{
+		Name: "fipe_client_requests_total",
+		Help: "HTTP requests by detected client class and policy action (allowed, blocked, limited)",
+	},
+	[]string{"client_class", "action"},
+)
+
+func init() {
+	registerBudgeted(clientRequestsCounter)
+}
+
+// classifyClient tags a request with a client class.
+// It runs on every request; unknown keys are classified by User-Agent
+// like requests without one, so a made-up key does not escape the policy.
+func classifyClient(r *http.Request) string {
+	if _, ok := apiKeyName(r); ok {
+		return clientAPIKey
+	}
+	ua := strings.ToLower(r.UserAgent())
+	if ua == "" {
+		return clientScript
+	}
+	for _, s := range botUserAgents {
+		if strings.Contains(ua, s) {
+			return clientBot
+		}
+	}
+	for _, s := range scriptUserAgents {
+		if strings.Contains(ua, s) {
+			return clientScript
+		}
+	}
+	if strings.HasPrefix(ua, "mozilla/") {
+		return clientBrowser
+	}
+	return clientOther
+}
+
+// trustProxyHeaders controls whether clientIP honors X-Forwarded-For.
+var trustProxyHeaders = os.Getenv("GOFIPE_TRUST_PROXY_HEADERS") == "true"
+
+// trustedProxyHops is the number of proxies appending to X-Forwarded-For.
+var trustedProxyHops = loadTrustedProxyHops()
+
+// loadTrustedProxyHops reads GOFIPE_TRUSTED_PROXY_HOPS.
+func loadTrustedProxyHops() int {
+	v := os.Getenv("GOFIPE_TRUSTED_PROXY_HOPS")
+	if v == "" {
+		return 1
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		log.Fatalf("Invalid GOFIPE_TRUSTED_PROXY_HOPS %q: must be a positive integer", v)
+	}
+	return n
+}
+
+// clientIP returns the IP address of the client that sent r.
+func clientIP(r *http.Request) string {
+	if trustProxyHeaders {
+		// Proxies may append their own header line or extend the last one.
+		var entries []string
+		for _, line := range r.Header.Values("X-Forwarded-For") {
+			entries = append(entries, strings.Split(line, ",")...)
+		}
+		if len(entries) > 0 {
+			if ip := strings.TrimSpace(entries[max(len(entries)-trustedProxyHops, 0)]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// clientPolicy holds the configured action per client class.
+type clientPolicy struct {
+	actions  map[string]string
+	limitRPM int
+
+	mu      sync.Mutex
+	windows map[string]rateWindow
+}
+
+// rateWindow counts requests from one IP in the current minute.
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+// loadClientPolicy reads GOFIPE_CLIENT_POLICY and GOFIPE_CLIENT_LIMIT_RPM.
+func loadClientPolicy() (*clientPolicy, error) {
+	p := &clientPolicy{actions: map[string]string{}, limitRPM: defaultClientLimitRPM, windows: map[string]rateWindow{}}
+	for _, entry := range strings.Split(os.Getenv("GOFIPE_CLIENT_POLICY"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		class, action, ok := strings.Cut(entry, "=")
+		if !ok || (action != "block" && action != "limit" && action != "allow") {
+			return nil, fmt.Errorf("entry %q: expected <class>=block|limit|allow", entry)
+		}
+		p.actions[strings.TrimSpace(class)] = action
+	}
+	if v := os.Getenv("GOFIPE_CLIENT_LIMIT_RPM"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("GOFIPE_CLIENT_LIMIT_RPM must be a positive integer")
+		}
+		p.limitRPM = n
+	}
+	return p, nil
+}
+
+// allow reports whether ip may make another request in the current minute,
+// and the seconds until the window resets when it may not.
+func (p *clientPolicy) allow(ip string, now time.Time) (bool, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	w := p.windows[ip]
+	if now.Sub(w.start) >= time.Minute {
+		if len(p.windows) > 10000 {
+			for k, old := range p.windows {
+				if now.Sub(old.start) >= time.Minute {
+					delete(p.windows, k)
+				}
+			}
+		}
+		w = rateWindow{start: now}
+	}
+	if w.count >= p.limitRPM {
+		return false, int(time.Minute-now.Sub(w.start))/int(time.Second) + 1
+	}
+	w.count++
+	p.windows[ip] = w
+	return true, 0
+}
+
+// withClientPolicy classifies each request, counts it and applies the
+// configured policy. The class is not stored in the request context, which
+// would copy every request; the rare readers call classifyClient again.
+func withClientPolicy(next http.Handler) http.Handler {
+	policy, err := loadClientPolicy()
+	if err != nil {
+		log.Fatalf("Invalid client policy: %v", err)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		class := classifyClient(r)
+
+		if r.URL.Path != "/health" && r.URL.Path != "/metrics" && r.URL.Path != "/internal/cache" {
+			switch policy.actions[class] {
+			case "block":
+				clientRequestsCounter.Inc(class, "blocked")
+				http.Error(w, "automated access is not allowed", http.StatusForbidden)
+				return
+			case "limit":
+				if ok, retry := policy.allow(clientIP(r), time.Now()); !ok {
+					clientRequestsCounter.Inc(class, "limited")
+					writeRetryLater(w, http.StatusTooManyRequests, "too many requests", time.Duration(retry)*time.Second, nil)
+					return
+				}
+			}
+		}
+
+		clientRequestsCounter.Inc(class, "allowed")
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"gofipe/pkg/fipe"
+)
+
+// --- Clock and current reference ---
+//
+// Time-dependent behavior reads the time from appClock rather than
+// time.Now: cache expiry and retention, the timestamps of history
+// snapshots, anomalies, snapshot retries, quality reports, warehouse rows,
+// watchlist, basket, Telegram and alert webhook entries, Sheets
+// observations and index series, and the reference-cycle schedule, which
+// also sleeps on it. Replacing appClock makes them deterministic; latency
+// measurements, rate limits and request deadlines keep the wall clock.
+//
+// The current reference table is FIPE's newest unless pinned. When FIPE
+// publishes a table late or broken, pinning makes the previous one current
+// again for every request without a reference parameter, /api/references,
+// price histories and the history collector, until unpinned; newer tables
+// are hidden meanwhile. GOFIPE_REFERENCE_PIN pins a table code at startup,
+// and with GOFIPE_ADMIN_TOKEN set:
+//
+//   - GET    /admin/reference shows the pin and FIPE's newest table.
+//   - PUT    /admin/reference {"code": "329"} pins a table; an empty body
+//     freezes the current one.
+//   - DELETE /admin/reference removes the pin.
+//
+// With the history store (GOFIPE_HISTORY_DB) the pin set through the admin
+// API is stored there and every replica applies it within
+// referencePinRefresh; GOFIPE_REFERENCE_PIN only applies until a pin is
+// first set or removed through the API. Without the store pins are kept
+// per replica.
+
+// clock tells the time and waits.
+type clock interface {
+	Now() time.Time
+	// Sleep waits for d, or returns ctx.Err() when ctx is done first.
+	Sleep(ctx context.Context, d time.Duration) error
+}
+
+// systemClock is the wall clock.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) Sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// appClock is the clock of time-dependent behavior.
+var appClock clock = systemClock{}
+
+// referencePinRefresh is how often replicas reread the stored pin.
+const referencePinRefresh = 10 * time.Second
+
+// referencePin holds the pinned reference table code, "" when unpinned.
+var referencePin = struct {
+	sync.RWMutex
+	code string
+}{code: os.Getenv("GOFIPE_REFERENCE_PIN")}
+
+// pinnedReference returns the pinned table code, "" when unpinned. It is
+// the fipe.Client CurrentReference hook.
+func pinnedReference() string {
+	referencePin.RLock()
+	defer referencePin.RUnlock()
+	return referencePin.code
+}
+
+// storedReferencePin returns the stored pin, "" when unpinned; ok is
+// false when the pin was never set through the admin API.
+func (s *historyStore) storedReferencePin(ctx context.Context) (code string, ok bool, err error) {
+	err = s.db.QueryRowContext(ctx, `SELECT code FROM reference_pin WHERE id = 1`).Scan(&code)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	return code, err == nil, err
+}
+
+// storeReferencePin stores code as the pin, "" to unpin.
+func (s *historyStore) storeReferencePin(ctx context.Context, code string) error {
+	_, err := s.db.ExecContext(ctx, s.rebind(`INSERT INTO reference_pin (id, code, updated_at) VALUES (1, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET code = excluded.code, updated_at = excluded.updated_at`),
+		code, appClock.Now().Unix())
+	return err
+}
+
+// setReferencePin pins code, "" to unpin, in the store when there is one.
+func setReferencePin(ctx context.Context, code string) error {
+	if historyDB != nil {
+		if err := historyDB.storeReferencePin(ctx, code); err != nil {
+			return err
+		}
+	}
+	referencePin.Lock()
+	referencePin.code = code
+	referencePin.Unlock()
+	return nil
+}
+
+// syncReferencePin applies the stored pin, if one was set.
+func syncReferencePin(ctx context.Context) {
+	code, ok, err := historyDB.storedReferencePin(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "reference pin query failed", "error", err)
+		return
+	}
+	if !ok {
+		return
+	}
+	referencePin.Lock()
+	changed := referencePin.code != code
+	referencePin.code = code
+	referencePin.Unlock()
+	if changed {
+		slog.InfoContext(ctx, "current reference pin applied", "reference_code", code)
+	}
+}
+
+// startReferencePinSync applies the stored pin now and every
+// referencePinRefresh, as a history job.
+func startReferencePinSync() {
+	syncReferencePin(context.Background())
+	goHistoryJob(func(ctx context.Context) {
+		for appClock.Sleep(ctx, referencePinRefresh) == nil {
+			syncReferencePin(ctx)
+		}
+	})
+}
+
+// handleReferencePin serves GET, PUT and DELETE /admin/reference.
+func handleReferencePin(w http.ResponseWriter, r *http.Request) {
+	recordHTTPRequest("/admin/reference", r.Method)
+	ctx := r.Context()
+	switch r.Method {
+	case http.MethodPut:
+		var body struct {
+			Code string `json:"code"`
+		}
+		if b, _ := io.ReadAll(io.LimitReader(r.Body, 1<<10)); len(b) > 0 {
+			if err := json.Unmarshal(b, &body); err != nil {
+				http.Error(w, "body must be {\"code\": \"<table code>\"}", http.StatusBadRequest)
+				return
+			}
+		}
+		tables, err := latestReferences(ctx)
+		if err != nil {
+			writeUpstreamError(w, err)
+			return
+		}
+		if body.Code == "" {
+			// Freeze the table current now, pinned or not.
+			current, err := fipeClient.References(ctx)
+			if err != nil || len(current) == 0 {
+				http.Error(w, "no current reference table", http.StatusBadGateway)
+				return
+			}
+			body.Code = current[0].Code
+		}
+		if !slices.ContainsFunc(tables, func(t fipe.ReferenceTable) bool { return t.Code == body.Code }) {
+			http.Error(w, "code must be a table code from /api/references", http.StatusBadRequest)
+			return
+		}
+		if err := setReferencePin(ctx, body.Code); err != nil {
+			slog.ErrorContext(ctx, "reference pin query failed", "error", err)
+			http.Error(w, "reference pin unavailable", http.StatusInternalServerError)
+			return
+		}
+		slog.InfoContext(ctx, "current reference pinned", "reference_code", body.Code)
+	case http.MethodDelete:
+		if err := setReferencePin(ctx, ""); err != nil {
+			slog.ErrorContext(ctx, "reference pin query failed", "error", err)
+			http.Error(w, "reference pin unavailable", http.StatusInternalServerError)
+			return
+		}
+		slog.InfoContext(ctx, "current reference unpinned")
+	}
+	out := map[string]interface{}{"pinned": nil}
+	if code := pinnedReference(); code != "" {
+		out["pinned"] = code
+	}
+	if tables, err := latestReferences(ctx); err == nil && len(tables) > 0 {
+		out["latest"] = tables[0]
+	}
+	b, _ := json.Marshal(out)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// latestReferences lists every reference table FIPE publishes, ignoring
+// the pin.
+func latestReferences(ctx context.Context) ([]fipe.ReferenceTable, error) {
+	c := *fipeClient
+	c.CurrentReference = nil
+	return c.References(ctx)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock that only moves when told to; Sleep advances it
+// unless its context is done.
+type fakeClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	slept []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.slept = append(c.slept, d)
+	c.now = c.now.Add(d)
+	return nil
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// useFakeClock installs a fakeClock at now for the test.
+func useFakeClock(t *testing.T, now time.Time) *fakeClock {
+	c := &fakeClock{now: now}
+	prev := appClock
+	appClock = c
+	t.Cleanup(func() { appClock = prev })
+	return c
+}
+
+func TestCacheExpiryFollowsClock(t *testing.T) {
+	c := useFakeClock(t, time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC))
+	const key = "clock:test"
+	setToCache(key, []byte(`[]`), time.Hour)
+	t.Cleanup(func() { cache.deletePrefix("clock:") })
+
+	it, ok := cache.get(key)
+	if !ok {
+		t.Fatal("entry not cached")
+	}
+	if ttl := it.expiresAt.Sub(c.Now()); ttl <= 0 {
+		t.Fatalf("expiresAt %v is not after the fake now %v", it.expiresAt, c.Now())
+	}
+	if _, ok := getFromCache(key); !ok {
+		t.Error("fresh entry missed")
+	}
+	c.advance(it.expiresAt.Sub(c.Now()))
+	if _, ok := getFromCache(key); !ok {
+		t.Error("entry missed at its expiry")
+	}
+	c.advance(time.Second)
+	if _, ok := getFromCache(key); ok {
+		t.Error("expired entry served")
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"gofipe/pkg/fipe"
+)
+
+// --- v1 compatibility layer ---
+//
+// With GOFIPE_COMPAT_V1=true, /api/compat/v1/ answers in the format of the
+// retired FIPE v1 API, with Portuguese keys mapped from the v2 data, so
+// scripts written against it keep working by changing only their base URL:
+//
+//   - GET /api/compat/v1/{tipo}/marcas
+//   - GET /api/compat/v1/{tipo}/marcas/{marca}/modelos
+//   - GET /api/compat/v1/{tipo}/marcas/{marca}/modelos/{modelo}/anos
+//   - GET /api/compat/v1/{tipo}/marcas/{marca}/modelos/{modelo}/anos/{ano}
+//
+// tipo is carros, motos or caminhoes. Lists are [{"nome", "codigo"}] and
+// prices carry Valor, Marca, Modelo, AnoModelo, Combustivel, CodigoFipe,
+// MesReferencia, TipoVeiculo and SiglaCombustivel. Model codes are numbers,
+// as in v1. The "anos" list v1 returned next to the models of a brand is
+// always empty: ask for the years of a model instead. The reference
+// parameter selects a table as on the other endpoints.
+//
+// The other /api/ endpoints answer in the v1 schema too when asked with
+// format=v1 or an Accept profile (Accept: application/json; profile=v1),
+// whatever GOFIPE_COMPAT_V1 says: "code" and "name" become "codigo" and
+// "nome", prices take the keys above, and /api/models answers
+// {"modelos", "anos"} with numeric codes. Keys without a v1 counterpart
+// keep their v2 names. Every /api/ answer the v1 format applies to carries
+// Vary: Accept, so shared caches keep the two formats apart.
+
+// compatVehicleTypes maps the v1 vehicle types to the v2 ones.
+var compatVehicleTypes = map[string]string{
+	"carros":    "cars",
+	"motos":     "motorcycles",
+	"caminhoes": "trucks",
+}
+
+// compatItem is an item of the v1 lists.
+type compatItem struct {
+	Nome   string      `json:"nome"`
+	Codigo interface{} `json:"codigo"`
+}
+
+// compatPriceKeys maps the keys of v2 prices to the v1 ones.
+var compatPriceKeys = map[string]string{
+	"price":          "Valor",
+	"brand":          "Marca",
+	"model":          "Modelo",
+	"modelYear":      "AnoModelo",
+	"fuel":           "Combustivel",
+	"codeFipe":       "CodigoFipe",
+	"referenceMonth": "MesReferencia",
+	"vehicleType":    "TipoVeiculo",
+	"acronymFuel":    "SiglaCombustivel",
+}
+
+// priceFromCompat decodes a v1 price, whose keys compatPriceKeys maps.
+func priceFromCompat(v1 map[string]json.RawMessage) (fipe.Price, error) {
+	v2 := make(map[string]json.RawMessage, len(compatPriceKeys))
+	for k2, k1 := range compatPriceKeys {
+		if v, ok := v1[k1]; ok {
+			v2[k2] = v
+		}
+	}
+	b, _ := json.Marshal(v2)
+	var pr fipe.Price
+	err := json.Unmarshal(b, &pr)
+	return pr, err
+}
+
+// registerCompatEndpoints adds the v1 routes when GOFIPE_COMPAT_V1 is true.
+func registerCompatEndpoints(mux *http.ServeMux) {
+	if os.Getenv("GOFIPE_COMPAT_V1") != "true" {
+		return
+	}
+	mux.HandleFunc("GET /api/compat/v1/{tipo}/marcas", handleCompatBrands)
+	mux.HandleFunc("GET /api/compat/v1/{tipo}/marcas/{marca}/modelos", handleCompatModels)
+	mux.HandleFunc("GET /api/compat/v1/{tipo}/marcas/{marca}/modelos/{modelo}/anos", handleCompatYears)
+	mux.HandleFunc("GET /api/compat/v1/{tipo}/marcas/{marca}/modelos/{modelo}/anos/{ano}", handleCompatPrice)
+}
+
+// compatClient returns the vehicle type and the client of a v1 request,
+// answering the request itself when its parameters are invalid.
+func compatClient(w http.ResponseWriter, r *http.Request) (string, *fipe.Client, bool) {
+	vehicleType, ok := compatVehicleTypes[r.PathValue("tipo")]
+	if !ok {
+		http.Error(w, "tipo must be carros, motos or caminhoes", http.StatusNotFound)
+		return "", nil, false
+	}
+	ref, ok := referenceParam(w, r)
+	if !ok {
+		return "", nil, false
+	}
+	return vehicleType, clientAt(ref), true
+}
+
+func handleCompatBrands(w http.ResponseWriter, r *http.Request) {
+	recordHTTPRequest("/api/compat/v1/marcas", r.Method)
+	vehicleType, c, ok := compatClient(w, r)
+	if !ok {
+		return
+	}
+	brands, err := c.Brands(r.Context(), vehicleType)
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	writeCompatJSON(w, compatItems(brands, false))
+}
+
+func handleCompatModels(w http.ResponseWriter, r *http.Request) {
+	recordHTTPRequest("/api/compat/v1/modelos", r.Method)
+	vehicleType, c, ok := compatClient(w, r)
+	if !ok {
+		return
+	}
+	models, err := c.Models(r.Context(), vehicleType, r.PathValue("marca"))
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	writeCompatJSON(w, map[string][]compatItem{
+		"modelos": compatItems(models, true),
+		"anos":    {},
+	})
+}
+
+func handleCompatYears(w http.ResponseWriter, r *http.Request) {
+	recordHTTPRequest("/api/compat/v1/anos", r.Method)
+	vehicleType, c, ok := compatClient(w, r)
+	if !ok {
+		return
+	}
+	years, err := c.Years(r.Context(), vehicleType, r.PathValue("marca"), r.PathValue("modelo"))
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	writeCompatJSON(w, compatItems(years, false))
+}
+
+func handleCompatPrice(w http.ResponseWriter, r *http.Request) {
+	recordHTTPRequest("/api/compat/v1/valor", r.Method)
+	vehicleType, c, ok := compatClient(w, r)
+	if !ok {
+		return
+	}
+	pr, err := c.Price(r.Context(), vehicleType, r.PathValue("marca"), r.PathValue("modelo"), r.PathValue("ano"))
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	b, _ := json.Marshal(pr)
+	v1, err := compatPayload(r.URL.Path, b)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(v1)
+}
+
+// compatItems maps a v2 list to v1 items, with numeric codes when numeric
+// is set and the code is a number.
+func compatItems(refs []fipe.Reference, numeric bool) []compatItem {
+	out := make([]compatItem, len(refs))
+	for i, ref := range refs {
+		out[i] = compatItem{Nome: ref.Name, Codigo: ref.Code}
+		if n, err := strconv.Atoi(ref.Code); err == nil && numeric {
+			out[i].Codigo = n
+		}
+	}
+	return out
+}
+
+// writeCompatJSON writes a v1 response.
+func writeCompatJSON(w http.ResponseWriter, v interface{}) {
+	b, _ := json.Marshal(v)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// compatFormatWriter holds a response back for withCompatFormat.
+type compatFormatWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (c *compatFormatWriter) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+}
+
+func (c *compatFormatWriter) Write(b []byte) (int, error) {
+	return c.body.Write(b)
+}
+
+// withCompatFormat rewrites the JSON answers of /api/ endpoints in the v1
+// schema for requests asking for it.
+func withCompatFormat(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") || strings.HasPrefix(r.URL.Path, "/api/compat/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// Whether the answer is rewritten depends on Accept, whichever way
+		// it goes.
+		addVary(w.Header(), "Accept")
+		if !wantsCompatFormat(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// The answer is rewritten, so it must come uncompressed.
+		r.Header.Del("Accept-Encoding")
+		rec := &compatFormatWriter{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		data := rec.body.Bytes()
+		if rec.status == http.StatusOK && strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+			if v1, err := compatPayload(r.URL.Path, data); err == nil {
+				data = v1
+			}
+		}
+		w.Header().Del("Content-Length")
+		w.WriteHeader(rec.status)
+		w.Write(data)
+	})
+}
+
+// wantsCompatFormat reports whether r asks for the v1 schema.
+func wantsCompatFormat(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "v1" {
+		return true
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if _, params, err := mime.ParseMediaType(accept); err == nil && params["profile"] == "v1" {
+			return true
+		}
+	}
+	return false
+}
+
+// compatPayload rewrites the v2 JSON answer of the endpoint at path in the
+// v1 schema.
+func compatPayload(path string, data []byte) ([]byte, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	v = compatValue(v)
+	if items, ok := v.([]interface{}); ok && path == "/api/models" {
+		for _, item := range items {
+			m, _ := item.(map[string]interface{})
+			code, _ := m["codigo"].(string)
+			if n, err := strconv.Atoi(code); err == nil {
+				m["codigo"] = n
+			}
+		}
+		v = map[string]interface{}{"modelos": items, "anos": []interface{}{}}
+	}
+	return json.Marshal(v)
+}
+
+// compatValue renames the keys of a decoded v2 value to the v1 ones.
+func compatValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []interface{}:
+		for i := range v {
+			v[i] = compatValue(v[i])
+		}
+		return v
+	case map[string]interface{}:
+		_, fipeCode := v["codeFipe"]
+		_, month := v["referenceMonth"]
+		isPrice := fipeCode && month
+		out := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			switch {
+			case isPrice && compatPriceKeys[k] != "":
+				k = compatPriceKeys[k]
+			case k == "code":
+				k = "codigo"
+			case k == "name":
+				k = "nome"
+			}
+			out[k] = compatValue(val)
+		}
+		return out
+	}
+	return v
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// --- Response compression ---
+
+// gzipWriterPool recycles gzip writers between responses.
+var gzipWriterPool = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(io.Discard) },
+}
+
+// gzipResponseWriter sends everything written through a gzip writer.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz *gzip.Writer
+}
+
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+	return g.gz.Write(b)
+}
+
+// withGzip compresses responses for clients that accept gzip. Meant for
+// routes returning large JSON payloads.
+func withGzip(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			next(w, r)
+			return
+		}
+		gz := gzipWriterPool.Get().(*gzip.Writer)
+		defer gzipWriterPool.Put(gz)
+		gz.Reset(w)
+		defer gz.Close()
+
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Del("Content-Length")
+		next(&gzipResponseWriter{ResponseWriter: w, gz: gz}, r)
+	}
+}
+
+// acceptsGzip reports whether the request's Accept-Encoding allows gzip.
+func acceptsGzip(r *http.Request) bool {
+	rest := r.Header.Get("Accept-Encoding")
+	for rest != "" {
+		var enc string
+		enc, rest, _ = strings.Cut(rest, ",")
+		enc = strings.TrimSpace(enc)
+		if enc == "gzip" || strings.HasPrefix(enc, "gzip;") && !strings.HasSuffix(enc, "q=0") {
+			return true
+		}
+	}
+	return false
+}
+
+// minGzipPayload is the smallest cached payload worth pre-compressing;
+// below it the gzip framing eats most of the savings.
+const minGzipPayload = 512
+
+// gzipPayload compresses a cached payload once, at store time, at the best
+// compression level. It returns nil for payloads that are too small or do
+// not shrink.
+func gzipPayload(data []byte) []byte {
+	if len(data) < minGzipPayload {
+		return nil
+	}
+	var buf bytes.Buffer
+	gz, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	gz.Write(data)
+	gz.Close()
+	if buf.Len() >= len(data) {
+		return nil
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gofipe/pkg/fipe"
+)
+
+// --- Server configuration ---
+//
+// Core server settings come from environment variables and can be
+// overridden by command-line flags (flags win):
+//
+//	GOFIPE_PORT                   -port                   listen port (default 8080)
+//	GOFIPE_FIPE_BASE_URL          -fipe-base-url          FIPE v2 endpoint
+//	GOFIPE_PUBLIC_URL             -public-url             public base URL of links and QR codes (default http://localhost:PORT)
+//	GOFIPE_CACHE_TTL_BRANDS       -cache-ttl-brands       brands list TTL (default 12h)
+//	GOFIPE_CACHE_TTL_MODELS       -cache-ttl-models       models list TTL (default 12h)
+//	GOFIPE_CACHE_TTL_YEARS        -cache-ttl-years        years list TTL (default 24h)
+//	GOFIPE_HTTP_TIMEOUT           -http-timeout           FIPE request timeout (default 10s)
+//	GOFIPE_SHUTDOWN_TIMEOUT       -shutdown-timeout       graceful shutdown drain time (default 25s)
+//	GOFIPE_CACHE_BACKEND          -cache-backend          "memory" (default) or "redis"
+//	GOFIPE_REDIS_URL              -redis-url              Redis URL, required for the redis backend
+//	GOFIPE_REDIS_KEY_PREFIX       -redis-key-prefix       Redis key prefix (default "gofipe:")
+//	GOFIPE_CACHE_MAX_ENTRIES      -cache-max-entries      memory cache entry limit (default 100000, 0 unlimited)
+//	GOFIPE_CACHE_MAX_BYTES        -cache-max-bytes        memory cache size limit (default 268435456, 0 unlimited)
+//	GOFIPE_CACHE_SWEEP_INTERVAL   -cache-sweep-interval   memory cache eviction of stale entries (default 10m)
+//	GOFIPE_STREAM_MIN_BYTES       -stream-min-bytes       stream list misses from this size (default 32768, 0 disables)
+//	GOFIPE_UPSTREAM_MAX_BYTES     -upstream-max-bytes     largest FIPE answer accepted (default 8388608, 0 unlimited)
+//	GOFIPE_UPSTREAM_CONCURRENCY   -upstream-concurrency   concurrent FIPE requests (default 16, 0 unlimited)
+//	GOFIPE_UPSTREAM_RPS           -upstream-rps           FIPE requests per second (default 0, unlimited)
+//	GOFIPE_UPSTREAM_BURST         -upstream-burst         FIPE requests sent at once under the rate (default 10)
+//	GOFIPE_UPSTREAM_RATE_MODE     -upstream-rate-mode     "queue" (default) or "shed" requests over the rate
+//	GOFIPE_UPSTREAM_PROVIDERS     -upstream-providers     FIPE providers in fallback order (default "v2")
+//	GOFIPE_UPSTREAM_RETRIES       -upstream-retries       retries of transient FIPE failures (default 2, 0 disables)
+//	GOFIPE_UPSTREAM_RETRY_BACKOFF -upstream-retry-backoff delay before the first retry, doubled after each (default 250ms)
+//	GOFIPE_BREAKER_FAILURES       -breaker-failures       consecutive FIPE failures opening the breaker (default 5, 0 disables)
+//	GOFIPE_BREAKER_COOLDOWN       -breaker-cooldown       time an open breaker fails fast before a trial (default 30s)
+//
+// GOFIPE_FIPE_TOKEN sets the FIPE subscription token sent with every FIPE
+// request. It has no flag, so it does not show in process lists, and it is
+// never logged or included in error messages.
+//
+// TTLs are base values; adaptive TTLs still stretch or shorten them. Invalid
+// values stop the server at startup. Feature-specific settings keep their
+// own GOFIPE_* variables.
+
+// Config holds the core server settings.
+type Config struct {
+	Port                int
+	FipeBaseURL         string
+	FipeToken           string
+	PublicURL           string
+	BrandsTTL           time.Duration
+	ModelsTTL           time.Duration
+	YearsTTL            time.Duration
+	HTTPTimeout         time.Duration
+	ShutdownTimeout     time.Duration
+	CacheBackend        string
+	RedisURL            string
+	RedisKeyPrefix      string
+	CacheMaxEntries     int64
+	CacheMaxBytes       int64
+	CacheSweepInterval  time.Duration
+	StreamMinBytes      int64
+	UpstreamMaxBytes    int64
+	UpstreamConcurrency int
+	UpstreamRPS         float64
+	UpstreamBurst       int
+	UpstreamRateMode    string
+	UpstreamProviders   string
+	UpstreamRetries     int
+	UpstreamBackoff     time.Duration
+	BreakerFailures     int
+	BreakerCooldown     time.Duration
+}
+
+// defaultConfig returns the settings used when nothing is configured.
+func defaultConfig() Config {
+	return Config{
+		Port:                8080,
+		FipeBaseURL:         fipe.DefaultBaseURL,
+		BrandsTTL:           fipe.DefaultBrandsTTL,
+		ModelsTTL:           fipe.DefaultModelsTTL,
+		YearsTTL:            fipe.DefaultYearsTTL,
+		HTTPTimeout:         fipe.DefaultTimeout,
+		ShutdownTimeout:     25 * time.Second,
+		CacheBackend:        "memory",
+		RedisKeyPrefix:      "gofipe:",
+		CacheMaxEntries:     100000,
+		CacheMaxBytes:       256 << 20,
+		CacheSweepInterval:  10 * time.Minute,
+		StreamMinBytes:      defaultStreamMinBytes,
+		UpstreamMaxBytes:    defaultUpstreamMaxBytes,
+		UpstreamConcurrency: defaultUpstreamConcurrency,
+		UpstreamBurst:       10,
+		UpstreamRateMode:    "queue",
+		UpstreamProviders:   "v2",
+		UpstreamRetries:     2,
+		UpstreamBackoff:     250 * time.Millisecond,
+		BreakerFailures:     5,
+		BreakerCooldown:     30 * time.Second,
+	}
+}
+
+// loadConfig reads the environment, then applies the command-line args.
+func loadConfig(args []string) (Config, error) {
+	cfg := defaultConfig()
+	if v := os.Getenv("GOFIPE_PORT"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return cfg, fmt.Errorf("GOFIPE_PORT: %q is not a number", v)
+		}
+		cfg.Port = n
+	}
+	if v := os.Getenv("GOFIPE_STREAM_MIN_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return cfg, fmt.Errorf("GOFIPE_STREAM_MIN_BYTES: %q is not a number", v)
+		}
+		cfg.StreamMinBytes = n
+	}
+	if v := os.Getenv("GOFIPE_UPSTREAM_RPS"); v != "" {
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return cfg, fmt.Errorf("GOFIPE_UPSTREAM_RPS: %q is not a number", v)
+		}
+		cfg.UpstreamRPS = n
+	}
+	for _, n := range []struct {
+		env string
+		dst *int64
+	}{
+		{"GOFIPE_CACHE_MAX_ENTRIES", &cfg.CacheMaxEntries},
+		{"GOFIPE_CACHE_MAX_BYTES", &cfg.CacheMaxBytes},
+		{"GOFIPE_UPSTREAM_MAX_BYTES", &cfg.UpstreamMaxBytes},
+	} {
+		if v := os.Getenv(n.env); v != "" {
+			parsed, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return cfg, fmt.Errorf("%s: %q is not a number", n.env, v)
+			}
+			*n.dst = parsed
+		}
+	}
+	for _, n := range []struct {
+		env string
+		dst *int
+	}{
+		{"GOFIPE_UPSTREAM_CONCURRENCY", &cfg.UpstreamConcurrency},
+		{"GOFIPE_UPSTREAM_BURST", &cfg.UpstreamBurst},
+		{"GOFIPE_UPSTREAM_RETRIES", &cfg.UpstreamRetries},
+		{"GOFIPE_BREAKER_FAILURES", &cfg.BreakerFailures},
+	} {
+		if v := os.Getenv(n.env); v != "" {
+			parsed, err := strconv.Atoi(v)
+			if err != nil {
+				return cfg, fmt.Errorf("%s: %q is not a number", n.env, v)
+			}
+			*n.dst = parsed
+		}
+	}
+	texts := []struct {
+		env string
+		dst *string
+	}{
+		{"GOFIPE_FIPE_BASE_URL", &cfg.FipeBaseURL},
+		{"GOFIPE_FIPE_TOKEN", &cfg.FipeToken},
+		{"GOFIPE_PUBLIC_URL", &cfg.PublicURL},
+		{"GOFIPE_CACHE_BACKEND", &cfg.CacheBackend},
+		{"GOFIPE_REDIS_URL", &cfg.RedisURL},
+		{"GOFIPE_REDIS_KEY_PREFIX", &cfg.RedisKeyPrefix},
+		{"GOFIPE_UPSTREAM_RATE_MODE", &cfg.UpstreamRateMode},
+		{"GOFIPE_UPSTREAM_PROVIDERS", &cfg.UpstreamProviders},
+	}
+	for _, t := range texts {
+		if v := os.Getenv(t.env); v != "" {
+			*t.dst = v
+		}
+	}
+	durations := []struct {
+		env string
+		dst *time.Duration
+	}{
+		{"GOFIPE_CACHE_TTL_BRANDS", &cfg.BrandsTTL},
+		{"GOFIPE_CACHE_TTL_MODELS", &cfg.ModelsTTL},
+		{"GOFIPE_CACHE_TTL_YEARS", &cfg.YearsTTL},
+		{"GOFIPE_HTTP_TIMEOUT", &cfg.HTTPTimeout},
+		{"GOFIPE_SHUTDOWN_TIMEOUT", &cfg.ShutdownTimeout},
+		{"GOFIPE_CACHE_SWEEP_INTERVAL", &cfg.CacheSweepInterval},
+		{"GOFIPE_UPSTREAM_RETRY_BACKOFF", &cfg.UpstreamBackoff},
+		{"GOFIPE_BREAKER_COOLDOWN", &cfg.BreakerCooldown},
+	}
+	for _, d := range durations {
+		if v := os.Getenv(d.env); v != "" {
+			parsed, err := time.ParseDuration(v)
+			if err != nil {
+				return cfg, fmt.Errorf("%s: %q is not a duration (e.g. 30s, 12h)", d.env, v)
+			}
+			*d.dst = parsed
+		}
+	}
+
+	fs := flag.NewFlagSet("gofipe", flag.ContinueOnError)
+	fs.IntVar(&cfg.Port, "port", cfg.Port, "listen port (GOFIPE_PORT)")
+	fs.StringVar(&cfg.FipeBaseURL, "fipe-base-url", cfg.FipeBaseURL, "FIPE v2 API base URL (GOFIPE_FIPE_BASE_URL)")
+	fs.StringVar(&cfg.PublicURL, "public-url", cfg.PublicURL, "public base URL of absolute links and QR codes (GOFIPE_PUBLIC_URL)")
+	fs.DurationVar(&cfg.BrandsTTL, "cache-ttl-brands", cfg.BrandsTTL, "brands list cache TTL (GOFIPE_CACHE_TTL_BRANDS)")
+	fs.DurationVar(&cfg.ModelsTTL, "cache-ttl-models", cfg.ModelsTTL, "models list cache TTL (GOFIPE_CACHE_TTL_MODELS)")
+	fs.DurationVar(&cfg.YearsTTL, "cache-ttl-years", cfg.YearsTTL, "years list cache TTL (GOFIPE_CACHE_TTL_YEARS)")
+	fs.DurationVar(&cfg.HTTPTimeout, "http-timeout", cfg.HTTPTimeout, "FIPE request timeout (GOFIPE_HTTP_TIMEOUT)")
+	fs.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", cfg.ShutdownTimeout, "graceful shutdown drain time (GOFIPE_SHUTDOWN_TIMEOUT)")
+	fs.StringVar(&cfg.CacheBackend, "cache-backend", cfg.CacheBackend, "cache backend, memory or redis (GOFIPE_CACHE_BACKEND)")
+	fs.StringVar(&cfg.RedisURL, "redis-url", cfg.RedisURL, "Redis URL for the redis cache backend (GOFIPE_REDIS_URL)")
+	fs.StringVar(&cfg.RedisKeyPrefix, "redis-key-prefix", cfg.RedisKeyPrefix, "Redis key prefix (GOFIPE_REDIS_KEY_PREFIX)")
+	fs.Int64Var(&cfg.CacheMaxEntries, "cache-max-entries", cfg.CacheMaxEntries, "memory cache entry limit, 0 is unlimited (GOFIPE_CACHE_MAX_ENTRIES)")
+	fs.Int64Var(&cfg.CacheMaxBytes, "cache-max-bytes", cfg.CacheMaxBytes, "memory cache size limit in bytes, 0 is unlimited (GOFIPE_CACHE_MAX_BYTES)")
+	fs.DurationVar(&cfg.CacheSweepInterval, "cache-sweep-interval", cfg.CacheSweepInterval, "memory cache eviction interval of stale entries (GOFIPE_CACHE_SWEEP_INTERVAL)")
+	fs.Int64Var(&cfg.StreamMinBytes, "stream-min-bytes", cfg.StreamMinBytes, "stream list cache misses of at least this many bytes, 0 disables (GOFIPE_STREAM_MIN_BYTES)")
+	fs.Int64Var(&cfg.UpstreamMaxBytes, "upstream-max-bytes", cfg.UpstreamMaxBytes, "largest FIPE answer accepted in bytes, 0 is unlimited (GOFIPE_UPSTREAM_MAX_BYTES)")
+	fs.IntVar(&cfg.UpstreamConcurrency, "upstream-concurrency", cfg.UpstreamConcurrency, "concurrent FIPE requests, 0 is unlimited (GOFIPE_UPSTREAM_CONCURRENCY)")
+	fs.Float64Var(&cfg.UpstreamRPS, "upstream-rps", cfg.UpstreamRPS, "FIPE requests per second, 0 is unlimited (GOFIPE_UPSTREAM_RPS)")
+	fs.IntVar(&cfg.UpstreamBurst, "upstream-burst", cfg.UpstreamBurst, "FIPE requests sent at once within the rate limit (GOFIPE_UPSTREAM_BURST)")
+	fs.StringVar(&cfg.UpstreamRateMode, "upstream-rate-mode", cfg.UpstreamRateMode, "requests over the rate limit, queue or shed (GOFIPE_UPSTREAM_RATE_MODE)")
+	fs.StringVar(&cfg.UpstreamProviders, "upstream-providers", cfg.UpstreamProviders, "comma-separated FIPE providers in fallback order: v2, official or a v2 mirror URL (GOFIPE_UPSTREAM_PROVIDERS)")
+	fs.IntVar(&cfg.UpstreamRetries, "upstream-retries", cfg.UpstreamRetries, "retries of transient FIPE failures, 0 disables (GOFIPE_UPSTREAM_RETRIES)")
+	fs.DurationVar(&cfg.UpstreamBackoff, "upstream-retry-backoff", cfg.UpstreamBackoff, "delay before the first FIPE retry, doubled after each (GOFIPE_UPSTREAM_RETRY_BACKOFF)")
+	fs.IntVar(&cfg.BreakerFailures, "breaker-failures", cfg.BreakerFailures, "consecutive FIPE failures opening the circuit breaker, 0 disables (GOFIPE_BREAKER_FAILURES)")
+	fs.DurationVar(&cfg.BreakerCooldown, "breaker-cooldown", cfg.BreakerCooldown, "time an open circuit breaker fails fast before a trial request (GOFIPE_BREAKER_COOLDOWN)")
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+	if fs.NArg() > 0 {
+		return cfg, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	return cfg, cfg.validate()
+}
+
+// validate checks ranges and formats.
+func (c Config) validate() error {
+	if c.Port < 1 || c.Port > 65535 {
+		return fmt.Errorf("port must be between 1 and 65535, got %d", c.Port)
+	}
+	u, err := url.Parse(c.FipeBaseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("FIPE base URL must be an absolute http(s) URL, got %q", c.FipeBaseURL)
+	}
+	if c.PublicURL != "" {
+		u, err := url.Parse(c.PublicURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+			return fmt.Errorf("public URL must be an absolute http(s) URL without query, got %q", c.PublicURL)
+		}
+	}
+	if strings.ContainsFunc(c.FipeToken, func(r rune) bool { return r <= ' ' || r >= 0x7f }) {
+		// The token itself is left out of the message.
+		return fmt.Errorf("FIPE token (GOFIPE_FIPE_TOKEN) must be printable ASCII without spaces")
+	}
+	for _, ttl := range []struct {
+		name string
+		d    time.Duration
+	}{{"brands", c.BrandsTTL}, {"models", c.ModelsTTL}, {"years", c.YearsTTL}} {
+		if ttl.d < time.Minute {
+			return fmt.Errorf("%s cache TTL must be at least 1m, got %s", ttl.name, ttl.d)
+		}
+	}
+	if c.HTTPTimeout < time.Second || c.HTTPTimeout > 2*time.Minute {
+		return fmt.Errorf("HTTP timeout must be between 1s and 2m, got %s", c.HTTPTimeout)
+	}
+	if c.ShutdownTimeout <= 0 || c.ShutdownTimeout > 10*time.Minute {
+		return fmt.Errorf("shutdown timeout must be positive and at most 10m, got %s", c.ShutdownTimeout)
+	}
+	if c.CacheMaxEntries < 0 || c.CacheMaxBytes < 0 {
+		return fmt.Errorf("cache limits must be 0 (unlimited) or positive, got %d entries and %d bytes", c.CacheMaxEntries, c.CacheMaxBytes)
+	}
+	if c.CacheSweepInterval < time.Second {
+		return fmt.Errorf("cache sweep interval must be at least 1s, got %s", c.CacheSweepInterval)
+	}
+	if c.StreamMinBytes < 0 {
+		return fmt.Errorf("stream threshold must be 0 (disabled) or positive, got %d", c.StreamMinBytes)
+	}
+	if c.UpstreamMaxBytes < 0 {
+		return fmt.Errorf("upstream size limit must be 0 (unlimited) or positive, got %d", c.UpstreamMaxBytes)
+	}
+	if c.UpstreamConcurrency < 0 {
+		return fmt.Errorf("upstream concurrency must be 0 (unlimited) or positive, got %d", c.UpstreamConcurrency)
+	}
+	if c.UpstreamRPS < 0 {
+		return fmt.Errorf("upstream rate must be 0 (unlimited) or positive, got %g", c.UpstreamRPS)
+	}
+	if c.UpstreamBurst < 1 {
+		return fmt.Errorf("upstream burst must be at least 1, got %d", c.UpstreamBurst)
+	}
+	if c.UpstreamRateMode != "queue" && c.UpstreamRateMode != "shed" {
+		return fmt.Errorf("upstream rate mode must be queue or shed, got %q", c.UpstreamRateMode)
+	}
+	if _, err := parseUpstreamProviders(c.UpstreamProviders, c.FipeBaseURL); err != nil {
+		return fmt.Errorf("upstream providers: %v", err)
+	}
+	if c.UpstreamRetries < 0 || c.UpstreamRetries > 10 {
+		return fmt.Errorf("upstream retries must be between 0 and 10, got %d", c.UpstreamRetries)
+	}
+	if c.UpstreamBackoff < 10*time.Millisecond || c.UpstreamBackoff > time.Minute {
+		return fmt.Errorf("upstream retry backoff must be between 10ms and 1m, got %s", c.UpstreamBackoff)
+	}
+	if c.BreakerFailures < 0 {
+		return fmt.Errorf("breaker failures must be 0 (disabled) or positive, got %d", c.BreakerFailures)
+	}
+	if c.BreakerCooldown < time.Second || c.BreakerCooldown > 10*time.Minute {
+		return fmt.Errorf("breaker cooldown must be between 1s and 10m, got %s", c.BreakerCooldown)
+	}
+	switch c.CacheBackend {
+	case "memory":
+	case "redis":
+		if c.RedisURL == "" {
+			return fmt.Errorf("the redis cache backend needs a Redis URL (GOFIPE_REDIS_URL)")
+		}
+	default:
+		return fmt.Errorf("cache backend must be memory or redis, got %q", c.CacheBackend)
+	}
+	return nil
+}
+
+// addr is the listen address.
+func (c Config) addr() string {
+	return ":" + strconv.Itoa(c.Port)
+}
+
+// publicURL is the base URL of absolute links, without a trailing slash.
+func (c Config) publicURL() string {
+	if c.PublicURL == "" {
+		return "http://localhost:" + strconv.Itoa(c.Port)
+	}
+	return strings.TrimSuffix(c.PublicURL, "/")
+}
+
+// mustLoadConfig loads the configuration from args and the environment.
+func mustLoadConfig(args []string) Config {
+	cfg, err := loadConfig(args)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	return cfg
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/csv"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gofipe/pkg/fipe"
+)
+
+// --- CSV export ---
+//
+// /api/price and /api/priceHistory answer in CSV, one row per price, with
+// format=csv or Accept: text/csv, so analysts can open them straight in a
+// spreadsheet. The columns are referenceMonth, brand, model, modelYear,
+// fuel, codeFipe, priceValue and currency. Numbers follow the locale
+// parameter the way spreadsheets expect them: with the default pt-BR,
+// fields are separated by ";" and priceValue is written as 45123,00; with
+// en-US by "," and as 45123.00. There is no thousands separator. Lines end
+// in CRLF, as in RFC 4180, and the file starts with a UTF-8 byte order
+// mark, so Excel reads accented names right; it is sent as an attachment.
+// Both formats answer with Vary: Accept, so caches keep them apart.
+
+// csvColumns is the header row of the CSV exports.
+var csvColumns = []string{"referenceMonth", "brand", "model", "modelYear", "fuel", "codeFipe", "priceValue", "currency"}
+
+// wantsCSV reports whether r asks for CSV.
+func wantsCSV(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "csv" {
+		return true
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(accept); err == nil && mediaType == "text/csv" {
+			return true
+		}
+	}
+	return false
+}
+
+// writePricesCSV writes prices as the CSV file name.csv, with numbers in
+// the format of l.
+func writePricesCSV(w http.ResponseWriter, l Locale, name string, prices []fipe.Price) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + ".csv"}))
+	w.Write([]byte("\ufeff"))
+	cw := csv.NewWriter(w)
+	cw.UseCRLF = true
+	if l.DecimalSep == "," {
+		cw.Comma = ';'
+	}
+	cw.Write(csvColumns)
+	for _, pr := range prices {
+		value := ""
+		if f, err := pr.Value(); err == nil {
+			value = strings.Replace(strconv.FormatFloat(f, 'f', 2, 64), ".", l.DecimalSep, 1)
+		}
+		cw.Write([]string{pr.ReferenceMonth, pr.Brand, pr.Model, strconv.Itoa(pr.ModelYear), pr.Fuel, pr.CodeFipe, value, "BRL"})
+	}
+	cw.Flush()
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"sync"
+
+	"gofipe/pkg/fipe"
+)
+
+// --- Price deltas ---
+//
+// GET /api/vehicles/{fipeCode}/delta?from=&to= tells what changed for a
+// vehicle between two reference months: both prices, the change in reais
+// and in percent. from and to are table codes from /api/references or
+// months as YYYY-MM; to defaults to the current table and from to the table
+// before to. type defaults to cars, and yearId narrows the answer to one of
+// the model years FIPE lists for the code in the to table. Prices are read
+// from the history store when it holds them (source "store") and fetched
+// from FIPE for that table otherwise (source "fipe"), cached for
+// HistoryTTL. Stored prices flagged suspect are left out, as in histories.
+
+// PriceDelta compares a model year between two tables. Years whose price
+// could not be found in either table are listed without change.
+type PriceDelta struct {
+	YearID        string                 `json:"yearId"`
+	Name          string                 `json:"name"`
+	From          map[string]interface{} `json:"from,omitempty"`
+	FromSource    string                 `json:"fromSource,omitempty"`
+	To            map[string]interface{} `json:"to,omitempty"`
+	ToSource      string                 `json:"toSource,omitempty"`
+	Change        *float64               `json:"change,omitempty"`
+	ChangePercent *float64               `json:"changePercent,omitempty"`
+}
+
+// deltaTable returns the index in tables of a from/to parameter: a table
+// code or a YYYY-MM month.
+func deltaTable(tables []fipe.ReferenceTable, v string) (int, bool) {
+	for i, t := range tables {
+		if t.Code == v {
+			return i, true
+		}
+		if month, year, ok := parseReferenceMonth(t.Month); ok && archiveMonthKey(month, year) == v {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// errSuspectPrice reports a stored price flagged as suspect.
+var errSuspectPrice = errors.New("price flagged as suspect")
+
+// storedCodePrices are the stored prices of a FIPE code in one table, by
+// year; suspect lists the years whose price is flagged as suspect.
+type storedCodePrices struct {
+	prices  map[string]fipe.Price
+	suspect map[string]bool
+}
+
+// codePrices returns the stored prices of the vehicle with a FIPE code in
+// table code.
+func (s *historyStore) codePrices(ctx context.Context, vehicleType, fipeCode, code string) (storedCodePrices, error) {
+	out := storedCodePrices{prices: map[string]fipe.Price{}, suspect: map[string]bool{}}
+	rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT p.year_id, p.payload, EXISTS (SELECT 1 FROM price_anomalies a
+			WHERE a.vehicle_type = p.vehicle_type AND a.brand_id = p.brand_id AND a.model_id = p.model_id
+			AND a.year_id = p.year_id AND a.reference_code = p.reference_code)
+		FROM price_snapshots p
+		WHERE p.vehicle_type = ? AND p.reference_code = ? AND p.payload LIKE ?`),
+		vehicleType, code, `%"codeFipe":"`+fipeCode+`"%`)
+	if err != nil {
+		return out, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var yearID, payload string
+		var suspect bool
+		if err := rows.Scan(&yearID, &payload, &suspect); err != nil {
+			return out, err
+		}
+		var pr fipe.Price
+		if json.Unmarshal([]byte(payload), &pr) == nil && pr.CodeFipe == fipeCode {
+			out.prices[yearID] = pr
+			out.suspect[yearID] = suspect
+		}
+	}
+	return out, rows.Err()
+}
+
+// deltaPrice returns the price of a model year in table code, from stored
+// when it holds it.
+func deltaPrice(ctx context.Context, stored storedCodePrices, vehicleType, fipeCode, yearID, code string) (fipe.Price, string, error) {
+	if stored.suspect[yearID] {
+		return fipe.Price{}, "", errSuspectPrice
+	}
+	if pr, ok := stored.prices[yearID]; ok {
+		return pr, "store", nil
+	}
+	pr, err := clientAt(code).CodePrice(ctx, vehicleType, fipeCode, yearID)
+	return pr, "fipe", err
+}
+
+// handleVehicleDelta serves GET /api/vehicles/{fipeCode}/delta.
+func handleVehicleDelta(w http.ResponseWriter, r *http.Request) {
+	recordHTTPRequest("/api/vehicles/delta", r.Method)
+	ctx := r.Context()
+	code := r.PathValue("fipeCode")
+	if !fipe.ValidCode(code) {
+		http.Error(w, "code must be a FIPE code such as 001004-9", http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	vehicleType := q.Get("type")
+	if vehicleType == "" {
+		vehicleType = "cars"
+	}
+	if _, ok := vehicleTypes[vehicleType]; !ok {
+		http.Error(w, "type must be cars, motorcycles or trucks", http.StatusBadRequest)
+		return
+	}
+	loc, err := lookupLocale(q.Get("locale"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tables, err := fipeClient.References(ctx)
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	to, ok := 0, len(tables) > 0
+	if v := q.Get("to"); v != "" {
+		to, ok = deltaTable(tables, v)
+	}
+	if !ok {
+		http.Error(w, "to must be a table code from /api/references or a month as YYYY-MM", http.StatusBadRequest)
+		return
+	}
+	from, ok := to+1, to+1 < len(tables)
+	if v := q.Get("from"); v != "" {
+		from, ok = deltaTable(tables, v)
+	}
+	if !ok {
+		http.Error(w, "from must be a table code from /api/references or a month as YYYY-MM", http.StatusBadRequest)
+		return
+	}
+	// Tables are listed newest first.
+	if from <= to {
+		http.Error(w, "from must be an older table than to", http.StatusBadRequest)
+		return
+	}
+
+	years, err := clientAt(tables[to].Code).CodeYears(ctx, vehicleType, code)
+	var se *fipe.StatusError
+	if errors.As(err, &se) && se.StatusCode == http.StatusNotFound {
+		http.Error(w, "FIPE code not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	if yearID := q.Get("yearId"); yearID != "" {
+		years = slices.DeleteFunc(years, func(y fipe.Reference) bool { return y.Code != yearID })
+		if len(years) == 0 {
+			http.Error(w, "year not available for this FIPE code", http.StatusNotFound)
+			return
+		}
+	}
+
+	var storedFrom, storedTo storedCodePrices
+	if historyDB != nil {
+		if storedFrom, err = historyDB.codePrices(ctx, vehicleType, code, tables[from].Code); err == nil {
+			storedTo, err = historyDB.codePrices(ctx, vehicleType, code, tables[to].Code)
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "delta prices query failed", "error", err)
+		}
+	}
+
+	// Prices missing from the store are fetched concurrently.
+	deltas := make([]PriceDelta, len(years))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, resolveConcurrency)
+	for i, y := range years {
+		deltas[i] = PriceDelta{YearID: y.Code, Name: y.Name}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			d := &deltas[i]
+			fromPrice, fromSource, errFrom := deltaPrice(ctx, storedFrom, vehicleType, code, y.Code, tables[from].Code)
+			if errFrom == nil {
+				d.From, d.FromSource = localizedPrice(fromPrice, loc), fromSource
+			}
+			toPrice, toSource, errTo := deltaPrice(ctx, storedTo, vehicleType, code, y.Code, tables[to].Code)
+			if errTo == nil {
+				d.To, d.ToSource = localizedPrice(toPrice, loc), toSource
+			}
+			if errFrom != nil || errTo != nil {
+				return
+			}
+			prev, err1 := fromPrice.Value()
+			cur, err2 := toPrice.Value()
+			if err1 != nil || err2 != nil || prev <= 0 {
+				return
+			}
+			change := math.Round((cur-prev)*100) / 100
+			percent := math.Round((cur-prev)/prev*1e4) / 100
+			d.Change, d.ChangePercent = &change, &percent
+		}()
+	}
+	wg.Wait()
+
+	b, _ := json.Marshal(map[string]interface{}{
+		"code":  code,
+		"type":  vehicleType,
+		"from":  tables[from],
+		"to":    tables[to],
+		"years": deltas,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
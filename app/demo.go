@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Demo mode ---
+//
+// "gofipe demo" runs the app against an embedded fake of the FIPE v2 API,
+// so the UI and the API can be shown without internet access. The fake
+// listens on a loopback port and serves a seeded catalog of cars,
+// motorcycles and trucks: brands, models, model years, lookups by FIPE code
+// and prices in the last demoReferenceMonths reference tables, the newest
+// one being the current month. Prices are deterministic, depreciating with
+// the model year and drifting slightly from table to table, so histories,
+// deltas and projections have something to show. Arguments after "demo"
+// are the usual flags; -fipe-base-url is ignored.
+
+// demoReferenceMonths is the number of reference tables the fake serves.
+const demoReferenceMonths = 36
+
+// demoModel is a model of the demo catalog.
+type demoModel struct {
+	code, name, fipeCode string
+	// fuel is the FIPE fuel code: 1 gasoline, 3 diesel.
+	fuel int
+	// first and last are the model years sold.
+	first, last int
+	// price is the price of the newest model year in the current table.
+	price float64
+}
+
+// demoBrand is a brand of the demo catalog.
+type demoBrand struct {
+	code, name string
+	models     []demoModel
+}
+
+// demoCatalog is the seeded data of the fake FIPE API by vehicle type.
+var demoCatalog = map[string][]demoBrand{
+	"cars": {
+		{"59", "VW - VolksWagen", []demoModel{
+			{"5940", "Gol 1.0 Flex 12V 5p", "005340-6", 1, 2014, 2023, 61890},
+			{"9530", "T-Cross 200 TSI 1.0 Flex 12V Aut.", "005540-9", 1, 2019, 2026, 142750},
+			{"9817", "Polo Track 1.0 Flex 12V 5p", "005571-9", 1, 2023, 2026, 89990},
+		}},
+		{"21", "Fiat", []demoModel{
+			{"4420", "UNO Mille 1.0 Fire/ F.Flex/ ECONOMY 4p", "001267-0", 1, 2010, 2014, 27450},
+			{"9373", "ARGO DRIVE 1.0 6V Flex", "001496-7", 1, 2018, 2026, 84230},
+			{"10156", "STRADA Freedom 1.3 Flex 8V CS Plus", "001565-3", 1, 2021, 2026, 106900},
+		}},
+		{"23", "GM - Chevrolet", []demoModel{
+			{"8440", "ONIX PLUS LT 1.0 12V TB Flex Aut.", "004477-7", 1, 2020, 2026, 109540},
+			{"7391", "ONIX HATCH 1.0 12V Flex 5p Mec.", "004462-9", 1, 2020, 2026, 88320},
+			{"9612", "S10 LTZ 2.8 4x4 CD Diesel Aut.", "004528-5", 3, 2017, 2026, 278400},
+		}},
+		{"25", "Honda", []demoModel{
+			{"8753", "HR-V EX 1.5 Flex TB 16V 5p Aut.", "014110-1", 1, 2022, 2026, 171600},
+			{"6121", "Civic Sedan EXL 2.0 Flex 16V Aut. 4p", "014084-9", 1, 2017, 2021, 139800},
+		}},
+		{"56", "Toyota", []demoModel{
+			{"9211", "Corolla XEi 2.0 Flex 16V Aut.", "002152-1", 1, 2020, 2026, 168900},
+			{"8946", "Hilux CD SRX 4x4 2.8 TDI Diesel Aut.", "002174-2", 3, 2016, 2026, 312500},
+		}},
+		{"26", "Hyundai", []demoModel{
+			{"9005", "HB20 Comfort 1.0 Flex 12V Mec.", "015136-0", 1, 2020, 2026, 82450},
+			{"9851", "CRETA Limited 1.0 TB 12V Flex Aut.", "015190-5", 1, 2022, 2026, 149700},
+		}},
+	},
+	"motorcycles": {
+		{"80", "HONDA", []demoModel{
+			{"4815", "CG 160 FAN FLEXONE", "811164-6", 1, 2016, 2026, 17350},
+			{"6287", "BIZ 125 FLEXONE", "811183-2", 1, 2018, 2026, 15120},
+			{"7003", "XRE 300 SAHARA ADVENTURE", "811257-0", 1, 2024, 2026, 33900},
+		}},
+		{"101", "YAMAHA", []demoModel{
+			{"5211", "FAZER FZ25 250 CONNECTED", "827148-1", 1, 2018, 2026, 24890},
+			{"6672", "NMAX 160 CONNECTED ABS", "827182-1", 1, 2021, 2026, 21640},
+		}},
+	},
+	"trucks": {
+		{"109", "Mercedes-Benz", []demoModel{
+			{"5124", "Accelo 1016 2p (diesel)(E5)", "509196-0", 3, 2013, 2026, 398500},
+			{"6380", "Actros 2651 S 6x4 2p (diesel)(E6)", "509306-8", 3, 2020, 2026, 1085000},
+		}},
+		{"102", "Volvo", []demoModel{
+			{"4912", "FH-540 6x4 2p (diesel)(E5)", "514096-1", 3, 2015, 2023, 689400},
+			{"6845", "VM 270 4x2 2p (diesel)(E6)", "514134-8", 3, 2023, 2026, 612300},
+		}},
+	},
+}
+
+// demoVehicleTypes are the FIPE vehicle type numbers.
+var demoVehicleTypes = map[string]int{"cars": 1, "motorcycles": 2, "trucks": 3}
+
+// demoFuels are the FIPE fuel names and acronyms by fuel code.
+var demoFuels = map[int][2]string{1: {"Gasolina", "G"}, 3: {"Diesel", "D"}}
+
+// startDemo starts the fake FIPE API and returns args pointing the app at
+// it.
+func startDemo(args []string) []string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatalf("Demo FIPE server: %v", err)
+	}
+	go http.Serve(ln, http.HandlerFunc(serveDemoFipe))
+	baseURL := "http://" + ln.Addr().String()
+	slog.Info("demo mode: serving seeded FIPE data", "fipe_base_url", baseURL)
+	return append(args, "-fipe-base-url="+baseURL)
+}
+
+// demoReference is a reference table of the fake API.
+type demoReference struct {
+	code  int
+	month time.Month
+	year  int
+}
+
+// demoReferences lists the reference tables of the fake API, newest
+// first. Codes follow FIPE's numbering (308 is March 2024).
+func demoReferences() []demoReference {
+	y, m, _ := fipeNow().Date()
+	out := make([]demoReference, demoReferenceMonths)
+	for i := range out {
+		t := time.Date(y, m-time.Month(i), 1, 0, 0, 0, 0, time.UTC)
+		out[i] = demoReference{308 + (t.Year()-2024)*12 + int(t.Month()) - 3, t.Month(), t.Year()}
+	}
+	return out
+}
+
+// serveDemoFipe answers the FIPE v2 API from demoCatalog.
+func serveDemoFipe(w http.ResponseWriter, r *http.Request) {
+	refs := demoReferences()
+	ref := 0
+	if v := r.URL.Query().Get("reference"); v != "" {
+		code, _ := strconv.Atoi(v)
+		ref = refs[0].code - code
+		if ref < 0 || ref >= len(refs) {
+			http.Error(w, "reference not found", http.StatusNotFound)
+			return
+		}
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) == 1 && parts[0] == "references" {
+		out := make([]map[string]string, len(refs))
+		for i, t := range refs {
+			out[i] = map[string]string{"code": strconv.Itoa(t.code), "month": locales["pt-BR"].FormatMonth(t.month, t.year)}
+		}
+		writeDemoJSON(w, out)
+		return
+	}
+	brands, ok := demoCatalog[parts[0]]
+	if !ok || len(parts) < 2 {
+		http.NotFound(w, r)
+		return
+	}
+	vehicleType := parts[0]
+	if parts[1] != "brands" {
+		// /{type}/{fipeCode}/years[/{yearId}]
+		if len(parts) < 3 || parts[2] != "years" {
+			http.NotFound(w, r)
+			return
+		}
+		for _, b := range brands {
+			for _, m := range b.models {
+				if m.fipeCode == parts[1] {
+					serveDemoModel(w, r, vehicleType, b, m, parts[3:], refs, ref)
+					return
+				}
+			}
+		}
+		http.NotFound(w, r)
+		return
+	}
+	if len(parts) == 2 {
+		out := make([]map[string]string, len(brands))
+		for i, b := range brands {
+			out[i] = map[string]string{"code": b.code, "name": b.name}
+		}
+		writeDemoJSON(w, out)
+		return
+	}
+	for _, b := range brands {
+		if b.code != parts[2] {
+			continue
+		}
+		if len(parts) == 4 && parts[3] == "models" {
+			out := make([]map[string]string, len(b.models))
+			for i, m := range b.models {
+				out[i] = map[string]string{"code": m.code, "name": m.name}
+			}
+			writeDemoJSON(w, out)
+			return
+		}
+		if len(parts) < 6 || parts[3] != "models" || parts[5] != "years" {
+			break
+		}
+		for _, m := range b.models {
+			if m.code == parts[4] {
+				serveDemoModel(w, r, vehicleType, b, m, parts[6:], refs, ref)
+				return
+			}
+		}
+	}
+	http.NotFound(w, r)
+}
+
+// serveDemoModel answers the years list of a model, or with rest holding a
+// year code, its price in refs[ref].
+func serveDemoModel(w http.ResponseWriter, r *http.Request, vehicleType string, b demoBrand, m demoModel, rest []string, refs []demoReference, ref int) {
+	fuel := demoFuels[m.fuel]
+	switch len(rest) {
+	case 0:
+		var out []map[string]string
+		for year := m.last; year >= m.first; year-- {
+			out = append(out, map[string]string{
+				"code": fmt.Sprintf("%d-%d", year, m.fuel),
+				"name": fmt.Sprintf("%d %s", year, fuel[0]),
+			})
+		}
+		writeDemoJSON(w, out)
+	case 1:
+		y, fuelCode, _ := strings.Cut(rest[0], "-")
+		year, err := strconv.Atoi(y)
+		if err != nil || year < m.first || year > m.last || fuelCode != strconv.Itoa(m.fuel) {
+			http.NotFound(w, r)
+			return
+		}
+		writeDemoJSON(w, map[string]interface{}{
+			"vehicleType":    demoVehicleTypes[vehicleType],
+			"price":          formatBRL(demoPrice(m, year, refs[ref].code, ref)),
+			"brand":          b.name,
+			"model":          m.name,
+			"modelYear":      year,
+			"fuel":           fuel[0],
+			"codeFipe":       m.fipeCode,
+			"referenceMonth": locales["pt-BR"].FormatMonth(refs[ref].month, refs[ref].year),
+			"acronymFuel":    fuel[1],
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// demoPrice is the price of a model year in the reference table code,
+// published months before the current one: 8% less per year of age, 0.3%
+// less per month back, and a stable wiggle of up to 0.75%.
+func demoPrice(m demoModel, year, code, months int) float64 {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s/%d/%d", m.fipeCode, year, code)
+	wiggle := float64(int(h.Sum32()%151)-75) / 10000
+	return math.Round(m.price * math.Pow(0.92, float64(m.last-year)) * math.Pow(0.997, float64(months)) * (1 + wiggle))
+}
+
+// writeDemoJSON writes v as a JSON response of the fake API.
+func writeDemoJSON(w http.ResponseWriter, v interface{}) {
+	b, _ := json.Marshal(v)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// --- A/B experiments ---
+//
+// GOFIPE_EXPERIMENTS declares experiments and the weight of each variant as
+// JSON, e.g. {"comparison_layout": {"control": 50, "grid": 50}}.
+//
+// Visitors are bucketed deterministically from their X-API-Key or, for
+// browsers, a random visitor cookie, so they keep seeing the same variant.
+// Pages expose the assignments as body classes ("exp-<experiment>-<variant>")
+// and /api/experiments returns them to scripts. Every page render logs an
+// exposure and every successful price lookup counts as a conversion, both
+// per experiment and variant.
+
+const visitorCookie = "fipe_vid"
+
+var (
+	experimentExposuresCounter = newBudgetedCounterVec(
+		prometheus.CounterOpts{
+			Name: "fipe_experiment_exposures_total",
+			Help: "Page renders per experiment variant",
+		},
+		[]string{"experiment", "variant"},
+	)
+	experimentConversionsCounter = newBudgetedCounterVec(
+		prometheus.CounterOpts{
+			Name: "fipe_experiment_conversions_total",
+			Help: "Successful price lookups per experiment variant",
+		},
+		[]string{"experiment", "variant"},
+	)
+)
+
+// experiment is one A/B test with weighted variants, sorted by name.
+type experiment struct {
+	Name     string
+	Variants []string
+	Weights  []int
+	total    int
+}
+
+var experiments []experiment
+
+func init() {
+	registerBudgeted(experimentExposuresCounter, experimentConversionsCounter)
+	var err error
+	if experiments, err = parseExperiments(os.Getenv("GOFIPE_EXPERIMENTS")); err != nil {
+		log.Fatalf("Invalid GOFIPE_EXPERIMENTS: %v", err)
+	}
+}
+
+// parseExperiments parses the GOFIPE_EXPERIMENTS JSON document.
+func parseExperiments(s string) ([]experiment, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var raw map[string]map[string]int
+	if err := json.Unmarshal([]byte(s), &raw); err != nil {
+		return nil, err
+	}
+	out := make([]experiment, 0, len(raw))
+	for name, variants := range raw {
+		e := experiment{Name: name}
+		for v := range variants {
+			e.Variants = append(e.Variants, v)
+		}
+		sort.Strings(e.Variants)
+		for _, v := range e.Variants {
+			w := variants[v]
+			if w < 0 {
+				return nil, fmt.Errorf("experiment %q: negative weight for %q", name, v)
+			}
+			e.Weights = append(e.Weights, w)
+			e.total += w
+		}
+		if e.total == 0 {
+			return nil, fmt.Errorf("experiment %q: weights must add up to more than zero", name)
+		}
+		out = append(out, e)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+// assign deterministically picks the variant of e for visitor.
+func (e experiment) assign(visitor string) string {
+	h := fnv.New64a()
+	h.Write([]byte(e.Name + ":" + visitor))
+	point := int(h.Sum64() % uint64(e.total))
+	for i, w := range e.Weights {
+		if point < w {
+			return e.Variants[i]
+		}
+		point -= w
+	}
+	return e.Variants[len(e.Variants)-1]
+}
+
+// existingVisitorID returns the API key or visitor cookie of r, if any.
+func existingVisitorID(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return "key:" + key
+	}
+	if c, err := r.Cookie(visitorCookie); err == nil && c.Value != "" {
+		return c.Value
+	}
+	return ""
+}
+
+// visitorID returns the visitor identity, issuing a cookie to new browsers.
+func visitorID(w http.ResponseWriter, r *http.Request) string {
+	if id := existingVisitorID(r); id != "" {
+		return id
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{
+		Name:     visitorCookie,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   365 * 24 * 3600,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return id
+}
+
+// assignExperiments returns the variant per experiment for the visitor of r.
+// When exposed is true the assignments are logged and counted as exposures.
+func assignExperiments(w http.ResponseWriter, r *http.Request, exposed bool) map[string]string {
+	out := map[string]string{}
+	if len(experiments) == 0 {
+		return out
+	}
+	visitor := visitorID(w, r)
+	for _, e := range experiments {
+		v := e.assign(visitor)
+		out[e.Name] = v
+		if exposed {
+			experimentExposuresCounter.Inc(e.Name, v)
+			slog.InfoContext(r.Context(), "experiment exposure", "experiment", e.Name, "variant", v, "path", r.URL.Path)
+		}
+	}
+	return out
+}
+
+// experimentClasses renders assignments as CSS classes for the page body.
+func experimentClasses(assignments map[string]string) string {
+	classes := make([]string, 0, len(assignments))
+	for e, v := range assignments {
+		classes = append(classes, "exp-"+e+"-"+v)
+	}
+	sort.Strings(classes)
+	return strings.Join(classes, " ")
+}
+
+// recordExperimentConversion counts a successful lookup for the visitor's variants.
+func recordExperimentConversion(r *http.Request) {
+	visitor := existingVisitorID(r)
+	if visitor == "" {
+		return
+	}
+	for _, e := range experiments {
+		experimentConversionsCounter.Inc(e.Name, e.assign(visitor))
+	}
+}
+
+// handleExperiments returns the visitor's assignments for client-side variants.
+func handleExperiments(w http.ResponseWriter, r *http.Request) {
+	recordHTTPRequest("/api/experiments", r.Method)
+	b, _ := json.Marshal(map[string]interface{}{"experiments": assignExperiments(w, r, false)})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -0,0 +1,557 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/prometheus/client_golang/prometheus"
+	_ "modernc.org/sqlite"
+
+	"gofipe/pkg/fipe"
+)
+
+// --- Stored price history ---
+//
+// GOFIPE_HISTORY_DB enables a price history store: a SQLite file path
+// (e.g. /data/gofipe.db), or a postgres:// URL to use PostgreSQL instead.
+// A background collector snapshots the price of every watched vehicle
+// (GOFIPE_HISTORY_WATCH, "type/brandId/modelId/yearId" separated by commas,
+// plus the /api/watchlist, /api/baskets and Telegram subscription entries)
+// in each reference table, backfilling the last maxHistoryMonths tables on
+// first run and adding each new monthly table as FIPE publishes it. It runs
+// at startup and every GOFIPE_HISTORY_COLLECT_INTERVAL (default 6h, 0 runs
+// it only once) on slots aligned to the reference cycle (see schedule.go),
+// only fetching snapshots it does not have yet.
+//
+// /api/priceHistory and the vehicle pages answer from the store when it
+// holds every requested table for the vehicle, and otherwise rebuild the
+// history from FIPE as before.
+
+const defaultHistoryCollectInterval = 6 * time.Hour
+
+// historyDB is the price history store, nil when GOFIPE_HISTORY_DB is unset.
+var historyDB *historyStore
+
+var (
+	historySnapshotsCounter = newBudgetedCounterVec(
+		prometheus.CounterOpts{
+			Name: "fipe_history_snapshots_total",
+			Help: "Price snapshots taken by the history collector by result (stored, absent, error)",
+		},
+		[]string{"result"},
+	)
+	historyRequestsCounter = newBudgetedCounterVec(
+		prometheus.CounterOpts{
+			Name: "fipe_history_requests_total",
+			Help: "Price histories served by source (store, live)",
+		},
+		[]string{"source"},
+	)
+)
+
+func init() {
+	registerBudgeted(historySnapshotsCounter, historyRequestsCounter)
+}
+
+// watchedVehicle identifies a vehicle whose prices are collected.
+type watchedVehicle struct {
+	Type    string `json:"type"`
+	BrandID string `json:"brandId"`
+	ModelID string `json:"modelId"`
+	YearID  string `json:"yearId"`
+}
+
+// validate reports what is wrong with v, if anything.
+func (v watchedVehicle) validate() error {
+	if _, ok := vehicleTypes[v.Type]; !ok {
+		return errors.New("type must be cars, motorcycles or trucks")
+	}
+	if v.BrandID == "" || v.ModelID == "" || v.YearID == "" {
+		return errors.New("brandId, modelId and yearId are required")
+	}
+	return nil
+}
+
+// String formats v as type/brandId/modelId/yearId, the GOFIPE_HISTORY_WATCH
+// format.
+func (v watchedVehicle) String() string {
+	return v.Type + "/" + v.BrandID + "/" + v.ModelID + "/" + v.YearID
+}
+
+// parseWatchedVehicles parses the GOFIPE_HISTORY_WATCH format.
+func parseWatchedVehicles(s string) ([]watchedVehicle, error) {
+	var out []watchedVehicle
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(strings.Trim(entry, "/"), "/")
+		if len(parts) != 4 {
+			return nil, fmt.Errorf("%q: expected type/brandId/modelId/yearId", entry)
+		}
+		v := watchedVehicle{Type: parts[0], BrandID: parts[1], ModelID: parts[2], YearID: parts[3]}
+		if err := v.validate(); err != nil {
+			return nil, fmt.Errorf("%q: %v", entry, err)
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+// historyStore keeps price snapshots per vehicle and reference table.
+type historyStore struct {
+	db       *sql.DB
+	postgres bool
+}
+
+// openHistoryStore opens dsn, a SQLite path or a postgres:// URL, and
+// creates the table if needed.
+func openHistoryStore(dsn string) (*historyStore, error) {
+	s := &historyStore{postgres: strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://")}
+	var err error
+	if s.postgres {
+		s.db, err = sql.Open("pgx", dsn)
+	} else {
+		s.db, err = sql.Open("sqlite", dsn)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !s.postgres {
+		// One connection avoids "database is locked" between writers.
+		s.db.SetMaxOpenConns(1)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, stmt := range historySchema {
+		if _, err := s.db.ExecContext(ctx, stmt); err != nil {
+			s.db.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// historySchema creates the store tables; statements must be idempotent.
+var historySchema = []string{
+	`CREATE TABLE IF NOT EXISTS price_snapshots (
+		vehicle_type   TEXT NOT NULL,
+		brand_id       TEXT NOT NULL,
+		model_id       TEXT NOT NULL,
+		year_id        TEXT NOT NULL,
+		reference_code TEXT NOT NULL,
+		payload        TEXT NOT NULL,
+		collected_at   BIGINT NOT NULL,
+		PRIMARY KEY (vehicle_type, brand_id, model_id, year_id, reference_code)
+	)`,
+	`CREATE TABLE IF NOT EXISTS price_anomalies (
+		vehicle_type             TEXT NOT NULL,
+		brand_id                 TEXT NOT NULL,
+		model_id                 TEXT NOT NULL,
+		year_id                  TEXT NOT NULL,
+		reference_code           TEXT NOT NULL,
+		reference_month          TEXT NOT NULL,
+		price                    DOUBLE PRECISION NOT NULL,
+		previous_reference_month TEXT NOT NULL,
+		previous_price           DOUBLE PRECISION NOT NULL,
+		change_percent           DOUBLE PRECISION NOT NULL,
+		detected_at              BIGINT NOT NULL,
+		PRIMARY KEY (vehicle_type, brand_id, model_id, year_id, reference_code)
+	)`,
+	`CREATE TABLE IF NOT EXISTS quality_reports (
+		started_at BIGINT NOT NULL PRIMARY KEY,
+		status     TEXT NOT NULL,
+		report     TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS snapshot_retries (
+		vehicle_type    TEXT NOT NULL,
+		brand_id        TEXT NOT NULL,
+		model_id        TEXT NOT NULL,
+		year_id         TEXT NOT NULL,
+		reference_code  TEXT NOT NULL,
+		attempts        INTEGER NOT NULL,
+		first_failed_at BIGINT NOT NULL,
+		last_failed_at  BIGINT NOT NULL,
+		last_error      TEXT NOT NULL,
+		PRIMARY KEY (vehicle_type, brand_id, model_id, year_id, reference_code)
+	)`,
+	`CREATE TABLE IF NOT EXISTS watchlist (
+		owner        TEXT NOT NULL,
+		vehicle_type TEXT NOT NULL,
+		brand_id     TEXT NOT NULL,
+		model_id     TEXT NOT NULL,
+		year_id      TEXT NOT NULL,
+		added_at     BIGINT NOT NULL,
+		PRIMARY KEY (owner, vehicle_type, brand_id, model_id, year_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS baskets (
+		owner    TEXT NOT NULL,
+		name     TEXT NOT NULL,
+		added_at BIGINT NOT NULL,
+		PRIMARY KEY (owner, name)
+	)`,
+	`CREATE TABLE IF NOT EXISTS basket_vehicles (
+		owner        TEXT NOT NULL,
+		name         TEXT NOT NULL,
+		vehicle_type TEXT NOT NULL,
+		brand_id     TEXT NOT NULL,
+		model_id     TEXT NOT NULL,
+		year_id      TEXT NOT NULL,
+		PRIMARY KEY (owner, name, vehicle_type, brand_id, model_id, year_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS telegram_subscriptions (
+		chat_id      BIGINT NOT NULL,
+		vehicle_type TEXT NOT NULL,
+		brand_id     TEXT NOT NULL,
+		model_id     TEXT NOT NULL,
+		year_id      TEXT NOT NULL,
+		label        TEXT NOT NULL,
+		added_at     BIGINT NOT NULL,
+		PRIMARY KEY (chat_id, vehicle_type, brand_id, model_id, year_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS alert_webhooks (
+		owner             TEXT NOT NULL,
+		url               TEXT NOT NULL,
+		threshold_percent DOUBLE PRECISION NOT NULL,
+		added_at          BIGINT NOT NULL,
+		secret            TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (owner, url)
+	)`,
+	`CREATE TABLE IF NOT EXISTS reference_pin (
+		id         INTEGER NOT NULL PRIMARY KEY,
+		code       TEXT NOT NULL,
+		updated_at BIGINT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS incident_notes (
+		id          BIGINT NOT NULL PRIMARY KEY,
+		start_at    BIGINT NOT NULL,
+		end_at      BIGINT,
+		description TEXT NOT NULL
+	)`,
+}
+
+// rebind rewrites ? placeholders as $n for PostgreSQL.
+func (s *historyStore) rebind(query string) string {
+	if !s.postgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// snapshots returns the stored payloads of v by reference table code. An
+// empty payload means the vehicle is not listed in that table.
+func (s *historyStore) snapshots(ctx context.Context, v watchedVehicle) (map[string]string, error) {
+	rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT reference_code, payload FROM price_snapshots
+		WHERE vehicle_type = ? AND brand_id = ? AND model_id = ? AND year_id = ?`),
+		v.Type, v.BrandID, v.ModelID, v.YearID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := map[string]string{}
+	for rows.Next() {
+		var code, payload string
+		if err := rows.Scan(&code, &payload); err != nil {
+			return nil, err
+		}
+		out[code] = payload
+	}
+	return out, rows.Err()
+}
+
+// record stores the snapshot of v in table code; existing ones are kept.
+func (s *historyStore) record(ctx context.Context, v watchedVehicle, code, payload string) error {
+	_, err := s.db.ExecContext(ctx, s.rebind(`INSERT INTO price_snapshots
+		(vehicle_type, brand_id, model_id, year_id, reference_code, payload, collected_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING`),
+		v.Type, v.BrandID, v.ModelID, v.YearID, code, payload, appClock.Now().Unix())
+	return err
+}
+
+// history builds the history of v over tables from the store, leaving out
+// suspect prices unless includeSuspect. It reports false when a table has no
+// snapshot yet.
+func (s *historyStore) history(ctx context.Context, v watchedVehicle, tables []fipe.ReferenceTable, includeSuspect bool) ([]fipe.Price, bool) {
+	stored, err := s.snapshots(ctx, v)
+	var suspect map[string]bool
+	if err == nil && !includeSuspect {
+		suspect, err = s.suspectCodes(ctx, v)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "history store query failed", "error", err)
+		return nil, false
+	}
+	history := make([]fipe.Price, 0, len(tables))
+	for _, t := range tables {
+		payload, ok := stored[t.Code]
+		if !ok {
+			return nil, false
+		}
+		if payload == "" || suspect[t.Code] {
+			continue
+		}
+		var p fipe.Price
+		if err := json.Unmarshal([]byte(payload), &p); err != nil {
+			return nil, false
+		}
+		if p.ReferenceMonth = strings.TrimSpace(p.ReferenceMonth); p.ReferenceMonth == "" {
+			p.ReferenceMonth = strings.TrimSpace(t.Month)
+		}
+		history = append(history, p)
+	}
+	return history, true
+}
+
+// collect snapshots the missing tables of every vehicle in the last
+// maxHistoryMonths tables, and warms the cached lists leading to it. The
+// series is then checked for anomalies, and a new current table following a
+// stored one for price alerts, whose emails are sent once the run ends.
+// report, when not nil, gathers the data quality figures of the run.
+func (s *historyStore) collect(ctx context.Context, vehicles []watchedVehicle, report *QualityReport) error {
+	tables, err := fipeClient.References(ctx)
+	if err != nil {
+		return err
+	}
+	digest := alertDigest{}
+	defer digest.send()
+	export := &warehouseExport{}
+	defer export.flush()
+	tables = tables[:min(maxHistoryMonths, len(tables))]
+	if report != nil {
+		report.Tables = len(tables)
+	}
+	for _, v := range vehicles {
+		warmVehicleLists(ctx, v)
+		stored, err := s.snapshots(ctx, v)
+		if err != nil {
+			return err
+		}
+		var current *fipe.Price
+		for i, t := range tables {
+			if _, ok := stored[t.Code]; ok {
+				continue
+			}
+			pr, err := fipeClient.WithReference(t.Code).Price(ctx, v.Type, v.BrandID, v.ModelID, v.YearID)
+			var se *fipe.StatusError
+			var pe *fipe.PayloadError
+			payload, result := "", "absent"
+			switch {
+			case errors.As(err, &se) && se.StatusCode == http.StatusNotFound:
+				// Not listed in this table (e.g. before its launch).
+			case err != nil:
+				historySnapshotsCounter.Inc("error")
+				if errors.As(err, &pe) {
+					report.parseError()
+				} else {
+					report.fail(v)
+				}
+				slog.ErrorContext(ctx, "history collector lookup failed", "vehicle", v.String(), "reference_code", t.Code, "error", err)
+				if i == 0 && snapshotRetryBackoff > 0 {
+					if err := s.queueSnapshotRetry(ctx, v, t.Code, err); err != nil {
+						slog.ErrorContext(ctx, "snapshot retries query failed", "error", err)
+					}
+				}
+				continue
+			default:
+				_, verr := pr.Value()
+				report.fetched(verr == nil)
+				b, _ := json.Marshal(pr)
+				payload, result = string(b), "stored"
+				if i == 0 {
+					current = &pr
+				}
+			}
+			if err := s.record(ctx, v, t.Code, payload); err != nil {
+				return err
+			}
+			historySnapshotsCounter.Inc(result)
+			if payload != "" {
+				export.add(v, t, pr)
+			}
+			if i == 0 {
+				if retried, err := s.clearSnapshotRetry(ctx, v, t.Code); err != nil {
+					slog.ErrorContext(ctx, "snapshot retries query failed", "error", err)
+				} else if retried {
+					snapshotRetriesCounter.Inc("recovered")
+					slog.InfoContext(ctx, "snapshot retry recovered", "vehicle", v.String(), "reference_code", t.Code)
+				}
+			}
+			if i == 1 {
+				// The previous table is only filled in now: a backfill, not a newly
+				// published table, so it must not trigger price alerts.
+				current = nil
+			}
+			stored[t.Code] = payload
+		}
+		report.cover(len(tables), countStored(stored, tables))
+		found := detectAnomalies(v, tables, stored, anomalyThreshold)
+		flagged, err := s.refreshAnomalies(ctx, v, found)
+		if err != nil {
+			return err
+		}
+		report.flagged(flagged)
+		if current != nil && len(tables) > 1 && stored[tables[1].Code] != "" && !suspectIn(found, tables[0].Code, tables[1].Code) {
+			s.alertPriceChange(ctx, v, stored[tables[1].Code], *current, digest)
+		}
+	}
+	return nil
+}
+
+// countStored counts the tables stored holds a snapshot of.
+func countStored(stored map[string]string, tables []fipe.ReferenceTable) int {
+	n := 0
+	for _, t := range tables {
+		if _, ok := stored[t.Code]; ok {
+			n++
+		}
+	}
+	return n
+}
+
+// suspectIn reports whether found flags any of codes.
+func suspectIn(found []PriceAnomaly, codes ...string) bool {
+	for _, a := range found {
+		if slices.Contains(codes, a.ReferenceCode) {
+			return true
+		}
+	}
+	return false
+}
+
+// warmVehicleLists loads the brand, model and year lists of v into the
+// cache, so browsing to a watched vehicle does not wait for FIPE.
+func warmVehicleLists(ctx context.Context, v watchedVehicle) {
+	fipeClient.BrandsJSON(ctx, v.Type)
+	fipeClient.ModelsJSON(ctx, v.Type, v.BrandID)
+	fipeClient.YearsJSON(ctx, v.Type, v.BrandID, v.ModelID)
+}
+
+// priceHistory returns the history of a vehicle over the last months
+// tables, from the store when it has it, without suspect prices unless
+// includeSuspect.
+func priceHistory(ctx context.Context, vehicleType, brandId, modelId, yearId string, months int, includeSuspect bool) ([]fipe.Price, error) {
+	if historyDB != nil {
+		if tables, err := fipeClient.References(ctx); err == nil && len(tables) > 0 {
+			v := watchedVehicle{Type: vehicleType, BrandID: brandId, ModelID: modelId, YearID: yearId}
+			if history, ok := historyDB.history(ctx, v, tables[:min(months, len(tables))], includeSuspect); ok {
+				historyRequestsCounter.Inc("store")
+				return history, nil
+			}
+		}
+	}
+	historyRequestsCounter.Inc("live")
+	return fipeClient.PriceHistory(ctx, vehicleType, brandId, modelId, yearId, months)
+}
+
+// startHistoryCollector reads the environment and, when GOFIPE_HISTORY_DB is
+// set, opens the store and collects watched vehicles in the background.
+func startHistoryCollector() {
+	dsn := os.Getenv("GOFIPE_HISTORY_DB")
+	if dsn == "" {
+		return
+	}
+	vehicles, err := parseWatchedVehicles(os.Getenv("GOFIPE_HISTORY_WATCH"))
+	if err != nil {
+		log.Fatalf("Invalid GOFIPE_HISTORY_WATCH: %v", err)
+	}
+	interval := defaultHistoryCollectInterval
+	if v := os.Getenv("GOFIPE_HISTORY_COLLECT_INTERVAL"); v != "" {
+		if interval, err = time.ParseDuration(v); err != nil {
+			log.Fatalf("Invalid GOFIPE_HISTORY_COLLECT_INTERVAL: %v", err)
+		}
+	}
+	if historyDB, err = openHistoryStore(dsn); err != nil {
+		log.Fatalf("Invalid GOFIPE_HISTORY_DB: %v", err)
+	}
+	historyJobs.ctx, historyJobs.cancel = context.WithCancel(context.Background())
+	onShutdown("history store", closeHistoryStore)
+
+	startSnapshotRetries()
+	startReferencePinSync()
+
+	goHistoryJob(func(ctx context.Context) {
+		ctx = withUpstreamPriority(ctx, upstreamBackground)
+		for {
+			report := newQualityReport()
+			watched, err := historyDB.watchedVehicles(ctx)
+			var inBaskets, subscribed []watchedVehicle
+			if err == nil {
+				inBaskets, err = historyDB.basketVehicles(ctx)
+			}
+			if err == nil {
+				subscribed, err = historyDB.telegramVehicles(ctx)
+			}
+			if err == nil {
+				err = historyDB.collect(ctx, mergeWatched(mergeWatched(mergeWatched(vehicles, watched), inBaskets), subscribed), report)
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			if err = historyDB.finishQualityReport(ctx, report, err); err != nil {
+				slog.Error("history collector failed", "error", err)
+			}
+			if interval <= 0 || sleepUntilNextRun(ctx, interval) != nil {
+				return
+			}
+		}
+	})
+}
+
+// historyJobs are the background loops using historyDB. They stop when
+// ctx is cancelled, at shutdown, before the store closes.
+var historyJobs struct {
+	sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// goHistoryJob runs fn in the background with the context of historyJobs.
+func goHistoryJob(fn func(ctx context.Context)) {
+	historyJobs.Add(1)
+	go func() {
+		defer historyJobs.Done()
+		fn(historyJobs.ctx)
+	}()
+}
+
+// closeHistoryStore stops the history jobs, waiting for them until ctx is
+// done, and closes the store.
+func closeHistoryStore(ctx context.Context) error {
+	historyJobs.cancel()
+	done := make(chan struct{})
+	go func() {
+		historyJobs.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("history jobs still running: %w", ctx.Err())
+	}
+	return errors.Join(err, historyDB.db.Close())
+}
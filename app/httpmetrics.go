@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// --- Latency and error metrics ---
+//
+// fipe_http_request_duration_seconds observes every request by route
+// pattern and status, for latency SLOs; requests no route matched (or
+// turned away before routing) are labeled "unmatched".
+// fipe_upstream_errors_total counts FIPE responses with an error status, by
+// endpoint and status code ("network" when no response arrived), and
+// fipe_cache_hits_total / fipe_cache_misses_total count cache lookups by key
+// prefix, a miss being a lookup that had to go to FIPE (or to the replica
+// owning the key in shard mode).
+
+var (
+	// httpRequestDuration observes request latency by route and status.
+	httpRequestDuration = newBudgetedHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "fipe_http_request_duration_seconds",
+			Help:    "HTTP request latency by route pattern and status code",
+			Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+		},
+		[]string{"path", "status"},
+	)
+
+	// upstreamErrorsCounter counts failed FIPE requests.
+	upstreamErrorsCounter = newBudgetedCounterVec(
+		prometheus.CounterOpts{
+			Name: "fipe_upstream_errors_total",
+			Help: "Upstream FIPE API requests answered with an error status, or without a response (network), by endpoint and status code",
+		},
+		[]string{"endpoint", "status"},
+	)
+
+	// cacheHitsCounter counts lookups served from the cache.
+	cacheHitsCounter = newBudgetedCounterVec(
+		prometheus.CounterOpts{
+			Name: "fipe_cache_hits_total",
+			Help: "Cache lookups served from the cache by cache key prefix",
+		},
+		[]string{"prefix"},
+	)
+
+	// cacheMissesCounter counts lookups that went to FIPE.
+	cacheMissesCounter = newBudgetedCounterVec(
+		prometheus.CounterOpts{
+			Name: "fipe_cache_misses_total",
+			Help: "Cache lookups that had to fetch from FIPE by cache key prefix",
+		},
+		[]string{"prefix"},
+	)
+)
+
+func init() {
+	registerBudgeted(httpRequestDuration, upstreamErrorsCounter, cacheHitsCounter, cacheMissesCounter)
+}
+
+// recordCacheMiss counts a lookup of key that has to be fetched.
+func recordCacheMiss(key string) {
+	prefix, _, _ := strings.Cut(key, ":")
+	cacheMissesCounter.Inc(prefix)
+	cacheCountersFor(key).misses.Add(1)
+}
+
+// withRequestMetrics observes the latency of every request. Like
+// withBandwidthMetrics, it must not be separated from the ServeMux by a
+// handler that clones the request, or r.Pattern stays empty.
+func withRequestMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		httpRequestDuration.Observe(time.Since(start).Seconds(), route, strconv.Itoa(rec.status))
+	})
+}
+
+// upstreamErrorMetrics is an http.RoundTripper counting failed FIPE
+// requests.
+type upstreamErrorMetrics struct {
+	next http.RoundTripper
+}
+
+func (m upstreamErrorMetrics) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := m.next.RoundTrip(req)
+	var page *upstreamHTMLError
+	switch {
+	case errors.As(err, &page):
+		upstreamErrorsCounter.Inc(upstreamEndpoint(req.URL.String()), "html")
+	case err != nil:
+		upstreamErrorsCounter.Inc(upstreamEndpoint(req.URL.String()), "network")
+	case resp.StatusCode >= 400:
+		upstreamErrorsCounter.Inc(upstreamEndpoint(req.URL.String()), strconv.Itoa(resp.StatusCode))
+	}
+	return resp, err
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Incident notes ---
+//
+// Operators explain outages the synthetic check cannot, such as FIPE
+// maintenance windows, with incident notes: POST /admin/incidents takes
+// {"start": "2026-10-15T08:00:00-03:00", "end": "...", "description": "..."}
+// (start defaults to now; without end the note stays active until
+// deleted), GET lists the notes and DELETE /admin/incidents/{id} removes
+// one. Notes show on /status, where an active note makes the
+// status "degraded", and active ones are attached as "incidents" to the
+// 503 answers of lookups FIPE refused. With the history store
+// (GOFIPE_HISTORY_DB) notes are stored there, so every replica shows them:
+// each replica rereads them at most every incidentNotesRefresh. Without it
+// they are kept in memory by the replica that received them. The last
+// maxIncidentNotes are kept.
+
+const (
+	maxIncidentNotes           = 50
+	maxIncidentNoteDescription = 1000
+	incidentNotesRefresh       = 10 * time.Second
+)
+
+// IncidentNote is an operator's note on an incident.
+type IncidentNote struct {
+	ID    int       `json:"id"`
+	Start time.Time `json:"start"`
+	// End is nil while the incident lasts.
+	End         *time.Time `json:"end,omitempty"`
+	Description string     `json:"description"`
+}
+
+// active reports whether the incident is under way at now.
+func (n IncidentNote) active(now time.Time) bool {
+	return !now.Before(n.Start) && (n.End == nil || now.Before(*n.End))
+}
+
+// incidentNotes holds the notes, oldest first: all of them without the
+// history store, its copy read at loadedAt otherwise.
+var incidentNotes struct {
+	sync.Mutex
+	seq      int
+	notes    []IncidentNote
+	loadedAt time.Time
+}
+
+// incidentNotes returns the stored notes, oldest first.
+func (s *historyStore) incidentNotes(ctx context.Context) ([]IncidentNote, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, start_at, end_at, description FROM incident_notes ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []IncidentNote
+	for rows.Next() {
+		var n IncidentNote
+		var start int64
+		var end sql.NullInt64
+		if err := rows.Scan(&n.ID, &start, &end, &n.Description); err != nil {
+			return nil, err
+		}
+		n.Start = time.Unix(start, 0).UTC()
+		if end.Valid {
+			t := time.Unix(end.Int64, 0).UTC()
+			n.End = &t
+		}
+		out = append(out, n)
+	}
+	return out, rows.Err()
+}
+
+// addIncidentNote stores n with the next id, which it returns, and drops
+// the notes older than the last maxIncidentNotes.
+func (s *historyStore) addIncidentNote(ctx context.Context, n IncidentNote) (int, error) {
+	var end sql.NullInt64
+	if n.End != nil {
+		end = sql.NullInt64{Int64: n.End.Unix(), Valid: true}
+	}
+	var id int
+	err := s.db.QueryRowContext(ctx, s.rebind(`INSERT INTO incident_notes (id, start_at, end_at, description)
+		SELECT COALESCE(MAX(id), 0) + 1, ?, ?, ? FROM incident_notes RETURNING id`),
+		n.Start.Unix(), end, n.Description).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	_, err = s.db.ExecContext(ctx, s.rebind(`DELETE FROM incident_notes WHERE id <= ?`), id-maxIncidentNotes)
+	return id, err
+}
+
+// deleteIncidentNote removes the note id and reports whether it existed.
+func (s *historyStore) deleteIncidentNote(ctx context.Context, id int) (bool, error) {
+	res, err := s.db.ExecContext(ctx, s.rebind(`DELETE FROM incident_notes WHERE id = ?`), id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// listIncidentNotes returns the notes, latest start first; only those
+// active at now with activeOnly.
+func listIncidentNotes(now time.Time, activeOnly bool) []IncidentNote {
+	incidentNotes.Lock()
+	defer incidentNotes.Unlock()
+	if historyDB != nil && appClock.Now().Sub(incidentNotes.loadedAt) >= incidentNotesRefresh {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		notes, err := historyDB.incidentNotes(ctx)
+		cancel()
+		if err != nil {
+			// Keep the last copy rather than hide active incidents.
+			slog.Error("incident notes query failed", "error", err)
+		} else {
+			incidentNotes.notes = notes
+		}
+		incidentNotes.loadedAt = appClock.Now()
+	}
+	out := []IncidentNote{}
+	for _, n := range incidentNotes.notes {
+		if !activeOnly || n.active(now) {
+			out = append(out, n)
+		}
+	}
+	slices.SortStableFunc(out, func(a, b IncidentNote) int { return b.Start.Compare(a.Start) })
+	return out
+}
+
+// forgetIncidentNotes makes the next listIncidentNotes reread the store.
+func forgetIncidentNotes() {
+	incidentNotes.Lock()
+	incidentNotes.loadedAt = time.Time{}
+	incidentNotes.Unlock()
+}
+
+// handleIncidentNotes serves GET and POST /admin/incidents and DELETE
+// /admin/incidents/{id}.
+func handleIncidentNotes(w http.ResponseWriter, r *http.Request) {
+	recordHTTPRequest("/admin/incidents", r.Method)
+	ctx := r.Context()
+	switch r.Method {
+	case http.MethodPost:
+		var body struct {
+			Start       *time.Time `json:"start"`
+			End         *time.Time `json:"end"`
+			Description string     `json:"description"`
+		}
+		b, _ := io.ReadAll(io.LimitReader(r.Body, 8<<10))
+		if err := json.Unmarshal(b, &body); err != nil {
+			http.Error(w, `body must be {"start": "<RFC 3339 time>", "end": "<RFC 3339 time>", "description": "..."}`, http.StatusBadRequest)
+			return
+		}
+		body.Description = strings.TrimSpace(body.Description)
+		if body.Description == "" || len([]rune(body.Description)) > maxIncidentNoteDescription {
+			http.Error(w, "description must have 1 to "+strconv.Itoa(maxIncidentNoteDescription)+" characters", http.StatusBadRequest)
+			return
+		}
+		note := IncidentNote{Start: appClock.Now(), End: body.End, Description: body.Description}
+		if body.Start != nil {
+			note.Start = *body.Start
+		}
+		if note.End != nil && !note.End.After(note.Start) {
+			http.Error(w, "end must be after start", http.StatusBadRequest)
+			return
+		}
+		if historyDB != nil {
+			id, err := historyDB.addIncidentNote(ctx, note)
+			if err != nil {
+				slog.ErrorContext(ctx, "incident notes query failed", "error", err)
+				http.Error(w, "incident notes unavailable", http.StatusInternalServerError)
+				return
+			}
+			note.ID = id
+			forgetIncidentNotes()
+		} else {
+			incidentNotes.Lock()
+			incidentNotes.seq++
+			note.ID = incidentNotes.seq
+			incidentNotes.notes = append(incidentNotes.notes, note)
+			if len(incidentNotes.notes) > maxIncidentNotes {
+				incidentNotes.notes = incidentNotes.notes[1:]
+			}
+			incidentNotes.Unlock()
+		}
+		slog.InfoContext(ctx, "incident note added", "id", note.ID, "start", note.Start, "end", note.End)
+		b, _ = json.Marshal(note)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(b)
+		return
+	case http.MethodDelete:
+		id, err := strconv.Atoi(r.PathValue("id"))
+		found := false
+		if err == nil && historyDB != nil {
+			if found, err = historyDB.deleteIncidentNote(ctx, id); err != nil {
+				slog.ErrorContext(ctx, "incident notes query failed", "error", err)
+				http.Error(w, "incident notes unavailable", http.StatusInternalServerError)
+				return
+			}
+			forgetIncidentNotes()
+		} else if err == nil {
+			incidentNotes.Lock()
+			i := slices.IndexFunc(incidentNotes.notes, func(n IncidentNote) bool { return n.ID == id })
+			if found = i >= 0; found {
+				incidentNotes.notes = slices.Delete(incidentNotes.notes, i, i+1)
+			}
+			incidentNotes.Unlock()
+		}
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		slog.InfoContext(ctx, "incident note deleted", "id", id)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	b, _ := json.Marshal(map[string]interface{}{"incidents": listIncidentNotes(appClock.Now(), false)})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gofipe/pkg/fipe"
+)
+
+// --- Segment indices ---
+//
+// GOFIPE_INDICES declares baskets of vehicles, by FIPE code and model year,
+// whose average price forms a segment index, as JSON:
+//
+//	{"suv": ["cars/001004-9/2014-1", "cars/005340-6/2015-1"], "hatch": [...]}
+//
+// A background job averages the basket prices in each of the last
+// maxHistoryMonths reference tables, at startup and every
+// GOFIPE_INDEX_INTERVAL (default 6h, 0 runs it only once), as background
+// work. Members missing from a table (e.g. before their launch) are left out
+// of that month's average, and the point says how many were averaged. A
+// month is only published once every member answered, so a FIPE error does
+// not skew the index, and carries its change from the previous published
+// month. GET /api/indices lists the indices with their newest
+// value, GET /api/indices/{name} returns the series, and fipe_index_value
+// exports the newest value of each. With the history store, prices it
+// flagged as suspect (see Price anomalies) are left out like missing members.
+
+const (
+	defaultIndexInterval = 6 * time.Hour
+	maxIndexMembers      = 50
+)
+
+var indexNameRe = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// indexValueGauge is the newest value of each index.
+var indexValueGauge = newBudgetedGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "fipe_index_value",
+		Help: "Average FIPE price of the index basket in the newest reference table",
+	},
+	[]string{"index"},
+)
+
+func init() {
+	registerBudgeted(indexValueGauge)
+}
+
+// basketMember is a vehicle of an index basket.
+type basketMember struct {
+	Type     string `json:"type"`
+	CodeFipe string `json:"codeFipe"`
+	YearID   string `json:"yearId"`
+}
+
+// indexBasket is a GOFIPE_INDICES entry.
+type indexBasket struct {
+	Name    string
+	Members []basketMember
+}
+
+// IndexPoint is the value of an index in one reference table.
+type IndexPoint struct {
+	ReferenceCode           string   `json:"referenceCode"`
+	ReferenceMonth          string   `json:"referenceMonth"`
+	ReferenceMonthFormatted string   `json:"referenceMonthFormatted,omitempty"`
+	Value                   float64  `json:"value"`
+	ValueFormatted          string   `json:"valueFormatted"`
+	Members                 int      `json:"members"`
+	ChangePercent           *float64 `json:"changePercent,omitempty"` // from the previous point; absent on the oldest
+}
+
+// parseIndexBaskets parses the GOFIPE_INDICES JSON document.
+func parseIndexBaskets(s string) ([]indexBasket, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var raw map[string][]string
+	if err := json.Unmarshal([]byte(s), &raw); err != nil {
+		return nil, err
+	}
+	out := make([]indexBasket, 0, len(raw))
+	for name, entries := range raw {
+		if !indexNameRe.MatchString(name) {
+			return nil, fmt.Errorf("%q: index names use a-z, 0-9, _ and - (up to 32)", name)
+		}
+		if len(entries) == 0 || len(entries) > maxIndexMembers {
+			return nil, fmt.Errorf("%q: baskets need 1 to %d vehicles", name, maxIndexMembers)
+		}
+		b := indexBasket{Name: name}
+		for _, entry := range entries {
+			parts := strings.Split(strings.Trim(entry, "/"), "/")
+			if len(parts) != 3 {
+				return nil, fmt.Errorf("%q: %q: expected type/codeFipe/yearId", name, entry)
+			}
+			m := basketMember{Type: parts[0], CodeFipe: parts[1], YearID: parts[2]}
+			if _, ok := vehicleTypes[m.Type]; !ok {
+				return nil, fmt.Errorf("%q: %q: type must be cars, motorcycles or trucks", name, entry)
+			}
+			if !fipe.ValidCode(m.CodeFipe) || m.YearID == "" {
+				return nil, fmt.Errorf("%q: %q: expected a FIPE code such as 001004-9 and a yearId", name, entry)
+			}
+			b.Members = append(b.Members, m)
+		}
+		out = append(out, b)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+// indexSeries holds the computed series, newest first, by index name.
+var indexSeries struct {
+	sync.RWMutex
+	points    map[string][]IndexPoint
+	updatedAt time.Time
+}
+
+// computeIndex averages the prices of b in each of tables, newest first.
+// Tables in which a member failed are left out, and so are members whose
+// price is in suspect, keyed by suspectCodePriceKey. Prices of the older
+// tables are cached for HistoryTTL, so only the newest one is fetched
+// every run.
+func computeIndex(ctx context.Context, b indexBasket, tables []fipe.ReferenceTable, suspect map[string]bool) []IndexPoint {
+	points := make([]IndexPoint, 0, len(tables))
+	for i, t := range tables {
+		c := clientAt(t.Code)
+		if i == 0 {
+			c = fipeClient.WithReference(t.Code)
+		}
+		p := IndexPoint{ReferenceCode: t.Code, ReferenceMonth: strings.TrimSpace(t.Month)}
+		sum, failed := 0.0, false
+		for _, m := range b.Members {
+			if suspect[suspectCodePriceKey(m.Type, m.CodeFipe, m.YearID, t.Code)] {
+				continue
+			}
+			pr, err := c.CodePrice(ctx, m.Type, m.CodeFipe, m.YearID)
+			var se *fipe.StatusError
+			if errors.As(err, &se) && se.StatusCode == http.StatusNotFound {
+				continue
+			}
+			v, verr := pr.Value()
+			if err == nil {
+				err = verr
+			}
+			if err != nil {
+				slog.ErrorContext(ctx, "index member lookup failed", "index", b.Name, "vehicle", m.Type+"/"+m.CodeFipe+"/"+m.YearID, "reference_code", t.Code, "error", err)
+				failed = true
+				break
+			}
+			sum += v
+			p.Members++
+		}
+		if failed || p.Members == 0 {
+			continue
+		}
+		p.Value = math.Round(sum/float64(p.Members)*100) / 100
+		points = append(points, p)
+	}
+	setIndexChanges(points)
+	return points
+}
+
+// setIndexChanges sets the change of each point, newest first, from the
+// one after it.
+func setIndexChanges(points []IndexPoint) {
+	for i := 0; i+1 < len(points); i++ {
+		if prev := points[i+1].Value; prev > 0 {
+			change := math.Round((points[i].Value-prev)/prev*1e4) / 100
+			points[i].ChangePercent = &change
+		}
+	}
+}
+
+// updateIndices recomputes every index over the last maxHistoryMonths tables.
+func updateIndices(ctx context.Context, baskets []indexBasket) error {
+	tables, err := fipeClient.References(ctx)
+	if err != nil {
+		return err
+	}
+	tables = tables[:min(maxHistoryMonths, len(tables))]
+	var suspect map[string]bool
+	if historyDB != nil {
+		if suspect, err = historyDB.suspectCodePrices(ctx); err != nil {
+			return err
+		}
+	}
+	for _, b := range baskets {
+		points := computeIndex(ctx, b, tables, suspect)
+		if len(points) > 0 && points[0].ReferenceCode == tables[0].Code {
+			indexValueGauge.Set(points[0].Value, b.Name)
+		}
+		indexSeries.Lock()
+		indexSeries.points[b.Name] = points
+		indexSeries.Unlock()
+	}
+	indexSeries.Lock()
+	indexSeries.updatedAt = appClock.Now().UTC().Truncate(time.Second)
+	indexSeries.Unlock()
+	return nil
+}
+
+// indexHandler serves /api/indices and /api/indices/{name}.
+type indexHandler struct {
+	baskets []indexBasket
+}
+
+// basket returns the basket named name.
+func (h *indexHandler) basket(name string) (indexBasket, bool) {
+	for _, b := range h.baskets {
+		if b.Name == name {
+			return b, true
+		}
+	}
+	return indexBasket{}, false
+}
+
+// localizedPoints copies points with values formatted for l.
+func localizedPoints(points []IndexPoint, l Locale) []IndexPoint {
+	out := make([]IndexPoint, len(points))
+	for i, p := range points {
+		p.ValueFormatted = l.FormatBRL(p.Value)
+		if month, year, ok := parseReferenceMonth(p.ReferenceMonth); ok {
+			p.ReferenceMonthFormatted = l.FormatMonth(month, year)
+		}
+		out[i] = p
+	}
+	return out
+}
+
+// list serves GET /api/indices.
+func (h *indexHandler) list(w http.ResponseWriter, r *http.Request) {
+	recordHTTPRequest("/api/indices", r.Method)
+	loc, err := lookupLocale(r.URL.Query().Get("locale"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	indexSeries.RLock()
+	items := make([]map[string]interface{}, len(h.baskets))
+	for i, b := range h.baskets {
+		item := map[string]interface{}{"name": b.Name, "members": b.Members, "latest": nil}
+		if points := indexSeries.points[b.Name]; len(points) > 0 {
+			item["latest"] = localizedPoints(points[:1], loc)[0]
+		}
+		items[i] = item
+	}
+	updated := indexSeries.updatedAt
+	indexSeries.RUnlock()
+	writeIndexJSON(w, map[string]interface{}{"indices": items, "updatedAt": updated})
+}
+
+// series serves GET /api/indices/{name}.
+func (h *indexHandler) series(w http.ResponseWriter, r *http.Request) {
+	recordHTTPRequest("/api/indices/{name}", r.Method)
+	b, ok := h.basket(r.PathValue("name"))
+	if !ok {
+		http.Error(w, "index not found", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	months, err := strconv.Atoi(q.Get("months"))
+	if err != nil || months <= 0 {
+		months = defaultHistoryMonths
+	}
+	loc, err := lookupLocale(q.Get("locale"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	indexSeries.RLock()
+	points, computed := indexSeries.points[b.Name]
+	updated := indexSeries.updatedAt
+	indexSeries.RUnlock()
+	if !computed {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "index not computed yet", http.StatusServiceUnavailable)
+		return
+	}
+	writeIndexJSON(w, map[string]interface{}{
+		"name":      b.Name,
+		"members":   b.Members,
+		"series":    localizedPoints(points[:min(months, len(points))], loc),
+		"updatedAt": updated,
+	})
+}
+
+// writeIndexJSON writes v as JSON.
+func writeIndexJSON(w http.ResponseWriter, v interface{}) {
+	b, _ := json.Marshal(v)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// registerIndexEndpoints reads the environment and, when GOFIPE_INDICES is
+// set, adds the index routes and computes the indices in the background.
+func registerIndexEndpoints(mux *http.ServeMux) {
+	baskets, err := parseIndexBaskets(os.Getenv("GOFIPE_INDICES"))
+	if err != nil {
+		log.Fatalf("Invalid GOFIPE_INDICES: %v", err)
+	}
+	if len(baskets) == 0 {
+		return
+	}
+	interval := defaultIndexInterval
+	if v := os.Getenv("GOFIPE_INDEX_INTERVAL"); v != "" {
+		if interval, err = time.ParseDuration(v); err != nil {
+			log.Fatalf("Invalid GOFIPE_INDEX_INTERVAL: %v", err)
+		}
+	}
+	indexSeries.points = map[string][]IndexPoint{}
+	h := &indexHandler{baskets: baskets}
+	mux.HandleFunc("GET /api/indices", h.list)
+	mux.HandleFunc("GET /api/indices/{name}", h.series)
+
+	go func() {
+		ctx := withUpstreamPriority(context.Background(), upstreamBackground)
+		for {
+			if err := updateIndices(ctx, baskets); err != nil {
+				slog.Error("index update failed", "error", err)
+			}
+			if interval <= 0 {
+				return
+			}
+			sleepUntilNextRun(ctx, interval)
+		}
+	}()
+}
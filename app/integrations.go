@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// --- No-code integrations (Zapier, Make) ---
+//
+// A small key-protected surface under /integrations/v1/ shaped for no-code
+// platforms:
+//
+//   - GET  /integrations/v1/me: authentication test, returns the key name.
+//   - GET  /integrations/v1/triggers/price-changed: polling trigger. Given a
+//     vehicle (FIPE codes or q), returns the current observation with an id
+//     that only changes when the price or reference month does, so the
+//     platform's deduplication fires the trigger exactly on price changes.
+//   - POST /integrations/v1/actions/lookup-price: action returning the flat
+//     price row for FIPE codes or a free-text q.
+//
+// Rows use the same flat fields as the Sheets endpoints.
+
+// PriceObservation is one item of the price-changed trigger.
+type PriceObservation struct {
+	ID string `json:"id"`
+	SheetsPrice
+	ObservedAt time.Time `json:"observedAt"`
+}
+
+// observationID identifies a price and reference month of a vehicle.
+func observationID(p SheetsPrice) string {
+	return p.CodeFipe + ":" + p.YearID + ":" + p.ReferenceMonth + ":" + strconv.FormatFloat(p.Price, 'f', 2, 64)
+}
+
+// lookupIntegrationPrice resolves a vehicle and returns its price row,
+// with the HTTP status to use on failure.
+func lookupIntegrationPrice(ctx context.Context, it SheetsBatchItem) (SheetsPrice, int, error) {
+	it, err := resolveSheetsItem(ctx, it)
+	switch {
+	case errors.Is(err, errVehicleNotFound), errors.Is(err, errYearNotFound):
+		return SheetsPrice{}, http.StatusNotFound, err
+	case err != nil && it.Q != "":
+		return SheetsPrice{}, upstreamErrorStatus(err), err
+	case err != nil:
+		return SheetsPrice{}, http.StatusBadRequest, err
+	}
+	p, err := fetchSheetsPrice(ctx, it.Type, it.BrandID, it.ModelID, it.YearID)
+	if err != nil {
+		return SheetsPrice{}, upstreamErrorStatus(err), err
+	}
+	return p, http.StatusOK, nil
+}
+
+// writeIntegrationError writes a JSON error, which no-code platforms display verbatim.
+func writeIntegrationError(w http.ResponseWriter, status int, err error) {
+	b, _ := json.Marshal(map[string]string{"error": err.Error()})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// handleIntegrationMe serves GET /integrations/v1/me.
+func handleIntegrationMe(w http.ResponseWriter, r *http.Request) {
+	recordHTTPRequest("/integrations/v1/me", r.Method)
+	name, _ := apiKeyName(r)
+	b, _ := json.Marshal(map[string]string{"keyName": name})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// handlePriceChangedTrigger serves GET /integrations/v1/triggers/price-changed.
+func handlePriceChangedTrigger(w http.ResponseWriter, r *http.Request) {
+	recordHTTPRequest("/integrations/v1/triggers/price-changed", r.Method)
+	q := r.URL.Query()
+	p, status, err := lookupIntegrationPrice(r.Context(), SheetsBatchItem{
+		Type: q.Get("type"), BrandID: q.Get("brandId"), ModelID: q.Get("modelId"), YearID: q.Get("yearId"), Q: q.Get("q"),
+	})
+	if err != nil {
+		writeIntegrationError(w, status, err)
+		return
+	}
+	// Polling triggers expect an array, newest first.
+	b, _ := json.Marshal([]PriceObservation{{ID: observationID(p), SheetsPrice: p, ObservedAt: appClock.Now().UTC()}})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// handleLookupPriceAction serves POST /integrations/v1/actions/lookup-price.
+func handleLookupPriceAction(w http.ResponseWriter, r *http.Request) {
+	recordHTTPRequest("/integrations/v1/actions/lookup-price", r.Method)
+	var it SheetsBatchItem
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16<<10)).Decode(&it); err != nil {
+		writeIntegrationError(w, http.StatusBadRequest, errors.New("invalid JSON body"))
+		return
+	}
+	p, status, err := lookupIntegrationPrice(r.Context(), it)
+	if err != nil {
+		writeIntegrationError(w, status, err)
+		return
+	}
+	b, _ := json.Marshal(p)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// registerIntegrationEndpoints adds the no-code routes when API keys are configured.
+func registerIntegrationEndpoints(mux *http.ServeMux) {
+	if len(apiKeys) == 0 {
+		return
+	}
+	mux.HandleFunc("GET /integrations/v1/me", requireAPIKey(handleIntegrationMe))
+	mux.HandleFunc("GET /integrations/v1/triggers/price-changed", requireAPIKey(handlePriceChangedTrigger))
+	mux.HandleFunc("POST /integrations/v1/actions/lookup-price", requireAPIKey(handleLookupPriceAction))
+}
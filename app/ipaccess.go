@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// --- IP allowlist / denylist ---
+//
+// GOFIPE_IP_ACCESS_FILE points to a JSON file with CIDR lists for the public
+// routes and the admin routes (/metrics and /admin/*):
+//
+//	{
+//	  "public": {"allow": [], "deny": ["203.0.113.0/24"]},
+//	  "admin":  {"allow": ["10.0.0.0/8", "127.0.0.1"], "deny": []}
+//	}
+//
+// Deny entries always win. A non-empty allow list rejects every address not
+// in it. Bare IPs are accepted as single-address prefixes. The file is
+// checked for changes every GOFIPE_IP_ACCESS_RELOAD (default 10s) and
+// reloaded live; an invalid file keeps the previous rules. /health is exempt.
+
+const defaultIPAccessReload = 10 * time.Second
+
+// ipAccessDeniedCounter counts requests rejected by the IP rules.
+var ipAccessDeniedCounter = newBudgetedCounterVec(
+	prometheus.CounterOpts{
+		Name: "fipe_ip_access_denied_total",
+		Help: "Requests rejected by the IP allowlist/denylist by scope",
+	},
+	[]string{"scope"},
+)
+
+func init() {
+	registerBudgeted(ipAccessDeniedCounter)
+}
+
+// ipRuleSet holds the allow and deny prefixes of one scope.
+type ipRuleSet struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// ipAccessRules is the parsed content of GOFIPE_IP_ACCESS_FILE.
+type ipAccessRules struct {
+	Public ipRuleSet `json:"public"`
+	Admin  ipRuleSet `json:"admin"`
+}
+
+// permits reports whether addr passes the rule set.
+func (s *ipRuleSet) permits(addr netip.Addr) bool {
+	for _, p := range s.deny {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	if len(s.allow) == 0 {
+		return true
+	}
+	for _, p := range s.allow {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// compile parses the textual prefixes of the rule set.
+func (s *ipRuleSet) compile() error {
+	var err error
+	if s.allow, err = parsePrefixes(s.Allow); err != nil {
+		return err
+	}
+	s.deny, err = parsePrefixes(s.Deny)
+	return err
+}
+
+// parsePrefixes parses CIDRs or bare IPs.
+func parsePrefixes(entries []string) ([]netip.Prefix, error) {
+	out := make([]netip.Prefix, 0, len(entries))
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if !strings.Contains(e, "/") {
+			addr, err := netip.ParseAddr(e)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q", e)
+			}
+			out = append(out, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", e)
+		}
+		out = append(out, p.Masked())
+	}
+	return out, nil
+}
+
+// loadIPAccessRules reads and compiles the rules file.
+func loadIPAccessRules(path string) (*ipAccessRules, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rules := &ipAccessRules{}
+	if err := json.Unmarshal(b, rules); err != nil {
+		return nil, err
+	}
+	if err := rules.Public.compile(); err != nil {
+		return nil, fmt.Errorf("public: %v", err)
+	}
+	if err := rules.Admin.compile(); err != nil {
+		return nil, fmt.Errorf("admin: %v", err)
+	}
+	return rules, nil
+}
+
+// isAdminPath reports whether path belongs to the admin scope.
+func isAdminPath(path string) bool {
+	return path == "/metrics" || strings.HasPrefix(path, "/admin/")
+}
+
+// withIPAccess enforces the IP rules when GOFIPE_IP_ACCESS_FILE is set.
+func withIPAccess(next http.Handler) http.Handler {
+	path := os.Getenv("GOFIPE_IP_ACCESS_FILE")
+	if path == "" {
+		return next
+	}
+	interval := defaultIPAccessReload
+	if v := os.Getenv("GOFIPE_IP_ACCESS_RELOAD"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid GOFIPE_IP_ACCESS_RELOAD: %q", v)
+		}
+		interval = d
+	}
+
+	rules, err := loadIPAccessRules(path)
+	if err != nil {
+		log.Fatalf("Failed to load IP access rules from %s: %v", path, err)
+	}
+	var current atomic.Pointer[ipAccessRules]
+	current.Store(rules)
+	go watchIPAccessRules(path, interval, &current)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rules := current.Load()
+		scope, set := "public", &rules.Public
+		if isAdminPath(r.URL.Path) {
+			scope, set = "admin", &rules.Admin
+		}
+		addr, err := netip.ParseAddr(clientIP(r))
+		if err != nil || !set.permits(addr.Unmap()) {
+			ipAccessDeniedCounter.Inc(scope)
+			http.Error(w, "access denied", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// watchIPAccessRules reloads the rules whenever the file modification time changes.
+func watchIPAccessRules(path string, interval time.Duration, current *atomic.Pointer[ipAccessRules]) {
+	var lastMod time.Time
+	if fi, err := os.Stat(path); err == nil {
+		lastMod = fi.ModTime()
+	}
+	for range time.Tick(interval) {
+		fi, err := os.Stat(path)
+		if err != nil || fi.ModTime().Equal(lastMod) {
+			continue
+		}
+		lastMod = fi.ModTime()
+		rules, err := loadIPAccessRules(path)
+		if err != nil {
+			slog.Warn("keeping previous IP access rules, reload failed", "error", err)
+			continue
+		}
+		current.Store(rules)
+		slog.Info("reloaded IP access rules", "file", path)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gofipe/pkg/fipe"
+)
+
+// --- Locale-aware formatting ---
+
+// defaultLocale is used when clients do not ask for one.
+const defaultLocale = "pt-BR"
+
+// Locale describes how numbers, prices and reference months are presented.
+type Locale struct {
+	Tag          string
+	ThousandsSep string
+	DecimalSep   string
+	// CurrencyPrefix is prepended to BRL amounts, e.g. "R$ " or "R$".
+	CurrencyPrefix string
+	MonthNames     [12]string
+	// MonthLayout formats a month name and year, e.g. "%s de %d".
+	MonthLayout string
+}
+
+// locales lists the supported locales by BCP 47 tag.
+var locales = map[string]Locale{
+	"pt-BR": {
+		Tag:            "pt-BR",
+		ThousandsSep:   ".",
+		DecimalSep:     ",",
+		CurrencyPrefix: "R$ ",
+		MonthNames:     [12]string{"janeiro", "fevereiro", "março", "abril", "maio", "junho", "julho", "agosto", "setembro", "outubro", "novembro", "dezembro"},
+		MonthLayout:    "%s de %d",
+	},
+	"en-US": {
+		Tag:            "en-US",
+		ThousandsSep:   ",",
+		DecimalSep:     ".",
+		CurrencyPrefix: "R$",
+		MonthNames:     [12]string{"January", "February", "March", "April", "May", "June", "July", "August", "September", "October", "November", "December"},
+		MonthLayout:    "%s %d",
+	},
+}
+
+// lookupLocale resolves a locale tag case-insensitively, accepting "_" as separator.
+// An empty tag resolves to the default locale.
+func lookupLocale(tag string) (Locale, error) {
+	if tag == "" {
+		return locales[defaultLocale], nil
+	}
+	tag = strings.ReplaceAll(tag, "_", "-")
+	for k, l := range locales {
+		if strings.EqualFold(k, tag) {
+			return l, nil
+		}
+	}
+	return Locale{}, fmt.Errorf("unsupported locale %q", tag)
+}
+
+// FormatNumber formats v with two decimals and the locale separators.
+func (l Locale) FormatNumber(v float64) string {
+	s := strconv.FormatFloat(math.Abs(v), 'f', 2, 64)
+	intPart, frac := s[:len(s)-3], s[len(s)-2:]
+	var b strings.Builder
+	if v < 0 {
+		b.WriteByte('-')
+	}
+	for i, c := range intPart {
+		if i > 0 && (len(intPart)-i)%3 == 0 {
+			b.WriteString(l.ThousandsSep)
+		}
+		b.WriteRune(c)
+	}
+	return b.String() + l.DecimalSep + frac
+}
+
+// FormatBRL formats v as a Brazilian real amount, e.g. "R$ 45.123,00".
+func (l Locale) FormatBRL(v float64) string {
+	s := l.FormatNumber(v)
+	if strings.HasPrefix(s, "-") {
+		return "-" + l.CurrencyPrefix + s[1:]
+	}
+	return l.CurrencyPrefix + s
+}
+
+// FormatMonth formats a reference month, e.g. "outubro de 2026" or "October 2026".
+func (l Locale) FormatMonth(month time.Month, year int) string {
+	return fmt.Sprintf(l.MonthLayout, l.MonthNames[month-1], year)
+}
+
+// formatBRL formats a value as Brazilian currency in the default locale.
+func formatBRL(v float64) string {
+	return locales[defaultLocale].FormatBRL(v)
+}
+
+var (
+	numericMonthRe    = regexp.MustCompile(`^(\d{1,2})/(\d{4})$`)
+	portugueseMonthRe = regexp.MustCompile(`^([a-zç]+)\s+de\s+(\d{4})$`)
+)
+
+// parseReferenceMonth understands the reference month labels used by FIPE
+// ("outubro de 2026") and by the history normalization ("10/2026").
+func parseReferenceMonth(s string) (time.Month, int, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if m := numericMonthRe.FindStringSubmatch(s); m != nil {
+		month, _ := strconv.Atoi(m[1])
+		year, _ := strconv.Atoi(m[2])
+		if month < 1 || month > 12 {
+			return 0, 0, false
+		}
+		return time.Month(month), year, true
+	}
+	if m := portugueseMonthRe.FindStringSubmatch(s); m != nil {
+		year, _ := strconv.Atoi(m[2])
+		name := strings.ReplaceAll(m[1], "ç", "c")
+		for i, n := range locales["pt-BR"].MonthNames {
+			if strings.ReplaceAll(n, "ç", "c") == name {
+				return time.Month(i + 1), year, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// localizedPrice returns the FIPE price fields plus currency, priceValue,
+// priceFormatted and referenceMonthFormatted for l.
+func localizedPrice(pr fipe.Price, l Locale) map[string]interface{} {
+	item := map[string]interface{}{
+		"price":          pr.Price,
+		"brand":          pr.Brand,
+		"model":          pr.Model,
+		"modelYear":      pr.ModelYear,
+		"fuel":           pr.Fuel,
+		"codeFipe":       pr.CodeFipe,
+		"referenceMonth": pr.ReferenceMonth,
+		"vehicleType":    pr.VehicleType,
+		"acronymFuel":    pr.AcronymFuel,
+		"currency":       "BRL",
+		"locale":         l.Tag,
+	}
+	if f, err := pr.Value(); err == nil {
+		item["priceValue"] = f
+		item["priceFormatted"] = l.FormatBRL(f)
+	}
+	if month, year, ok := parseReferenceMonth(pr.ReferenceMonth); ok {
+		item["referenceMonthFormatted"] = l.FormatMonth(month, year)
+	}
+	return item
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// --- Structured logging ---
+//
+// Logs are JSON records (log/slog) on stderr. GOFIPE_LOG_LEVEL sets the
+// minimum level: debug, info (default), warn or error. With
+// GOFIPE_ADMIN_TOKEN set, GET /admin/loglevel reports it and
+// PUT /admin/loglevel {"level": "debug"} changes it without a restart.
+// Every request is logged with its method, path, status, latency and size
+// (health checks and scrapes at debug, 5xx responses at error), and every
+// FIPE request at debug with its upstream URL, status and latency, or at
+// warn when it fails. Failures carry the error in an "error" attribute.
+
+// logLevel is the minimum level of the default logger.
+var logLevel = mustLoadLogLevel()
+
+// mustLoadLogLevel reads GOFIPE_LOG_LEVEL and installs the JSON logger.
+func mustLoadLogLevel() *slog.LevelVar {
+	level := new(slog.LevelVar)
+	if v := os.Getenv("GOFIPE_LOG_LEVEL"); v != "" {
+		if err := level.UnmarshalText([]byte(v)); err != nil {
+			log.Fatalf("Invalid GOFIPE_LOG_LEVEL: %q is not debug, info, warn or error", v)
+		}
+	}
+	slog.SetDefault(slog.New(requestIDHandler{slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level})}))
+	return level
+}
+
+// latencyMillis is d in fractional milliseconds, for log records.
+func latencyMillis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// statusRecorder remembers the status and size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	n      int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.n += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (s *statusRecorder) Unwrap() http.ResponseWriter { return s.ResponseWriter }
+
+// withRequestLog logs every request once it has been served. The query
+// string is left out, as it may carry API keys.
+func withRequestLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		level := slog.LevelInfo
+		switch {
+		case rec.status >= 500:
+			level = slog.LevelError
+		case r.URL.Path == "/health" || r.URL.Path == "/metrics":
+			level = slog.LevelDebug
+		}
+		slog.Log(r.Context(), level, "request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"latency_ms", latencyMillis(time.Since(start)),
+			"bytes", rec.n,
+			"remote", clientIP(r),
+		)
+	})
+}
+
+// upstreamLogger is an http.RoundTripper logging FIPE requests.
+type upstreamLogger struct {
+	next http.RoundTripper
+}
+
+func (l upstreamLogger) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := l.next.RoundTrip(req)
+	latency := latencyMillis(time.Since(start))
+	switch {
+	case err != nil:
+		slog.WarnContext(req.Context(), "upstream request failed",
+			"method", req.Method, "upstream_url", req.URL.String(), "latency_ms", latency, "error", err)
+	case resp.StatusCode >= 500:
+		slog.WarnContext(req.Context(), "upstream request",
+			"method", req.Method, "upstream_url", req.URL.String(), "status", resp.StatusCode, "latency_ms", latency)
+	default:
+		slog.DebugContext(req.Context(), "upstream request",
+			"method", req.Method, "upstream_url", req.URL.String(), "status", resp.StatusCode, "latency_ms", latency)
+	}
+	return resp, err
+}
+
+// handleLogLevel serves GET and PUT /admin/loglevel.
+func handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	recordHTTPRequest("/admin/loglevel", r.Method)
+	if r.Method == http.MethodPut {
+		var body struct {
+			Level string `json:"level"`
+		}
+		var level slog.Level
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&body); err != nil ||
+			level.UnmarshalText([]byte(body.Level)) != nil {
+			http.Error(w, "expected {\"level\": \"debug|info|warn|error\"}", http.StatusBadRequest)
+			return
+		}
+		if previous := logLevel.Level(); previous != level {
+			logLevel.Set(level)
+			slog.InfoContext(r.Context(), "log level changed", "from", strings.ToLower(previous.String()), "to", strings.ToLower(level.String()))
+		}
+	}
+	b, _ := json.Marshal(map[string]string{"level": strings.ToLower(logLevel.Level().String())})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -2,13 +2,15 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
+	"errors"
 	"html/template"
-	"io"
 	"log"
-	"math"
+	"log/slog"
+	"maps"
 	"net/http"
-	"regexp"
+	"net/url"
+	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -16,13 +18,19 @@ import (
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
+
+	"gofipe/pkg/fipe"
 )
 
 // --- Prometheus Metrics ---
 
 var (
 	// httpRequestsCounter counts incoming HTTP requests by path and method.
-	httpRequestsCounter = prometheus.NewCounterVec(
+	httpRequestsCounter = newBudgetedCounterVec(
 		prometheus.CounterOpts{
 			Name: "fipe_http_requests_total",
 			Help: "Total number of HTTP requests",
@@ -31,7 +39,7 @@ var (
 	)
 
 	// vehicleSearchCounter counts vehicle searches labeled by brand, model and year.
-	vehicleSearchCounter = prometheus.NewCounterVec(
+	vehicleSearchCounter = newBudgetedCounterVec(
 		prometheus.CounterOpts{
 			Name: "fipe_search_stats",
 			Help: "Counter for specific vehicle searches by brand, model, and year",
@@ -40,7 +48,7 @@ var (
 	)
 
 	// minPriceGauge stores the minimum observed price per vehicle label.
-	minPriceGauge = prometheus.NewGaugeVec(
+	minPriceGauge = newBudgetedGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "fipe_price_min",
 			Help: "Minimum observed price for searches",
@@ -49,7 +57,7 @@ var (
 	)
 
 	// maxPriceGauge stores the maximum observed price per vehicle label.
-	maxPriceGauge = prometheus.NewGaugeVec(
+	maxPriceGauge = newBudgetedGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "fipe_price_max",
 			Help: "Maximum observed price for searches",
@@ -58,7 +66,7 @@ var (
 	)
 
 	// fuelTypeCounter counts searches grouped by fuel type.
-	fuelTypeCounter = prometheus.NewCounterVec(
+	fuelTypeCounter = newBudgetedCounterVec(
 		prometheus.CounterOpts{
 			Name: "fipe_fuel_count",
 			Help: "Count of searches by fuel type",
@@ -67,7 +75,7 @@ var (
 	)
 
 	// brandSearchCounter counts searches by brand name.
-	brandSearchCounter = prometheus.NewCounterVec(
+	brandSearchCounter = newBudgetedCounterVec(
 		prometheus.CounterOpts{
 			Name: "fipe_brand_search_count",
 			Help: "Count of searches by brand",
@@ -77,83 +85,113 @@ var (
 )
 
 func init() {
-	prometheus.MustRegister(httpRequestsCounter)
-	prometheus.MustRegister(vehicleSearchCounter)
-	prometheus.MustRegister(minPriceGauge)
-	prometheus.MustRegister(maxPriceGauge)
-	prometheus.MustRegister(fuelTypeCounter)
-	prometheus.MustRegister(brandSearchCounter)
-}
-
-// --- Data Structs (Updated for API v2) ---
-
-// v2 uses "code" and "name" instead of "codigo" and "nome"
-// ReferenceItem represents a single item returned by FIPE v2 lists (brand, model, etc.).
-type ReferenceItem struct {
-	Code string `json:"code"`
-	Name string `json:"name"`
+	prometheus.MustRegister(metricBudgetOverflowCounter)
+	registerBudgeted(
+		httpRequestsCounter,
+		vehicleSearchCounter,
+		minPriceGauge,
+		maxPriceGauge,
+		fuelTypeCounter,
+		brandSearchCounter,
+	)
 }
 
-// v2 Price response uses English keys
-// PriceResponse models the JSON structure returned by FIPE v2 for a vehicle price.
-type PriceResponse struct {
-	Price          string `json:"price"` // human-readable price
-	Brand          string `json:"brand"`
-	Model          string `json:"model"`
-	ModelYear      int    `json:"modelYear"`
-	Fuel           string `json:"fuel"`
-	CodeFipe       string `json:"codeFipe"`
-	ReferenceMonth string `json:"referenceMonth"`
-	VehicleType    int    `json:"vehicleType"`
-	AcronymFuel    string `json:"acronymFuel"`
+// metricsHandler serves the default registry with gzip/zstd compression
+// negotiated from Accept-Encoding. Scrapers may pass one or more
+// collect[]=<name or prefix> params to only receive matching metric families.
+func metricsHandler() http.Handler {
+	return promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var gatherer prometheus.Gatherer = prometheus.DefaultGatherer
+			if names := r.URL.Query()["collect[]"]; len(names) > 0 {
+				gatherer = filteredGatherer{Gatherer: gatherer, names: names}
+			}
+			promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{
+				OfferedCompressions: []promhttp.Compression{promhttp.Identity, promhttp.Gzip, promhttp.Zstd},
+			}).ServeHTTP(w, r)
+		}))
 }
 
-// --- Simple in-memory cache ---
-// cacheItem stores a cached payload and its expiration time.
-type cacheItem struct {
-	data      []byte
-	expiresAt time.Time
+// filteredGatherer only returns metric families whose name starts with one of names.
+type filteredGatherer struct {
+	prometheus.Gatherer
+	names []string
 }
 
-var (
-	cacheMutex sync.RWMutex
-	cacheStore = map[string]cacheItem{}
-)
-
-// getFromCache returns cached data and a boolean indicating presence and freshness.
-func getFromCache(key string) ([]byte, bool) {
-	cacheMutex.RLock()
-	defer cacheMutex.RUnlock()
-	it, ok := cacheStore[key]
-	if !ok || time.Now().After(it.expiresAt) {
-		return nil, false
+// Gather implements prometheus.Gatherer.
+func (f filteredGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := f.Gatherer.Gather()
+	out := mfs[:0]
+	for _, mf := range mfs {
+		for _, n := range f.names {
+			if strings.HasPrefix(mf.GetName(), n) {
+				out = append(out, mf)
+				break
+			}
+		}
 	}
-	return it.data, true
-}
-
-// setToCache stores bytes at key for ttl duration.
-func setToCache(key string, data []byte, ttl time.Duration) {
-	cacheMutex.Lock()
-	defer cacheMutex.Unlock()
-	cacheStore[key] = cacheItem{data: data, expiresAt: time.Now().Add(ttl)}
+	return out, err
 }
 
 // --- Main Application ---
 
 func main() {
-	tmpl := template.Must(template.ParseFiles("templates/index.html"))
+	args := os.Args[1:]
+	if len(args) > 0 {
+		switch args[0] {
+		case "demo":
+			args = startDemo(args[1:])
+		case "verify-upstream":
+			os.Exit(runVerifyUpstream(args[1:], os.Stdout))
+		case "refresh-seed":
+			os.Exit(runRefreshSeed(args[1:], os.Stdout))
+		}
+	}
+	cfg := mustLoadConfig(args)
+	startTracing()
+	fipeClient = newFipeClient(cfg)
+	configureCache(cfg)
+	seedCache()
+	streamMinBytes = cfg.StreamMinBytes
+	upstreamMaxBytes = cfg.UpstreamMaxBytes
+	publicBaseURL = cfg.publicURL()
+	startHistoryCollector()
+
+	indexPage := newRenderedTemplate("templates/index.html")
+	vehicleTmpl := template.Must(template.ParseFiles("templates/vehicle.html"))
+	printTmpl := template.Must(template.New("vehicle_print.html").Funcs(pageFuncs).ParseFiles("templates/vehicle_print.html"))
+	statusTmpl := template.Must(template.New("status.html").Funcs(pageFuncs).ParseFiles("templates/status.html"))
 
 	mux := http.NewServeMux()
 
 	// Frontend
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		recordHTTPRequest(r.URL.Path, r.Method)
-		tmpl.Execute(w, nil)
+		captureAttribution(w, r)
+		classes := experimentClasses(assignExperiments(w, r, true))
+		indexPage.serve(w, r, classes, IndexPage{ExperimentClasses: classes})
 	})
 
+	// Vehicle detail pages
+	mux.HandleFunc("GET /vehicle/{type}/{brandId}/{modelId}/{yearId}", vehiclePageHandler(vehicleTmpl))
+	mux.HandleFunc("GET /vehicle/{type}/{brandId}/{modelId}/{yearId}/print", vehiclePrintHandler(printTmpl))
+
+	// Archived reference months (requires GOFIPE_HISTORY_DB)
+	registerArchivePages(mux)
+
+	// Progressive Web App
+	mux.HandleFunc("GET /manifest.json", handleManifest)
+	mux.HandleFunc("GET /sw.js", serviceWorkerHandler(staticAssetsVersion("static")))
+
 	// Serve static assets under /static/
 	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
 
+	// Serve JSON Schema and .proto definitions of the API responses under /schemas/
+	mux.Handle("GET /schemas/", http.StripPrefix("/schemas/", http.FileServer(http.Dir("schemas"))))
+
+	// Status page for users wondering whether FIPE is down
+	mux.HandleFunc("GET /status", statusHandler(statusTmpl))
+
 	// Health Check
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		recordHTTPRequest(r.URL.Path, r.Method)
@@ -163,19 +201,87 @@ func main() {
 	})
 
 	// Metrics
-	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/metrics", metricsHandler())
 
 	// API Proxy Routes (BFF)
 	mux.HandleFunc("/api/brands", handleBrands)
 	mux.HandleFunc("/api/models", handleModels)
 	mux.HandleFunc("/api/years", handleYears)
+	mux.HandleFunc("/api/references", handleReferences)
+	mux.HandleFunc("/api/fipeCode", handleFipeCode)
+	mux.HandleFunc("GET /api/vehicles/{fipeCode}/delta", handleVehicleDelta)
 	mux.HandleFunc("/api/price", handlePrice)
 	mux.HandleFunc("/api/priceHistory", handlePriceHistory)
+	mux.HandleFunc("/api/priceProjection", handlePriceProjection)
+	exportLimit, err := newExportLimit()
+	if err != nil {
+		log.Fatalf("Invalid export settings: %v", err)
+	}
+	mux.HandleFunc("GET /api/export/xlsx", exportLimit(handleXLSXExport))
+	mux.HandleFunc("GET /api/report", exportLimit(handleReport))
+	mux.HandleFunc("/api/changes", withGzip(handleChanges))
+	mux.HandleFunc("/api/config", handleConfig)
+	mux.HandleFunc("/api/experiments", handleExperiments)
+	voice, err := newVoiceIntents()
+	if err != nil {
+		log.Fatalf("Invalid voice intent settings: %v", err)
+	}
+	mux.Handle("POST /api/voice/intent", voice)
+
+	// Batch price lookup for programmatic consumers (GOFIPE_API_KEYS)
+	priceBatch, err := newPriceBatcher()
+	if err != nil {
+		log.Fatalf("Invalid price batch settings: %v", err)
+	}
+	if len(apiKeys) > 0 {
+		mux.HandleFunc("POST /api/prices/batch", requireAPIKey(priceBatch.ServeHTTP))
+	}
+
+	// FIPE v1-format compatibility routes (GOFIPE_COMPAT_V1)
+	registerCompatEndpoints(mux)
+
+	// Model Context Protocol tool server for AI assistants
+	if os.Getenv("GOFIPE_MCP") == "true" {
+		mcp, err := newMCPServer()
+		if err != nil {
+			log.Fatalf("Invalid MCP settings: %v", err)
+		}
+		mux.Handle("POST /mcp", mcp)
+	}
+
+	// Chatbot webhooks (Telegram, WhatsApp via Twilio)
+	registerChatbotWebhooks(mux)
+
+	// Slack slash command
+	registerSlackCommand(mux)
+
+	// Google Sheets add-on endpoints (require GOFIPE_API_KEYS)
+	registerSheetsEndpoints(mux)
+
+	// Zapier/Make triggers and actions (require GOFIPE_API_KEYS)
+	registerIntegrationEndpoints(mux)
+
+	// Watchlist of tracked vehicles (requires GOFIPE_API_KEYS and GOFIPE_HISTORY_DB)
+	registerWatchlistEndpoints(mux)
+
+	// Segment indices over baskets of FIPE codes (GOFIPE_INDICES)
+	registerIndexEndpoints(mux)
 
-	port := ":8080"
-	fmt.Printf("Server starting on port %s...\n", port)
-	if err := http.ListenAndServe(port, mux); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	// Peer cache endpoint for consistent hashing shard mode
+	registerShardEndpoint(mux)
+
+	// Benchmark and profiling harness (requires GOFIPE_ADMIN_TOKEN)
+	registerAdminEndpoints(mux)
+
+	startSyntheticChecks()
+
+	srv := &http.Server{
+		Addr:    cfg.addr(),
+		Handler: withRequestID(withTracing(withRequestLog(withRequestMetrics(withIPAccess(withClientPolicy(withBandwidthMetrics(withCacheHints(withCompatFormat(mux))))))))),
+	}
+	slog.Info("server starting", "addr", cfg.addr(), "version", appVersion, "fipe_token", cfg.FipeToken != "")
+	if err := serveUntilSignal(srv, cfg.ShutdownTimeout); err != nil {
+		log.Fatalf("Server error: %v", err)
 	}
 }
 
@@ -183,125 +289,456 @@ func main() {
 
 // recordHTTPRequest increments the HTTP requests counter for a path and method.
 func recordHTTPRequest(path, method string) {
-	httpRequestsCounter.WithLabelValues(path, method).Inc()
+	httpRequestsCounter.Inc(path, method)
 }
 
-// fetchURL performs a GET against the provided URL and returns the response body.
-func fetchURL(url string) ([]byte, error) {
-	// Added a User-Agent just in case v2 enforces it
-	client := http.Client{Timeout: 10 * time.Second}
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
+// memoryCache adapts the in-memory cache to fipe.Cache.
+type memoryCache struct{}
+
+// Get serves cache hits.
+func (memoryCache) Get(key string) ([]byte, bool) {
+	d, ok := getFromCache(key)
+	if ok {
+		recordCacheServedBytes(key, len(d))
 	}
-	req.Header.Set("User-Agent", "Go-Fipe-App/1.0")
+	return d, ok
+}
+
+// Fetch serves key from the cache. In shard mode, misses on keys owned by
+// another replica are served by that replica.
+func (memoryCache) Fetch(key, url string, ttl time.Duration, fetch func() ([]byte, error)) ([]byte, error) {
+	if d, ok := getFromCache(key); ok {
+		recordCacheServedBytes(key, len(d))
+		return d, nil
+	}
+	if d, ok := fetchShardedMiss(key, url, ttl); ok {
+		recordCacheMiss(key)
+		return d, nil
+	}
+	return fetchCachedLocal(key, ttl, fetch)
+}
+
+// upstreamFetches coalesces concurrent misses on the same cache key into a
+// single FIPE request.
+var upstreamFetches singleflight.Group
+
+// coalescedFetchesCounter counts misses that waited for another request's fetch.
+var coalescedFetchesCounter = newBudgetedCounterVec(
+	prometheus.CounterOpts{
+		Name: "fipe_upstream_coalesced_total",
+		Help: "Cache misses served by an identical in-flight FIPE request by cache key prefix",
+	},
+	[]string{"prefix"},
+)
 
-	resp, err := client.Do(req)
+func init() {
+	registerBudgeted(coalescedFetchesCounter)
+}
+
+// fetchCachedLocal is memoryCache.Fetch without shard forwarding. Concurrent
+// misses on key share one fetch; a failed fetch fails all of its waiters.
+func fetchCachedLocal(key string, ttl time.Duration, fetch func() ([]byte, error)) ([]byte, error) {
+	if d, ok := getFromCache(key); ok {
+		recordCacheServedBytes(key, len(d))
+		return d, nil
+	}
+	recordCacheMiss(key)
+	leader := false
+	v, err, shared := upstreamFetches.Do(key, func() (interface{}, error) {
+		leader = true
+		data, err := fetch()
+		if err != nil {
+			return nil, err
+		}
+		setToCache(key, data, ttl)
+		return data, nil
+	})
+	if shared && !leader {
+		prefix, _, _ := strings.Cut(key, ":")
+		coalescedFetchesCounter.Inc(prefix)
+	}
 	if err != nil {
+		if d, ok := seededPayload(key); ok {
+			return d, nil
+		}
 		return nil, err
 	}
-	defer resp.Body.Close()
+	return v.([]byte), nil
+}
+
+// --- API Handlers (Updated for v2 Endpoints) ---
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("external API returned status: %d for url: %s", resp.StatusCode, url)
+// fipeClient is the shared FIPE client, rebuilt from the configuration at
+// startup. Lists are cached in memory; prices are fetched fresh unless a
+// caller opts into caching with WithPriceTTL.
+var fipeClient = newFipeClient(defaultConfig())
+
+// newFipeClient builds the client backed by the in-memory cache.
+func newFipeClient(cfg Config) *fipe.Client {
+	c := fipe.NewClient(cfg.FipeBaseURL)
+	c.HTTPClient.Timeout = cfg.HTTPTimeout
+	c.Token = cfg.FipeToken
+	fipeBreaker = nil
+	if cfg.BreakerFailures > 0 {
+		fipeBreaker = newUpstreamBreaker(nil, cfg.BreakerFailures, cfg.BreakerCooldown)
+	}
+	transport := http.RoundTripper(upstreamHealth{provider: "v2", next: upstreamTransport})
+	multiProvider := cfg.UpstreamProviders != "v2"
+	if multiProvider {
+		// Validated with the config.
+		providers, _ := parseUpstreamProviders(cfg.UpstreamProviders, cfg.FipeBaseURL)
+		transport = newUpstreamProviders(cfg.FipeBaseURL, providers, fipeBreaker)
+	}
+	// Logged inside the limiter, so latencies leave out the queue wait.
+	c.HTTPClient.Transport = upstreamLogger{next: upstreamErrorMetrics{next: requestIDTransport{next: tracingTransport{next: transport}}}}
+	if cfg.UpstreamRPS > 0 {
+		// Inside the limiter, so requests take tokens in priority order.
+		c.HTTPClient.Transport = newUpstreamRateLimiter(c.HTTPClient.Transport, cfg.UpstreamRPS, cfg.UpstreamBurst, cfg.UpstreamRateMode == "shed")
+	}
+	if cfg.UpstreamConcurrency > 0 {
+		c.HTTPClient.Transport = newUpstreamLimiter(c.HTTPClient.Transport, cfg.UpstreamConcurrency)
 	}
+	if cfg.UpstreamRetries > 0 {
+		// Outside the limiter, so backoffs do not hold a slot.
+		c.HTTPClient.Transport = upstreamRetry{next: c.HTTPClient.Transport, retries: cfg.UpstreamRetries, backoff: cfg.UpstreamBackoff}
+	}
+	if fipeBreaker != nil && !multiProvider {
+		// Outermost, so a request counts once however often it was retried.
+		fipeBreaker.next = c.HTTPClient.Transport
+		c.HTTPClient.Transport = fipeBreaker
+	}
+	c.BrandsTTL = cfg.BrandsTTL
+	c.ModelsTTL = cfg.ModelsTTL
+	c.YearsTTL = cfg.YearsTTL
+	c.Cache = memoryCache{}
+	c.OnResponse = recordUpstreamBytes
+	c.CurrentReference = pinnedReference
+	return c
+}
 
-	return io.ReadAll(resp.Body)
+const (
+	// appVersion is the gofipe release, kept in sync with the Makefile VERSION.
+	appVersion = "2.0.0"
+	// apiVersion is the FIPE API generation mirrored by the /api routes.
+	apiVersion = "v2"
+	// schemaVersion is the version of the /api response schemas in
+	// app/schemas, bumped on incompatible changes.
+	schemaVersion = 1
+	// defaultHistoryMonths and maxHistoryMonths bound /api/priceHistory.
+	defaultHistoryMonths = 12
+	maxHistoryMonths     = 24
+)
+
+// FrontendConfig is the non-secret runtime configuration exposed at /api/config.
+type FrontendConfig struct {
+	Version              string          `json:"version"`
+	APIVersion           string          `json:"apiVersion"`
+	SchemaVersion        int             `json:"schemaVersion"`
+	Features             map[string]bool `json:"features"`
+	Currencies           []string        `json:"currencies"`
+	Locales              []string        `json:"locales"`
+	DefaultLocale        string          `json:"defaultLocale"`
+	VehicleTypes         []string        `json:"vehicleTypes"`
+	DefaultHistoryMonths int             `json:"defaultHistoryMonths"`
+	MaxHistoryMonths     int             `json:"maxHistoryMonths"`
 }
 
-// --- API Handlers (Updated for v2 Endpoints) ---
+// frontendConfig returns the settings the frontend should adapt to.
+func frontendConfig() FrontendConfig {
+	return FrontendConfig{
+		Version:       appVersion,
+		APIVersion:    apiVersion,
+		SchemaVersion: schemaVersion,
+		Features: map[string]bool{
+			"priceHistory": true,
+			"vehiclePages": true,
+			"printPages":   true,
+			"changes":      true,
+			"offline":      true,
+		},
+		Currencies:           []string{"BRL"},
+		Locales:              slices.Sorted(maps.Keys(locales)),
+		DefaultLocale:        defaultLocale,
+		VehicleTypes:         slices.Sorted(maps.Keys(vehicleTypes)),
+		DefaultHistoryMonths: defaultHistoryMonths,
+		MaxHistoryMonths:     maxHistoryMonths,
+	}
+}
+
+// handleConfig serves the frontend configuration.
+func handleConfig(w http.ResponseWriter, r *http.Request) {
+	recordHTTPRequest("/api/config", r.Method)
+	b, _ := json.Marshal(frontendConfig())
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
 
-// Base URL for v2
-// FipeBaseURL is the base endpoint for FIPE v2.
-const FipeBaseURL = "https://fipe.parallelum.com.br/api/v2"
+// Header values shared by the cache-hit handlers so setting them does not
+// allocate. net/http never modifies header value slices.
+var (
+	jsonContentType       = []string{"application/json"}
+	gzipEncoding          = []string{"gzip"}
+	varyAcceptEncoding    = []string{"Accept-Encoding"}
+	varyAcceptAndEncoding = []string{"Accept", "Accept-Encoding"}
+)
+
+// setVaryEncoding adds Accept-Encoding to the Vary header of h, keeping
+// the Accept withCompatFormat sets, without allocating.
+func setVaryEncoding(h http.Header) {
+	if v := h["Vary"]; len(v) == 1 && v[0] == "Accept" {
+		h["Vary"] = varyAcceptAndEncoding
+		return
+	}
+	h["Vary"] = varyAcceptEncoding
+}
+
+// addVary adds value to the Vary header of h unless it is there already.
+func addVary(h http.Header, value string) {
+	if !slices.Contains(h.Values("Vary"), value) {
+		h.Add("Vary", value)
+	}
+}
+
+// writeCacheHit writes the pre-serialized cache entry at key, gzip-encoded
+// when it has a compressed variant the client accepts. It reports false,
+// writing nothing, when key is not cached.
+func writeCacheHit(w http.ResponseWriter, r *http.Request, key string) bool {
+	it, ok := getCachedResponse(key)
+	// Only traced requests get a span: starting one allocates even without
+	// a tracer, and this is the hottest path.
+	if trace.SpanFromContext(r.Context()).IsRecording() {
+		_, span := tracer.Start(r.Context(), "fipe.cache")
+		span.SetAttributes(attribute.String("cache.key", key), attribute.Bool("cache.hit", ok))
+		span.End()
+	}
+	if !ok {
+		return false
+	}
+	recordCacheServedBytes(key, len(it.data))
+	h := w.Header()
+	h["Content-Type"] = jsonContentType
+	setVaryEncoding(h)
+	body, length := it.data, it.length
+	if it.gz != nil && acceptsGzip(r) {
+		h["Content-Encoding"] = gzipEncoding
+		body, length = it.gz, it.gzLength
+	}
+	h["Content-Length"] = length
+	w.Write(body)
+	return true
+}
+
+// writeCachedJSON writes a proxied FIPE payload fetched on a cache miss.
+func writeCachedJSON(w http.ResponseWriter, data []byte, err error) {
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	w.Header()["Content-Type"] = jsonContentType
+	setVaryEncoding(w.Header())
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+// queryValue returns the first value of name in the query string, like
+// r.URL.Query().Get(name) but without building the values map.
+func queryValue(r *http.Request, name string) string {
+	rest := r.URL.RawQuery
+	for rest != "" {
+		var pair string
+		pair, rest, _ = strings.Cut(rest, "&")
+		k, v, _ := strings.Cut(pair, "=")
+		if strings.ContainsAny(k, "%+") {
+			k, _ = url.QueryUnescape(k)
+		}
+		if k != name || strings.Contains(pair, ";") {
+			continue
+		}
+		if !strings.ContainsAny(v, "%+") {
+			return v
+		}
+		if v, err := url.QueryUnescape(v); err == nil {
+			return v
+		}
+	}
+	return ""
+}
 
 // Get Brands: /api/brands?type=cars
 // handleBrands proxies the brands list from FIPE for the requested type.
 func handleBrands(w http.ResponseWriter, r *http.Request) {
 	recordHTTPRequest("/api/brands", r.Method)
-	vehicleType := r.URL.Query().Get("type") // cars, motorcycles, trucks
+	vehicleType := queryValue(r, "type") // cars, motorcycles, trucks
 	if vehicleType == "" {
 		vehicleType = "cars"
 	}
-
-	key := "brands:" + vehicleType
-	if d, ok := getFromCache(key); ok {
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(d)
+	ref, ok := referenceParam(w, r)
+	if !ok {
 		return
 	}
-
-	// v2 Endpoint: /{type}/brands
-	url := fmt.Sprintf("%s/%s/brands", FipeBaseURL, vehicleType)
-
-	data, err := fetchURL(url)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadGateway)
+	if writeCacheHit(w, r, fipe.ReferenceKey(fipe.BrandsKey(vehicleType), ref)) {
 		return
 	}
-
-	// cache for 12 hours
-	setToCache(key, data, 12*time.Hour)
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(data)
+	if c := clientAt(ref); !streamListMiss(w, r, c, c.BrandsSource(vehicleType)) {
+		data, err := c.BrandsJSON(r.Context(), vehicleType)
+		writeCachedJSON(w, data, err)
+	}
 }
 
 // handleModels proxies the models list from FIPE for a given brand.
 func handleModels(w http.ResponseWriter, r *http.Request) {
 	recordHTTPRequest("/api/models", r.Method)
-	vehicleType := r.URL.Query().Get("type")
-	brandId := r.URL.Query().Get("brandId")
-
-	key := fmt.Sprintf("models:%s:%s", vehicleType, brandId)
-	if d, ok := getFromCache(key); ok {
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(d)
+	vehicleType, brandID := queryValue(r, "type"), queryValue(r, "brandId")
+	ref, ok := referenceParam(w, r)
+	if !ok {
 		return
 	}
-
-	// v2 Endpoint: /{type}/brands/{brandId}/models
-	url := fmt.Sprintf("%s/%s/brands/%s/models", FipeBaseURL, vehicleType, brandId)
-
-	data, err := fetchURL(url)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadGateway)
+	if writeCacheHit(w, r, fipe.ReferenceKey(fipe.ModelsKey(vehicleType, brandID), ref)) {
 		return
 	}
-
-	setToCache(key, data, 12*time.Hour)
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(data)
+	if c := clientAt(ref); !streamListMiss(w, r, c, c.ModelsSource(vehicleType, brandID)) {
+		data, err := c.ModelsJSON(r.Context(), vehicleType, brandID)
+		writeCachedJSON(w, data, err)
+	}
 }
 
 // handleYears proxies the available years for a model from FIPE.
 func handleYears(w http.ResponseWriter, r *http.Request) {
 	recordHTTPRequest("/api/years", r.Method)
-	vehicleType := r.URL.Query().Get("type")
-	brandId := r.URL.Query().Get("brandId")
-	modelId := r.URL.Query().Get("modelId")
+	vehicleType, brandID, modelID := queryValue(r, "type"), queryValue(r, "brandId"), queryValue(r, "modelId")
+	ref, ok := referenceParam(w, r)
+	if !ok {
+		return
+	}
+	if writeCacheHit(w, r, fipe.ReferenceKey(fipe.YearsKey(vehicleType, brandID, modelID), ref)) {
+		return
+	}
+	if c := clientAt(ref); !streamListMiss(w, r, c, c.YearsSource(vehicleType, brandID, modelID)) {
+		data, err := c.YearsJSON(r.Context(), vehicleType, brandID, modelID)
+		writeCachedJSON(w, data, err)
+	}
+}
 
-	key := fmt.Sprintf("years:%s:%s:%s", vehicleType, brandId, modelId)
-	if d, ok := getFromCache(key); ok {
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(d)
+// handleReferences lists the FIPE monthly reference tables, newest first.
+// Their codes select a table with the reference parameter of the other
+// endpoints.
+func handleReferences(w http.ResponseWriter, r *http.Request) {
+	recordHTTPRequest("/api/references", r.Method)
+	if pinnedReference() != "" {
+		// The cached list also has the tables newer than the pin.
+		tables, err := fipeClient.References(r.Context())
+		var data []byte
+		if err == nil {
+			data, _ = json.Marshal(tables)
+		}
+		writeCachedJSON(w, data, err)
+		return
+	}
+	if writeCacheHit(w, r, fipe.ReferencesKey) {
 		return
 	}
+	data, err := fipeClient.ReferencesJSON(r.Context())
+	writeCachedJSON(w, data, err)
+}
 
-	// v2 Endpoint: /{type}/brands/{brandId}/models/{modelId}/years
-	url := fmt.Sprintf("%s/%s/brands/%s/models/%s/years", FipeBaseURL, vehicleType, brandId, modelId)
+// handleFipeCode returns the model years of a FIPE code, each with its
+// price, so callers who know the code skip the brand and model lookups.
+// Params: code (e.g. 001004-9), type (default cars) and optional yearId,
+// locale and reference.
+func handleFipeCode(w http.ResponseWriter, r *http.Request) {
+	recordHTTPRequest("/api/fipeCode", r.Method)
+	q := r.URL.Query()
+	code := q.Get("code")
+	if !fipe.ValidCode(code) {
+		http.Error(w, "code must be a FIPE code such as 001004-9", http.StatusBadRequest)
+		return
+	}
+	vehicleType := q.Get("type")
+	if vehicleType == "" {
+		vehicleType = "cars"
+	}
+	if _, ok := vehicleTypes[vehicleType]; !ok {
+		http.Error(w, "type must be cars, motorcycles or trucks", http.StatusBadRequest)
+		return
+	}
+	loc, err := lookupLocale(q.Get("locale"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ref, ok := referenceParam(w, r)
+	if !ok {
+		return
+	}
+	c := clientAt(ref)
 
-	data, err := fetchURL(url)
+	years, err := c.CodeYears(r.Context(), vehicleType, code)
+	var se *fipe.StatusError
+	if errors.As(err, &se) && se.StatusCode == http.StatusNotFound {
+		http.Error(w, "FIPE code not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadGateway)
+		writeUpstreamError(w, err)
 		return
 	}
+	if yearID := q.Get("yearId"); yearID != "" {
+		years = slices.DeleteFunc(years, func(y fipe.Reference) bool { return y.Code != yearID })
+		if len(years) == 0 {
+			http.Error(w, "year not available for this FIPE code", http.StatusNotFound)
+			return
+		}
+	}
 
-	setToCache(key, data, 24*time.Hour)
+	// Prices are fetched concurrently; years whose price fails are listed
+	// without one.
+	items := make([]map[string]interface{}, len(years))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, resolveConcurrency)
+	for i, y := range years {
+		items[i] = map[string]interface{}{"code": y.Code, "name": y.Name}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if pr, err := c.CodePrice(r.Context(), vehicleType, code, y.Code); err == nil {
+				items[i]["price"] = localizedPrice(pr, loc)
+			}
+		}()
+	}
+	wg.Wait()
 
+	b, _ := json.Marshal(map[string]interface{}{"code": code, "type": vehicleType, "years": items})
 	w.Header().Set("Content-Type", "application/json")
-	w.Write(data)
+	w.Write(b)
+}
+
+// referenceParam returns the optional reference table code of r, or the
+// pinned current table. It answers 400 and reports false when the code is
+// malformed.
+func referenceParam(w http.ResponseWriter, r *http.Request) (string, bool) {
+	ref := queryValue(r, "reference")
+	for i := 0; i < len(ref); i++ {
+		if ref[i] < '0' || ref[i] > '9' {
+			http.Error(w, "reference must be a table code from /api/references", http.StatusBadRequest)
+			return "", false
+		}
+	}
+	if ref == "" {
+		ref = pinnedReference()
+	}
+	return ref, true
+}
+
+// clientAt returns fipeClient, or a copy querying reference table ref.
+// The prices of a table never change, so the copy caches them for
+// HistoryTTL, as PriceHistory does.
+func clientAt(ref string) *fipe.Client {
+	if ref == "" {
+		return fipeClient
+	}
+	return fipeClient.WithReference(ref).WithPriceTTL(fipeClient.HistoryTTL)
 }
 
 // handlePrice returns the current price for a vehicle and updates metrics.
@@ -311,241 +748,125 @@ func handlePrice(w http.ResponseWriter, r *http.Request) {
 	brandId := r.URL.Query().Get("brandId")
 	modelId := r.URL.Query().Get("modelId")
 	yearId := r.URL.Query().Get("yearId")
+	if _, ok := vehicleTypes[vehicleType]; !ok {
+		http.Error(w, "type must be cars, motorcycles or trucks", http.StatusBadRequest)
+		return
+	}
+	if brandId == "" || modelId == "" || yearId == "" {
+		http.Error(w, "brandId, modelId and yearId are required", http.StatusBadRequest)
+		return
+	}
 
 	brandName := r.URL.Query().Get("brandName")
 	modelName := r.URL.Query().Get("modelName")
 
-	vehicleSearchCounter.WithLabelValues(brandName, modelName, yearId).Inc()
-
-	// increment brand count
-	brandSearchCounter.WithLabelValues(brandName).Inc()
-
-	// v2 Endpoint: /{type}/brands/{brandId}/models/{modelId}/years/{yearId}
-	url := fmt.Sprintf("%s/%s/brands/%s/models/%s/years/%s", FipeBaseURL, vehicleType, brandId, modelId, yearId)
+	loc, err := lookupLocale(r.URL.Query().Get("locale"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ref, ok := referenceParam(w, r)
+	if !ok {
+		return
+	}
 
-	data, err := fetchURL(url)
+	pr, err := clientAt(ref).Price(r.Context(), vehicleType, brandId, modelId, yearId)
+	var se *fipe.StatusError
+	if errors.As(err, &se) && se.StatusCode == http.StatusNotFound {
+		http.Error(w, "vehicle not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadGateway)
+		writeUpstreamError(w, err)
 		return
 	}
 
-	// Try to parse price to update min/max metrics and fuel counts
-	var pr PriceResponse
-	if err := json.Unmarshal(data, &pr); err == nil {
-		if f, err := parseFipePrice(pr.Price); err == nil {
-			// set min and max to current observed value
-			minPriceGauge.WithLabelValues(pr.Brand, pr.Model, yearId).Set(f)
-			maxPriceGauge.WithLabelValues(pr.Brand, pr.Model, yearId).Set(f)
-		}
-		if pr.Fuel != "" {
-			fuelTypeCounter.WithLabelValues(pr.Fuel).Inc()
-		}
+	// Update search, min/max and fuel metrics. Past tables do not move the
+	// current min/max gauges.
+	recordSearchLabels(r, brandName, modelName, yearId, pr)
+	recordAttributedLookup(r)
+	recordExperimentConversion(r)
+	if f, err := pr.Value(); err == nil && ref == "" {
+		// set min and max to current observed value
+		minPriceGauge.Set(f, pr.Brand, pr.Model, yearId)
+		maxPriceGauge.Set(f, pr.Brand, pr.Model, yearId)
+	}
+	if pr.Fuel != "" {
+		fuelTypeCounter.Inc(pr.Fuel)
+	}
+
+	// CSV or JSON, the answer depends on Accept.
+	addVary(w.Header(), "Accept")
+	if wantsCSV(r) {
+		writePricesCSV(w, loc, "fipe-"+pr.CodeFipe+"-"+yearId, []fipe.Price{pr})
+		return
 	}
 
+	// Add numeric and locale-formatted values next to the FIPE fields
+	b, _ := json.Marshal(localizedPrice(pr, loc))
 	w.Header().Set("Content-Type", "application/json")
-	w.Write(data)
+	w.Write(b)
 }
 
-// fetchURLsConcurrent fetches multiple URLs concurrently and returns results in order.
-func fetchURLsConcurrent(urls []string) ([][]byte, []error) {
-	var wg sync.WaitGroup
-	results := make([][]byte, len(urls))
-	errs := make([]error, len(urls))
-
-	for i, u := range urls {
-		wg.Add(1)
-		go func(idx int, url string) {
-			defer wg.Done()
-			b, err := fetchURL(url)
-			results[idx] = b
-			errs[idx] = err
-		}(i, u)
+// handleChanges lists cached resources whose upstream content recently changed.
+// Optional params: since (RFC 3339 timestamp) and limit (default 50).
+func handleChanges(w http.ResponseWriter, r *http.Request) {
+	recordHTTPRequest("/api/changes", r.Method)
+	var since time.Time
+	if s := r.URL.Query().Get("since"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			http.Error(w, "invalid since: expected RFC 3339 timestamp", http.StatusBadRequest)
+			return
+		}
+		since = t
 	}
-	wg.Wait()
-	return results, errs
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > maxContentChanges {
+		limit = 50
+	}
+
+	b, _ := json.Marshal(map[string]interface{}{"changes": recentContentChanges(since, limit)})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
 }
 
-// handlePriceHistory attempts to return a price history for the vehicle.
+// handlePriceHistory returns the prices of a vehicle in the last reference tables.
 func handlePriceHistory(w http.ResponseWriter, r *http.Request) {
 	recordHTTPRequest("/api/priceHistory", r.Method)
 	vehicleType := r.URL.Query().Get("type")
 	brandId := r.URL.Query().Get("brandId")
 	modelId := r.URL.Query().Get("modelId")
 	yearId := r.URL.Query().Get("yearId")
-	monthsStr := r.URL.Query().Get("months")
-	if monthsStr == "" {
-		monthsStr = "12"
-	}
-	months, err := strconv.Atoi(monthsStr)
+	months, err := strconv.Atoi(r.URL.Query().Get("months"))
 	if err != nil || months <= 0 {
-		months = 12
-	}
-
-	// Try a common history path. If it fails, fallback to single-point history.
-	histURL := fmt.Sprintf("%s/%s/brands/%s/models/%s/years/%s/history?months=%d", FipeBaseURL, vehicleType, brandId, modelId, yearId, months)
-	data, err := fetchURL(histURL)
-	if err == nil {
-		// Normalize the returned history payload so each item has a distinct reference label
-		var raw interface{}
-		if err := json.Unmarshal(data, &raw); err == nil {
-			if m, ok := raw.(map[string]interface{}); ok {
-				if arr, ok2 := m["history"].([]interface{}); ok2 {
-					log.Printf("normalizing %d history entries (direct)\n", len(arr))
-					for i := range arr {
-						if item, ok3 := arr[i].(map[string]interface{}); ok3 {
-							// set normalized reference label
-							ref := time.Now().AddDate(0, -i, 0)
-							item["referenceMonth"] = fmt.Sprintf("%02d/%d", int(ref.Month()), ref.Year())
-							arr[i] = item
-						}
-					}
-					m["history"] = arr
-					if b, err := json.Marshal(m); err == nil {
-						w.Header().Set("Content-Type", "application/json")
-						w.Write(b)
-						return
-					}
-				}
-			}
-		}
-		// if normalization failed, return raw data
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(data)
+		months = defaultHistoryMonths
+	}
+	months = min(months, maxHistoryMonths)
+	loc, err := lookupLocale(r.URL.Query().Get("locale"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Fallback: try to query multiple past months concurrently using common query params
-	results := make([]json.RawMessage, months)
-	var wg sync.WaitGroup
-	for i := 0; i < months; i++ {
-		wg.Add(1)
-		go func(offset int) {
-			defer wg.Done()
-			ref := time.Now().AddDate(0, -offset, 0).Format("2006-01")
-			// try several candidate endpoints that some FIPE providers use for historic data
-			candidates := []string{
-				// query param variants
-				fmt.Sprintf("%s/%s/brands/%s/models/%s/years/%s?referenceMonth=%s", FipeBaseURL, vehicleType, brandId, modelId, yearId, ref),
-				fmt.Sprintf("%s/%s/brands/%s/models/%s/years/%s?reference=%s", FipeBaseURL, vehicleType, brandId, modelId, yearId, ref),
-				fmt.Sprintf("%s/%s/brands/%s/models/%s/years/%s?month=%s", FipeBaseURL, vehicleType, brandId, modelId, yearId, ref),
-				// path variant
-				fmt.Sprintf("%s/%s/brands/%s/models/%s/years/%s/history/%s", FipeBaseURL, vehicleType, brandId, modelId, yearId, ref),
-				fmt.Sprintf("%s/%s/brands/%s/models/%s/years/%s/historico/%s", FipeBaseURL, vehicleType, brandId, modelId, yearId, ref),
-			}
-
-			for _, u := range candidates {
-				b, e := fetchURL(u)
-				if e == nil {
-					// decode into PriceResponse when possible and set ReferenceMonth explicitly
-					var pr PriceResponse
-					if err := json.Unmarshal(b, &pr); err == nil {
-						if pr.ReferenceMonth == "" {
-							parts := strings.Split(ref, "-")
-							if len(parts) == 2 {
-								pr.ReferenceMonth = parts[1] + "/" + parts[0]
-							} else {
-								pr.ReferenceMonth = ref
-							}
-						}
-						// ensure price string exists; if empty, skip this candidate
-						if pr.Price == "" {
-							// try next candidate
-							continue
-						}
-						if nb, err := json.Marshal(pr); err == nil {
-							results[offset] = json.RawMessage(nb)
-							return
-						}
-					}
-					// if unmarshalling failed, but we have raw bytes, try to set a minimal wrapper
-					// attempt to extract numeric price and set a reference
-					var raw map[string]interface{}
-					if err := json.Unmarshal(b, &raw); err == nil {
-						if raw["referenceMonth"] == nil {
-							raw["referenceMonth"] = ref
-						}
-						if _, ok := raw["price"]; !ok {
-							// attempt to look for value-like fields
-							if v, ok2 := raw["Valor"]; ok2 {
-								raw["price"] = v
-							}
-						}
-						if nb, err := json.Marshal(raw); err == nil {
-							results[offset] = json.RawMessage(nb)
-							return
-						}
-					}
-					// last resort: store raw bytes
-					results[offset] = json.RawMessage(b)
-					return
-				}
-			}
-		}(i)
+	history, err := priceHistory(r.Context(), vehicleType, brandId, modelId, yearId, months, r.URL.Query().Get("includeSuspect") == "true")
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
 	}
-	wg.Wait()
 
-	// collect non-empty results preserving month order (current -> past)
-	history := make([]json.RawMessage, 0, months)
-	for i := 0; i < months; i++ {
-		if len(results[i]) > 0 {
-			history = append(history, results[i])
-		}
+	addVary(w.Header(), "Accept")
+	if wantsCSV(r) {
+		writePricesCSV(w, loc, "fipe-history-"+modelId+"-"+yearId, history)
+		return
 	}
 
-	if len(history) == 0 {
-		// final fallback: fetch the single current price
-		singleURL := fmt.Sprintf("%s/%s/brands/%s/models/%s/years/%s", FipeBaseURL, vehicleType, brandId, modelId, yearId)
-		single, err2 := fetchURL(singleURL)
-		if err2 != nil {
-			http.Error(w, fmt.Sprintf("history fetch failed: %v, fallback failed: %v", err, err2), http.StatusBadGateway)
-			return
-		}
-		history = append(history, json.RawMessage(single))
-	}
-
-	// Normalize entries: ensure each history item has a distinct ReferenceMonth label
-	for i := range history {
-		var pr PriceResponse
-		if err := json.Unmarshal(history[i], &pr); err == nil {
-			// compute label for this offset: current month -> offset 0
-			ref := time.Now().AddDate(0, -i, 0)
-			label := fmt.Sprintf("%02d/%d", int(ref.Month()), ref.Year())
-			pr.ReferenceMonth = label
-			if nb, err := json.Marshal(pr); err == nil {
-				history[i] = json.RawMessage(nb)
-			}
-		} else {
-			// try to add a simple wrapper if raw data doesn't match structure
-			var raw map[string]interface{}
-			if err := json.Unmarshal(history[i], &raw); err == nil {
-				ref := time.Now().AddDate(0, -i, 0)
-				raw["referenceMonth"] = fmt.Sprintf("%02d/%d", int(ref.Month()), ref.Year())
-				if nb, err := json.Marshal(raw); err == nil {
-					history[i] = json.RawMessage(nb)
-				}
-			}
-		}
+	// Add numeric and locale-formatted values to each history entry
+	items := make([]map[string]interface{}, len(history))
+	for i, pr := range history {
+		items[i] = localizedPrice(pr, loc)
 	}
-
-	resp := map[string]interface{}{"history": history}
-	b, _ := json.Marshal(resp)
+	b, _ := json.Marshal(map[string]interface{}{"history": items})
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(b)
 }
-
-// parseFipePrice attempts to convert FIPE price strings to float64.
-func parseFipePrice(s string) (float64, error) {
-	s = strings.TrimSpace(s)
-	re := regexp.MustCompile(`[0-9,.]+`)
-	m := re.FindString(s)
-	if m == "" {
-		return math.NaN(), fmt.Errorf("no numeric part")
-	}
-	if strings.Contains(m, ".") && strings.Contains(m, ",") {
-		m = strings.ReplaceAll(m, ".", "")
-		m = strings.ReplaceAll(m, ",", ".")
-	} else if strings.Contains(m, ",") && !strings.Contains(m, ".") {
-		m = strings.ReplaceAll(m, ",", ".")
-	}
-	return strconv.ParseFloat(m, 64)
-}
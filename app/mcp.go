@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gofipe/pkg/fipe"
+)
+
+// --- MCP tool server ---
+//
+// With GOFIPE_MCP=true, POST /mcp speaks the Model Context Protocol over the
+// Streamable HTTP transport (single JSON responses, no sessions), so AI
+// assistants can call the FIPE lookups as tools:
+//
+//   - list_brands: vehicleType
+//   - list_models: vehicleType, brandId
+//   - list_years:  vehicleType, brandId, modelId
+//   - get_price:   vehicleType, brandId, modelId, yearId
+//
+// Arguments are validated strictly (known keys only, enum vehicle types,
+// numeric IDs, "<year>-<fuel>" year IDs) before anything reaches FIPE.
+// Tool calls are limited to GOFIPE_MCP_LIMIT_RPM per client IP (default 30);
+// limited calls return a tool error telling the model when to retry.
+
+const (
+	mcpProtocolVersion = "2025-06-18"
+	defaultMCPLimitRPM = 30
+
+	// JSON-RPC 2.0 error codes
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+)
+
+var (
+	mcpNumericID = regexp.MustCompile(`^[0-9]{1,10}$`)
+	mcpYearID    = regexp.MustCompile(`^[0-9]{4}-[0-9]$`)
+)
+
+// mcpToolCallsCounter counts tool calls by tool and result.
+var mcpToolCallsCounter = newBudgetedCounterVec(
+	prometheus.CounterOpts{
+		Name: "fipe_mcp_tool_calls_total",
+		Help: "MCP tool calls by tool and result (ok, invalid, limited, error)",
+	},
+	[]string{"tool", "result"},
+)
+
+func init() {
+	registerBudgeted(mcpToolCallsCounter)
+}
+
+// rpcRequest is a JSON-RPC 2.0 request or notification.
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+// rpcError is a JSON-RPC 2.0 error object.
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// rpcResponse is a JSON-RPC 2.0 response.
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+// mcpTool describes a tool and the arguments it requires, in order.
+type mcpTool struct {
+	Name        string
+	Description string
+	Args        []string
+}
+
+var mcpTools = []mcpTool{
+	{"list_brands", "List the vehicle brands in the FIPE table.", []string{"vehicleType"}},
+	{"list_models", "List the models of a brand. Use a brand code from list_brands.", []string{"vehicleType", "brandId"}},
+	{"list_years", "List the model years (with fuel) of a model. Use codes from list_brands and list_models.", []string{"vehicleType", "brandId", "modelId"}},
+	{"get_price", "Get the current FIPE price of a vehicle. Use codes from the list tools.", []string{"vehicleType", "brandId", "modelId", "yearId"}},
+}
+
+// mcpArgDescriptions documents each argument in the tool input schemas.
+var mcpArgDescriptions = map[string]string{
+	"vehicleType": "Vehicle type.",
+	"brandId":     "Brand code, e.g. \"59\".",
+	"modelId":     "Model code, e.g. \"5940\".",
+	"yearId":      "Year code as <year>-<fuel>, e.g. \"2014-1\".",
+}
+
+// inputSchema returns the JSON Schema of the tool arguments.
+func (t mcpTool) inputSchema() map[string]interface{} {
+	props := map[string]interface{}{}
+	for _, a := range t.Args {
+		p := map[string]interface{}{"type": "string", "description": mcpArgDescriptions[a]}
+		if a == "vehicleType" {
+			p["enum"] = slices.Sorted(maps.Keys(vehicleTypes))
+		}
+		props[a] = p
+	}
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           props,
+		"required":             t.Args,
+		"additionalProperties": false,
+	}
+}
+
+// validate checks that args holds exactly the tool arguments with valid values.
+func (t mcpTool) validate(args map[string]string) error {
+	for k := range args {
+		if !slices.Contains(t.Args, k) {
+			return fmt.Errorf("unknown argument %q", k)
+		}
+	}
+	for _, a := range t.Args {
+		v, ok := args[a]
+		if !ok || v == "" {
+			return fmt.Errorf("missing argument %q", a)
+		}
+		switch a {
+		case "vehicleType":
+			if _, ok := vehicleTypes[v]; !ok {
+				return fmt.Errorf("vehicleType must be one of cars, motorcycles, trucks")
+			}
+		case "yearId":
+			if !mcpYearID.MatchString(v) {
+				return fmt.Errorf("yearId must look like \"2014-1\"")
+			}
+		default:
+			if !mcpNumericID.MatchString(v) {
+				return fmt.Errorf("%s must be a numeric code", a)
+			}
+		}
+	}
+	return nil
+}
+
+// call runs the tool against FIPE and returns the JSON result.
+func (t mcpTool) call(ctx context.Context, args map[string]string) ([]byte, error) {
+	var (
+		result interface{}
+		err    error
+	)
+	switch t.Name {
+	case "list_brands":
+		result, err = fipeClient.Brands(ctx, args["vehicleType"])
+	case "list_models":
+		result, err = fipeClient.Models(ctx, args["vehicleType"], args["brandId"])
+	case "list_years":
+		result, err = fipeClient.Years(ctx, args["vehicleType"], args["brandId"], args["modelId"])
+	default:
+		var pr fipe.Price
+		pr, err = fipeClient.Price(ctx, args["vehicleType"], args["brandId"], args["modelId"], args["yearId"])
+		result = localizedPrice(pr, locales[defaultLocale])
+	}
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(result)
+}
+
+// mcpToolResult builds a tools/call result with a single text block.
+func mcpToolResult(text string, isError bool) map[string]interface{} {
+	return map[string]interface{}{
+		"content": []map[string]string{{"type": "text", "text": text}},
+		"isError": isError,
+	}
+}
+
+// mcpServer dispatches MCP requests.
+type mcpServer struct {
+	limiter *clientPolicy
+}
+
+// newMCPServer reads GOFIPE_MCP_LIMIT_RPM.
+func newMCPServer() (*mcpServer, error) {
+	limit := defaultMCPLimitRPM
+	if v := os.Getenv("GOFIPE_MCP_LIMIT_RPM"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("GOFIPE_MCP_LIMIT_RPM must be a positive integer")
+		}
+		limit = n
+	}
+	return &mcpServer{limiter: &clientPolicy{limitRPM: limit, windows: map[string]rateWindow{}}}, nil
+}
+
+// dispatch handles one request and returns its result or error.
+func (s *mcpServer) dispatch(r *http.Request, req rpcRequest) (interface{}, *rpcError) {
+	switch req.Method {
+	case "initialize":
+		return map[string]interface{}{
+			"protocolVersion": mcpProtocolVersion,
+			"capabilities":    map[string]interface{}{"tools": map[string]interface{}{}},
+			"serverInfo":      map[string]string{"name": "gofipe", "version": appVersion},
+			"instructions":    "Look up Brazilian FIPE vehicle prices: list_brands, then list_models, list_years and get_price using the returned codes.",
+		}, nil
+	case "ping":
+		return map[string]interface{}{}, nil
+	case "tools/list":
+		tools := make([]map[string]interface{}, 0, len(mcpTools))
+		for _, t := range mcpTools {
+			tools = append(tools, map[string]interface{}{
+				"name":        t.Name,
+				"description": t.Description,
+				"inputSchema": t.inputSchema(),
+			})
+		}
+		return map[string]interface{}{"tools": tools}, nil
+	case "tools/call":
+		return s.callTool(r, req.Params)
+	}
+	return nil, &rpcError{Code: rpcMethodNotFound, Message: "method not found: " + req.Method}
+}
+
+// callTool validates, rate limits and runs a tools/call request.
+func (s *mcpServer) callTool(r *http.Request, raw json.RawMessage) (interface{}, *rpcError) {
+	var params struct {
+		Name      string            `json:"name"`
+		Arguments map[string]string `json:"arguments"`
+	}
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, &rpcError{Code: rpcInvalidParams, Message: "arguments must be an object of strings"}
+	}
+	i := slices.IndexFunc(mcpTools, func(t mcpTool) bool { return t.Name == params.Name })
+	if i < 0 {
+		return nil, &rpcError{Code: rpcInvalidParams, Message: "unknown tool: " + params.Name}
+	}
+	tool := mcpTools[i]
+
+	if err := tool.validate(params.Arguments); err != nil {
+		mcpToolCallsCounter.Inc(tool.Name, "invalid")
+		return mcpToolResult("Invalid arguments: "+err.Error(), true), nil
+	}
+	if ok, retry := s.limiter.allow(clientIP(r), time.Now()); !ok {
+		mcpToolCallsCounter.Inc(tool.Name, "limited")
+		return mcpToolResult(fmt.Sprintf("Rate limit exceeded, retry in %d seconds.", retry), true), nil
+	}
+	data, err := tool.call(r.Context(), params.Arguments)
+	if err != nil {
+		mcpToolCallsCounter.Inc(tool.Name, "error")
+		slog.ErrorContext(r.Context(), "mcp tool failed", "tool", tool.Name, "error", err)
+		return mcpToolResult("FIPE lookup failed, try again later.", true), nil
+	}
+	mcpToolCallsCounter.Inc(tool.Name, "ok")
+	return mcpToolResult(string(data), false), nil
+}
+
+// ServeHTTP handles POST /mcp.
+func (s *mcpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	recordHTTPRequest("/mcp", r.Method)
+	var req rpcRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		writeRPC(w, rpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &rpcError{Code: rpcParseError, Message: "invalid JSON-RPC message"}})
+		return
+	}
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		writeRPC(w, rpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &rpcError{Code: rpcInvalidRequest, Message: "invalid JSON-RPC 2.0 request"}})
+		return
+	}
+	// Notifications (no id) get no response body.
+	if len(req.ID) == 0 {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	result, rpcErr := s.dispatch(r, req)
+	writeRPC(w, rpcResponse{JSONRPC: "2.0", ID: req.ID, Result: result, Error: rpcErr})
+}
+
+// writeRPC writes a JSON-RPC response.
+func writeRPC(w http.ResponseWriter, resp rpcResponse) {
+	b, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// --- Metric toggles and cardinality budgets ---
+//
+// GOFIPE_METRICS_DISABLED is a comma-separated list of app metric names that
+// are not registered at all, e.g. "fipe_search_stats,fipe_price_min".
+//
+// GOFIPE_METRICS_MAX_SERIES caps the number of label sets per metric, e.g.
+// "fipe_search_stats=500,*=1000" ("*" applies to every other app metric).
+// Label sets beyond the cap are folded into a single series whose labels
+// are all "other".
+
+// overflowLabel replaces every label value of series past their metric's budget.
+const overflowLabel = "other"
+
+// metricBudgetOverflowCounter counts observations folded into the "other" series.
+var metricBudgetOverflowCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "fipe_metric_budget_overflow_total",
+		Help: "Observations recorded under the \"other\" series because a metric exceeded its cardinality budget",
+	},
+	[]string{"metric"},
+)
+
+// metricBudget decides which label sets a metric family may record.
+type metricBudget struct {
+	name     string
+	disabled bool
+	// maxSeries is the number of distinct label sets allowed; 0 means unlimited.
+	maxSeries int
+
+	mu   sync.Mutex
+	seen map[string]struct{}
+}
+
+// admit returns the label values to record, or false if the metric is disabled.
+func (b *metricBudget) admit(labelValues []string) ([]string, bool) {
+	if b.disabled {
+		return nil, false
+	}
+	if b.maxSeries <= 0 {
+		return labelValues, true
+	}
+
+	key := strings.Join(labelValues, "\xff")
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.seen[key]; ok {
+		return labelValues, true
+	}
+	if len(b.seen) < b.maxSeries {
+		b.seen[key] = struct{}{}
+		return labelValues, true
+	}
+
+	metricBudgetOverflowCounter.WithLabelValues(b.name).Inc()
+	other := make([]string, len(labelValues))
+	for i := range other {
+		other[i] = overflowLabel
+	}
+	return other, true
+}
+
+// budgetedCounterVec is a CounterVec that honors metric toggles and budgets.
+type budgetedCounterVec struct {
+	*prometheus.CounterVec
+	budget *metricBudget
+}
+
+// newBudgetedCounterVec creates a CounterVec governed by its own budget.
+func newBudgetedCounterVec(opts prometheus.CounterOpts, labelNames []string) *budgetedCounterVec {
+	return &budgetedCounterVec{
+		CounterVec: prometheus.NewCounterVec(opts, labelNames),
+		budget:     &metricBudget{name: opts.Name, seen: map[string]struct{}{}},
+	}
+}
+
+// Inc increments the series for labelValues if the budget admits it.
+func (c *budgetedCounterVec) Inc(labelValues ...string) {
+	if lv, ok := c.budget.admit(labelValues); ok {
+		c.WithLabelValues(lv...).Inc()
+	}
+}
+
+// Add adds v to the series for labelValues if the budget admits it.
+func (c *budgetedCounterVec) Add(v float64, labelValues ...string) {
+	if lv, ok := c.budget.admit(labelValues); ok {
+		c.WithLabelValues(lv...).Add(v)
+	}
+}
+
+// budgetedGaugeVec is a GaugeVec that honors metric toggles and budgets.
+type budgetedGaugeVec struct {
+	*prometheus.GaugeVec
+	budget *metricBudget
+}
+
+// newBudgetedGaugeVec creates a GaugeVec governed by its own budget.
+func newBudgetedGaugeVec(opts prometheus.GaugeOpts, labelNames []string) *budgetedGaugeVec {
+	return &budgetedGaugeVec{
+		GaugeVec: prometheus.NewGaugeVec(opts, labelNames),
+		budget:   &metricBudget{name: opts.Name, seen: map[string]struct{}{}},
+	}
+}
+
+// Set sets the series for labelValues if the budget admits it.
+func (g *budgetedGaugeVec) Set(v float64, labelValues ...string) {
+	if lv, ok := g.budget.admit(labelValues); ok {
+		g.WithLabelValues(lv...).Set(v)
+	}
+}
+
+// budgetedHistogramVec is a HistogramVec that honors metric toggles and budgets.
+type budgetedHistogramVec struct {
+	*prometheus.HistogramVec
+	budget *metricBudget
+}
+
+// newBudgetedHistogramVec creates a HistogramVec governed by its own budget.
+func newBudgetedHistogramVec(opts prometheus.HistogramOpts, labelNames []string) *budgetedHistogramVec {
+	return &budgetedHistogramVec{
+		HistogramVec: prometheus.NewHistogramVec(opts, labelNames),
+		budget:       &metricBudget{name: opts.Name, seen: map[string]struct{}{}},
+	}
+}
+
+// Observe records v for labelValues if the budget admits it.
+func (h *budgetedHistogramVec) Observe(v float64, labelValues ...string) {
+	if lv, ok := h.budget.admit(labelValues); ok {
+		h.WithLabelValues(lv...).Observe(v)
+	}
+}
+
+// budgetedCollector is implemented by the budgeted vector types.
+type budgetedCollector interface {
+	prometheus.Collector
+	metricBudget() *metricBudget
+}
+
+func (c *budgetedCounterVec) metricBudget() *metricBudget   { return c.budget }
+func (g *budgetedGaugeVec) metricBudget() *metricBudget     { return g.budget }
+func (h *budgetedHistogramVec) metricBudget() *metricBudget { return h.budget }
+
+// registerBudgeted applies the environment settings to collectors and
+// registers the ones that are not disabled.
+func registerBudgeted(collectors ...budgetedCollector) {
+	disabled := map[string]bool{}
+	for _, name := range strings.Split(os.Getenv("GOFIPE_METRICS_DISABLED"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			disabled[name] = true
+		}
+	}
+	maxSeries, err := parseMaxSeries(os.Getenv("GOFIPE_METRICS_MAX_SERIES"))
+	if err != nil {
+		log.Fatalf("Invalid GOFIPE_METRICS_MAX_SERIES: %v", err)
+	}
+
+	for _, c := range collectors {
+		b := c.metricBudget()
+		b.disabled = disabled[b.name]
+		if n, ok := maxSeries[b.name]; ok {
+			b.maxSeries = n
+		} else {
+			b.maxSeries = maxSeries["*"]
+		}
+		if !b.disabled {
+			prometheus.MustRegister(c)
+		}
+	}
+}
+
+// parseMaxSeries parses "name=N,name2=N" into a map.
+func parseMaxSeries(s string) (map[string]int, error) {
+	out := map[string]int{}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(entry, "=")
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if !ok || err != nil || n < 0 {
+			return nil, fmt.Errorf("entry %q: expected <metric>=<non-negative integer>", entry)
+		}
+		out[strings.TrimSpace(name)] = n
+	}
+	return out, nil
+}
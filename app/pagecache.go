@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// --- Page render cache ---
+//
+// The index page only varies with the visitor's A/B experiment variants, so
+// each rendered variant combination is kept in memory and written as-is,
+// with its Content-Length and a gzip variant, instead of executing the
+// template per request. The template and GOFIPE_EXPERIMENTS are loaded once
+// at startup, so rendered copies live until restart. For template work set
+// GOFIPE_TEMPLATE_RELOAD=true: the file is then re-parsed whenever its
+// modification time changes and the rendered copies are dropped.
+
+// maxRenderedPages bounds the variant combinations kept per template;
+// further combinations are rendered per request.
+const maxRenderedPages = 256
+
+var htmlContentType = []string{"text/html; charset=utf-8"}
+
+// renderedPage is a template output ready to be written.
+type renderedPage struct {
+	body, gz         []byte
+	length, gzLength []string
+}
+
+// renderedTemplate renders a template once per variant key.
+type renderedTemplate struct {
+	path   string
+	reload bool
+
+	mu    sync.RWMutex
+	tmpl  *template.Template
+	mtime time.Time
+	pages map[string]renderedPage
+}
+
+// newRenderedTemplate parses the template at path, exiting on errors like
+// template.Must.
+func newRenderedTemplate(path string) *renderedTemplate {
+	t := &renderedTemplate{
+		path:   path,
+		reload: os.Getenv("GOFIPE_TEMPLATE_RELOAD") == "true",
+		tmpl:   template.Must(template.ParseFiles(path)),
+		pages:  map[string]renderedPage{},
+	}
+	if fi, err := os.Stat(path); err == nil {
+		t.mtime = fi.ModTime()
+	}
+	return t
+}
+
+// reloadIfChanged re-parses the template when its file changed. A template
+// that fails to parse keeps the previous one.
+func (t *renderedTemplate) reloadIfChanged() {
+	fi, err := os.Stat(t.path)
+	if err != nil {
+		return
+	}
+	t.mu.RLock()
+	changed := !fi.ModTime().Equal(t.mtime)
+	t.mu.RUnlock()
+	if !changed {
+		return
+	}
+	tmpl, err := template.ParseFiles(t.path)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.mtime = fi.ModTime()
+	if err != nil {
+		slog.Warn("keeping previous template, reload failed", "file", t.path, "error", err)
+		return
+	}
+	t.tmpl = tmpl
+	t.pages = map[string]renderedPage{}
+	slog.Info("reloaded template", "file", t.path)
+}
+
+// page returns the output for key, rendering data on first use.
+func (t *renderedTemplate) page(key string, data interface{}) (renderedPage, error) {
+	if t.reload {
+		t.reloadIfChanged()
+	}
+	t.mu.RLock()
+	p, ok := t.pages[key]
+	tmpl := t.tmpl
+	t.mu.RUnlock()
+	if ok {
+		return p, nil
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return renderedPage{}, err
+	}
+	p = renderedPage{body: buf.Bytes(), length: []string{strconv.Itoa(buf.Len())}}
+	if p.gz = gzipPayload(p.body); p.gz != nil {
+		p.gzLength = []string{strconv.Itoa(len(p.gz))}
+	}
+	t.mu.Lock()
+	if t.tmpl == tmpl && len(t.pages) < maxRenderedPages {
+		t.pages[key] = p
+	}
+	t.mu.Unlock()
+	return p, nil
+}
+
+// serve writes the output for key, gzip-encoded when the client accepts it.
+func (t *renderedTemplate) serve(w http.ResponseWriter, r *http.Request, key string, data interface{}) {
+	p, err := t.page(key, data)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "render failed", "file", t.path, "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	h := w.Header()
+	h["Content-Type"] = htmlContentType
+	h["Vary"] = varyAcceptEncoding
+	body, length := p.body, p.length
+	if p.gz != nil && acceptsGzip(r) {
+		h["Content-Encoding"] = gzipEncoding
+		body, length = p.gz, p.gzLength
+	}
+	h["Content-Length"] = length
+	w.Write(body)
+}
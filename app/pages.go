@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"time"
+
+	qrcode "github.com/skip2/go-qrcode"
+
+	"gofipe/pkg/fipe"
+)
+
+// --- Server-rendered pages ---
+
+// vehicleTypes lists the vehicle types accepted in page routes.
+var vehicleTypes = map[string]string{
+	"cars":        "Cars",
+	"motorcycles": "Motorcycles",
+	"trucks":      "Trucks",
+}
+
+// IndexPage is the view model rendered by templates/index.html.
+type IndexPage struct {
+	ExperimentClasses string
+}
+
+// VehiclePage is the view model rendered by templates/vehicle.html.
+type VehiclePage struct {
+	Type       string
+	TypeName   string
+	BrandID    string
+	ModelID    string
+	YearID     string
+	Price      fipe.Price
+	PriceValue float64
+	History    PriceSeries
+	OtherYears []VehicleLink
+	// ExperimentClasses holds the visitor's A/B variants as body classes.
+	ExperimentClasses string
+}
+
+// PriceSeries holds chart-ready price history, oldest month first.
+type PriceSeries struct {
+	Labels []string  `json:"labels"`
+	Values []float64 `json:"values"`
+}
+
+// VehicleLink points to the detail page of a related vehicle.
+type VehicleLink struct {
+	Label   string
+	URL     string
+	Current bool
+}
+
+// PrintPage is the view model rendered by templates/vehicle_print.html.
+type PrintPage struct {
+	*VehiclePage
+	PageURL     string
+	QRCode      template.URL
+	GeneratedAt string
+}
+
+// pageFuncs are the helpers available to page templates.
+var pageFuncs = template.FuncMap{
+	"brl":       formatBRL,
+	"localTime": formatLocalTime,
+}
+
+// formatLocalTime formats t in the time zone of the FIPE reference cycle.
+func formatLocalTime(t time.Time) string {
+	return t.In(fipeLocation).Format("02/01/2006 15:04 MST")
+}
+
+// vehiclePath returns the detail page path for a vehicle.
+func vehiclePath(vehicleType, brandId, modelId, yearId string) string {
+	return fmt.Sprintf("/vehicle/%s/%s/%s/%s", vehicleType, brandId, modelId, yearId)
+}
+
+// vehiclePageHandler renders /vehicle/{type}/{brandId}/{modelId}/{yearId}.
+func vehiclePageHandler(tmpl *template.Template) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		recordHTTPRequest("/vehicle", r.Method)
+		vehicleType := r.PathValue("type")
+		if _, ok := vehicleTypes[vehicleType]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		page, err := loadVehiclePage(r.Context(), vehicleType, r.PathValue("brandId"), r.PathValue("modelId"), r.PathValue("yearId"))
+		if err != nil {
+			writeUpstreamError(w, err)
+			return
+		}
+
+		captureAttribution(w, r)
+		page.ExperimentClasses = experimentClasses(assignExperiments(w, r, true))
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := tmpl.Execute(w, page); err != nil {
+			slog.ErrorContext(r.Context(), "render vehicle page failed", "error", err)
+		}
+	}
+}
+
+// vehiclePrintHandler renders /vehicle/{type}/{brandId}/{modelId}/{yearId}/print,
+// a paper-formatted valuation with a QR code linking back to the detail page.
+func vehiclePrintHandler(tmpl *template.Template) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		recordHTTPRequest("/vehicle/print", r.Method)
+		vehicleType := r.PathValue("type")
+		if _, ok := vehicleTypes[vehicleType]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		page, err := loadVehiclePage(r.Context(), vehicleType, r.PathValue("brandId"), r.PathValue("modelId"), r.PathValue("yearId"))
+		if err != nil {
+			writeUpstreamError(w, err)
+			return
+		}
+
+		printPage := &PrintPage{
+			VehiclePage: page,
+			PageURL:     absoluteURL(vehiclePath(page.Type, page.BrandID, page.ModelID, page.YearID)),
+			GeneratedAt: formatLocalTime(fipeNow()),
+		}
+		if png, err := qrcode.Encode(printPage.PageURL, qrcode.Medium, 160); err == nil {
+			printPage.QRCode = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+		} else {
+			slog.ErrorContext(r.Context(), "print page qr code failed", "error", err)
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := tmpl.Execute(w, printPage); err != nil {
+			slog.ErrorContext(r.Context(), "render print page failed", "error", err)
+		}
+	}
+}
+
+// publicBaseURL is the configured public URL of the server
+// (GOFIPE_PUBLIC_URL), without a trailing slash.
+var publicBaseURL = "http://localhost:8080"
+
+// absoluteURL builds an absolute URL for path under publicBaseURL. The
+// Host and X-Forwarded-* headers are client-supplied, so they never end up
+// in links, QR codes or reports.
+func absoluteURL(path string) string {
+	return publicBaseURL + path
+}
+
+// loadVehiclePage gathers price, history and sibling years for a vehicle.
+// Only the price is mandatory; history and years degrade to empty sections.
+func loadVehiclePage(ctx context.Context, vehicleType, brandId, modelId, yearId string) (*VehiclePage, error) {
+	page := &VehiclePage{
+		Type:     vehicleType,
+		TypeName: vehicleTypes[vehicleType],
+		BrandID:  brandId,
+		ModelID:  modelId,
+		YearID:   yearId,
+	}
+
+	price, err := fipeClient.Price(ctx, vehicleType, brandId, modelId, yearId)
+	if err != nil {
+		return nil, err
+	}
+	page.Price = price
+	if f, err := price.Value(); err == nil {
+		page.PriceValue = f
+	}
+
+	if history, err := priceHistory(ctx, vehicleType, brandId, modelId, yearId, 12, false); err == nil {
+		page.History = parsePriceSeries(history)
+	} else {
+		slog.ErrorContext(ctx, "vehicle page history failed", "error", err)
+	}
+
+	if years, err := fipeClient.Years(ctx, vehicleType, brandId, modelId); err == nil {
+		for _, y := range years {
+			page.OtherYears = append(page.OtherYears, VehicleLink{
+				Label:   y.Name,
+				URL:     vehiclePath(vehicleType, brandId, modelId, y.Code),
+				Current: y.Code == yearId,
+			})
+		}
+	} else {
+		slog.ErrorContext(ctx, "vehicle page years failed", "error", err)
+	}
+
+	return page, nil
+}
+
+// parsePriceSeries converts a price history (newest first) into a chart
+// series ordered oldest first. Unparsable entries are skipped.
+func parsePriceSeries(history []fipe.Price) PriceSeries {
+	series := PriceSeries{Labels: []string{}, Values: []float64{}}
+	for i := len(history) - 1; i >= 0; i-- {
+		f, err := history[i].Value()
+		if err != nil {
+			continue
+		}
+		series.Labels = append(series.Labels, history[i].ReferenceMonth)
+		series.Values = append(series.Values, f)
+	}
+	return series
+}
@@ -0,0 +1,36 @@
+package fipe
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+)
+
+// codeRe matches FIPE codes such as "001004-9".
+var codeRe = regexp.MustCompile(`^\d{6}-\d$`)
+
+// ValidCode reports whether s is shaped like a FIPE code ("001004-9").
+func ValidCode(s string) bool {
+	return codeRe.MatchString(s)
+}
+
+// CodeYearsKey is the Cache key of the years list of a FIPE code.
+func CodeYearsKey(vehicleType, fipeCode string) string {
+	return "codeyears:" + vehicleType + ":" + fipeCode
+}
+
+// CodeYears lists the model years of the vehicle with a FIPE code, newest
+// first, without the brand and model lookups. Cached for YearsTTL.
+func (c *Client) CodeYears(ctx context.Context, vehicleType, fipeCode string) ([]Reference, error) {
+	key, path := c.at(CodeYearsKey(vehicleType, fipeCode), "/"+vehicleType+"/"+fipeCode+"/years")
+	return decodeReferences(c.listJSON(ctx, Source{key, path, c.YearsTTL}))
+}
+
+// CodePrice returns the price of the vehicle with a FIPE code in a model year.
+func (c *Client) CodePrice(ctx context.Context, vehicleType, fipeCode, yearID string) (Price, error) {
+	var out Price
+	key, path := c.at(fmt.Sprintf("codeprice:%s:%s:%s", vehicleType, fipeCode, yearID),
+		fmt.Sprintf("/%s/%s/years/%s", vehicleType, fipeCode, yearID))
+	err := c.getJSON(ctx, key, path, c.PriceTTL, &out)
+	return out, err
+}
@@ -0,0 +1,502 @@
+// Package fipe is a client for the FIPE v2 API (fipe.parallelum.com.br),
+// the Brazilian vehicle price table.
+//
+// Client methods return Go structs. List lookups go through an optional
+// Cache so applications can share, persist or shard payloads; prices are
+// only cached when PriceTTL is set. Cache lookups are traced with the
+// global OpenTelemetry tracer provider.
+package fipe
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// tracer creates the cache lookup spans.
+var tracer = otel.Tracer("gofipe/pkg/fipe")
+
+// DefaultBaseURL is the public FIPE v2 endpoint.
+const DefaultBaseURL = "https://fipe.parallelum.com.br/api/v2"
+
+// TokenHeader carries the subscription token of Client.Token.
+const TokenHeader = "X-Subscription-Token"
+
+// Default cache TTLs used by NewClient.
+const (
+	DefaultBrandsTTL = 12 * time.Hour
+	DefaultModelsTTL = 12 * time.Hour
+	DefaultYearsTTL  = 24 * time.Hour
+	// DefaultReferencesTTL is short enough to pick up a new monthly table
+	// on the day FIPE publishes it.
+	DefaultReferencesTTL = 6 * time.Hour
+	DefaultHistoryTTL    = 7 * 24 * time.Hour
+	DefaultTimeout       = 10 * time.Second
+)
+
+// Reference is an item of the FIPE lists: a brand, model or model year.
+type Reference struct {
+	Code string `json:"code"`
+	Name string `json:"name"`
+}
+
+// Price is the FIPE price of a vehicle in a reference month.
+type Price struct {
+	Price          string `json:"price"` // human-readable price, e.g. "R$ 45.123,00"
+	Brand          string `json:"brand"`
+	Model          string `json:"model"`
+	ModelYear      int    `json:"modelYear"`
+	Fuel           string `json:"fuel"`
+	CodeFipe       string `json:"codeFipe"`
+	ReferenceMonth string `json:"referenceMonth"`
+	VehicleType    int    `json:"vehicleType"`
+	AcronymFuel    string `json:"acronymFuel"`
+}
+
+// Value returns the numeric price.
+func (p Price) Value() (float64, error) {
+	return ParsePrice(p.Price)
+}
+
+// ReferenceTable is a monthly FIPE table.
+type ReferenceTable struct {
+	Code  string `json:"code"`
+	Month string `json:"month"`
+}
+
+// StatusError is returned when FIPE answers with a non-200 status.
+type StatusError struct {
+	StatusCode int
+	URL        string
+	// RetryAfter is the Retry-After header of the answer, if any.
+	RetryAfter string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("external API returned status: %d for url: %s", e.StatusCode, e.URL)
+}
+
+// PayloadError is returned when a FIPE payload cannot be decoded.
+type PayloadError struct {
+	Path string
+	Err  error
+}
+
+func (e *PayloadError) Error() string {
+	return fmt.Sprintf("unexpected payload from %s: %v", e.Path, e.Err)
+}
+
+func (e *PayloadError) Unwrap() error { return e.Err }
+
+// Cache stores raw FIPE payloads.
+//
+// Get returns the fresh payload cached under key. It is tried first, so
+// hits cost no URL building or closures. Fetch handles misses: it returns
+// the payload cached under key, calling fetch and caching its result for
+// ttl. url is the upstream URL behind key, for caches that may obtain it
+// elsewhere (e.g. from a peer). Fetch may share one fetch call between
+// concurrent misses on the same key.
+type Cache interface {
+	Get(key string) ([]byte, bool)
+	Fetch(key, url string, ttl time.Duration, fetch func() ([]byte, error)) ([]byte, error)
+}
+
+// Client calls the FIPE API. The zero value is not usable; use NewClient.
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+	UserAgent  string
+	// Token, when set, is sent in TokenHeader for the higher rate limits of
+	// a FIPE subscription. It is kept out of URLs and errors, and not sent
+	// on redirects to other hosts.
+	Token string
+
+	// Cache, when set, caches brands, models, years, reference tables and
+	// (with PriceTTL) prices.
+	Cache     Cache
+	BrandsTTL time.Duration
+	ModelsTTL time.Duration
+	YearsTTL  time.Duration
+	// PriceTTL caches prices when positive. Zero always fetches fresh prices.
+	PriceTTL      time.Duration
+	ReferencesTTL time.Duration
+	// HistoryTTL caches prices of past reference tables in PriceHistory.
+	HistoryTTL time.Duration
+
+	// ReferenceCode selects a monthly reference table (see References) for
+	// lists and prices. Empty means the current table.
+	ReferenceCode string
+	// CurrentReference, when set and returning a table code, pins the
+	// current table: it is queried when ReferenceCode is empty, and
+	// References leaves out the tables published after it.
+	CurrentReference func() string
+
+	// OnResponse, when set, is called with the URL and body size of every
+	// successful upstream response.
+	OnResponse func(url string, size int)
+
+	// Raw returns payloads as sent by FIPE. By default lists, reference
+	// tables and prices are normalized to the fields of Reference,
+	// ReferenceTable and Price (see Open).
+	Raw bool
+}
+
+// NewClient returns a client for baseURL with default timeout and TTLs.
+func NewClient(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		HTTPClient: &http.Client{Timeout: DefaultTimeout, CheckRedirect: dropTokenOnRedirect},
+		UserAgent:  "Go-Fipe-App/1.0",
+		BrandsTTL:  DefaultBrandsTTL,
+		ModelsTTL:  DefaultModelsTTL,
+		YearsTTL:   DefaultYearsTTL,
+
+		ReferencesTTL: DefaultReferencesTTL,
+		HistoryTTL:    DefaultHistoryTTL,
+	}
+}
+
+// Uncached returns a copy of c that always calls FIPE.
+func (c *Client) Uncached() *Client {
+	cp := *c
+	cp.Cache = nil
+	return &cp
+}
+
+// WithPriceTTL returns a copy of c caching prices for ttl.
+func (c *Client) WithPriceTTL(ttl time.Duration) *Client {
+	cp := *c
+	cp.PriceTTL = ttl
+	return &cp
+}
+
+// WithReference returns a copy of c querying the reference table code.
+func (c *Client) WithReference(code string) *Client {
+	cp := *c
+	cp.ReferenceCode = code
+	return &cp
+}
+
+// reference returns the table code to query, "" for FIPE's current table.
+func (c *Client) reference() string {
+	if c.ReferenceCode == "" && c.CurrentReference != nil {
+		return c.CurrentReference()
+	}
+	return c.ReferenceCode
+}
+
+// at adds the reference table query to path and to its cache key.
+func (c *Client) at(key, path string) (string, string) {
+	code := c.reference()
+	if code == "" {
+		return key, path
+	}
+	return ReferenceKey(key, code), path + "?reference=" + url.QueryEscape(code)
+}
+
+// Get fetches the raw payload of path, relative to BaseURL.
+func (c *Client) Get(ctx context.Context, path string) ([]byte, error) {
+	body, _, err := c.Open(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
+// Open requests path, relative to BaseURL, and returns the response body
+// for streaming with its size (-1 when unknown). The caller must close the
+// body; OnResponse is called then, with the bytes read from FIPE.
+//
+// Unless Raw is set, the bodies of lists, reference tables and prices are
+// decoded and encoded again: fields the package types lack are dropped,
+// and a body missing their fields or with other JSON types fails with a
+// *PayloadError while the body is read. Normalized bodies are rewritten as
+// they are read, so their size is unknown.
+func (c *Client) Open(ctx context.Context, path string) (io.ReadCloser, int64, error) {
+	u := c.BaseURL + path
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("User-Agent", c.UserAgent)
+	if c.Token != "" {
+		req.Header.Set(TokenHeader, c.Token)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, 0, &StatusError{StatusCode: resp.StatusCode, URL: u, RetryAfter: resp.Header.Get("Retry-After")}
+	}
+	body := &responseBody{ReadCloser: resp.Body, url: u, onClose: c.OnResponse}
+	n := normalizerFor(path)
+	switch {
+	case n == nil || c.Raw:
+		return body, resp.ContentLength, nil
+	}
+	return normalizeBody(path, body, n), -1, nil
+}
+
+// dropTokenOnRedirect is the CheckRedirect of NewClient: it follows up to
+// 10 redirects like the default policy, without the token on other hosts.
+func dropTokenOnRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	if req.URL.Host != via[0].URL.Host {
+		req.Header.Del(TokenHeader)
+	}
+	return nil
+}
+
+// responseBody counts the bytes read for Client.OnResponse.
+type responseBody struct {
+	io.ReadCloser
+	url     string
+	n       int
+	onClose func(url string, size int)
+}
+
+func (b *responseBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += n
+	return n, err
+}
+
+func (b *responseBody) Close() error {
+	if b.onClose != nil {
+		b.onClose(b.url, b.n)
+		b.onClose = nil
+	}
+	return b.ReadCloser.Close()
+}
+
+// cached returns the payload cached under key, if caching applies.
+func (c *Client) cached(key string, ttl time.Duration) ([]byte, bool) {
+	if c.Cache == nil || ttl <= 0 {
+		return nil, false
+	}
+	return c.Cache.Get(key)
+}
+
+// lookup returns the payload cached under key, fetching path on a miss,
+// in a "fipe.cache" span when caching applies.
+func (c *Client) lookup(ctx context.Context, key, path string, ttl time.Duration) ([]byte, error) {
+	if c.Cache == nil || ttl <= 0 {
+		return c.Get(ctx, path)
+	}
+	ctx, span := tracer.Start(ctx, "fipe.cache")
+	defer span.End()
+	data, ok := c.cached(key, ttl)
+	if span.IsRecording() {
+		span.SetAttributes(attribute.String("cache.key", key), attribute.Bool("cache.hit", ok))
+	}
+	if ok {
+		return data, nil
+	}
+	data, err := c.getCached(ctx, key, path, ttl)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return data, err
+}
+
+// getCached fetches path through the cache when one is configured and ttl is positive.
+func (c *Client) getCached(ctx context.Context, key, path string, ttl time.Duration) ([]byte, error) {
+	if c.Cache == nil || ttl <= 0 {
+		return c.Get(ctx, path)
+	}
+	// The Cache may share this fetch with concurrent callers, so it must not
+	// be canceled when this caller goes away; HTTPClient's timeout bounds it.
+	shared := context.WithoutCancel(ctx)
+	return c.Cache.Fetch(key, c.BaseURL+path, ttl, func() ([]byte, error) {
+		return c.Get(shared, path)
+	})
+}
+
+// getJSON fetches path through the cache and decodes it into v.
+func (c *Client) getJSON(ctx context.Context, key, path string, ttl time.Duration, v interface{}) error {
+	data, err := c.lookup(ctx, key, path, ttl)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return &PayloadError{Path: path, Err: err}
+	}
+	return nil
+}
+
+// BrandsKey is the Cache key of a brands list, for callers that serve
+// cache hits without going through the Client.
+func BrandsKey(vehicleType string) string {
+	return "brands:" + vehicleType
+}
+
+// ModelsKey is the Cache key of a models list.
+func ModelsKey(vehicleType, brandID string) string {
+	return "models:" + vehicleType + ":" + brandID
+}
+
+// ReferenceKey is the Cache key of the payload at key in the reference
+// table code; keys of the current table (empty code) are unchanged.
+func ReferenceKey(key, code string) string {
+	if code == "" {
+		return key
+	}
+	return key + "@" + code
+}
+
+// YearsKey is the Cache key of a years list.
+func YearsKey(vehicleType, brandID, modelID string) string {
+	return "years:" + vehicleType + ":" + brandID + ":" + modelID
+}
+
+// Source locates a raw FIPE list: its Cache key, its path relative to
+// BaseURL and its cache TTL. Proxies use it to stream cache misses.
+type Source struct {
+	Key  string
+	Path string
+	TTL  time.Duration
+}
+
+// BrandsSource locates the brands list of a vehicle type.
+func (c *Client) BrandsSource(vehicleType string) Source {
+	key, path := c.at(BrandsKey(vehicleType), "/"+vehicleType+"/brands")
+	return Source{key, path, c.BrandsTTL}
+}
+
+// ModelsSource locates the models list of a brand.
+func (c *Client) ModelsSource(vehicleType, brandID string) Source {
+	key, path := c.at(ModelsKey(vehicleType, brandID), "/"+vehicleType+"/brands/"+brandID+"/models")
+	return Source{key, path, c.ModelsTTL}
+}
+
+// YearsSource locates the years list of a model.
+func (c *Client) YearsSource(vehicleType, brandID, modelID string) Source {
+	key, path := c.at(YearsKey(vehicleType, brandID, modelID), "/"+vehicleType+"/brands/"+brandID+"/models/"+modelID+"/years")
+	return Source{key, path, c.YearsTTL}
+}
+
+// listJSON returns the list at src, from the cache when possible.
+func (c *Client) listJSON(ctx context.Context, src Source) ([]byte, error) {
+	return c.lookup(ctx, src.Key, src.Path, src.TTL)
+}
+
+// BrandsJSON returns the brands list of a vehicle type as JSON.
+// Cache hits are returned without decoding, for proxies.
+func (c *Client) BrandsJSON(ctx context.Context, vehicleType string) ([]byte, error) {
+	return c.listJSON(ctx, c.BrandsSource(vehicleType))
+}
+
+// ModelsJSON returns the models list of a brand as JSON.
+func (c *Client) ModelsJSON(ctx context.Context, vehicleType, brandID string) ([]byte, error) {
+	return c.listJSON(ctx, c.ModelsSource(vehicleType, brandID))
+}
+
+// YearsJSON returns the years list of a model as JSON.
+func (c *Client) YearsJSON(ctx context.Context, vehicleType, brandID, modelID string) ([]byte, error) {
+	return c.listJSON(ctx, c.YearsSource(vehicleType, brandID, modelID))
+}
+
+// Brands lists the brands of a vehicle type (cars, motorcycles, trucks).
+func (c *Client) Brands(ctx context.Context, vehicleType string) ([]Reference, error) {
+	return decodeReferences(c.BrandsJSON(ctx, vehicleType))
+}
+
+// Models lists the models of a brand.
+func (c *Client) Models(ctx context.Context, vehicleType, brandID string) ([]Reference, error) {
+	return decodeReferences(c.ModelsJSON(ctx, vehicleType, brandID))
+}
+
+// Years lists the model years of a model, newest first.
+func (c *Client) Years(ctx context.Context, vehicleType, brandID, modelID string) ([]Reference, error) {
+	return decodeReferences(c.YearsJSON(ctx, vehicleType, brandID, modelID))
+}
+
+// decodeReferences decodes a list payload.
+func decodeReferences(data []byte, err error) ([]Reference, error) {
+	if err != nil {
+		return nil, err
+	}
+	var out []Reference
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, fmt.Errorf("unexpected list payload: %v", err)
+	}
+	return out, nil
+}
+
+// Price returns the price of a vehicle in the current (or the selected
+// reference) table.
+func (c *Client) Price(ctx context.Context, vehicleType, brandID, modelID, yearID string) (Price, error) {
+	var out Price
+	key, path := c.at(fmt.Sprintf("price:%s:%s:%s:%s", vehicleType, brandID, modelID, yearID),
+		fmt.Sprintf("/%s/brands/%s/models/%s/years/%s", vehicleType, brandID, modelID, yearID))
+	err := c.getJSON(ctx, key, path, c.PriceTTL, &out)
+	return out, err
+}
+
+// ReferencesKey is the Cache key of the reference tables list.
+const ReferencesKey = "references"
+
+// ReferencesJSON returns the reference tables list as JSON.
+func (c *Client) ReferencesJSON(ctx context.Context) ([]byte, error) {
+	return c.lookup(ctx, ReferencesKey, "/references", c.ReferencesTTL)
+}
+
+// References lists the monthly reference tables, newest first.
+func (c *Client) References(ctx context.Context) ([]ReferenceTable, error) {
+	data, err := c.ReferencesJSON(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var out []ReferenceTable
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, &PayloadError{Path: "/references", Err: err}
+	}
+	if c.CurrentReference != nil {
+		if pin := c.CurrentReference(); pin != "" {
+			for i, t := range out {
+				if t.Code == pin {
+					return out[i:], nil
+				}
+			}
+		}
+	}
+	return out, nil
+}
+
+var priceNumberRe = regexp.MustCompile(`[0-9,.]+`)
+
+// ParsePrice converts FIPE price strings such as "R$ 45.123,00" to float64.
+func ParsePrice(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	m := priceNumberRe.FindString(s)
+	if m == "" {
+		return math.NaN(), fmt.Errorf("no numeric part")
+	}
+	if strings.Contains(m, ".") && strings.Contains(m, ",") {
+		m = strings.ReplaceAll(m, ".", "")
+		m = strings.ReplaceAll(m, ",", ".")
+	} else if strings.Contains(m, ",") && !strings.Contains(m, ".") {
+		m = strings.ReplaceAll(m, ",", ".")
+	}
+	return strconv.ParseFloat(m, 64)
+}
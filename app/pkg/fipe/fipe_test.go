@@ -0,0 +1,183 @@
+package fipe
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParsePrice(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    float64
+		wantErr bool
+	}{
+		{in: "R$ 45.123,00", want: 45123},
+		{in: "R$ 1.234.567,89", want: 1234567.89},
+		{in: "R$ 999,50", want: 999.5},
+		{in: "  R$ 10,00  ", want: 10},
+		{in: "45123.5", want: 45123.5},
+		{in: "R$", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParsePrice(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParsePrice(%q) = %v, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParsePrice(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestReferenceKey(t *testing.T) {
+	tests := []struct {
+		key, code, want string
+	}{
+		{key: "brands:cars", code: "", want: "brands:cars"},
+		{key: "brands:cars", code: "308", want: "brands:cars@308"},
+		{key: ModelsKey("cars", "21"), code: "290", want: "models:cars:21@290"},
+	}
+	for _, tt := range tests {
+		if got := ReferenceKey(tt.key, tt.code); got != tt.want {
+			t.Errorf("ReferenceKey(%q, %q) = %q, want %q", tt.key, tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestReferencesPin(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `[{"code":"310","month":"março de 2024"},{"code":"309","month":"fevereiro de 2024"},{"code":"308","month":"janeiro de 2024"}]`)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name string
+		pin  string
+		want []string
+	}{
+		{name: "no pin", pin: "", want: []string{"310", "309", "308"}},
+		{name: "newest", pin: "310", want: []string{"310", "309", "308"}},
+		{name: "older", pin: "309", want: []string{"309", "308"}},
+		{name: "oldest", pin: "308", want: []string{"308"}},
+		{name: "unknown", pin: "400", want: []string{"310", "309", "308"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewClient(srv.URL)
+			c.CurrentReference = func() string { return tt.pin }
+			tables, err := c.References(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, table := range tables {
+				got = append(got, table.Code)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("References() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOpenErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		status     int
+		body       string
+		retryAfter string
+		// check inspects the error of Open, or of reading the body.
+		check func(t *testing.T, err error)
+	}{
+		{
+			name:   "not found",
+			path:   "/cars/brands",
+			status: http.StatusNotFound,
+			check: func(t *testing.T, err error) {
+				var se *StatusError
+				if !errors.As(err, &se) || se.StatusCode != http.StatusNotFound {
+					t.Errorf("err = %v, want a 404 *StatusError", err)
+				}
+			},
+		},
+		{
+			name:       "rate limited",
+			path:       "/cars/brands",
+			status:     http.StatusTooManyRequests,
+			retryAfter: "30",
+			check: func(t *testing.T, err error) {
+				var se *StatusError
+				if !errors.As(err, &se) || se.RetryAfter != "30" {
+					t.Errorf("err = %v, want a *StatusError with Retry-After 30", err)
+				}
+			},
+		},
+		{
+			name:   "not a list",
+			path:   "/cars/brands",
+			status: http.StatusOK,
+			body:   `{"error":"maintenance"}`,
+			check:  wantPayloadError("/cars/brands"),
+		},
+		{
+			name:   "missing fields",
+			path:   "/cars/brands/21/models",
+			status: http.StatusOK,
+			body:   `[{"code":"1","name":"Gol"},{"code":"2"}]`,
+			check:  wantPayloadError("/cars/brands/21/models"),
+		},
+		{
+			name:   "bad price",
+			path:   "/cars/brands/21/models/4420/years/2014-1",
+			status: http.StatusOK,
+			body:   `{"price":"sob consulta","codeFipe":"001004-9","referenceMonth":"março de 2024"}`,
+			check:  wantPayloadError("/cars/brands/21/models/4420/years/2014-1"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.body)
+			}))
+			defer srv.Close()
+			c := NewClient(srv.URL)
+			c.Token = "secret"
+			body, _, err := c.Open(context.Background(), tt.path)
+			if err == nil {
+				_, err = io.ReadAll(body)
+				body.Close()
+			}
+			if err == nil {
+				t.Fatal("no error")
+			}
+			if strings.Contains(err.Error(), "secret") {
+				t.Errorf("err = %v, leaks the token", err)
+			}
+			tt.check(t, err)
+		})
+	}
+}
+
+// wantPayloadError checks for a *PayloadError of path.
+func wantPayloadError(path string) func(t *testing.T, err error) {
+	return func(t *testing.T, err error) {
+		var pe *PayloadError
+		if !errors.As(err, &pe) || pe.Path != path {
+			t.Errorf("err = %v, want a *PayloadError of %s", err, path)
+		}
+	}
+}
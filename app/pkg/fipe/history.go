@@ -0,0 +1,57 @@
+package fipe
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+)
+
+// PriceHistory returns the prices of a vehicle in the last months reference
+// tables, newest first, with the reference months named by FIPE.
+//
+// It lists the tables with References and queries each of the last months
+// concurrently. Tables in which the vehicle is not listed (e.g. before its
+// launch) are skipped; the history fails only when the current table fails.
+// Prices of past tables never change, so they are cached for HistoryTTL.
+func (c *Client) PriceHistory(ctx context.Context, vehicleType, brandID, modelID, yearID string, months int) ([]Price, error) {
+	tables, err := c.References(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(tables) == 0 {
+		return nil, errors.New("FIPE returned no reference tables")
+	}
+	tables = tables[:min(months, len(tables))]
+
+	prices := make([]Price, len(tables))
+	errs := make([]error, len(tables))
+	var wg sync.WaitGroup
+	for i, t := range tables {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			at := c.WithReference(t.Code)
+			if i > 0 {
+				at.PriceTTL = c.HistoryTTL
+			}
+			prices[i], errs[i] = at.Price(ctx, vehicleType, brandID, modelID, yearID)
+		}()
+	}
+	wg.Wait()
+	if errs[0] != nil {
+		return nil, errs[0]
+	}
+
+	history := make([]Price, 0, len(tables))
+	for i, p := range prices {
+		if errs[i] != nil || p.Price == "" {
+			continue
+		}
+		if p.ReferenceMonth = strings.TrimSpace(p.ReferenceMonth); p.ReferenceMonth == "" {
+			p.ReferenceMonth = strings.TrimSpace(tables[i].Month)
+		}
+		history = append(history, p)
+	}
+	return history, nil
+}
@@ -0,0 +1,101 @@
+package fipe
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// normalizer rewrites a FIPE payload read from d to w.
+type normalizer func(d *json.Decoder, w *bufio.Writer) error
+
+// normalizerFor returns the normalizer of the payload at path, nil for
+// paths the Client does not know.
+//
+// Lists, reference tables and prices are decoded into Reference,
+// ReferenceTable and Price and encoded again, so payloads hold exactly
+// their fields whatever else FIPE sends, and payloads lacking them fail
+// with a *PayloadError instead of reaching callers.
+func normalizerFor(path string) normalizer {
+	path, _, _ = strings.Cut(path, "?")
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	switch last := parts[len(parts)-1]; {
+	case path == "/references":
+		return func(d *json.Decoder, w *bufio.Writer) error {
+			return normalizeList(d, w, func(t ReferenceTable) bool { return t.Code != "" && t.Month != "" })
+		}
+	case len(parts) >= 2 && (last == "brands" || last == "models" || last == "years"):
+		return func(d *json.Decoder, w *bufio.Writer) error {
+			return normalizeList(d, w, func(r Reference) bool { return r.Code != "" && r.Name != "" })
+		}
+	case len(parts) >= 3 && parts[len(parts)-2] == "years":
+		return normalizePrice
+	}
+	return nil
+}
+
+// normalizeList rewrites a list of T, checking each item with valid.
+func normalizeList[T any](d *json.Decoder, w *bufio.Writer, valid func(T) bool) error {
+	if tok, err := d.Token(); err != nil {
+		return err
+	} else if tok != json.Delim('[') {
+		return errors.New("not a JSON list")
+	}
+	w.WriteByte('[')
+	for i := 0; d.More(); i++ {
+		var item T
+		if err := d.Decode(&item); err != nil {
+			return fmt.Errorf("item %d: %w", i, err)
+		}
+		if !valid(item) {
+			return fmt.Errorf("item %d: missing fields", i)
+		}
+		if i > 0 {
+			w.WriteByte(',')
+		}
+		b, _ := json.Marshal(item)
+		w.Write(b)
+	}
+	if _, err := d.Token(); err != nil {
+		return err
+	}
+	return w.WriteByte(']')
+}
+
+// normalizePrice rewrites a price.
+func normalizePrice(d *json.Decoder, w *bufio.Writer) error {
+	var p Price
+	if err := d.Decode(&p); err != nil {
+		return err
+	}
+	if p.CodeFipe == "" || p.ReferenceMonth == "" {
+		return errors.New("missing fields")
+	}
+	if _, err := p.Value(); err != nil {
+		return fmt.Errorf("price %q: %v", p.Price, err)
+	}
+	b, _ := json.Marshal(p)
+	_, err := w.Write(b)
+	return err
+}
+
+// normalizeBody returns body rewritten by n as it is read.
+func normalizeBody(path string, body io.ReadCloser, n normalizer) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		// Closed here rather than by the reader, which may stop early.
+		defer body.Close()
+		w := bufio.NewWriter(pw)
+		err := n(json.NewDecoder(body), w)
+		if err != nil {
+			err = &PayloadError{Path: path, Err: err}
+		} else {
+			err = w.Flush()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
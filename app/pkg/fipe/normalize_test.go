@@ -0,0 +1,86 @@
+package fipe
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestNormalizerFor(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{path: "/references", want: true},
+		{path: "/cars/brands", want: true},
+		{path: "/cars/brands?reference=308", want: true},
+		{path: "/cars/brands/21/models", want: true},
+		{path: "/cars/brands/21/models/4420/years", want: true},
+		{path: "/cars/brands/21/models/4420/years/2014-1", want: true},
+		{path: "/cars/001004-9/years/2014-1", want: true},
+		{path: "/brands", want: false},
+		{path: "/status", want: false},
+	}
+	for _, tt := range tests {
+		if got := normalizerFor(tt.path) != nil; got != tt.want {
+			t.Errorf("normalizerFor(%q) != nil = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeBody(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "list drops unknown fields",
+			path: "/cars/brands",
+			in:   `[{"code":"21","name":"Fiat","extra":true},{"code":"59","name":"VW"}]`,
+			want: `[{"code":"21","name":"Fiat"},{"code":"59","name":"VW"}]`,
+		},
+		{
+			name: "empty list",
+			path: "/cars/brands",
+			in:   `[]`,
+			want: `[]`,
+		},
+		{
+			name: "references",
+			path: "/references",
+			in:   `[{"code":"308","month":"janeiro de 2024 ","extra":1}]`,
+			want: `[{"code":"308","month":"janeiro de 2024 "}]`,
+		},
+		{
+			name: "price",
+			path: "/cars/brands/21/models/4420/years/2014-1",
+			in:   `{"price":"R$ 45.123,00","brand":"Fiat","model":"Uno","modelYear":2014,"fuel":"Flex","codeFipe":"001004-9","referenceMonth":"janeiro de 2024","vehicleType":1,"acronymFuel":"F","extra":"x"}`,
+			want: `{"price":"R$ 45.123,00","brand":"Fiat","model":"Uno","modelYear":2014,"fuel":"Flex","codeFipe":"001004-9","referenceMonth":"janeiro de 2024","vehicleType":1,"acronymFuel":"F"}`,
+		},
+		{name: "list is an object", path: "/cars/brands", in: `{}`, wantErr: true},
+		{name: "item without name", path: "/cars/brands", in: `[{"code":"21"}]`, wantErr: true},
+		{name: "table without month", path: "/references", in: `[{"code":"308"}]`, wantErr: true},
+		{name: "price without code", path: "/cars/001004-9/years/2014-1", in: `{"price":"R$ 1,00","referenceMonth":"x"}`, wantErr: true},
+		{name: "price not a number", path: "/cars/001004-9/years/2014-1", in: `{"price":"-","codeFipe":"001004-9","referenceMonth":"x"}`, wantErr: true},
+		{name: "truncated", path: "/cars/brands", in: `[{"code":"21","name":"Fiat"}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := normalizeBody(tt.path, io.NopCloser(strings.NewReader(tt.in)), normalizerFor(tt.path))
+			got, err := io.ReadAll(body)
+			body.Close()
+			if tt.wantErr {
+				if _, ok := err.(*PayloadError); !ok {
+					t.Errorf("err = %v, want a *PayloadError", err)
+				}
+				return
+			}
+			if err != nil || string(got) != tt.want {
+				t.Errorf("got %s, %v, want %s", got, err, tt.want)
+			}
+		})
+	}
+}
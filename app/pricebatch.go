@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gofipe/pkg/fipe"
+)
+
+// --- Batch price lookup ---
+//
+// POST /api/prices/batch prices many vehicles in one round trip, for fleet
+// and other programmatic consumers. A batch costs up to
+// maxPriceBatchItems FIPE lookups, so it needs one of the GOFIPE_API_KEYS
+// and is not registered without them:
+//
+//	[{"type": "cars", "brandId": "59", "modelId": "5940", "yearId": "2014-3"},
+//	 {"type": "cars", "brandId": "21", "modelId": "4828", "yearId": "2019-1", "reference": "301"}]
+//
+// Results come back in request order, each with the /api/price fields or an
+// error and its HTTP-like status, so one bad row does not fail the batch.
+// Up to GOFIPE_PRICE_BATCH_CONCURRENCY rows (default 8) are looked up at
+// once, and their FIPE requests are scheduled as background work so
+// interactive lookups go first. Rows with a reference are cached for
+// HistoryTTL, like price histories. The locale query parameter applies to
+// every row.
+
+const (
+	defaultPriceBatchConcurrency = 8
+	maxPriceBatchItems           = 200
+)
+
+// priceBatchItemsCounter counts batch rows by result.
+var priceBatchItemsCounter = newBudgetedCounterVec(
+	prometheus.CounterOpts{
+		Name: "fipe_price_batch_items_total",
+		Help: "Rows of /api/prices/batch by result (ok, invalid, not_found, error)",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	registerBudgeted(priceBatchItemsCounter)
+}
+
+// PriceBatchItem selects one vehicle of a batch.
+type PriceBatchItem struct {
+	Type      string `json:"type"`
+	BrandID   string `json:"brandId"`
+	ModelID   string `json:"modelId"`
+	YearID    string `json:"yearId"`
+	Reference string `json:"reference,omitempty"`
+}
+
+// PriceBatchResult is the answer for one batch row: a price or an error.
+type PriceBatchResult struct {
+	Price  map[string]interface{} `json:"price,omitempty"`
+	Error  string                 `json:"error,omitempty"`
+	Status int                    `json:"status"`
+}
+
+// validate reports what is wrong with the selector, if anything.
+func (it PriceBatchItem) validate() error {
+	if _, ok := vehicleTypes[it.Type]; !ok {
+		return errors.New("type must be cars, motorcycles or trucks")
+	}
+	if it.BrandID == "" || it.ModelID == "" || it.YearID == "" {
+		return errors.New("brandId, modelId and yearId are required")
+	}
+	for i := 0; i < len(it.Reference); i++ {
+		if it.Reference[i] < '0' || it.Reference[i] > '9' {
+			return errors.New("reference must be a table code from /api/references")
+		}
+	}
+	return nil
+}
+
+// priceBatcher serves POST /api/prices/batch.
+type priceBatcher struct {
+	concurrency int
+}
+
+// newPriceBatcher reads GOFIPE_PRICE_BATCH_CONCURRENCY.
+func newPriceBatcher() (*priceBatcher, error) {
+	n := defaultPriceBatchConcurrency
+	if v := os.Getenv("GOFIPE_PRICE_BATCH_CONCURRENCY"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n <= 0 {
+			return nil, fmt.Errorf("GOFIPE_PRICE_BATCH_CONCURRENCY must be a positive integer")
+		}
+	}
+	return &priceBatcher{concurrency: n}, nil
+}
+
+// ServeHTTP implements http.Handler.
+func (b *priceBatcher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	recordHTTPRequest("/api/prices/batch", r.Method)
+	loc, err := lookupLocale(r.URL.Query().Get("locale"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var items []PriceBatchItem
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 256<<10)).Decode(&items); err != nil {
+		http.Error(w, "body must be a JSON array of vehicles", http.StatusBadRequest)
+		return
+	}
+	if len(items) == 0 || len(items) > maxPriceBatchItems {
+		http.Error(w, fmt.Sprintf("batch must have between 1 and %d vehicles", maxPriceBatchItems), http.StatusBadRequest)
+		return
+	}
+
+	ctx := withUpstreamPriority(r.Context(), upstreamBackground)
+	results := make([]PriceBatchResult, len(items))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, b.concurrency)
+	for i, it := range items {
+		if err := it.validate(); err != nil {
+			results[i] = PriceBatchResult{Error: err.Error(), Status: http.StatusBadRequest}
+			priceBatchItemsCounter.Inc("invalid")
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			pr, err := clientAt(it.Reference).Price(ctx, it.Type, it.BrandID, it.ModelID, it.YearID)
+			var se *fipe.StatusError
+			switch {
+			case errors.As(err, &se) && se.StatusCode == http.StatusNotFound:
+				results[i] = PriceBatchResult{Error: "vehicle not found", Status: http.StatusNotFound}
+				priceBatchItemsCounter.Inc("not_found")
+			case err != nil:
+				results[i] = PriceBatchResult{Error: err.Error(), Status: upstreamErrorStatus(err)}
+				priceBatchItemsCounter.Inc("error")
+			default:
+				results[i] = PriceBatchResult{Price: localizedPrice(pr, loc), Status: http.StatusOK}
+				priceBatchItemsCounter.Inc("ok")
+			}
+		}()
+	}
+	wg.Wait()
+
+	out, _ := json.Marshal(map[string]interface{}{"results": results})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// --- Price projection ---
+//
+// GET /api/priceProjection projects a vehicle's value for the next months
+// by extending its past FIPE trend, for budgeting tools:
+//
+//	/api/priceProjection?type=cars&brandId=59&modelId=5940&yearId=2014-1&months=12&basis=12
+//
+// The monthly rate is the compound rate between the oldest and the newest
+// price of the last basis tables (see /api/priceHistory, default 12), and
+// each projected month applies it once more to the current price. It is a
+// deliberately simple extrapolation, labeled as such in the response, not a
+// market forecast.
+
+const (
+	defaultProjectionMonths = 12
+	maxProjectionMonths     = 36
+	projectionMethod        = "compound monthly rate of the FIPE price history"
+	projectionNote          = "Simple extrapolation of the past FIPE price trend, not a forecast. Real prices depend on the market and the vehicle's condition."
+)
+
+// ProjectedValue is one month of a projection.
+type ProjectedValue struct {
+	MonthsAhead    int     `json:"monthsAhead"`
+	Month          string  `json:"month"`
+	Value          float64 `json:"value"`
+	ValueFormatted string  `json:"valueFormatted"`
+}
+
+// handlePriceProjection serves GET /api/priceProjection.
+func handlePriceProjection(w http.ResponseWriter, r *http.Request) {
+	recordHTTPRequest("/api/priceProjection", r.Method)
+	q := r.URL.Query()
+	vehicleType, brandId, modelId, yearId := q.Get("type"), q.Get("brandId"), q.Get("modelId"), q.Get("yearId")
+	if err := (watchedVehicle{vehicleType, brandId, modelId, yearId}).validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	months, err := strconv.Atoi(q.Get("months"))
+	if err != nil || months <= 0 {
+		months = defaultProjectionMonths
+	}
+	months = min(months, maxProjectionMonths)
+	basis, err := strconv.Atoi(q.Get("basis"))
+	if err != nil || basis < 2 {
+		basis = defaultHistoryMonths
+	}
+	basis = min(basis, maxHistoryMonths)
+	loc, err := lookupLocale(q.Get("locale"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	history, err := priceHistory(r.Context(), vehicleType, brandId, modelId, yearId, basis, false)
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	if len(history) < 2 {
+		http.Error(w, "not enough price history to project", http.StatusUnprocessableEntity)
+		return
+	}
+	newest, oldest := history[0], history[len(history)-1]
+	to, err1 := newest.Value()
+	from, err2 := oldest.Value()
+	if err1 != nil || err2 != nil || from <= 0 || to <= 0 {
+		http.Error(w, "unparsable FIPE prices", http.StatusBadGateway)
+		return
+	}
+
+	// Elapsed months come from the reference months when FIPE names them,
+	// since tables in which the vehicle is missing are skipped.
+	elapsed := len(history) - 1
+	month, year, okTo := parseReferenceMonth(newest.ReferenceMonth)
+	fromMonth, fromYear, okFrom := parseReferenceMonth(oldest.ReferenceMonth)
+	if okTo && okFrom {
+		if n := (year*12 + int(month)) - (fromYear*12 + int(fromMonth)); n > 0 {
+			elapsed = n
+		}
+	}
+	rate := math.Pow(to/from, 1/float64(elapsed)) - 1
+
+	projection := make([]ProjectedValue, months)
+	for k := 1; k <= months; k++ {
+		v := math.Round(to*math.Pow(1+rate, float64(k))*100) / 100
+		p := ProjectedValue{MonthsAhead: k, Value: v, ValueFormatted: loc.FormatBRL(v)}
+		if okTo {
+			t := time.Date(year, month+time.Month(k), 1, 0, 0, 0, 0, time.UTC)
+			p.Month = loc.FormatMonth(t.Month(), t.Year())
+		}
+		projection[k-1] = p
+	}
+
+	b, _ := json.Marshal(map[string]interface{}{
+		"method": projectionMethod,
+		"note":   projectionNote,
+		"basis": map[string]interface{}{
+			"fromReferenceMonth": oldest.ReferenceMonth,
+			"toReferenceMonth":   newest.ReferenceMonth,
+			"months":             elapsed,
+			"fromPrice":          from,
+			"toPrice":            to,
+		},
+		"monthlyRatePercent": math.Round(rate*1e6) / 1e4,
+		"current":            localizedPrice(newest, loc),
+		"projection":         projection,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// --- Progressive Web App support ---
+
+// maxCachedVehicles bounds how many recently viewed vehicles the service worker keeps offline.
+const maxCachedVehicles = 20
+
+// webManifest is served at /manifest.json so browsers can install the site.
+var webManifest = map[string]interface{}{
+	"name":             "Go FIPE Search",
+	"short_name":       "gofipe",
+	"description":      "Search the Brazilian FIPE vehicle price table.",
+	"start_url":        "/",
+	"scope":            "/",
+	"display":          "standalone",
+	"background_color": "#0b1220",
+	"theme_color":      "#2563eb",
+	"icons": []map[string]string{
+		{"src": "/static/img/icon.svg", "sizes": "any", "type": "image/svg+xml", "purpose": "any maskable"},
+	},
+}
+
+// serviceWorkerJS caches static assets cache-first, and keeps the last viewed
+// vehicle pages and prices network-first so they remain available offline.
+// __VERSION__ and __MAX_VEHICLES__ are replaced when the script is served.
+const serviceWorkerJS = `// Generated by gofipe. Do not edit.
+const VERSION = '__VERSION__';
+const STATIC_CACHE = 'gofipe-static-' + VERSION;
+const VEHICLE_CACHE = 'gofipe-vehicles';
+const MAX_VEHICLES = __MAX_VEHICLES__;
+const PRECACHE = ['/', '/static/css/style.css', '/static/js/app.js', '/static/img/icon.svg'];
+
+self.addEventListener('install', event => {
+  event.waitUntil(caches.open(STATIC_CACHE).then(c => c.addAll(PRECACHE)).then(() => self.skipWaiting()));
+});
+
+self.addEventListener('activate', event => {
+  event.waitUntil(caches.keys().then(keys => Promise.all(
+    keys.filter(k => k.startsWith('gofipe-static-') && k !== STATIC_CACHE).map(k => caches.delete(k))
+  )).then(() => self.clients.claim()));
+});
+
+async function trimCache(name, max) {
+  const cache = await caches.open(name);
+  const keys = await cache.keys();
+  for (let i = 0; i < keys.length - max; i++) await cache.delete(keys[i]);
+}
+
+async function networkFirst(request, cacheName) {
+  const cache = await caches.open(cacheName);
+  try {
+    const response = await fetch(request);
+    if (response.ok) {
+      await cache.delete(request);
+      await cache.put(request, response.clone());
+      trimCache(cacheName, MAX_VEHICLES);
+    }
+    return response;
+  } catch (err) {
+    const cached = await cache.match(request);
+    if (cached) return cached;
+    throw err;
+  }
+}
+
+async function cacheFirst(request) {
+  const cached = await caches.match(request);
+  if (cached) return cached;
+  const response = await fetch(request);
+  if (response.ok) (await caches.open(STATIC_CACHE)).put(request, response.clone());
+  return response;
+}
+
+self.addEventListener('fetch', event => {
+  const url = new URL(event.request.url);
+  if (event.request.method !== 'GET' || url.origin !== self.location.origin) return;
+  if (url.pathname.startsWith('/static/')) {
+    event.respondWith(cacheFirst(event.request));
+  } else if (url.pathname.startsWith('/vehicle/') || url.pathname === '/api/price') {
+    event.respondWith(networkFirst(event.request, VEHICLE_CACHE));
+  } else if (url.pathname === '/') {
+    event.respondWith(networkFirst(event.request, STATIC_CACHE));
+  }
+});
+`
+
+// handleManifest serves the web app manifest.
+func handleManifest(w http.ResponseWriter, r *http.Request) {
+	recordHTTPRequest("/manifest.json", r.Method)
+	b, _ := json.Marshal(webManifest)
+	w.Header().Set("Content-Type", "application/manifest+json")
+	w.Write(b)
+}
+
+// serviceWorkerHandler serves the service worker from the site root so its
+// scope covers every page. version changes whenever static assets change,
+// which makes browsers drop the outdated static cache.
+func serviceWorkerHandler(version string) http.HandlerFunc {
+	script := strings.NewReplacer(
+		"__VERSION__", version,
+		"__MAX_VEHICLES__", strconv.Itoa(maxCachedVehicles),
+	).Replace(serviceWorkerJS)
+	return func(w http.ResponseWriter, r *http.Request) {
+		recordHTTPRequest("/sw.js", r.Method)
+		w.Header().Set("Content-Type", "application/javascript")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write([]byte(script))
+	}
+}
+
+// staticAssetsVersion hashes the files under dir into a short version string.
+func staticAssetsVersion(dir string) string {
+	h := sha256.New()
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		h.Write([]byte(path))
+		h.Write(b)
+		return nil
+	})
+	if err != nil {
+		slog.Error("hash static assets failed", "error", err)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:12]
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// --- Data quality reports ---
+//
+// Every history collector run ends with a data quality report: the share of
+// the watched vehicles' snapshots in the last maxHistoryMonths tables held
+// by the store (coverage), the lookups that failed, by brand, the FIPE
+// payloads and prices that could not be parsed, and the prices newly flagged
+// as suspect. The newest maxQualityReports are stored with the history and
+// listed, newest first, by GET /admin/quality (limit, default 20; status=ok
+// or failed).
+//
+// GOFIPE_QUALITY_THRESHOLDS fails the runs that breach any of its limits,
+// e.g. "minCoverage=95,maxFailures=10,maxParseErrors=0,maxAnomalies=5". The
+// report then lists the violations, the run is logged as failed and, with
+// GOFIPE_QUALITY_ALERT_URL set, the report is POSTed there as a
+// quality_failed event. Runs that could not finish fail too.
+// fipe_quality_runs_total and fipe_quality_coverage_percent export each run
+// for alerting rules.
+
+const maxQualityReports = 1000
+
+var (
+	// qualityRunsCounter counts collector runs by quality status.
+	qualityRunsCounter = newBudgetedCounterVec(
+		prometheus.CounterOpts{
+			Name: "fipe_quality_runs_total",
+			Help: "History collector runs by data quality status (ok, failed)",
+		},
+		[]string{"status"},
+	)
+
+	// qualityCoverageGauge is the coverage of the last collector run.
+	qualityCoverageGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "fipe_quality_coverage_percent",
+		Help: "Share of the watched vehicles' snapshots held by the store after the last history collector run",
+	})
+)
+
+func init() {
+	registerBudgeted(qualityRunsCounter)
+	prometheus.MustRegister(qualityCoverageGauge)
+}
+
+// qualityThresholds are the GOFIPE_QUALITY_THRESHOLDS limits; nil ones are
+// not checked.
+type qualityThresholds struct {
+	MinCoverage    *float64
+	MaxFailures    *float64
+	MaxParseErrors *float64
+	MaxAnomalies   *float64
+}
+
+var (
+	// qualityLimits are the GOFIPE_QUALITY_THRESHOLDS limits.
+	qualityLimits = mustLoadQualityThresholds()
+	// qualityAlertURL receives the failed reports, if set.
+	qualityAlertURL = mustLoadQualityAlertURL()
+)
+
+// mustLoadQualityThresholds reads GOFIPE_QUALITY_THRESHOLDS.
+func mustLoadQualityThresholds() qualityThresholds {
+	t, err := parseQualityThresholds(os.Getenv("GOFIPE_QUALITY_THRESHOLDS"))
+	if err != nil {
+		log.Fatalf("Invalid GOFIPE_QUALITY_THRESHOLDS: %v", err)
+	}
+	return t
+}
+
+// mustLoadQualityAlertURL reads GOFIPE_QUALITY_ALERT_URL.
+func mustLoadQualityAlertURL() string {
+	u := os.Getenv("GOFIPE_QUALITY_ALERT_URL")
+	if u == "" {
+		return ""
+	}
+	if p, err := url.Parse(u); err != nil || (p.Scheme != "http" && p.Scheme != "https") || p.Host == "" {
+		log.Fatalf("Invalid GOFIPE_QUALITY_ALERT_URL: %q is not an absolute http(s) URL", u)
+	}
+	return u
+}
+
+// parseQualityThresholds parses "name=value" limits separated by commas.
+func parseQualityThresholds(s string) (qualityThresholds, error) {
+	var t qualityThresholds
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(entry, "=")
+		f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || f < 0 {
+			return t, fmt.Errorf("%q: expected name=number", entry)
+		}
+		switch strings.TrimSpace(name) {
+		case "minCoverage":
+			t.MinCoverage = &f
+		case "maxFailures":
+			t.MaxFailures = &f
+		case "maxParseErrors":
+			t.MaxParseErrors = &f
+		case "maxAnomalies":
+			t.MaxAnomalies = &f
+		default:
+			return t, fmt.Errorf("%q: unknown threshold, expected minCoverage, maxFailures, maxParseErrors or maxAnomalies", name)
+		}
+	}
+	return t, nil
+}
+
+// QualityReport describes a history collector run.
+type QualityReport struct {
+	StartedAt         time.Time      `json:"startedAt"`
+	FinishedAt        time.Time      `json:"finishedAt"`
+	Status            string         `json:"status"` // ok or failed
+	Vehicles          int            `json:"vehicles"`
+	Tables            int            `json:"tables"`
+	ExpectedSnapshots int            `json:"expectedSnapshots"`
+	StoredSnapshots   int            `json:"storedSnapshots"` // including confirmed absences
+	CoveragePercent   float64        `json:"coveragePercent"`
+	Fetched           int            `json:"fetched"`
+	Failures          int            `json:"failures"`
+	FailuresByBrand   map[string]int `json:"failuresByBrand"` // by type/brandId
+	ParseErrors       int            `json:"parseErrors"`
+	Anomalies         int            `json:"anomalies"` // newly flagged
+	Violations        []string       `json:"violations,omitempty"`
+	Error             string         `json:"error,omitempty"`
+}
+
+// newQualityReport starts the report of a run.
+func newQualityReport() *QualityReport {
+	return &QualityReport{StartedAt: appClock.Now().UTC().Truncate(time.Second), FailuresByBrand: map[string]int{}}
+}
+
+// The counting methods do nothing on a nil report, for the collector runs
+// that are not reported.
+
+// fail counts a failed lookup of v.
+func (q *QualityReport) fail(v watchedVehicle) {
+	if q == nil {
+		return
+	}
+	q.Failures++
+	q.FailuresByBrand[v.Type+"/"+v.BrandID]++
+}
+
+// fetched counts a snapshot fetched from FIPE, unparseable unless ok.
+func (q *QualityReport) fetched(ok bool) {
+	if q == nil {
+		return
+	}
+	q.Fetched++
+	if !ok {
+		q.ParseErrors++
+	}
+}
+
+// parseError counts a FIPE payload that could not be decoded.
+func (q *QualityReport) parseError() {
+	if q != nil {
+		q.ParseErrors++
+	}
+}
+
+// flagged counts newly suspect prices.
+func (q *QualityReport) flagged(n int) {
+	if q != nil {
+		q.Anomalies += n
+	}
+}
+
+// cover counts the snapshots of a vehicle held out of tables.
+func (q *QualityReport) cover(tables, stored int) {
+	if q == nil {
+		return
+	}
+	q.Vehicles++
+	q.ExpectedSnapshots += tables
+	q.StoredSnapshots += stored
+}
+
+// check fills in the coverage, status and violations of a run that ended
+// with runErr.
+func (q *QualityReport) check(t qualityThresholds, runErr error) {
+	q.FinishedAt = appClock.Now().UTC().Truncate(time.Second)
+	q.CoveragePercent = 100
+	if q.ExpectedSnapshots > 0 {
+		q.CoveragePercent = math.Floor(float64(q.StoredSnapshots)/float64(q.ExpectedSnapshots)*1e4) / 100
+	}
+	if runErr != nil {
+		q.Error = runErr.Error()
+	}
+	if t.MinCoverage != nil && q.CoveragePercent < *t.MinCoverage {
+		q.Violations = append(q.Violations, fmt.Sprintf("coverage %.2f%% is below %g%%", q.CoveragePercent, *t.MinCoverage))
+	}
+	for _, c := range []struct {
+		name  string
+		value int
+		limit *float64
+	}{
+		{"failures", q.Failures, t.MaxFailures},
+		{"parse errors", q.ParseErrors, t.MaxParseErrors},
+		{"anomalies", q.Anomalies, t.MaxAnomalies},
+	} {
+		if c.limit != nil && float64(c.value) > *c.limit {
+			q.Violations = append(q.Violations, fmt.Sprintf("%d %s exceed %g", c.value, c.name, *c.limit))
+		}
+	}
+	q.Status = "ok"
+	if q.Error != "" || len(q.Violations) > 0 {
+		q.Status = "failed"
+	}
+}
+
+// finishQualityReport checks, stores and exports the report of a run that
+// ended with runErr, and alerts when it failed. It returns runErr, or an
+// error naming the violations.
+func (s *historyStore) finishQualityReport(ctx context.Context, q *QualityReport, runErr error) error {
+	q.check(qualityLimits, runErr)
+	qualityRunsCounter.Inc(q.Status)
+	if runErr == nil {
+		qualityCoverageGauge.Set(q.CoveragePercent)
+	}
+	if err := s.saveQualityReport(ctx, q); err != nil {
+		slog.ErrorContext(ctx, "quality reports query failed", "error", err)
+	}
+	if q.Status == "failed" && qualityAlertURL != "" {
+		go func() {
+			body, _ := json.Marshal(map[string]interface{}{"event": "quality_failed", "report": q})
+			if err := postWebhook(alertClient, qualityAlertURL, body, ""); err != nil {
+				slog.ErrorContext(ctx, "quality alert delivery failed", "url", qualityAlertURL, "attempts", alertDeliveryAttempts, "error", err)
+			}
+		}()
+	}
+	if runErr == nil && len(q.Violations) > 0 {
+		return fmt.Errorf("data quality thresholds breached: %s", strings.Join(q.Violations, "; "))
+	}
+	return runErr
+}
+
+// saveQualityReport stores q, dropping the reports past maxQualityReports.
+func (s *historyStore) saveQualityReport(ctx context.Context, q *QualityReport) error {
+	b, _ := json.Marshal(q)
+	if _, err := s.db.ExecContext(ctx, s.rebind(`INSERT INTO quality_reports (started_at, status, report)
+		VALUES (?, ?, ?)`), q.StartedAt.Unix(), q.Status, string(b)); err != nil {
+		return err
+	}
+	_, err := s.db.ExecContext(ctx, s.rebind(`DELETE FROM quality_reports WHERE started_at NOT IN
+		(SELECT started_at FROM quality_reports ORDER BY started_at DESC LIMIT ?)`), maxQualityReports)
+	return err
+}
+
+// qualityReports lists up to limit reports, newest first, only those with
+// status unless it is empty.
+func (s *historyStore) qualityReports(ctx context.Context, status string, limit int) ([]json.RawMessage, error) {
+	query, args := `SELECT report FROM quality_reports`, []interface{}{}
+	if status != "" {
+		query, args = query+` WHERE status = ?`, append(args, status)
+	}
+	rows, err := s.db.QueryContext(ctx, s.rebind(query+` ORDER BY started_at DESC LIMIT ?`), append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []json.RawMessage{}
+	for rows.Next() {
+		var report string
+		if err := rows.Scan(&report); err != nil {
+			return nil, err
+		}
+		out = append(out, json.RawMessage(report))
+	}
+	return out, rows.Err()
+}
+
+// handleQuality serves GET /admin/quality.
+func handleQuality(w http.ResponseWriter, r *http.Request) {
+	recordHTTPRequest("/admin/quality", r.Method)
+	q := r.URL.Query()
+	status := q.Get("status")
+	if status != "" && status != "ok" && status != "failed" {
+		http.Error(w, "status must be ok or failed", http.StatusBadRequest)
+		return
+	}
+	limit, err := strconv.Atoi(q.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 20
+	}
+	limit = min(limit, maxQualityReports)
+	reports, err := historyDB.qualityReports(r.Context(), status, limit)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "quality reports query failed", "error", err)
+		http.Error(w, "quality reports unavailable", http.StatusInternalServerError)
+		return
+	}
+	b, _ := json.Marshal(map[string]interface{}{"reports": reports})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/go-pdf/fpdf"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// --- PDF report ---
+//
+// GET /api/report?type=&brandId=&modelId=&yearId=&format=pdf renders a
+// one-page A4 PDF to attach to sales proposals: the vehicle details and
+// current price, a sparkline and a table of the last 12 months of prices
+// with the change from the month before, and a QR code linking to the
+// vehicle page. It gathers the same data as the detail and print pages,
+// so a failing history only leaves its sections out. pdf is the only
+// format, and the default. Reports count against the Excel export rate
+// limit.
+
+// handleReport serves GET /api/report.
+func handleReport(w http.ResponseWriter, r *http.Request) {
+	recordHTTPRequest("/api/report", r.Method)
+	q := r.URL.Query()
+	if format := q.Get("format"); format != "" && format != "pdf" {
+		http.Error(w, "format must be pdf", http.StatusBadRequest)
+		return
+	}
+	vehicleType := q.Get("type")
+	if _, ok := vehicleTypes[vehicleType]; !ok {
+		http.Error(w, "type must be cars, motorcycles or trucks", http.StatusBadRequest)
+		return
+	}
+	brandId, modelId, yearId := q.Get("brandId"), q.Get("modelId"), q.Get("yearId")
+	if brandId == "" || modelId == "" || yearId == "" {
+		http.Error(w, "brandId, modelId and yearId are required", http.StatusBadRequest)
+		return
+	}
+
+	page, err := loadVehiclePage(r.Context(), vehicleType, brandId, modelId, yearId)
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	var buf bytes.Buffer
+	if err := writeVehicleReport(&buf, page, absoluteURL(vehiclePath(vehicleType, brandId, modelId, yearId))); err != nil {
+		slog.ErrorContext(r.Context(), "render vehicle report failed", "error", err)
+		http.Error(w, "report failed", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": "fipe-report-" + page.Price.CodeFipe + "-" + yearId + ".pdf"}))
+	w.Write(buf.Bytes())
+}
+
+// writeVehicleReport writes the PDF report of page, whose QR code links to
+// pageURL.
+func writeVehicleReport(buf *bytes.Buffer, page *VehiclePage, pageURL string) error {
+	pdf := fpdf.New("P", "mm", "A4", "")
+	// The core fonts are in cp1252, which covers Portuguese.
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	pr := page.Price
+	title := fmt.Sprintf("%s %s (%d)", pr.Brand, pr.Model, pr.ModelYear)
+	pdf.SetTitle(title, true)
+	pdf.SetCreator("gofipe "+appVersion, true)
+	pdf.SetAutoPageBreak(false, 0)
+	pdf.AddPage()
+
+	pdf.SetFont("Helvetica", "", 10)
+	pdf.SetTextColor(100, 100, 100)
+	pdf.CellFormat(0, 6, tr("FIPE valuation report"), "", 1, "L", false, 0, "")
+	pdf.SetTextColor(0, 0, 0)
+	pdf.SetFont("Helvetica", "B", 18)
+	pdf.MultiCell(150, 8, tr(title), "", "L", false)
+	pdf.SetFont("Helvetica", "", 10)
+	pdf.CellFormat(0, 6, tr(fmt.Sprintf("%s · %s · FIPE code %s", page.TypeName, pr.Fuel, pr.CodeFipe)), "", 1, "L", false, 0, "")
+	pdf.Ln(4)
+	pdf.SetFont("Helvetica", "B", 24)
+	pdf.CellFormat(0, 11, tr(pr.Price), "", 1, "L", false, 0, "")
+	pdf.SetFont("Helvetica", "", 10)
+	pdf.CellFormat(0, 6, tr("Reference month: "+pr.ReferenceMonth), "", 1, "L", false, 0, "")
+
+	if png, err := qrcode.Encode(pageURL, qrcode.Medium, 160); err == nil {
+		pdf.RegisterImageOptionsReader("qr", fpdf.ImageOptions{ImageType: "PNG"}, bytes.NewReader(png))
+		pdf.ImageOptions("qr", 165, 12, 30, 30, false, fpdf.ImageOptions{ImageType: "PNG"}, 0, pageURL)
+	} else {
+		slog.Error("vehicle report qr code failed", "error", err)
+	}
+
+	if values := page.History.Values; len(values) > 1 {
+		pdf.Ln(6)
+		pdf.SetFont("Helvetica", "B", 11)
+		pdf.CellFormat(0, 7, tr(fmt.Sprintf("Last %d months", len(values))), "", 1, "L", false, 0, "")
+		drawSparkline(pdf, 10, pdf.GetY()+1, 180, 30, values)
+		pdf.SetY(pdf.GetY() + 34)
+		pdf.SetFont("Helvetica", "", 8)
+		pdf.SetTextColor(100, 100, 100)
+		pdf.CellFormat(90, 4, tr(page.History.Labels[0]), "", 0, "L", false, 0, "")
+		pdf.CellFormat(90, 4, tr(page.History.Labels[len(values)-1]), "", 1, "R", false, 0, "")
+		pdf.SetTextColor(0, 0, 0)
+	}
+
+	if len(page.History.Values) > 0 {
+		pdf.Ln(6)
+		pdf.SetFont("Helvetica", "B", 10)
+		pdf.SetFillColor(235, 240, 250)
+		pdf.CellFormat(70, 7, tr("Reference month"), "B", 0, "L", true, 0, "")
+		pdf.CellFormat(60, 7, tr("Price"), "B", 0, "R", true, 0, "")
+		pdf.CellFormat(50, 7, tr("Change"), "B", 1, "R", true, 0, "")
+		pdf.SetFont("Helvetica", "", 10)
+		// Newest first, like the FIPE history.
+		values, labels := page.History.Values, page.History.Labels
+		for i := len(values) - 1; i >= 0; i-- {
+			change := ""
+			if i > 0 && values[i-1] != 0 {
+				// Decimal comma, as in the pt-BR prices.
+				change = strings.Replace(fmt.Sprintf("%+.1f%%", (values[i]/values[i-1]-1)*100), ".", ",", 1)
+			}
+			pdf.CellFormat(70, 6, tr(labels[i]), "", 0, "L", false, 0, "")
+			pdf.CellFormat(60, 6, tr(formatBRL(values[i])), "", 0, "R", false, 0, "")
+			pdf.CellFormat(50, 6, change, "", 1, "R", false, 0, "")
+		}
+	}
+
+	pdf.SetY(-22)
+	pdf.SetFont("Helvetica", "", 8)
+	pdf.SetTextColor(100, 100, 100)
+	pdf.CellFormat(0, 4, tr("Generated "+formatLocalTime(fipeNow())+" by gofipe · data from fipe.org.br"), "", 1, "L", false, 0, "")
+	pdf.CellFormat(0, 4, pageURL, "", 1, "L", false, 0, pageURL)
+	return pdf.Output(buf)
+}
+
+// drawSparkline draws values, oldest first, as a line within the box at
+// x, y of width w and height h.
+func drawSparkline(pdf *fpdf.Fpdf, x, y, w, h float64, values []float64) {
+	lo, hi := values[0], values[0]
+	for _, v := range values {
+		lo, hi = min(lo, v), max(hi, v)
+	}
+	pdf.SetDrawColor(220, 220, 220)
+	pdf.SetLineWidth(0.2)
+	pdf.Rect(x, y, w, h, "D")
+	point := func(i int) (float64, float64) {
+		py := y + h/2
+		if hi > lo {
+			py = y + h - 2 - (values[i]-lo)/(hi-lo)*(h-4)
+		}
+		return x + float64(i)*w/float64(len(values)-1), py
+	}
+	pdf.SetDrawColor(37, 99, 235)
+	pdf.SetLineWidth(0.6)
+	for i := 1; i < len(values); i++ {
+		x0, y0 := point(i - 1)
+		x1, y1 := point(i)
+		pdf.Line(x0, y0, x1, y1)
+	}
+}
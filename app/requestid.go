@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// --- Request IDs ---
+//
+// Every request gets an ID: the incoming X-Request-ID when it is up to 128
+// visible ASCII characters, so a gateway's ID is kept, or a random one. It
+// is echoed in the X-Request-ID response header, logged as request_id by
+// the records made for the request, appended to plain-text error responses
+// and sent as X-Request-ID on the FIPE requests made for it, so a failed
+// lookup can be traced from the client through the logs to FIPE.
+
+const (
+	requestIDHeader    = "X-Request-ID"
+	maxRequestIDLength = 128
+)
+
+type requestIDKey struct{}
+
+// requestIDFrom returns the request ID carried by ctx, if any.
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// validRequestID reports whether an incoming ID is safe to log and echo.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random 128-bit ID in hex.
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestIDWriter appends the request ID to plain-text error bodies, as
+// written by http.Error, once the handler is done.
+type requestIDWriter struct {
+	http.ResponseWriter
+	id          string
+	wroteHeader bool
+	textError   bool
+}
+
+func (w *requestIDWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		h := w.Header()
+		w.textError = code >= 400 && strings.HasPrefix(h.Get("Content-Type"), "text/plain") &&
+			h.Get("Content-Encoding") == "" && h.Get("Content-Length") == ""
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *requestIDWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *requestIDWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// withRequestID assigns the request ID. It must wrap the request log.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		rw := &requestIDWriter{ResponseWriter: w, id: id}
+		next.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+		if rw.textError && r.Method != http.MethodHead {
+			fmt.Fprintf(w, "request id: %s\n", id)
+		}
+	})
+}
+
+// requestIDHandler adds the request ID and the trace ID, when traced, of
+// the context to log records.
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := requestIDFrom(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsSampled() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
+
+// requestIDTransport forwards the request ID to FIPE.
+type requestIDTransport struct {
+	next http.RoundTripper
+}
+
+func (t requestIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if id := requestIDFrom(req.Context()); id != "" {
+		req = req.Clone(req.Context())
+		req.Header.Set(requestIDHeader, id)
+	}
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+
+	"gofipe/pkg/fipe"
+)
+
+// --- Vehicle name resolution ---
+//
+// Resolves free-text descriptions such as "preço do Onix 2019" or
+// "moto honda cg 160 0km" to FIPE brand, model and year codes, using the
+// cached brand and model lists. Words naming a vehicle type pick the type
+// (cars by default), a four-digit year or "0km" picks the model year, brand
+// names narrow the search and the remaining words must all prefix words of
+// the model name. Without a brand, the models of every brand are searched,
+// or only the cached ones with CachedModelsOnly.
+
+const resolveConcurrency = 8
+
+var (
+	errVehicleNotFound = errors.New("vehicle not found")
+	errYearNotFound    = errors.New("year not available for this model")
+
+	queryYearPattern = regexp.MustCompile(`^(19|20)[0-9]{2}$`)
+
+	// accentReplacer folds the Portuguese accents found in queries and FIPE names.
+	accentReplacer = strings.NewReplacer(
+		"á", "a", "à", "a", "â", "a", "ã", "a", "é", "e", "ê", "e", "í", "i",
+		"ó", "o", "ô", "o", "õ", "o", "ú", "u", "ü", "u", "ç", "c",
+	)
+
+	// queryTypeWords maps words naming a vehicle type to the FIPE type.
+	queryTypeWords = map[string]string{
+		"carro": "cars", "carros": "cars", "car": "cars",
+		"moto": "motorcycles", "motos": "motorcycles", "motocicleta": "motorcycles", "motorcycle": "motorcycles",
+		"caminhao": "trucks", "caminhoes": "trucks", "truck": "trucks",
+	}
+
+	// queryStopWords are ignored when matching names.
+	queryStopWords = map[string]bool{
+		"preco": true, "precos": true, "price": true, "valor": true, "quanto": true, "custa": true,
+		"qual": true, "tabela": true, "fipe": true, "do": true, "da": true, "de": true, "o": true,
+		"a": true, "e": true, "um": true, "uma": true, "ano": true, "modelo": true, "of": true,
+		"the": true, "how": true, "much": true, "is": true, "what": true, "year": true,
+		"km": true,
+	}
+)
+
+// zeroKmYear is the FIPE model year code for brand new vehicles.
+const zeroKmYear = "32000"
+
+// vehicleQuery is a parsed free-text vehicle description.
+type vehicleQuery struct {
+	VehicleType string
+	Year        string
+	Terms       []string
+	// CachedModelsOnly searches, without a brand, only the brands whose
+	// models are cached, so the query costs no FIPE models requests.
+	CachedModelsOnly bool
+}
+
+// resolvedVehicle holds the FIPE codes and names a query resolved to.
+type resolvedVehicle struct {
+	VehicleType string
+	BrandID     string
+	BrandName   string
+	ModelID     string
+	ModelName   string
+	YearID      string
+	YearName    string
+}
+
+// normalizeTokens lowercases s, folds accents and splits it into words.
+// Dots are kept so engine sizes such as "1.0" stay one word.
+func normalizeTokens(s string) []string {
+	s = accentReplacer.Replace(strings.ToLower(s))
+	return strings.FieldsFunc(s, func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c) && c != '.'
+	})
+}
+
+// parseVehicleQuery extracts the vehicle type, year and name terms of text.
+func parseVehicleQuery(text string) vehicleQuery {
+	q := vehicleQuery{VehicleType: "cars"}
+	for _, t := range normalizeTokens(text) {
+		t = strings.Trim(t, ".")
+		switch {
+		case t == "":
+		case queryTypeWords[t] != "":
+			q.VehicleType = queryTypeWords[t]
+		case queryYearPattern.MatchString(t):
+			q.Year = t
+		case t == "0km" || t == "zero" || t == "0":
+			q.Year = zeroKmYear
+		case queryStopWords[t]:
+		default:
+			q.Terms = append(q.Terms, t)
+		}
+	}
+	return q
+}
+
+// brandMatches reports whether term names the brand, e.g. "vw" or "chevrolet"
+// for "GM - Chevrolet".
+func brandMatches(term string, brand fipe.Reference) bool {
+	return len(term) > 1 && slices.Contains(normalizeTokens(brand.Name), term)
+}
+
+// modelScore returns how well terms match a model name: -1 when a term
+// prefixes no word of the name, otherwise larger for shorter names.
+func modelScore(terms []string, model fipe.Reference) int {
+	words := normalizeTokens(model.Name)
+	for _, t := range terms {
+		if !slices.ContainsFunc(words, func(w string) bool { return strings.HasPrefix(w, t) }) {
+			return -1
+		}
+	}
+	return 1000 - len(words)
+}
+
+// resolveVehicle looks up the FIPE codes matching q.
+func resolveVehicle(ctx context.Context, q vehicleQuery) (resolvedVehicle, error) {
+	brands, err := fipeClient.Brands(ctx, q.VehicleType)
+	if err != nil {
+		return resolvedVehicle{}, err
+	}
+
+	// Brand words narrow the search; without them every brand is searched.
+	var candidates []fipe.Reference
+	var terms []string
+	for _, t := range q.Terms {
+		matched := false
+		for _, b := range brands {
+			if brandMatches(t, b) {
+				matched = true
+				if !slices.Contains(candidates, b) {
+					candidates = append(candidates, b)
+				}
+			}
+		}
+		if !matched {
+			terms = append(terms, t)
+		}
+	}
+	if len(terms) == 0 {
+		return resolvedVehicle{}, errVehicleNotFound
+	}
+	if len(candidates) == 0 {
+		candidates = brands
+		if q.CachedModelsOnly {
+			candidates = slices.DeleteFunc(slices.Clone(brands), func(b fipe.Reference) bool {
+				_, ok := getFromCache(fipeClient.ModelsSource(q.VehicleType, b.Code).Key)
+				return !ok
+			})
+		}
+	}
+
+	best, bestScore := resolvedVehicle{}, -1
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, resolveConcurrency)
+	for _, b := range candidates {
+		wg.Add(1)
+		go func(b fipe.Reference) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			models, err := fipeClient.Models(ctx, q.VehicleType, b.Code)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for _, m := range models {
+				score := modelScore(terms, m)
+				// Ties go to the lower brand code so results are stable.
+				if score > bestScore || score == bestScore && score >= 0 && b.Code < best.BrandID {
+					bestScore = score
+					best = resolvedVehicle{VehicleType: q.VehicleType, BrandID: b.Code, BrandName: b.Name, ModelID: m.Code, ModelName: m.Name}
+				}
+			}
+		}(b)
+	}
+	wg.Wait()
+	if bestScore < 0 {
+		return resolvedVehicle{}, errVehicleNotFound
+	}
+
+	years, err := fipeClient.Years(ctx, best.VehicleType, best.BrandID, best.ModelID)
+	if err != nil {
+		return resolvedVehicle{}, err
+	}
+	// FIPE lists years newest first; without a year take the newest used one.
+	for _, y := range years {
+		year, _, _ := strings.Cut(y.Code, "-")
+		if year == q.Year || q.Year == "" && year != zeroKmYear {
+			best.YearID, best.YearName = y.Code, y.Name
+			return best, nil
+		}
+	}
+	if q.Year == "" && len(years) > 0 {
+		best.YearID, best.YearName = years[0].Code, years[0].Name
+		return best, nil
+	}
+	return best, errYearNotFound
+}
+
+// lookupVehiclePrice resolves q and fetches the current FIPE price.
+// The resolved vehicle is returned with errYearNotFound so callers can name it.
+func lookupVehiclePrice(ctx context.Context, q vehicleQuery) (resolvedVehicle, fipe.Price, error) {
+	v, err := resolveVehicle(ctx, q)
+	if err != nil {
+		return v, fipe.Price{}, err
+	}
+	pr, err := fipeClient.Price(ctx, v.VehicleType, v.BrandID, v.ModelID, v.YearID)
+	return v, pr, err
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand/v2"
+	"os"
+	"time"
+	// Embeds the time zone database, which slim images lack.
+	_ "time/tzdata"
+)
+
+// --- Reference-cycle scheduling ---
+//
+// FIPE publishes a new reference table at the start of each month, Brazil
+// time. GOFIPE_TIMEZONE (default America/Sao_Paulo) is the time zone the
+// background jobs and date labels follow: the history collector and the
+// index job run on slots of their interval counted from local midnight
+// (every 6h means 00:00, 06:00, 12:00 and 18:00 there) instead of from
+// whenever the replica started, and always at local midnight on the first
+// of the month, when the new cycle begins. Intervals of a day or more run
+// at local midnight every whole number of days, rounded up. FIPE rarely
+// publishes right at midnight, so GOFIPE_CYCLE_OFFSET (default 0) moves the
+// run of the first of the month later, e.g. 6h for 06:00. Each replica also
+// waits a random delay of up to GOFIPE_SCHEDULE_JITTER (default 5m, 0 turns
+// it off), drawn once at startup, after every slot, so replicas do not all
+// call FIPE at the same instant. The reference age metric and the print
+// pages use the same zone.
+
+// fipeLocation is the time zone of the FIPE reference cycle.
+var fipeLocation = mustLoadFipeLocation()
+
+// mustLoadFipeLocation reads GOFIPE_TIMEZONE.
+func mustLoadFipeLocation() *time.Location {
+	name := os.Getenv("GOFIPE_TIMEZONE")
+	if name == "" {
+		name = "America/Sao_Paulo"
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		log.Fatalf("Invalid GOFIPE_TIMEZONE: %v", err)
+	}
+	return loc
+}
+
+// cycleOffset delays the run of the first of the month after midnight.
+var cycleOffset = mustLoadScheduleDuration("GOFIPE_CYCLE_OFFSET", 0, 27*24*time.Hour)
+
+// scheduleJitter is the delay of this replica after each slot.
+var scheduleJitter = func() time.Duration {
+	limit := mustLoadScheduleDuration("GOFIPE_SCHEDULE_JITTER", 5*time.Minute, 24*time.Hour)
+	if limit <= 0 {
+		return 0
+	}
+	return rand.N(limit)
+}()
+
+// mustLoadScheduleDuration reads the duration in the environment variable
+// name, def if unset, which must lie between 0 and limit.
+func mustLoadScheduleDuration(name string, def, limit time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+	if d < 0 || d > limit {
+		log.Fatalf("Invalid %s: must be between 0 and %s", name, limit)
+	}
+	return d
+}
+
+// fipeNow returns the current time in fipeLocation.
+func fipeNow() time.Time {
+	return appClock.Now().In(fipeLocation)
+}
+
+// nextScheduledRun returns the first run after now of a job repeating
+// every interval.
+func nextScheduledRun(now time.Time, interval time.Duration) time.Time {
+	now = now.In(fipeLocation)
+	y, m, d := now.Date()
+	midnight := time.Date(y, m, d, 0, 0, 0, 0, fipeLocation)
+	var next time.Time
+	if interval < 24*time.Hour {
+		next = midnight.Add((now.Sub(midnight)/interval + 1) * interval)
+		// The last slot of the day is cut short at the next midnight.
+		if tomorrow := time.Date(y, m, d+1, 0, 0, 0, 0, fipeLocation); next.After(tomorrow) {
+			next = tomorrow
+		}
+	} else {
+		days := int((interval + 24*time.Hour - 1) / (24 * time.Hour))
+		next = time.Date(y, m, d+days, 0, 0, 0, 0, fipeLocation)
+	}
+	// The first of the month, cycleOffset after midnight, starts a new
+	// reference cycle.
+	cycle := time.Date(y, m, 1, 0, 0, 0, 0, fipeLocation).Add(cycleOffset)
+	if !cycle.After(now) {
+		cycle = time.Date(y, m+1, 1, 0, 0, 0, 0, fipeLocation).Add(cycleOffset)
+	}
+	if next.After(cycle) {
+		next = cycle
+	}
+	return next
+}
+
+// sleepUntilNextRun waits for the next run of a job repeating every
+// interval, scheduleJitter after its slot, or until ctx is done.
+func sleepUntilNextRun(ctx context.Context, interval time.Duration) error {
+	now := appClock.Now()
+	// Slots are counted before the jitter, so a run that woke up late does
+	// not take the same slot again.
+	next := nextScheduledRun(now.Add(-scheduleJitter), interval).Add(scheduleJitter)
+	return appClock.Sleep(ctx, next.Sub(now))
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestNextScheduledRun(t *testing.T) {
+	at := func(month time.Month, day, hour, min int) time.Time {
+		return time.Date(2024, month, day, hour, min, 0, 0, fipeLocation)
+	}
+	tests := []struct {
+		name     string
+		now      time.Time
+		interval time.Duration
+		offset   time.Duration
+		want     time.Time
+	}{
+		{name: "next slot", now: at(3, 10, 7, 30), interval: 6 * time.Hour, want: at(3, 10, 12, 0)},
+		{name: "on a slot", now: at(3, 10, 12, 0), interval: 6 * time.Hour, want: at(3, 10, 18, 0)},
+		{name: "last slot of the day", now: at(3, 10, 19, 0), interval: 6 * time.Hour, want: at(3, 11, 0, 0)},
+		{name: "uneven slots cut at midnight", now: at(3, 10, 21, 0), interval: 5 * time.Hour, want: at(3, 11, 0, 0)},
+		{name: "uneven slot before midnight", now: at(3, 10, 19, 0), interval: 5 * time.Hour, want: at(3, 10, 20, 0)},
+		{name: "two days", now: at(3, 10, 7, 30), interval: 48 * time.Hour, want: at(3, 12, 0, 0)},
+		{name: "partial days round up", now: at(3, 10, 7, 30), interval: 30 * time.Hour, want: at(3, 12, 0, 0)},
+		{name: "days cut at the month start", now: at(3, 28, 7, 30), interval: 7 * 24 * time.Hour, want: at(4, 1, 0, 0)},
+		{name: "offset delays the month start", now: at(3, 28, 7, 30), interval: 7 * 24 * time.Hour, offset: 6 * time.Hour, want: at(4, 1, 6, 0)},
+		{name: "slots run before the offset", now: at(3, 31, 23, 0), interval: 6 * time.Hour, offset: 6 * time.Hour, want: at(4, 1, 0, 0)},
+		{name: "offset run of this month", now: at(4, 1, 1, 0), interval: 7 * 24 * time.Hour, offset: 6 * time.Hour, want: at(4, 1, 6, 0)},
+		{name: "offset run already passed", now: at(4, 1, 7, 0), interval: 40 * 24 * time.Hour, offset: 6 * time.Hour, want: at(5, 1, 6, 0)},
+		{name: "offset into the next month", now: at(3, 29, 7, 0), interval: 7 * 24 * time.Hour, offset: 48 * time.Hour, want: at(4, 3, 0, 0)},
+		{name: "offset run within the month", now: at(4, 2, 7, 0), interval: 7 * 24 * time.Hour, offset: 48 * time.Hour, want: at(4, 3, 0, 0)},
+	}
+	prev := cycleOffset
+	t.Cleanup(func() { cycleOffset = prev })
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cycleOffset = tt.offset
+			if got := nextScheduledRun(tt.now, tt.interval); !got.Equal(tt.want) {
+				t.Errorf("nextScheduledRun(%v, %v) = %v, want %v", tt.now, tt.interval, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScheduleJitter(t *testing.T) {
+	if scheduleJitter < 0 || scheduleJitter >= 5*time.Minute {
+		t.Errorf("scheduleJitter = %v, want within [0, 5m)", scheduleJitter)
+	}
+
+	prevJitter, prevOffset := scheduleJitter, cycleOffset
+	t.Cleanup(func() { scheduleJitter, cycleOffset = prevJitter, prevOffset })
+	scheduleJitter, cycleOffset = 90*time.Second, 0
+	c := useFakeClock(t, time.Date(2024, 3, 10, 7, 30, 0, 0, fipeLocation))
+
+	sleepUntilNextRun(context.Background(), 6*time.Hour)
+	if want := time.Date(2024, 3, 10, 12, 1, 30, 0, fipeLocation); !c.Now().Equal(want) {
+		t.Fatalf("woke at %v, want %v", c.Now(), want)
+	}
+	// Woken on time, the next run is the following slot, not the same one.
+	sleepUntilNextRun(context.Background(), 6*time.Hour)
+	if want := time.Date(2024, 3, 10, 18, 1, 30, 0, fipeLocation); !c.Now().Equal(want) {
+		t.Errorf("woke at %v, want %v", c.Now(), want)
+	}
+	// Woken just before its jittered time, it still waits for it.
+	c.advance(6*time.Hour - time.Second)
+	sleepUntilNextRun(context.Background(), 6*time.Hour)
+	if got := c.slept[len(c.slept)-1]; got != time.Second {
+		t.Errorf("slept %v before the jittered slot, want 1s", got)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
+
+	"gofipe/pkg/fipe"
+)
+
+// --- Seed dataset ---
+//
+// A Brotli-compressed snapshot of slow-changing FIPE data is embedded in the
+// binary: the vehicle types, the recent reference tables, the brands of
+// each type and the models of the top brands. At startup its payloads are
+// put in the cache under their usual keys for seedTTL, unless the cache
+// already holds them, so a fresh replica renders the search form at once,
+// before any FIPE request succeeds. Seeded entries are fresh for seedTTL,
+// so FIPE is asked soon, but both backends keep them until a FIPE answer
+// replaces them and serve them while FIPE fails. With the Redis backend the
+// first replica to start seeds the shared cache. Seeded entries are not
+// content changes when FIPE's copy differs. GOFIPE_SEED=false turns
+// seeding off.
+//
+// "gofipe refresh-seed" (make seed) rebuilds seedPath from FIPE for the
+// next build; the usual flags apply, e.g. -fipe-base-url. A binary built
+// without the file starts unseeded.
+
+const (
+	seedPath = "seed/fipe-seed.json.br"
+	seedTTL  = time.Minute
+)
+
+// seedKeepUntil is the keepUntil of seeded entries in the memory backend.
+var seedKeepUntil = time.Unix(1<<62, 0)
+
+//go:embed seed
+var seedFiles embed.FS
+
+// seedTopBrands names the brands whose models are seeded, by vehicle type.
+var seedTopBrands = map[string][]string{
+	"cars":        {"VW - VolksWagen", "Fiat", "GM - Chevrolet", "Toyota", "Hyundai", "Honda", "Renault", "Jeep", "Ford", "Nissan"},
+	"motorcycles": {"HONDA", "YAMAHA"},
+	"trucks":      {"Mercedes-Benz", "Volvo", "Scania"},
+}
+
+// seedDataset is the embedded snapshot.
+type seedDataset struct {
+	GeneratedAt  time.Time `json:"generatedAt"`
+	VehicleTypes []string  `json:"vehicleTypes"`
+	// Payloads are raw FIPE payloads by cache key.
+	Payloads map[string]json.RawMessage `json:"payloads"`
+}
+
+// loadSeed decodes the embedded snapshot.
+func loadSeed() (seedDataset, error) {
+	var ds seedDataset
+	f, err := seedFiles.Open(seedPath)
+	if err != nil {
+		return ds, err
+	}
+	defer f.Close()
+	err = json.NewDecoder(brotli.NewReader(f)).Decode(&ds)
+	return ds, err
+}
+
+// seedCache puts the embedded payloads missing from the cache in it.
+func seedCache() {
+	if os.Getenv("GOFIPE_SEED") == "false" {
+		return
+	}
+	ds, err := loadSeed()
+	if errors.Is(err, fs.ErrNotExist) {
+		slog.Info("no seed dataset embedded, run gofipe refresh-seed before building")
+		return
+	}
+	if err != nil {
+		slog.Error("seed dataset unreadable", "error", err)
+		return
+	}
+	seeded := 0
+	expiresAt := appClock.Now().Add(seedTTL)
+	for key, payload := range ds.Payloads {
+		if _, ok := cache.get(key); ok {
+			continue
+		}
+		// No hash: the first FIPE copy is not logged as a change.
+		cache.set(key, cacheItem{data: payload, expiresAt: expiresAt, gz: gzipPayload(payload)}.withLengths())
+		seeded++
+	}
+	slog.Info("cache seeded", "entries", seeded, "generated_at", ds.GeneratedAt)
+}
+
+// seededPayload returns the seeded payload still held at key, served when
+// FIPE fails before replacing it.
+func seededPayload(key string) ([]byte, bool) {
+	it, ok := cache.get(key)
+	if !ok || it.hash != "" {
+		return nil, false
+	}
+	recordCacheServedBytes(key, len(it.data))
+	return it.data, true
+}
+
+// runRefreshSeed rebuilds seedPath from FIPE with args as flags, reporting
+// to out, and returns the exit status.
+func runRefreshSeed(args []string, out io.Writer) int {
+	cfg, err := loadConfig(args)
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+		return 2
+	}
+	c := fipe.NewClient(cfg.FipeBaseURL)
+	c.HTTPClient.Timeout = cfg.HTTPTimeout
+	c.Token = cfg.FipeToken
+	ds, err := fetchSeed(context.Background(), c)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Seed not refreshed: %v\n", err)
+		return 1
+	}
+	raw, _ := json.Marshal(ds)
+	var b bytes.Buffer
+	w := brotli.NewWriterLevel(&b, brotli.BestCompression)
+	w.Write(raw)
+	w.Close()
+	if err := os.MkdirAll(filepath.Dir(seedPath), 0o755); err == nil {
+		err = os.WriteFile(seedPath, b.Bytes(), 0o644)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Seed not written: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(out, "wrote %s: %d payloads, %d bytes (%d uncompressed)\n", seedPath, len(ds.Payloads), b.Len(), len(raw))
+	return 0
+}
+
+// fetchSeed fetches the payloads of the seed dataset.
+func fetchSeed(ctx context.Context, c *fipe.Client) (seedDataset, error) {
+	ds := seedDataset{
+		GeneratedAt:  appClock.Now().UTC().Truncate(time.Second),
+		VehicleTypes: []string{"cars", "motorcycles", "trucks"},
+		Payloads:     map[string]json.RawMessage{},
+	}
+	refs, err := c.References(ctx)
+	if err != nil {
+		return ds, err
+	}
+	// Enough tables for the longest price history.
+	raw, _ := json.Marshal(refs[:min(len(refs), maxHistoryMonths)])
+	ds.Payloads[fipe.ReferencesKey] = raw
+	for _, vehicleType := range ds.VehicleTypes {
+		data, err := c.BrandsJSON(ctx, vehicleType)
+		if err != nil {
+			return ds, err
+		}
+		ds.Payloads[fipe.BrandsKey(vehicleType)] = data
+		var brands []fipe.Reference
+		if err := json.Unmarshal(data, &brands); err != nil {
+			return ds, err
+		}
+		for _, b := range brands {
+			if !slices.ContainsFunc(seedTopBrands[vehicleType], func(name string) bool { return strings.EqualFold(name, b.Name) }) {
+				continue
+			}
+			data, err := c.ModelsJSON(ctx, vehicleType, b.Code)
+			if err != nil {
+				return ds, err
+			}
+			ds.Payloads[fipe.ModelsKey(vehicleType, b.Code)] = data
+		}
+	}
+	return ds, nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// --- Consistent hashing shard mode ---
+//
+// For large deployments, replicas can shard cache ownership instead of each
+// caching every FIPE payload. Set on every replica:
+//
+//   - GOFIPE_SHARD_PEERS: comma-separated base URLs of all replicas,
+//     including this one, e.g. "http://gofipe-0:8080,http://gofipe-1:8080".
+//   - GOFIPE_SHARD_SELF: the URL of this replica as written in the peer list.
+//   - GOFIPE_SHARD_SECRET: shared secret authenticating peer requests.
+//
+// Cache keys are placed on a consistent hash ring (shardVirtualNodes points
+// per peer). A miss on a key owned by another replica is forwarded to the
+// owner's /internal/cache endpoint, which serves it from its cache or fetches
+// it from FIPE once. Non-owners do not keep a copy, so the aggregate cache
+// holds each payload once. If the owner fails, the replica falls back to
+// fetching and caching the payload itself.
+
+const (
+	shardVirtualNodes = 64
+	shardPeerTimeout  = 12 * time.Second
+	shardSecretHeader = "X-Gofipe-Shard-Secret"
+)
+
+// shardRequestsCounter counts cache misses by how they were served.
+var shardRequestsCounter = newBudgetedCounterVec(
+	prometheus.CounterOpts{
+		Name: "fipe_shard_requests_total",
+		Help: "Cache misses in shard mode by result (owned, forwarded, fallback, served_for_peer)",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	registerBudgeted(shardRequestsCounter)
+}
+
+// shardRing maps hash points to peer URLs.
+type shardRing struct {
+	self   string
+	secret string
+	points []uint32
+	owners map[uint32]string
+}
+
+// shard is nil unless shard mode is configured.
+var shard = mustLoadShardRing()
+
+// mustLoadShardRing reads the GOFIPE_SHARD_* settings.
+func mustLoadShardRing() *shardRing {
+	peers := os.Getenv("GOFIPE_SHARD_PEERS")
+	if peers == "" {
+		return nil
+	}
+	ring, err := newShardRing(strings.Split(peers, ","), os.Getenv("GOFIPE_SHARD_SELF"), os.Getenv("GOFIPE_SHARD_SECRET"))
+	if err != nil {
+		log.Fatalf("Invalid shard settings: %v", err)
+	}
+	return ring
+}
+
+// newShardRing builds the ring for peers.
+func newShardRing(peers []string, self, secret string) (*shardRing, error) {
+	r := &shardRing{self: strings.TrimRight(self, "/"), secret: secret, owners: map[uint32]string{}}
+	if secret == "" {
+		return nil, fmt.Errorf("GOFIPE_SHARD_SECRET is required")
+	}
+	found := false
+	for _, p := range peers {
+		p = strings.TrimRight(strings.TrimSpace(p), "/")
+		if u, err := url.Parse(p); err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid peer URL %q", p)
+		}
+		found = found || p == r.self
+		for i := 0; i < shardVirtualNodes; i++ {
+			h := crc32.ChecksumIEEE([]byte(p + "#" + strconv.Itoa(i)))
+			r.points = append(r.points, h)
+			r.owners[h] = p
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("GOFIPE_SHARD_SELF %q is not in GOFIPE_SHARD_PEERS", self)
+	}
+	slices.Sort(r.points)
+	return r, nil
+}
+
+// owner returns the peer owning key.
+func (r *shardRing) owner(key string) string {
+	h := crc32.ChecksumIEEE([]byte(key))
+	i, _ := slices.BinarySearch(r.points, h)
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+// fetchFromPeer asks the owning peer for a cached FIPE payload.
+func (r *shardRing) fetchFromPeer(peer, key, upstreamURL string, ttl time.Duration) ([]byte, error) {
+	path, ok := strings.CutPrefix(upstreamURL, fipeClient.BaseURL)
+	if !ok {
+		return nil, fmt.Errorf("url outside FIPE base: %s", upstreamURL)
+	}
+	q := url.Values{"key": {key}, "path": {path}, "ttl": {strconv.Itoa(int(ttl.Seconds()))}}
+	req, err := http.NewRequest("GET", peer+"/internal/cache?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(shardSecretHeader, r.secret)
+	client := http.Client{Timeout: shardPeerTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("peer %s returned status %d", peer, resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// fetchShardedMiss serves a local cache miss in shard mode. It reports false
+// when this replica owns the key and should fetch it itself.
+func fetchShardedMiss(key, upstreamURL string, ttl time.Duration) ([]byte, bool) {
+	if shard == nil {
+		return nil, false
+	}
+	owner := shard.owner(key)
+	if owner == shard.self {
+		shardRequestsCounter.Inc("owned")
+		return nil, false
+	}
+	data, err := shard.fetchFromPeer(owner, key, upstreamURL, ttl)
+	if err != nil {
+		shardRequestsCounter.Inc("fallback")
+		slog.Warn("shard peer failed, fetching directly", "peer", owner, "key", key, "error", err)
+		return nil, false
+	}
+	shardRequestsCounter.Inc("forwarded")
+	return data, true
+}
+
+// handleShardCache serves GET /internal/cache for peers.
+func handleShardCache(w http.ResponseWriter, r *http.Request) {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(shardSecretHeader)), []byte(shard.secret)) != 1 {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	q := r.URL.Query()
+	key, path := q.Get("key"), q.Get("path")
+	ttl, err := strconv.Atoi(q.Get("ttl"))
+	if key == "" || !strings.HasPrefix(path, "/") || strings.Contains(path, "..") || err != nil || ttl <= 0 {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	shardRequestsCounter.Inc("served_for_peer")
+	data, err := fetchCachedLocal(key, time.Duration(ttl)*time.Second, func() ([]byte, error) {
+		return fipeClient.Get(r.Context(), path)
+	})
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// registerShardEndpoint adds the peer endpoint in shard mode.
+func registerShardEndpoint(mux *http.ServeMux) {
+	if shard != nil {
+		mux.HandleFunc("GET /internal/cache", handleShardCache)
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gofipe/pkg/fipe"
+)
+
+// --- Google Sheets add-on endpoints ---
+//
+// A small, stable endpoint set under /sheets/v1/ for spreadsheet add-ons and
+// Apps Script custom functions. All routes require an API key (see
+// GOFIPE_API_KEYS) and answer with flat values:
+//
+//   - GET  /sheets/v1/price?type=&brandId=&modelId=&yearId=
+//   - GET  /sheets/v1/lookup?q=onix 2019
+//   - POST /sheets/v1/batch with up to sheetsMaxBatchItems rows
+//
+// Adding &field=<name> to price or lookup returns that single value as plain
+// text, e.g. field=price for a number a cell can use directly. Prices are
+// cached for sheetsPriceTTL and responses carry a long Cache-Control, since
+// spreadsheets recalculate often and FIPE publishes once a month.
+//
+// Batches run one at a time, with price fetches that miss the cache spaced to
+// GOFIPE_SHEETS_UPSTREAM_RPS per second (default 5). At most
+// sheetsMaxQueuedBatches batches wait; further ones get 429 with Retry-After.
+
+const (
+	sheetsPriceTTL         = 3 * time.Hour
+	sheetsCacheControl     = "private, max-age=3600"
+	sheetsMaxBatchItems    = 50
+	sheetsMaxQueuedBatches = 4
+	defaultSheetsRPS       = 5
+)
+
+// sheetsBatchesCounter counts batch requests by result.
+var sheetsBatchesCounter = newBudgetedCounterVec(
+	prometheus.CounterOpts{
+		Name: "fipe_sheets_batches_total",
+		Help: "Sheets batch requests by result (processed, rejected)",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	registerBudgeted(sheetsBatchesCounter)
+}
+
+// SheetsPrice is the flat price row returned to spreadsheets.
+type SheetsPrice struct {
+	Price          float64 `json:"price"`
+	PriceFormatted string  `json:"priceFormatted"`
+	Brand          string  `json:"brand"`
+	Model          string  `json:"model"`
+	ModelYear      int     `json:"modelYear"`
+	Fuel           string  `json:"fuel"`
+	CodeFipe       string  `json:"codeFipe"`
+	ReferenceMonth string  `json:"referenceMonth"`
+	VehicleType    string  `json:"vehicleType"`
+	BrandID        string  `json:"brandId"`
+	ModelID        string  `json:"modelId"`
+	YearID         string  `json:"yearId"`
+}
+
+// field returns one value of the row as text.
+func (p SheetsPrice) field(name string) (string, bool) {
+	switch name {
+	case "price":
+		return strconv.FormatFloat(p.Price, 'f', 2, 64), true
+	case "priceFormatted":
+		return p.PriceFormatted, true
+	case "brand":
+		return p.Brand, true
+	case "model":
+		return p.Model, true
+	case "modelYear":
+		return strconv.Itoa(p.ModelYear), true
+	case "fuel":
+		return p.Fuel, true
+	case "codeFipe":
+		return p.CodeFipe, true
+	case "referenceMonth":
+		return p.ReferenceMonth, true
+	}
+	return "", false
+}
+
+// SheetsBatchItem is one row of a batch: either the FIPE codes or a free-text query.
+type SheetsBatchItem struct {
+	Type    string `json:"type"`
+	BrandID string `json:"brandId"`
+	ModelID string `json:"modelId"`
+	YearID  string `json:"yearId"`
+	Q       string `json:"q"`
+}
+
+// SheetsBatchResult is the answer for one batch row.
+type SheetsBatchResult struct {
+	*SheetsPrice
+	Error string `json:"error,omitempty"`
+}
+
+// sheetsPriceKey is the cache key of a price fetched for spreadsheets in
+// the current table.
+func sheetsPriceKey(vehicleType, brandId, modelId, yearId string) string {
+	return fipe.ReferenceKey(fmt.Sprintf("price:%s:%s:%s:%s", vehicleType, brandId, modelId, yearId), pinnedReference())
+}
+
+// fetchSheetsPrice fetches a price through the cache and flattens it.
+func fetchSheetsPrice(ctx context.Context, vehicleType, brandId, modelId, yearId string) (SheetsPrice, error) {
+	pr, err := fipeClient.WithPriceTTL(sheetsPriceTTL).Price(ctx, vehicleType, brandId, modelId, yearId)
+	if err != nil {
+		return SheetsPrice{}, err
+	}
+	f, err := pr.Value()
+	if err != nil {
+		return SheetsPrice{}, err
+	}
+	return SheetsPrice{
+		Price:          f,
+		PriceFormatted: formatBRL(f),
+		Brand:          pr.Brand,
+		Model:          pr.Model,
+		ModelYear:      pr.ModelYear,
+		Fuel:           pr.Fuel,
+		CodeFipe:       pr.CodeFipe,
+		ReferenceMonth: pr.ReferenceMonth,
+		VehicleType:    vehicleType,
+		BrandID:        brandId,
+		ModelID:        modelId,
+		YearID:         yearId,
+	}, nil
+}
+
+// resolveSheetsItem resolves a batch row to FIPE codes.
+func resolveSheetsItem(ctx context.Context, it SheetsBatchItem) (SheetsBatchItem, error) {
+	if it.Q == "" {
+		if it.Type == "" || it.BrandID == "" || it.ModelID == "" || it.YearID == "" {
+			return it, errors.New("type, brandId, modelId and yearId or q are required")
+		}
+		if _, ok := vehicleTypes[it.Type]; !ok {
+			return it, errors.New("invalid type")
+		}
+		return it, nil
+	}
+	v, err := resolveVehicle(ctx, parseVehicleQuery(it.Q))
+	if err != nil {
+		return it, err
+	}
+	return SheetsBatchItem{Type: v.VehicleType, BrandID: v.BrandID, ModelID: v.ModelID, YearID: v.YearID}, nil
+}
+
+// writeSheetsPrice writes a price row as JSON, or one field as plain text.
+func writeSheetsPrice(w http.ResponseWriter, r *http.Request, p SheetsPrice) {
+	w.Header().Set("Cache-Control", sheetsCacheControl)
+	if name := r.URL.Query().Get("field"); name != "" {
+		v, ok := p.field(name)
+		if !ok {
+			http.Error(w, "unknown field", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(v))
+		return
+	}
+	b, _ := json.Marshal(p)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// handleSheetsPrice serves GET /sheets/v1/price.
+func handleSheetsPrice(w http.ResponseWriter, r *http.Request) {
+	recordHTTPRequest("/sheets/v1/price", r.Method)
+	q := r.URL.Query()
+	it, err := resolveSheetsItem(r.Context(), SheetsBatchItem{Type: q.Get("type"), BrandID: q.Get("brandId"), ModelID: q.Get("modelId"), YearID: q.Get("yearId")})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p, err := fetchSheetsPrice(r.Context(), it.Type, it.BrandID, it.ModelID, it.YearID)
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	writeSheetsPrice(w, r, p)
+}
+
+// handleSheetsLookup serves GET /sheets/v1/lookup.
+func handleSheetsLookup(w http.ResponseWriter, r *http.Request) {
+	recordHTTPRequest("/sheets/v1/lookup", r.Method)
+	text := strings.TrimSpace(r.URL.Query().Get("q"))
+	if text == "" {
+		http.Error(w, "q is required", http.StatusBadRequest)
+		return
+	}
+	it, err := resolveSheetsItem(r.Context(), SheetsBatchItem{Q: text})
+	switch {
+	case errors.Is(err, errVehicleNotFound), errors.Is(err, errYearNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		writeUpstreamError(w, err)
+		return
+	}
+	p, err := fetchSheetsPrice(r.Context(), it.Type, it.BrandID, it.ModelID, it.YearID)
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	writeSheetsPrice(w, r, p)
+}
+
+// sheetsBatcher runs batches one at a time under an upstream rate limit.
+type sheetsBatcher struct {
+	queue    chan struct{}
+	running  chan struct{}
+	interval time.Duration
+	last     time.Time
+}
+
+// newSheetsBatcher reads GOFIPE_SHEETS_UPSTREAM_RPS.
+func newSheetsBatcher() (*sheetsBatcher, error) {
+	rps := defaultSheetsRPS
+	if v := os.Getenv("GOFIPE_SHEETS_UPSTREAM_RPS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("GOFIPE_SHEETS_UPSTREAM_RPS must be a positive integer")
+		}
+		rps = n
+	}
+	return &sheetsBatcher{
+		queue:    make(chan struct{}, sheetsMaxQueuedBatches+1),
+		running:  make(chan struct{}, 1),
+		interval: time.Second / time.Duration(rps),
+	}, nil
+}
+
+// waitTurn spaces upstream fetches. Callers must hold b.running.
+func (b *sheetsBatcher) waitTurn() {
+	if wait := time.Until(b.last.Add(b.interval)); wait > 0 {
+		time.Sleep(wait)
+	}
+	b.last = time.Now()
+}
+
+// run answers every row of a batch in order.
+func (b *sheetsBatcher) run(ctx context.Context, items []SheetsBatchItem) []SheetsBatchResult {
+	b.running <- struct{}{}
+	defer func() { <-b.running }()
+
+	results := make([]SheetsBatchResult, len(items))
+	for i, raw := range items {
+		it, err := resolveSheetsItem(ctx, raw)
+		if err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		if _, cached := getFromCache(sheetsPriceKey(it.Type, it.BrandID, it.ModelID, it.YearID)); !cached {
+			b.waitTurn()
+		}
+		p, err := fetchSheetsPrice(ctx, it.Type, it.BrandID, it.ModelID, it.YearID)
+		if err != nil {
+			slog.ErrorContext(ctx, "sheets batch row failed", "row", i, "error", err)
+			results[i].Error = "price unavailable"
+			continue
+		}
+		results[i].SheetsPrice = &p
+	}
+	return results
+}
+
+// ServeHTTP serves POST /sheets/v1/batch.
+func (b *sheetsBatcher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	recordHTTPRequest("/sheets/v1/batch", r.Method)
+	var req struct {
+		Items []SheetsBatchItem `json:"items"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 256<<10)).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if len(req.Items) == 0 || len(req.Items) > sheetsMaxBatchItems {
+		http.Error(w, fmt.Sprintf("items must have between 1 and %d rows", sheetsMaxBatchItems), http.StatusBadRequest)
+		return
+	}
+
+	select {
+	case b.queue <- struct{}{}:
+		defer func() { <-b.queue }()
+	default:
+		sheetsBatchesCounter.Inc("rejected")
+		writeRetryLater(w, http.StatusTooManyRequests, "too many batches queued", time.Duration(sheetsMaxBatchItems)*b.interval+time.Second, nil)
+		return
+	}
+
+	results := b.run(withUpstreamPriority(r.Context(), upstreamBackground), req.Items)
+	sheetsBatchesCounter.Inc("processed")
+	out, _ := json.Marshal(map[string]interface{}{"results": results})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(out)
+}
+
+// registerSheetsEndpoints adds the Sheets routes when API keys are configured.
+func registerSheetsEndpoints(mux *http.ServeMux) {
+	if len(apiKeys) == 0 {
+		return
+	}
+	batcher, err := newSheetsBatcher()
+	if err != nil {
+		log.Fatalf("Invalid Sheets settings: %v", err)
+	}
+	mux.HandleFunc("GET /sheets/v1/price", requireAPIKey(handleSheetsPrice))
+	mux.HandleFunc("GET /sheets/v1/lookup", requireAPIKey(handleSheetsLookup))
+	mux.HandleFunc("POST /sheets/v1/batch", requireAPIKey(batcher.ServeHTTP))
+}
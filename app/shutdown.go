@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// --- Graceful shutdown ---
+//
+// On SIGINT or SIGTERM the server stops accepting connections and waits up
+// to the shutdown timeout (GOFIPE_SHUTDOWN_TIMEOUT / -shutdown-timeout,
+// default 25s, inside the default 30s Kubernetes termination grace period)
+// for in-flight requests to finish. Shutdown hooks registered with
+// onShutdown then flush pending cache or persistence writes, in reverse
+// registration order, within the remaining time.
+
+type shutdownHook struct {
+	name string
+	fn   func(context.Context) error
+}
+
+var (
+	shutdownMu    sync.Mutex
+	shutdownHooks []shutdownHook
+)
+
+// onShutdown registers fn to run after the server has drained.
+func onShutdown(name string, fn func(context.Context) error) {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+	shutdownHooks = append(shutdownHooks, shutdownHook{name, fn})
+}
+
+// runShutdownHooks runs the hooks newest first, logging failures.
+func runShutdownHooks(ctx context.Context) {
+	shutdownMu.Lock()
+	hooks := shutdownHooks
+	shutdownMu.Unlock()
+	for i := len(hooks) - 1; i >= 0; i-- {
+		if err := hooks[i].fn(ctx); err != nil {
+			slog.Error("shutdown hook failed", "hook", hooks[i].name, "error", err)
+		}
+	}
+}
+
+// serveUntilSignal runs srv until SIGINT or SIGTERM, then shuts it down gracefully.
+func serveUntilSignal(srv *http.Server, timeout time.Duration) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	stop()
+	slog.Info("shutdown signal received, draining connections", "timeout", timeout.String())
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var err error
+	if err = srv.Shutdown(shutdownCtx); err != nil {
+		err = fmt.Errorf("draining connections: %w", err)
+	}
+	runShutdownHooks(shutdownCtx)
+	if e := <-errc; !errors.Is(e, http.ErrServerClosed) && err == nil {
+		err = e
+	}
+	slog.Info("server stopped")
+	return err
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gofipe/pkg/fipe"
+)
+
+// --- Slack slash command ---
+//
+// With GOFIPE_SLACK_SIGNING_SECRET set, POST /slack/command answers a Slack
+// slash command such as "/fipe onix 2020" with a Block Kit message. Requests
+// must carry a valid X-Slack-Signature computed with the app signing secret
+// and a timestamp no older than slackMaxSkew. Prices are posted to the
+// channel; help and errors are only shown to the user who asked.
+// Messages are counted in fipe_chatbot_messages_total{channel="slack"}.
+
+const slackMaxSkew = 5 * time.Minute
+
+// verifySlackSignature checks the v0 request signature Slack sends.
+func verifySlackSignature(secret string, header http.Header, body []byte, now time.Time) error {
+	ts, err := strconv.ParseInt(header.Get("X-Slack-Request-Timestamp"), 10, 64)
+	if err != nil {
+		return errors.New("missing timestamp")
+	}
+	if d := now.Sub(time.Unix(ts, 0)); d > slackMaxSkew || d < -slackMaxSkew {
+		return errors.New("stale timestamp")
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%d:%s", ts, body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(header.Get("X-Slack-Signature")), []byte(expected)) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+// slackText is a Block Kit text object.
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// slackBlock is the subset of Block Kit blocks used by the replies.
+type slackBlock struct {
+	Type     string                   `json:"type"`
+	Text     *slackText               `json:"text,omitempty"`
+	Fields   []slackText              `json:"fields,omitempty"`
+	Elements []map[string]interface{} `json:"elements,omitempty"`
+}
+
+// slackMessage is a slash command response.
+type slackMessage struct {
+	ResponseType string       `json:"response_type"`
+	Text         string       `json:"text"`
+	Blocks       []slackBlock `json:"blocks,omitempty"`
+}
+
+// slackEphemeral builds a reply only the requesting user sees.
+func slackEphemeral(text string) slackMessage {
+	return slackMessage{ResponseType: "ephemeral", Text: text}
+}
+
+// slackPriceMessage renders a price as Block Kit, linking to the vehicle page.
+func slackPriceMessage(pr fipe.Price, v resolvedVehicle, pageURL string) slackMessage {
+	l := locales[defaultLocale]
+	price := pr.Price
+	if f, err := pr.Value(); err == nil {
+		price = l.FormatBRL(f)
+	}
+	ref := pr.ReferenceMonth
+	if month, year, ok := parseReferenceMonth(ref); ok {
+		ref = l.FormatMonth(month, year)
+	}
+	return slackMessage{
+		ResponseType: "in_channel",
+		Text:         formatPriceMessage(pr, v),
+		Blocks: []slackBlock{
+			{Type: "section", Text: &slackText{Type: "mrkdwn", Text: fmt.Sprintf("*%s %s* (%s)", pr.Brand, pr.Model, v.YearName)}},
+			{Type: "section", Fields: []slackText{
+				{Type: "mrkdwn", Text: "*Preço FIPE*\n" + price},
+				{Type: "mrkdwn", Text: "*Referência*\n" + ref},
+				{Type: "mrkdwn", Text: "*Código FIPE*\n" + pr.CodeFipe},
+				{Type: "mrkdwn", Text: "*Combustível*\n" + pr.Fuel},
+			}},
+			{Type: "actions", Elements: []map[string]interface{}{{
+				"type": "button",
+				"text": slackText{Type: "plain_text", Text: "Ver detalhes"},
+				"url":  pageURL,
+			}}},
+		},
+	}
+}
+
+// slackReply answers the slash command text and returns the result label.
+func slackReply(r *http.Request, text string) (slackMessage, string) {
+	text = strings.TrimSpace(text)
+	if text == "" || text == "help" || text == "ajuda" {
+		return slackEphemeral(chatbotHelp), "help"
+	}
+	q := parseVehicleQuery(text)
+	v, pr, err := lookupVehiclePrice(r.Context(), q)
+	switch {
+	case errors.Is(err, errVehicleNotFound):
+		return slackEphemeral("Não encontrei esse veículo na tabela FIPE. " + chatbotHelp), "not_found"
+	case errors.Is(err, errYearNotFound):
+		return slackEphemeral(fmt.Sprintf("O %s não tem preço FIPE para %s. Tente outro ano.", v.ModelName, q.Year)), "not_found"
+	case err != nil:
+		slog.ErrorContext(r.Context(), "slack lookup failed", "query", truncateForLog(text), "error", err)
+		return slackEphemeral("A tabela FIPE está indisponível no momento. Tente novamente mais tarde."), "error"
+	}
+	return slackPriceMessage(pr, v, absoluteURL(vehiclePath(v.VehicleType, v.BrandID, v.ModelID, v.YearID))), "answered"
+}
+
+// handleSlackCommand serves POST /slack/command.
+func handleSlackCommand(secret string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		recordHTTPRequest("/slack/command", r.Method)
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 64<<10))
+		if err != nil {
+			http.Error(w, "invalid body", http.StatusBadRequest)
+			return
+		}
+		if err := verifySlackSignature(secret, r.Header, body, time.Now()); err != nil {
+			http.Error(w, "invalid signature: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			http.Error(w, "invalid form", http.StatusBadRequest)
+			return
+		}
+
+		msg, result := slackReply(r, form.Get("text"))
+		chatbotMessagesCounter.Inc("slack", result)
+		b, _ := json.Marshal(msg)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	}
+}
+
+// registerSlackCommand adds the slash command when a signing secret is configured.
+func registerSlackCommand(mux *http.ServeMux) {
+	if secret := os.Getenv("GOFIPE_SLACK_SIGNING_SECRET"); secret != "" {
+		mux.HandleFunc("POST /slack/command", handleSlackCommand(secret))
+	}
+}
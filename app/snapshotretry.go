@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// --- Snapshot retries ---
+//
+// When the history collector fails to fetch a vehicle's price in the
+// current reference table (a timeout or a FIPE 5xx; not a 404, which means
+// the vehicle is not listed), the vehicle is queued for a retry instead of
+// waiting for the next run. Retries back off exponentially from
+// GOFIPE_SNAPSHOT_RETRY_BACKOFF (default 5m, 0 disables the queue) up to
+// maxSnapshotRetryBackoff, and go through the collector, so a recovered
+// price is checked for anomalies and alerts like any other. Once FIPE
+// publishes the next table the month is closed and its remaining retries
+// expire. GET /admin/snapshot-retries lists the queue;
+// fipe_snapshot_retries_total and fipe_snapshot_retry_queue track it.
+
+const (
+	defaultSnapshotRetryBackoff = 5 * time.Minute
+	maxSnapshotRetryBackoff     = 6 * time.Hour
+	snapshotRetryTick           = time.Minute
+)
+
+var (
+	// snapshotRetriesCounter counts retry queue events.
+	snapshotRetriesCounter = newBudgetedCounterVec(
+		prometheus.CounterOpts{
+			Name: "fipe_snapshot_retries_total",
+			Help: "Current-table snapshot failures queued for a retry, retries that failed again, recovered and expired",
+		},
+		[]string{"result"},
+	)
+
+	// snapshotRetryQueueGauge is the number of queued retries.
+	snapshotRetryQueueGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "fipe_snapshot_retry_queue",
+		Help: "Vehicles waiting for a retry of their current-table snapshot",
+	})
+)
+
+func init() {
+	registerBudgeted(snapshotRetriesCounter)
+	prometheus.MustRegister(snapshotRetryQueueGauge)
+}
+
+// snapshotRetryBackoff is the first retry delay; 0 disables retries.
+var snapshotRetryBackoff = mustLoadSnapshotRetryBackoff()
+
+// mustLoadSnapshotRetryBackoff reads GOFIPE_SNAPSHOT_RETRY_BACKOFF.
+func mustLoadSnapshotRetryBackoff() time.Duration {
+	v := os.Getenv("GOFIPE_SNAPSHOT_RETRY_BACKOFF")
+	if v == "" {
+		return defaultSnapshotRetryBackoff
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Fatalf("Invalid GOFIPE_SNAPSHOT_RETRY_BACKOFF: %q is not a duration such as 5m", v)
+	}
+	return d
+}
+
+// SnapshotRetry is a queued current-table snapshot.
+type SnapshotRetry struct {
+	Vehicle       watchedVehicle `json:"vehicle"`
+	ReferenceCode string         `json:"referenceCode"`
+	Attempts      int            `json:"attempts"`
+	FirstFailedAt time.Time      `json:"firstFailedAt"`
+	LastFailedAt  time.Time      `json:"lastFailedAt"`
+	NextAttemptAt time.Time      `json:"nextAttemptAt"`
+	LastError     string         `json:"lastError"`
+}
+
+// snapshotRetryDelay is the wait after the given number of failed attempts.
+func snapshotRetryDelay(base time.Duration, attempts int) time.Duration {
+	d := base
+	for i := 1; i < attempts && d < maxSnapshotRetryBackoff; i++ {
+		d *= 2
+	}
+	return min(d, maxSnapshotRetryBackoff)
+}
+
+// queueSnapshotRetry records a failed snapshot of v in table code.
+func (s *historyStore) queueSnapshotRetry(ctx context.Context, v watchedVehicle, code string, cause error) error {
+	now := appClock.Now().Unix()
+	var attempts int
+	err := s.db.QueryRowContext(ctx, s.rebind(`INSERT INTO snapshot_retries
+		(vehicle_type, brand_id, model_id, year_id, reference_code, attempts, first_failed_at, last_failed_at, last_error)
+		VALUES (?, ?, ?, ?, ?, 1, ?, ?, ?)
+		ON CONFLICT (vehicle_type, brand_id, model_id, year_id, reference_code) DO UPDATE SET
+			attempts = snapshot_retries.attempts + 1,
+			last_failed_at = excluded.last_failed_at,
+			last_error = excluded.last_error
+		RETURNING attempts`),
+		v.Type, v.BrandID, v.ModelID, v.YearID, code, now, now, cause.Error()).Scan(&attempts)
+	if err != nil {
+		return err
+	}
+	if attempts == 1 {
+		snapshotRetriesCounter.Inc("queued")
+	} else {
+		snapshotRetriesCounter.Inc("failed")
+	}
+	return nil
+}
+
+// clearSnapshotRetry removes the queued snapshot of v in table code,
+// reporting whether there was one.
+func (s *historyStore) clearSnapshotRetry(ctx context.Context, v watchedVehicle, code string) (bool, error) {
+	res, err := s.db.ExecContext(ctx, s.rebind(`DELETE FROM snapshot_retries
+		WHERE vehicle_type = ? AND brand_id = ? AND model_id = ? AND year_id = ? AND reference_code = ?`),
+		v.Type, v.BrandID, v.ModelID, v.YearID, code)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// snapshotRetries lists the queue, oldest failure first.
+func (s *historyStore) snapshotRetries(ctx context.Context) ([]SnapshotRetry, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT vehicle_type, brand_id, model_id, year_id, reference_code,
+		attempts, first_failed_at, last_failed_at, last_error
+		FROM snapshot_retries ORDER BY first_failed_at, vehicle_type, brand_id, model_id, year_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []SnapshotRetry{}
+	for rows.Next() {
+		var r SnapshotRetry
+		var first, last int64
+		if err := rows.Scan(&r.Vehicle.Type, &r.Vehicle.BrandID, &r.Vehicle.ModelID, &r.Vehicle.YearID, &r.ReferenceCode,
+			&r.Attempts, &first, &last, &r.LastError); err != nil {
+			return nil, err
+		}
+		r.FirstFailedAt, r.LastFailedAt = time.Unix(first, 0).UTC(), time.Unix(last, 0).UTC()
+		r.NextAttemptAt = r.LastFailedAt.Add(snapshotRetryDelay(snapshotRetryBackoff, r.Attempts))
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+// retrySnapshots collects the vehicles whose retry is due and expires the
+// retries of closed months.
+func (s *historyStore) retrySnapshots(ctx context.Context) error {
+	retries, err := s.snapshotRetries(ctx)
+	if err != nil || len(retries) == 0 {
+		snapshotRetryQueueGauge.Set(float64(len(retries)))
+		return err
+	}
+	tables, err := fipeClient.References(ctx)
+	if err != nil {
+		return err
+	}
+	now := appClock.Now()
+	for _, r := range retries {
+		if len(tables) > 0 && r.ReferenceCode != tables[0].Code {
+			if _, err := s.clearSnapshotRetry(ctx, r.Vehicle, r.ReferenceCode); err != nil {
+				return err
+			}
+			snapshotRetriesCounter.Inc("expired")
+			slog.WarnContext(ctx, "snapshot retry expired, the reference month closed",
+				"vehicle", r.Vehicle.String(), "reference_code", r.ReferenceCode, "attempts", r.Attempts, "error", r.LastError)
+			continue
+		}
+		if now.Before(r.NextAttemptAt) {
+			continue
+		}
+		if err := s.collect(ctx, []watchedVehicle{r.Vehicle}, nil); err != nil {
+			return err
+		}
+	}
+	retries, err = s.snapshotRetries(ctx)
+	snapshotRetryQueueGauge.Set(float64(len(retries)))
+	return err
+}
+
+// startSnapshotRetries retries the queued snapshots as a history job.
+func startSnapshotRetries() {
+	if snapshotRetryBackoff <= 0 {
+		return
+	}
+	goHistoryJob(func(ctx context.Context) {
+		ctx = withUpstreamPriority(ctx, upstreamBackground)
+		for appClock.Sleep(ctx, snapshotRetryTick) == nil {
+			if err := historyDB.retrySnapshots(ctx); err != nil && ctx.Err() == nil {
+				slog.ErrorContext(ctx, "snapshot retries failed", "error", err)
+			}
+		}
+	})
+}
+
+// handleSnapshotRetries serves GET /admin/snapshot-retries.
+func handleSnapshotRetries(w http.ResponseWriter, r *http.Request) {
+	recordHTTPRequest("/admin/snapshot-retries", r.Method)
+	retries, err := historyDB.snapshotRetries(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "snapshot retries query failed", "error", err)
+		http.Error(w, "snapshot retries unavailable", http.StatusInternalServerError)
+		return
+	}
+	b, _ := json.Marshal(map[string]interface{}{"backoff": snapshotRetryBackoff.String(), "retries": retries})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
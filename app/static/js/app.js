@@ -10,6 +10,10 @@ document.addEventListener('DOMContentLoaded', () => {
   const resRef = document.getElementById('resRef');
   const fuelCode = document.getElementById('fuelCode');
   const codeFipeEl = document.getElementById('codeFipe');
+  const detailLink = document.getElementById('detailLink');
+  const retryNotice = document.getElementById('retryNotice');
+  const retryMessage = document.getElementById('retryMessage');
+  const retryCountdown = document.getElementById('retryCountdown');
 
   const setText = (el, txt) => { if (el) el.innerText = txt }
 
@@ -18,18 +22,66 @@ document.addEventListener('DOMContentLoaded', () => {
   const historyChartCtx = document.getElementById('historyChart').getContext('2d');
   let chart = null;
 
+  // Populate the history months selector from the server capabilities
+  async function loadConfig(){
+    const cfg = await fetchJSON('/api/config');
+    if(!cfg.features || !cfg.features.priceHistory){
+      btnLoadHistory.closest('.mt-4').classList.add('d-none');
+      return;
+    }
+    historyMonths.innerHTML = '';
+    [3, 6, 12, 24].filter(m => m <= cfg.maxHistoryMonths).forEach(m => {
+      const o = document.createElement('option'); o.value = m; o.text = m;
+      o.selected = m === cfg.defaultHistoryMonths;
+      historyMonths.appendChild(o);
+    });
+  }
+
   // Local cache to avoid repeated selects during session
   const localCache = { brands: {}, models: {}, years: {} };
 
+  // Thrown when the server is throttling and tells when to try again
+  class RetryLaterError extends Error {
+    constructor(message, seconds){ super(message); this.retryAfterSeconds = seconds }
+  }
+
   async function fetchJSON(url){
     const res = await fetch(url, {cache: 'no-cache'});
-    if(!res.ok) throw new Error(`${res.status} ${res.statusText}`);
+    if(!res.ok){
+      const body = await res.json().catch(()=>null);
+      if(body && body.retryAfterSeconds > 0){
+        // Operators' notes on an ongoing incident explain the outage better
+        const note = (body.incidents || []).map(i=>i.description).join(' ');
+        throw new RetryLaterError(note || body.error, body.retryAfterSeconds);
+      }
+      throw new Error(`${res.status} ${res.statusText}`);
+    }
     return res.json();
   }
 
+  // Count down a throttled request in the retry notice, then run retry
+  let retryTimer = null;
+  function cancelRetry(){
+    clearInterval(retryTimer);
+    retryNotice.classList.add('d-none');
+  }
+  function retryLater(err, retry){
+    cancelRetry();
+    let left = err.retryAfterSeconds;
+    setText(retryMessage, err.message);
+    setText(retryCountdown, left);
+    retryNotice.classList.remove('d-none');
+    retryTimer = setInterval(()=>{
+      left--;
+      setText(retryCountdown, left);
+      if(left <= 0){ cancelRetry(); retry() }
+    }, 1000);
+  }
+
   function resetSelects(...sels){
     sels.forEach(s=>{s.innerHTML='<option value="">Select...</option>'; s.disabled=true});
     resultBox.classList.add('d-none');
+    cancelRetry();
   }
 
   async function loadBrands(){
@@ -83,8 +135,10 @@ document.addEventListener('DOMContentLoaded', () => {
       if (data.codeFipe || data.code_fipe) {
         setText(codeFipeEl, `FIPE code: ${data.codeFipe || data.code_fipe}`);
       }
+      if (detailLink) detailLink.href = `/vehicle/${type}/${brandId}/${modelId}/${yearId}`;
       resultBox.classList.remove('d-none');
     }catch(err){
+      if(err instanceof RetryLaterError) return retryLater(err, loadPrice);
       alert('Failed to load price: '+err.message);
     }
   }
@@ -132,6 +186,7 @@ document.addEventListener('DOMContentLoaded', () => {
       if(chart) chart.destroy();
       chart = new Chart(historyChartCtx, {type:'line',data:{labels, datasets:[{label:'Price',data:values,backgroundColor:'rgba(37,99,235,0.2)',borderColor:'#2563eb'}]}});
     }catch(err){
+      if(err instanceof RetryLaterError) return retryLater(err, loadHistory);
       alert('Failed to load history: '+err.message);
     }
   }
@@ -149,6 +204,16 @@ document.addEventListener('DOMContentLoaded', () => {
   themeToggle.addEventListener('change', e=> setTheme(e.target.checked));
   setTheme(localStorage.getItem('theme-day') === '1');
 
+  // Offline support
+  if ('serviceWorker' in navigator) {
+    navigator.serviceWorker.register('/sw.js').catch(err => console.error('service worker registration failed', err));
+  }
+
   // initial load
-  loadBrands().catch(err=>console.error(err));
+  loadConfig().catch(err=>console.error(err));
+  const loadAllBrands = ()=> loadBrands().catch(err=>{
+    if(err instanceof RetryLaterError) return retryLater(err, loadAllBrands);
+    console.error(err);
+  });
+  loadAllBrands();
 });
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"log/slog"
+	"math"
+	"mime"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Status page ---
+//
+// GET /status answers "is it me or is FIPE down?": the last answer of each
+// upstream provider and the circuit breaker of each upstream host, this
+// replica's cache hit ratio, the latest reference table the synthetic
+// check saw, the check's recent incidents and the operators' incident
+// notes. It renders HTML, or JSON with format=json or Accept:
+// application/json. The overall status is "degraded" while a provider's
+// last request failed, a breaker is not closed, the synthetic check is
+// failing or an incident note is active, "ok" otherwise. Everything is
+// kept in memory per replica; only the last statusMaxIncidents incidents
+// are listed.
+
+// statusMaxIncidents is how many synthetic check incidents are kept.
+const statusMaxIncidents = 20
+
+// StatusReport is the /status response.
+type StatusReport struct {
+	Status      string           `json:"status"` // ok or degraded
+	GeneratedAt time.Time        `json:"generatedAt"`
+	Upstreams   []UpstreamStatus `json:"upstreams"`
+	Breakers    []BreakerStatus  `json:"breakers"`
+	Cache       CacheStatus      `json:"cache"`
+	// Reference is nil until the synthetic check saw a reference month.
+	Reference *ReferenceStatus `json:"reference"`
+	// Check is nil while the synthetic check is disabled or has not run.
+	Check     *CheckStatus `json:"check"`
+	Incidents []Incident   `json:"incidents"` // newest first
+	// Notes are the operators' incident notes, latest start first.
+	Notes []IncidentNote `json:"notes"`
+}
+
+// UpstreamStatus is the last outcome of the requests to a provider.
+type UpstreamStatus struct {
+	Provider    string     `json:"provider"`
+	Healthy     bool       `json:"healthy"`
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+	LastFailure *time.Time `json:"lastFailure,omitempty"`
+	// LastError labels the last failure, as in fipe_upstream_errors_total
+	// (network, html or the status code).
+	LastError string `json:"lastError,omitempty"`
+}
+
+// BreakerStatus is the circuit breaker state of an upstream host.
+type BreakerStatus struct {
+	Host  string `json:"host"`
+	State string `json:"state"` // closed, open or half-open
+}
+
+// CacheStatus sums the cache lookups of this replica since it started.
+type CacheStatus struct {
+	Backend  string  `json:"backend"`
+	Hits     int64   `json:"hits"`
+	Misses   int64   `json:"misses"`
+	HitRatio float64 `json:"hitRatio"` // hits / (hits + misses), 0 without lookups
+}
+
+// HitPercent is HitRatio in percent, for the page.
+func (c CacheStatus) HitPercent() float64 { return c.HitRatio * 100 }
+
+// ReferenceStatus is the reference month returned for the canary vehicle.
+type ReferenceStatus struct {
+	Month string `json:"month"`
+	// SeenAt is when the synthetic check first saw Month, which is when
+	// this replica started if it never saw another one.
+	SeenAt time.Time `json:"seenAt"`
+}
+
+// CheckStatus is the outcome of the last synthetic check.
+type CheckStatus struct {
+	OK          bool       `json:"ok"`
+	LastRun     time.Time  `json:"lastRun"`
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+}
+
+// Incident is a run of failed synthetic checks.
+type Incident struct {
+	// Step is the lookup step that failed first (brands, models, years,
+	// price).
+	Step  string    `json:"step"`
+	Error string    `json:"error"`
+	Start time.Time `json:"start"`
+	// End is when the check passed again, nil while the incident lasts.
+	End      *time.Time `json:"end,omitempty"`
+	Failures int        `json:"failures"`
+}
+
+// statusBoard collects what /status reports.
+type statusBoard struct {
+	mu        sync.Mutex
+	upstreams map[string]*UpstreamStatus
+	reference *ReferenceStatus
+	check     *CheckStatus
+	// incidents holds the last statusMaxIncidents incidents, oldest first.
+	incidents []*Incident
+}
+
+var serviceStatus = &statusBoard{upstreams: map[string]*UpstreamStatus{}}
+
+// recordUpstream notes the outcome of a request to provider; failure is
+// the status label of a failed request, empty on success.
+func (s *statusBoard) recordUpstream(provider, failure string, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.upstreams[provider]
+	if u == nil {
+		u = &UpstreamStatus{Provider: provider}
+		s.upstreams[provider] = u
+	}
+	u.Healthy = failure == ""
+	if u.Healthy {
+		u.LastSuccess = &at
+	} else {
+		u.LastFailure, u.LastError = &at, failure
+	}
+}
+
+// recordCheck notes the outcome of a synthetic check run at at: the
+// reference month it returned, or the step that failed and why.
+func (s *statusBoard) recordCheck(at time.Time, referenceMonth, step string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.check == nil {
+		s.check = &CheckStatus{}
+	}
+	s.check.LastRun, s.check.OK = at, err == nil
+	var open *Incident
+	if n := len(s.incidents); n > 0 && s.incidents[n-1].End == nil {
+		open = s.incidents[n-1]
+	}
+	if err != nil {
+		if open == nil {
+			open = &Incident{Step: step, Error: err.Error(), Start: at}
+			s.incidents = append(s.incidents, open)
+			if len(s.incidents) > statusMaxIncidents {
+				s.incidents = s.incidents[1:]
+			}
+		}
+		open.Failures++
+		return
+	}
+	s.check.LastSuccess = &at
+	if open != nil {
+		open.End = &at
+	}
+	if referenceMonth != "" && (s.reference == nil || s.reference.Month != referenceMonth) {
+		s.reference = &ReferenceStatus{Month: referenceMonth, SeenAt: at}
+	}
+}
+
+// report returns the current status, with the breaker states of breakers
+// and cache as the cache counters.
+func (s *statusBoard) report(now time.Time, breakers map[string]breakerState, cache CacheStatus) StatusReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rep := StatusReport{Status: "ok", GeneratedAt: now, Upstreams: []UpstreamStatus{}, Breakers: []BreakerStatus{}, Cache: cache, Incidents: []Incident{}}
+	for _, u := range s.upstreams {
+		rep.Upstreams = append(rep.Upstreams, *u)
+		if !u.Healthy {
+			rep.Status = "degraded"
+		}
+	}
+	sort.Slice(rep.Upstreams, func(i, j int) bool { return rep.Upstreams[i].Provider < rep.Upstreams[j].Provider })
+	for host, state := range breakers {
+		rep.Breakers = append(rep.Breakers, BreakerStatus{Host: host, State: breakerStateNames[state]})
+		if state != breakerClosed {
+			rep.Status = "degraded"
+		}
+	}
+	sort.Slice(rep.Breakers, func(i, j int) bool { return rep.Breakers[i].Host < rep.Breakers[j].Host })
+	if s.reference != nil {
+		ref := *s.reference
+		rep.Reference = &ref
+	}
+	if s.check != nil {
+		check := *s.check
+		rep.Check = &check
+		if !check.OK {
+			rep.Status = "degraded"
+		}
+	}
+	for i := len(s.incidents) - 1; i >= 0; i-- {
+		rep.Incidents = append(rep.Incidents, *s.incidents[i])
+	}
+	rep.Notes = listIncidentNotes(now, false)
+	if slices.ContainsFunc(rep.Notes, func(n IncidentNote) bool { return n.active(now) }) {
+		rep.Status = "degraded"
+	}
+	return rep
+}
+
+// upstreamHealth is an http.RoundTripper recording the outcome of the
+// requests to a single provider on the status page.
+type upstreamHealth struct {
+	provider string
+	next     http.RoundTripper
+}
+
+func (t upstreamHealth) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	recordUpstreamHealth(req, t.provider, resp, err)
+	return resp, err
+}
+
+// recordUpstreamHealth records the answer of provider to req, unless the
+// caller gave up on it.
+func recordUpstreamHealth(req *http.Request, provider string, resp *http.Response, err error) {
+	if req.Context().Err() != nil {
+		return
+	}
+	status, failed := retryableUpstream(resp, err)
+	if !failed {
+		status = ""
+	}
+	serviceStatus.recordUpstream(provider, status, appClock.Now())
+}
+
+// cacheStatus sums the cache counters of every key prefix.
+func cacheStatus() CacheStatus {
+	st := CacheStatus{Backend: cacheBackendName()}
+	cacheCounters.Range(func(_, v any) bool {
+		c := v.(*cachePrefixCounters)
+		st.Hits += c.hits.Load()
+		st.Misses += c.misses.Load()
+		return true
+	})
+	if n := st.Hits + st.Misses; n > 0 {
+		st.HitRatio = math.Round(float64(st.Hits)/float64(n)*1e4) / 1e4
+	}
+	return st
+}
+
+// wantsJSON reports whether r asks for JSON rather than a page.
+func wantsJSON(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "json" {
+		return true
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(accept); err == nil && mediaType == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+// statusHandler serves GET /status.
+func statusHandler(tmpl *template.Template) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		recordHTTPRequest("/status", r.Method)
+		var breakers map[string]breakerState
+		if fipeBreaker != nil {
+			breakers = fipeBreaker.states()
+		}
+		rep := serviceStatus.report(appClock.Now(), breakers, cacheStatus())
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Add("Vary", "Accept")
+		if wantsJSON(r) {
+			b, _ := json.Marshal(rep)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := tmpl.Execute(w, rep); err != nil {
+			slog.ErrorContext(r.Context(), "render status page failed", "error", err)
+		}
+	}
+}
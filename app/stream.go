@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gofipe/pkg/fipe"
+)
+
+// --- Streaming list proxy ---
+//
+// Brand, model and year list misses whose FIPE body is at least
+// GOFIPE_STREAM_MIN_BYTES (-stream-min-bytes, default 32 KiB; 0 disables)
+// or of unknown size are streamed to the client as they arrive and copied
+// into the cache on the way, instead of being read whole with io.ReadAll
+// first. The first byte leaves as soon as FIPE sends it, and the cache copy
+// is allocated once at the announced size. Concurrent misses on the same
+// list still share the one FIPE request and get the payload when the
+// stream completes. Shard mode keeps the buffered path.
+
+// streamMinBytes is set from Config at startup.
+var streamMinBytes int64 = defaultStreamMinBytes
+
+const defaultStreamMinBytes = 32 << 10
+
+// streamedListsCounter counts list misses streamed from FIPE.
+var streamedListsCounter = newBudgetedCounterVec(
+	prometheus.CounterOpts{
+		Name: "fipe_upstream_streamed_total",
+		Help: "List cache misses streamed from FIPE to the client by cache key prefix",
+	},
+	[]string{"prefix"},
+)
+
+func init() {
+	registerBudgeted(streamedListsCounter)
+}
+
+// streamListMiss answers a cache miss on src, streaming large bodies. It
+// reports false, writing nothing, when streaming does not apply.
+func streamListMiss(w http.ResponseWriter, r *http.Request, c *fipe.Client, src fipe.Source) bool {
+	if streamMinBytes <= 0 || shard != nil {
+		return false
+	}
+	recordCacheMiss(src.Key)
+	prefix, _, _ := strings.Cut(src.Key, ":")
+	leader, streamed := false, false
+	v, err, shared := upstreamFetches.Do(src.Key, func() (interface{}, error) {
+		leader = true
+		// The fetch fills the shared cache entry, so it outlives the client.
+		return streamAndCache(context.WithoutCancel(r.Context()), w, c, src, &streamed)
+	})
+	if shared && !leader {
+		coalescedFetchesCounter.Inc(prefix)
+	}
+	if streamed {
+		if err != nil {
+			// The status line is gone; cut the connection so the client sees
+			// a truncated body rather than a short valid one.
+			panic(http.ErrAbortHandler)
+		}
+		streamedListsCounter.Inc(prefix)
+		return true
+	}
+	var data []byte
+	if err == nil {
+		data = v.([]byte)
+	} else if d, ok := seededPayload(src.Key); ok {
+		data, err = d, nil
+	}
+	writeCachedJSON(w, data, err)
+	return true
+}
+
+// streamAndCache fetches src, copying it to w as it arrives when it is
+// large. streamed reports whether anything was written to w.
+func streamAndCache(ctx context.Context, w http.ResponseWriter, c *fipe.Client, src fipe.Source, streamed *bool) ([]byte, error) {
+	body, size, err := c.Open(ctx, src.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	if size >= 0 && size < streamMinBytes {
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		setToCache(src.Key, data, src.TTL)
+		return data, nil
+	}
+
+	var buf bytes.Buffer
+	if size > 0 {
+		buf.Grow(int(size))
+	}
+	h := w.Header()
+	h["Content-Type"] = jsonContentType
+	setVaryEncoding(h)
+	if size >= 0 {
+		h.Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	if _, err := io.Copy(&clientTee{w: w, buf: &buf, streamed: streamed}, body); err != nil {
+		return nil, fmt.Errorf("streaming %s: %w", src.Path, err)
+	}
+	setToCache(src.Key, buf.Bytes(), src.TTL)
+	return buf.Bytes(), nil
+}
+
+// clientTee copies a stream into buf and to the client, setting streamed
+// once it wrote to the client. Client write errors stop the client copy
+// only, so a disconnect does not cut the shared fetch.
+type clientTee struct {
+	w        io.Writer
+	buf      *bytes.Buffer
+	streamed *bool
+	failed   bool
+}
+
+func (t *clientTee) Write(p []byte) (int, error) {
+	*t.streamed = true
+	t.buf.Write(p)
+	if !t.failed {
+		if _, err := t.w.Write(p); err != nil {
+			t.failed = true
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gofipe/pkg/fipe"
+)
+
+// --- Synthetic transaction check ---
+//
+// A background job periodically walks brands -> models -> years -> price for
+// a canary vehicle straight against the upstream (bypassing the cache), so a
+// silently stale or broken FIPE source shows up in metrics before users
+// notice it.
+//
+// GOFIPE_SYNTHETIC_INTERVAL sets how often the check runs (default 15m, "0"
+// disables it). GOFIPE_SYNTHETIC_VEHICLE selects the canary as
+// "type/brandId/modelId/yearId"; empty or missing segments pick the first
+// entry listed by the upstream (default "cars").
+
+const defaultSyntheticInterval = 15 * time.Minute
+
+var (
+	syntheticSuccessGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "fipe_synthetic_check_success",
+		Help: "Whether the last synthetic brands-to-price check succeeded (1) or failed (0)",
+	})
+	syntheticDurationGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "fipe_synthetic_check_duration_seconds",
+		Help: "Duration of the last synthetic check",
+	})
+	syntheticLastSuccessGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "fipe_synthetic_check_last_success_timestamp_seconds",
+		Help: "Unix time of the last successful synthetic check",
+	})
+	syntheticFailuresCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "fipe_synthetic_check_failures_total",
+		Help: "Failed synthetic checks by the step that failed",
+	}, []string{"step"})
+	referenceAgeGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "fipe_data_reference_age_months",
+		Help: "Months between the current month and the reference month returned for the canary vehicle",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(syntheticSuccessGauge, syntheticDurationGauge, syntheticLastSuccessGauge, syntheticFailuresCounter, referenceAgeGauge)
+}
+
+// canaryVehicle identifies the vehicle looked up by the synthetic check.
+// Empty IDs are resolved to the first entry of the corresponding list.
+type canaryVehicle struct {
+	Type, BrandID, ModelID, YearID string
+}
+
+// syntheticStepError reports which lookup step of the check failed.
+type syntheticStepError struct {
+	step string
+	err  error
+}
+
+func (e *syntheticStepError) Error() string { return e.step + ": " + e.err.Error() }
+
+// startSyntheticChecks reads the environment and, unless disabled, runs the
+// check immediately and then on every interval in the background.
+func startSyntheticChecks() {
+	interval := defaultSyntheticInterval
+	if v := os.Getenv("GOFIPE_SYNTHETIC_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("Invalid GOFIPE_SYNTHETIC_INTERVAL: %v", err)
+		}
+		interval = d
+	}
+	if interval <= 0 {
+		return
+	}
+	canary := parseCanaryVehicle(os.Getenv("GOFIPE_SYNTHETIC_VEHICLE"))
+
+	go func() {
+		for {
+			runSyntheticCheck(canary)
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// parseCanaryVehicle parses "type/brandId/modelId/yearId"; missing parts stay empty.
+func parseCanaryVehicle(s string) canaryVehicle {
+	parts := strings.SplitN(strings.Trim(s, "/"), "/", 4)
+	for len(parts) < 4 {
+		parts = append(parts, "")
+	}
+	c := canaryVehicle{Type: parts[0], BrandID: parts[1], ModelID: parts[2], YearID: parts[3]}
+	if c.Type == "" {
+		c.Type = "cars"
+	}
+	return c
+}
+
+// runSyntheticCheck performs one check and records its metrics.
+func runSyntheticCheck(canary canaryVehicle) {
+	start := time.Now()
+	pr, err := syntheticLookup(canary)
+	syntheticDurationGauge.Set(time.Since(start).Seconds())
+
+	if err != nil {
+		syntheticSuccessGauge.Set(0)
+		step := "unknown"
+		if se, ok := err.(*syntheticStepError); ok {
+			step = se.step
+		}
+		syntheticFailuresCounter.WithLabelValues(step).Inc()
+		serviceStatus.recordCheck(appClock.Now(), "", step, err)
+		slog.Error("synthetic check failed", "error", err)
+		return
+	}
+
+	syntheticSuccessGauge.Set(1)
+	serviceStatus.recordCheck(appClock.Now(), pr.ReferenceMonth, "", nil)
+	syntheticLastSuccessGauge.Set(float64(time.Now().Unix()))
+	if month, year, ok := parseReferenceMonth(pr.ReferenceMonth); ok {
+		referenceAgeGauge.Set(float64(monthsBetween(year, month, fipeNow())))
+	} else {
+		slog.Warn("synthetic check cannot parse reference month", "reference_month", pr.ReferenceMonth)
+	}
+}
+
+// syntheticLookup walks brands -> models -> years -> price for the canary.
+// The cache is bypassed so every step exercises FIPE.
+func syntheticLookup(c canaryVehicle) (fipe.Price, error) {
+	ctx := withUpstreamPriority(context.Background(), upstreamBackground)
+	client := fipeClient.Uncached()
+
+	brands, err := client.Brands(ctx, c.Type)
+	brandId, err := syntheticPick("brands", brands, err, c.BrandID)
+	if err != nil {
+		return fipe.Price{}, err
+	}
+	models, err := client.Models(ctx, c.Type, brandId)
+	modelId, err := syntheticPick("models", models, err, c.ModelID)
+	if err != nil {
+		return fipe.Price{}, err
+	}
+	years, err := client.Years(ctx, c.Type, brandId, modelId)
+	yearId, err := syntheticPick("years", years, err, c.YearID)
+	if err != nil {
+		return fipe.Price{}, err
+	}
+
+	pr, err := client.Price(ctx, c.Type, brandId, modelId, yearId)
+	if err != nil {
+		return pr, &syntheticStepError{"price", err}
+	}
+	if _, err := pr.Value(); err != nil {
+		return pr, &syntheticStepError{"price", fmt.Errorf("unparsable price %q", pr.Price)}
+	}
+	return pr, nil
+}
+
+// syntheticPick checks a fetched reference list and returns want if listed,
+// or the first code when want is empty.
+func syntheticPick(step string, items []fipe.Reference, err error, want string) (string, error) {
+	if err != nil {
+		return "", &syntheticStepError{step, err}
+	}
+	if len(items) == 0 {
+		return "", &syntheticStepError{step, fmt.Errorf("empty list")}
+	}
+	if want == "" {
+		return items[0].Code, nil
+	}
+	for _, it := range items {
+		if it.Code == want {
+			return want, nil
+		}
+	}
+	return "", &syntheticStepError{step, fmt.Errorf("code %q not listed", want)}
+}
+
+// monthsBetween returns how many calendar months separate year/month from now.
+func monthsBetween(year int, month time.Month, now time.Time) int {
+	return (now.Year()*12 + int(now.Month())) - (year*12 + int(month))
+}
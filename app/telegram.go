@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Telegram price subscriptions ---
+//
+// With GOFIPE_TELEGRAM_BOT_TOKEN set next to GOFIPE_TELEGRAM_SECRET and a
+// history store (GOFIPE_HISTORY_DB), the Telegram chatbot also takes
+// subscriptions:
+//
+//   - /assinar onix 2019 subscribes the chat to the vehicle the query
+//     resolves to, answering with its current price.
+//   - /assinaturas lists the chat's subscriptions, numbered.
+//   - /cancelar 2 (or /cancelar onix 2019) removes one.
+//
+// Subscribed vehicles join the history collector, and when it stores a newly
+// published reference table in which their price changed, each chat gets one
+// message summarizing its vehicles. Unlike the free-text answers, these are
+// sent through the Bot API, which is why the bot token is needed. Chats that
+// blocked the bot (403) lose their subscriptions.
+
+const (
+	maxTelegramSubscriptions = 10
+	telegramAPIBase          = "https://api.telegram.org"
+)
+
+// telegramBotToken enables subscriptions when set.
+var telegramBotToken = os.Getenv("GOFIPE_TELEGRAM_BOT_TOKEN")
+
+// telegramSubscriptionHelp is added to chatbotHelp when subscriptions are on.
+const telegramSubscriptionHelp = "Para receber as mudanças de preço de cada mês, envie \"/assinar Onix 2019\". " +
+	"\"/assinaturas\" lista os veículos assinados e \"/cancelar 1\" cancela uma assinatura."
+
+// telegramSubscriptionsEnabled reports whether subscriptions are configured.
+func telegramSubscriptionsEnabled() bool {
+	return telegramBotToken != "" && historyDB != nil
+}
+
+// telegramSubscription is a vehicle a chat subscribed to.
+type telegramSubscription struct {
+	watchedVehicle
+	Label string
+}
+
+// addTelegramSubscription subscribes chat to v, reporting whether it is new.
+func (s *historyStore) addTelegramSubscription(ctx context.Context, chat int64, v watchedVehicle, label string) (bool, error) {
+	res, err := s.db.ExecContext(ctx, s.rebind(`INSERT INTO telegram_subscriptions
+		(chat_id, vehicle_type, brand_id, model_id, year_id, label, added_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING`),
+		chat, v.Type, v.BrandID, v.ModelID, v.YearID, label, appClock.Now().Unix())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// removeTelegramSubscription unsubscribes chat from v, reporting whether it
+// was subscribed.
+func (s *historyStore) removeTelegramSubscription(ctx context.Context, chat int64, v watchedVehicle) (bool, error) {
+	res, err := s.db.ExecContext(ctx, s.rebind(`DELETE FROM telegram_subscriptions
+		WHERE chat_id = ? AND vehicle_type = ? AND brand_id = ? AND model_id = ? AND year_id = ?`),
+		chat, v.Type, v.BrandID, v.ModelID, v.YearID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// telegramSubscriptions lists the subscriptions of chat, oldest first.
+func (s *historyStore) telegramSubscriptions(ctx context.Context, chat int64) ([]telegramSubscription, error) {
+	rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT vehicle_type, brand_id, model_id, year_id, label
+		FROM telegram_subscriptions WHERE chat_id = ? ORDER BY added_at, label`), chat)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []telegramSubscription
+	for rows.Next() {
+		var sub telegramSubscription
+		if err := rows.Scan(&sub.Type, &sub.BrandID, &sub.ModelID, &sub.YearID, &sub.Label); err != nil {
+			return nil, err
+		}
+		out = append(out, sub)
+	}
+	return out, rows.Err()
+}
+
+// telegramVehicles lists the vehicles any chat is subscribed to.
+func (s *historyStore) telegramVehicles(ctx context.Context) ([]watchedVehicle, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT DISTINCT vehicle_type, brand_id, model_id, year_id FROM telegram_subscriptions`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []watchedVehicle
+	for rows.Next() {
+		var v watchedVehicle
+		if err := rows.Scan(&v.Type, &v.BrandID, &v.ModelID, &v.YearID); err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, rows.Err()
+}
+
+// telegramSubscribers lists the chats subscribed to v.
+func (s *historyStore) telegramSubscribers(ctx context.Context, v watchedVehicle) ([]int64, error) {
+	rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT chat_id FROM telegram_subscriptions
+		WHERE vehicle_type = ? AND brand_id = ? AND model_id = ? AND year_id = ?`),
+		v.Type, v.BrandID, v.ModelID, v.YearID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []int64
+	for rows.Next() {
+		var chat int64
+		if err := rows.Scan(&chat); err != nil {
+			return nil, err
+		}
+		out = append(out, chat)
+	}
+	return out, rows.Err()
+}
+
+// telegramCommand splits a "/command@bot args" message.
+func telegramCommand(text string) (string, string) {
+	cmd, args, _ := strings.Cut(strings.TrimSpace(text), " ")
+	cmd, _, _ = strings.Cut(cmd, "@")
+	return strings.ToLower(cmd), strings.TrimSpace(args)
+}
+
+// telegramReply answers a Telegram message, handling the subscription
+// commands when enabled, and returns the result label.
+func telegramReply(ctx context.Context, chat int64, text string) (string, string) {
+	if !telegramSubscriptionsEnabled() {
+		return chatbotReply(ctx, text)
+	}
+	cmd, args := telegramCommand(text)
+	switch cmd {
+	case "/assinar", "/subscribe":
+		return telegramSubscribe(ctx, chat, args)
+	case "/assinaturas", "/subscriptions":
+		return telegramListSubscriptions(ctx, chat)
+	case "/cancelar", "/unsubscribe":
+		return telegramUnsubscribe(ctx, chat, args)
+	}
+	reply, result := chatbotReply(ctx, text)
+	if result == "help" {
+		reply += "\n\n" + telegramSubscriptionHelp
+	}
+	return reply, result
+}
+
+// telegramSubscribe serves /assinar.
+func telegramSubscribe(ctx context.Context, chat int64, args string) (string, string) {
+	if args == "" {
+		return telegramSubscriptionHelp, "help"
+	}
+	subs, err := historyDB.telegramSubscriptions(ctx, chat)
+	if err != nil {
+		slog.ErrorContext(ctx, "telegram subscriptions query failed", "error", err)
+		return "As assinaturas estão indisponíveis no momento. Tente novamente mais tarde.", "error"
+	}
+	if len(subs) >= maxTelegramSubscriptions {
+		return fmt.Sprintf("Você já assina %d veículos, o máximo. Cancele um com \"/cancelar\" antes.", maxTelegramSubscriptions), "subscription"
+	}
+	q := parseVehicleQuery(args)
+	rv, pr, err := lookupVehiclePrice(ctx, q)
+	switch {
+	case errors.Is(err, errVehicleNotFound):
+		return "Não encontrei esse veículo na tabela FIPE. " + chatbotHelp, "not_found"
+	case errors.Is(err, errYearNotFound):
+		return fmt.Sprintf("O %s não tem preço FIPE para %s. Tente outro ano.", rv.ModelName, q.Year), "not_found"
+	case err != nil:
+		slog.ErrorContext(ctx, "chatbot lookup failed", "query", truncateForLog(args), "error", err)
+		return "A tabela FIPE está indisponível no momento. Tente novamente mais tarde.", "error"
+	}
+	v := watchedVehicle{Type: rv.VehicleType, BrandID: rv.BrandID, ModelID: rv.ModelID, YearID: rv.YearID}
+	label := fmt.Sprintf("%s %s (%s)", pr.Brand, pr.Model, rv.YearName)
+	added, err := historyDB.addTelegramSubscription(ctx, chat, v, label)
+	if err != nil {
+		slog.ErrorContext(ctx, "telegram subscriptions query failed", "error", err)
+		return "As assinaturas estão indisponíveis no momento. Tente novamente mais tarde.", "error"
+	}
+	if !added {
+		return "Você já assina este veículo.\n\n" + formatPriceMessage(pr, rv), "subscription"
+	}
+	go func() {
+		ctx := withUpstreamPriority(context.Background(), upstreamBackground)
+		if err := historyDB.collect(ctx, []watchedVehicle{v}, nil); err != nil {
+			slog.Error("history collector failed", "error", err)
+		}
+	}()
+	return "Assinatura feita! Você vai receber as mudanças de preço deste veículo a cada nova tabela FIPE.\n\n" +
+		formatPriceMessage(pr, rv), "subscription"
+}
+
+// telegramListSubscriptions serves /assinaturas.
+func telegramListSubscriptions(ctx context.Context, chat int64) (string, string) {
+	subs, err := historyDB.telegramSubscriptions(ctx, chat)
+	if err != nil {
+		slog.ErrorContext(ctx, "telegram subscriptions query failed", "error", err)
+		return "As assinaturas estão indisponíveis no momento. Tente novamente mais tarde.", "error"
+	}
+	if len(subs) == 0 {
+		return "Você não assina nenhum veículo. " + telegramSubscriptionHelp, "subscription"
+	}
+	var b strings.Builder
+	b.WriteString("Suas assinaturas:\n")
+	for i, sub := range subs {
+		fmt.Fprintf(&b, "%d. %s\n", i+1, sub.Label)
+	}
+	b.WriteString("\nPara cancelar, envie \"/cancelar\" e o número.")
+	return b.String(), "subscription"
+}
+
+// telegramUnsubscribe serves /cancelar, taking a number of /assinaturas or
+// a vehicle query.
+func telegramUnsubscribe(ctx context.Context, chat int64, args string) (string, string) {
+	if args == "" {
+		return telegramListSubscriptions(ctx, chat)
+	}
+	subs, err := historyDB.telegramSubscriptions(ctx, chat)
+	if err != nil {
+		slog.ErrorContext(ctx, "telegram subscriptions query failed", "error", err)
+		return "As assinaturas estão indisponíveis no momento. Tente novamente mais tarde.", "error"
+	}
+	if len(subs) == 0 {
+		return "Você não assina nenhum veículo. " + telegramSubscriptionHelp, "subscription"
+	}
+	var target *telegramSubscription
+	if n, err := strconv.Atoi(args); err == nil {
+		if n < 1 || n > len(subs) {
+			return fmt.Sprintf("Envie um número de 1 a %d, como listado em \"/assinaturas\".", len(subs)), "subscription"
+		}
+		target = &subs[n-1]
+	} else if rv, err := resolveVehicle(ctx, parseVehicleQuery(args)); err == nil {
+		for i, sub := range subs {
+			if sub.watchedVehicle == (watchedVehicle{rv.VehicleType, rv.BrandID, rv.ModelID, rv.YearID}) {
+				target = &subs[i]
+			}
+		}
+	}
+	if target == nil {
+		return "Você não assina esse veículo. Veja suas assinaturas com \"/assinaturas\".", "subscription"
+	}
+	if _, err := historyDB.removeTelegramSubscription(ctx, chat, target.watchedVehicle); err != nil {
+		slog.ErrorContext(ctx, "telegram subscriptions query failed", "error", err)
+		return "As assinaturas estão indisponíveis no momento. Tente novamente mais tarde.", "error"
+	}
+	return "Assinatura cancelada: " + target.Label, "subscription"
+}
+
+// telegramAlertURL is the alert digest key of a chat.
+func telegramAlertURL(chat int64) string {
+	return "telegram:" + strconv.FormatInt(chat, 10)
+}
+
+// telegramAlertChat returns the chat of a telegramAlertURL.
+func telegramAlertChat(u string) (int64, bool) {
+	rest, ok := strings.CutPrefix(u, "telegram:")
+	if !ok {
+		return 0, false
+	}
+	chat, err := strconv.ParseInt(rest, 10, 64)
+	return chat, err == nil
+}
+
+// telegramChangeMessage renders the price changes of a chat's vehicles.
+func telegramChangeMessage(events []PriceChangeEvent) string {
+	var b strings.Builder
+	b.WriteString("Novos preços na tabela FIPE:\n")
+	for _, ev := range events {
+		fmt.Fprintf(&b, "\n%s %s - FIPE %s\n%s: %s\n%s: %s (%s)\n", ev.Brand, ev.Model, ev.CodeFipe,
+			ev.PreviousReferenceMonth, formatBRL(ev.PreviousPrice),
+			ev.ReferenceMonth, formatBRL(ev.Price), formatChangePercent(ev.ChangePercent))
+	}
+	b.WriteString("\nPara parar de receber, envie \"/cancelar\".")
+	return b.String()
+}
+
+// telegramNotify sends the price changes to chat, retrying with exponential
+// backoff. Chats that blocked the bot are unsubscribed.
+func telegramNotify(chat int64, events []PriceChangeEvent) {
+	body, _ := json.Marshal(map[string]interface{}{"chat_id": chat, "text": telegramChangeMessage(events)})
+	var err error
+	for attempt := 0; attempt < alertDeliveryAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(1<<attempt) * time.Second)
+		}
+		var resp *http.Response
+		resp, err = alertClient.Post(telegramAPIBase+"/bot"+telegramBotToken+"/sendMessage", "application/json", bytes.NewReader(body))
+		if err != nil {
+			// The error names the URL, which holds the token.
+			err = errors.New("request failed")
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			alertDeliveriesCounter.Inc("telegram", "delivered")
+			return
+		}
+		if resp.StatusCode == http.StatusForbidden {
+			alertDeliveriesCounter.Inc("telegram", "failed")
+			if _, err := historyDB.db.Exec(historyDB.rebind(`DELETE FROM telegram_subscriptions WHERE chat_id = ?`), chat); err != nil {
+				slog.Error("telegram subscriptions query failed", "error", err)
+			}
+			slog.Info("telegram chat blocked the bot, subscriptions removed", "chat_id", chat)
+			return
+		}
+		err = fmt.Errorf("status %d", resp.StatusCode)
+	}
+	alertDeliveriesCounter.Inc("telegram", "failed")
+	slog.Error("telegram price alert failed", "chat_id", chat, "attempts", alertDeliveryAttempts, "error", err)
+}
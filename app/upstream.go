@@ -0,0 +1,190 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// --- Upstream request scheduling ---
+//
+// At most GOFIPE_UPSTREAM_CONCURRENCY (-upstream-concurrency, default 16;
+// 0 disables the limit) FIPE requests are in flight at once. A request holds
+// its slot until its body is closed, so streamed lists count too. When every
+// slot is busy, waiting requests are served by priority rather than in
+// arrival order: interactive lookups first, then background work (price and
+// Sheets batches, synthetic checks), FIFO within a priority. A batch job can
+// then keep FIPE busy without making the UI wait behind it. Waiting counts
+// against the FIPE request timeout.
+
+const defaultUpstreamConcurrency = 16
+
+// upstreamPriority orders requests waiting for an upstream slot; lower
+// values go first.
+type upstreamPriority int
+
+const (
+	upstreamInteractive upstreamPriority = iota
+	upstreamBackground
+)
+
+var upstreamPriorityNames = [...]string{"interactive", "background"}
+
+// upstreamQueueWait observes how long requests waited for a slot.
+var upstreamQueueWait = newBudgetedHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "fipe_upstream_queue_wait_seconds",
+		Help:    "Time FIPE requests waited for an upstream slot by priority, for requests that had to wait",
+		Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	},
+	[]string{"priority"},
+)
+
+func init() {
+	registerBudgeted(upstreamQueueWait)
+}
+
+type upstreamPriorityKey struct{}
+
+// withUpstreamPriority marks the FIPE requests made with ctx.
+func withUpstreamPriority(ctx context.Context, p upstreamPriority) context.Context {
+	return context.WithValue(ctx, upstreamPriorityKey{}, p)
+}
+
+// upstreamPriorityOf returns the priority of ctx, interactive by default.
+func upstreamPriorityOf(ctx context.Context) upstreamPriority {
+	p, _ := ctx.Value(upstreamPriorityKey{}).(upstreamPriority)
+	return p
+}
+
+// upstreamWaiter is a request queued for a slot.
+type upstreamWaiter struct {
+	priority upstreamPriority
+	seq      uint64
+	ready    chan struct{}
+	index    int // in the queue; -1 once granted or removed
+}
+
+// upstreamQueue is a heap of waiters by priority, then arrival.
+type upstreamQueue []*upstreamWaiter
+
+func (q upstreamQueue) Len() int { return len(q) }
+
+func (q upstreamQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority < q[j].priority
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q upstreamQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index, q[j].index = i, j
+}
+
+func (q *upstreamQueue) Push(x interface{}) {
+	w := x.(*upstreamWaiter)
+	w.index = len(*q)
+	*q = append(*q, w)
+}
+
+func (q *upstreamQueue) Pop() interface{} {
+	old := *q
+	w := old[len(old)-1]
+	old[len(old)-1] = nil
+	w.index = -1
+	*q = old[:len(old)-1]
+	return w
+}
+
+// upstreamLimiter is an http.RoundTripper bounding concurrent requests.
+type upstreamLimiter struct {
+	next http.RoundTripper
+
+	mu      sync.Mutex
+	free    int
+	seq     uint64
+	waiting upstreamQueue
+}
+
+// newUpstreamLimiter allows n concurrent requests through next.
+func newUpstreamLimiter(next http.RoundTripper, n int) *upstreamLimiter {
+	return &upstreamLimiter{next: next, free: n}
+}
+
+// acquire takes a slot, waiting by priority while none is free.
+func (l *upstreamLimiter) acquire(ctx context.Context) error {
+	p := upstreamPriorityOf(ctx)
+	l.mu.Lock()
+	if l.free > 0 {
+		l.free--
+		l.mu.Unlock()
+		return nil
+	}
+	l.seq++
+	w := &upstreamWaiter{priority: p, seq: l.seq, ready: make(chan struct{})}
+	heap.Push(&l.waiting, w)
+	l.mu.Unlock()
+
+	start := time.Now()
+	select {
+	case <-w.ready:
+		upstreamQueueWait.Observe(time.Since(start).Seconds(), upstreamPriorityNames[p])
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		granted := w.index < 0
+		if !granted {
+			heap.Remove(&l.waiting, w.index)
+		}
+		l.mu.Unlock()
+		if granted {
+			// The slot was handed over as the context ended; pass it on.
+			l.release()
+		}
+		return ctx.Err()
+	}
+}
+
+// release frees a slot, handing it to the first waiter if any.
+func (l *upstreamLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.waiting) > 0 {
+		close(heap.Pop(&l.waiting).(*upstreamWaiter).ready)
+		return
+	}
+	l.free++
+}
+
+// RoundTrip implements http.RoundTripper; the slot is freed when the
+// response body is closed.
+func (l *upstreamLimiter) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := l.acquire(req.Context()); err != nil {
+		return nil, err
+	}
+	resp, err := l.next.RoundTrip(req)
+	if err != nil {
+		l.release()
+		return nil, err
+	}
+	resp.Body = &slotBody{ReadCloser: resp.Body, release: sync.OnceFunc(l.release)}
+	return resp, nil
+}
+
+// slotBody frees its upstream slot on Close.
+type slotBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *slotBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
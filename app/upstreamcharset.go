@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/transform"
+)
+
+// --- Upstream character encoding ---
+//
+// Some FIPE mirrors answer in Latin-1, or mix Latin-1 accented model names
+// into UTF-8 payloads, which breaks JSON consumers downstream. FIPE answers
+// are made valid UTF-8 before anything reads them: bodies declared as
+// ISO-8859-1 or Windows-1252 are transcoded whole, and bytes of other
+// bodies that are not valid UTF-8 are read as Windows-1252, the superset of
+// Latin-1 such payloads come in. Bodies are fixed as they are read, so
+// large answers still stream; since fixing may change their size, it is
+// reported as unknown. Fixed answers are logged and counted in
+// fipe_upstream_transcoded_total.
+
+// upstreamTranscodedCounter counts FIPE answers that were not UTF-8.
+var upstreamTranscodedCounter = newBudgetedCounterVec(
+	prometheus.CounterOpts{
+		Name: "fipe_upstream_transcoded_total",
+		Help: "FIPE answers transcoded to UTF-8 by endpoint",
+	},
+	[]string{"endpoint"},
+)
+
+func init() {
+	registerBudgeted(upstreamTranscodedCounter)
+}
+
+// upstreamCharsetGuard is an http.RoundTripper making the answers of next
+// valid UTF-8.
+type upstreamCharsetGuard struct {
+	next http.RoundTripper
+}
+
+func (g upstreamCharsetGuard) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := g.next.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	fixer := &utf8Fixer{url: req.URL.String(), latin1: latin1Charset(resp.Header.Get("Content-Type"))}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{transform.NewReader(resp.Body, fixer), resp.Body}
+	// Whether bytes change is only known once they are read.
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	return resp, nil
+}
+
+// latin1Charset reports whether a Content-Type declares a Latin-1 charset.
+func latin1Charset(contentType string) bool {
+	_, params, _ := mime.ParseMediaType(contentType)
+	switch strings.ToLower(params["charset"]) {
+	case "iso-8859-1", "latin1", "windows-1252", "cp1252":
+		return true
+	}
+	return false
+}
+
+// utf8Fixer is a transform.Transformer passing valid UTF-8 through and
+// reading other bytes as Windows-1252.
+type utf8Fixer struct {
+	url string
+	// latin1 reads every non-ASCII byte as Windows-1252.
+	latin1 bool
+	// fixed is set once a byte was transcoded.
+	fixed bool
+}
+
+func (f *utf8Fixer) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	var buf [utf8.UTFMax]byte
+	for nSrc < len(src) {
+		seq := src[nSrc : nSrc+1]
+		if seq[0] >= utf8.RuneSelf && !f.latin1 {
+			if !atEOF && !utf8.FullRune(src[nSrc:]) {
+				return nDst, nSrc, transform.ErrShortSrc
+			}
+			if r, size := utf8.DecodeRune(src[nSrc:]); r != utf8.RuneError || size > 1 {
+				seq = src[nSrc : nSrc+size]
+			}
+		}
+		n := len(seq)
+		if seq[0] >= utf8.RuneSelf && n == 1 {
+			seq = buf[:utf8.EncodeRune(buf[:], charmap.Windows1252.DecodeByte(seq[0]))]
+			f.transcoded()
+		}
+		if nDst+len(seq) > len(dst) {
+			return nDst, nSrc, transform.ErrShortDst
+		}
+		nDst += copy(dst[nDst:], seq)
+		nSrc += n
+	}
+	return nDst, nSrc, nil
+}
+
+func (f *utf8Fixer) Reset() {}
+
+// transcoded records the first transcoded byte of an answer.
+func (f *utf8Fixer) transcoded() {
+	if f.fixed {
+		return
+	}
+	f.fixed = true
+	upstreamTranscodedCounter.Inc(upstreamEndpoint(f.url))
+	slog.Warn("upstream answer is not UTF-8, transcoded from Windows-1252", "upstream_url", f.url)
+}
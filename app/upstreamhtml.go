@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// --- Upstream HTML answers ---
+//
+// FIPE, or a CDN in front of it, sometimes answers 200 with an HTML page
+// (a maintenance notice, a captcha challenge) instead of JSON. Such answers
+// become an *upstreamHTMLError before anything reads them, so they are
+// never cached or streamed to clients. As errors they count as FIPE
+// failures everywhere: they are retried, open the circuit breaker, make
+// the request fall back to the next upstream provider, are logged with the
+// page title and are counted in fipe_upstream_errors_total with status
+// "html". An answer is HTML when its Content-Type says so or its body
+// starts with "<".
+
+// upstreamHTMLSniffLen is how much of a body is read to tell HTML apart.
+const upstreamHTMLSniffLen = 1024
+
+// upstreamHTMLTitle matches the title of an HTML page.
+var upstreamHTMLTitle = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+
+// upstreamTransport is the transport FIPE requests go out on. HTML pages
+// are told apart once made UTF-8, so their titles log right; sizes are
+// checked first, before anything buffers the body.
+var upstreamTransport http.RoundTripper = upstreamHTMLGuard{next: upstreamCharsetGuard{next: upstreamSizeGuard{next: http.DefaultTransport}}}
+
+// upstreamHTMLError is returned for 200 answers holding an HTML page.
+type upstreamHTMLError struct {
+	title string
+}
+
+func (e *upstreamHTMLError) Error() string {
+	if e.title == "" {
+		return "FIPE answered with an HTML page"
+	}
+	return fmt.Sprintf("FIPE answered with an HTML page (%q)", e.title)
+}
+
+// upstreamHTMLGuard is an http.RoundTripper turning HTML answers from next
+// into errors.
+type upstreamHTMLGuard struct {
+	next http.RoundTripper
+}
+
+func (g upstreamHTMLGuard) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := g.next.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	body := bufio.NewReaderSize(resp.Body, upstreamHTMLSniffLen)
+	head, _ := body.Peek(upstreamHTMLSniffLen)
+	if !strings.Contains(resp.Header.Get("Content-Type"), "html") && !bytes.HasPrefix(bytes.TrimSpace(head), []byte("<")) {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{body, resp.Body}
+		return resp, nil
+	}
+	resp.Body.Close()
+	e := &upstreamHTMLError{}
+	if m := upstreamHTMLTitle.FindSubmatch(head); m != nil {
+		e.title = strings.Join(strings.Fields(html.UnescapeString(string(m[1]))), " ")
+	}
+	return nil, e
+}
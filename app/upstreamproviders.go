@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gofipe/pkg/fipe"
+)
+
+// --- Upstream providers ---
+//
+// FIPE data can come from several providers, tried in the order of
+// GOFIPE_UPSTREAM_PROVIDERS (-upstream-providers, default "v2"), a
+// comma-separated list of:
+//
+//   - v2: the FIPE v2 API at GOFIPE_FIPE_BASE_URL (parallelum by default);
+//   - official: FIPE's own POST API behind veiculos.fipe.org.br, whose
+//     answers are translated to the v2 format;
+//   - an http(s) URL: a self-hosted mirror of the v2 API.
+//
+// When a provider fails (network errors, timeouts, 429 and 5xx answers)
+// the request falls back to the next one; other answers, 404 included, are
+// final. Each provider but the last gets an equal share of the time left
+// before the request's deadline, so a hanging provider leaves time for the
+// next ones. Each provider host has its own circuit breaker, and providers
+// whose breaker is open are skipped. Whatever answered, callers see v2
+// payloads, so cache keys and retries work as with a single provider. The
+// subscription token (GOFIPE_FIPE_TOKEN) is only sent to v2. Requests are
+// counted in fipe_upstream_provider_requests_total by provider and result.
+
+// officialFipeURL is the root of FIPE's own API.
+const officialFipeURL = "https://veiculos.fipe.org.br/api/veiculos"
+
+// officialTableTTL is how long the official provider keeps the code of
+// the current reference table.
+const officialTableTTL = time.Hour
+
+// upstreamProviderCounter counts provider requests by result.
+var upstreamProviderCounter = newBudgetedCounterVec(
+	prometheus.CounterOpts{
+		Name: "fipe_upstream_provider_requests_total",
+		Help: "Upstream FIPE requests by provider and result (ok, failed, skipped)",
+	},
+	[]string{"provider", "result"},
+)
+
+func init() {
+	registerBudgeted(upstreamProviderCounter)
+}
+
+// upstreamProvider answers FIPE v2 requests.
+type upstreamProvider interface {
+	// name labels the provider in metrics and logs.
+	name() string
+	// host keys the provider's circuit breaker.
+	host() string
+	// fetch answers req for path, relative to the v2 API root (e.g.
+	// /cars/brands), with a v2 payload.
+	fetch(req *http.Request, path string) (*http.Response, error)
+}
+
+// parseUpstreamProviders builds the providers of a GOFIPE_UPSTREAM_PROVIDERS
+// list, with baseURL as the v2 endpoint.
+func parseUpstreamProviders(list, baseURL string) ([]upstreamProvider, error) {
+	var out []upstreamProvider
+	for _, entry := range strings.Split(list, ",") {
+		switch entry = strings.TrimSpace(entry); {
+		case entry == "v2":
+			out = append(out, v2Provider{label: "v2", base: baseURL, token: true})
+		case entry == "official":
+			out = append(out, &officialProvider{url: officialFipeURL})
+		case strings.HasPrefix(entry, "http://") || strings.HasPrefix(entry, "https://"):
+			u, err := url.Parse(entry)
+			if err != nil || u.Host == "" {
+				return nil, fmt.Errorf("provider %q is not a valid URL", entry)
+			}
+			out = append(out, v2Provider{label: u.Host, base: strings.TrimRight(entry, "/")})
+		default:
+			return nil, fmt.Errorf("provider %q must be v2, official or a v2 mirror URL", entry)
+		}
+	}
+	return out, nil
+}
+
+// upstreamProviders is an http.RoundTripper trying providers in order.
+type upstreamProviders struct {
+	// basePath is the path of GOFIPE_FIPE_BASE_URL, stripped from request
+	// paths.
+	basePath  string
+	providers []upstreamProvider
+	// breaker, when set, keeps a circuit breaker per provider host.
+	breaker *upstreamBreaker
+}
+
+func newUpstreamProviders(baseURL string, providers []upstreamProvider, breaker *upstreamBreaker) upstreamProviders {
+	u, _ := url.Parse(baseURL)
+	return upstreamProviders{basePath: strings.TrimRight(u.Path, "/"), providers: providers, breaker: breaker}
+}
+
+func (t upstreamProviders) RoundTrip(req *http.Request) (*http.Response, error) {
+	path := strings.TrimPrefix(req.URL.Path, t.basePath)
+	var lastErr error
+	for i, p := range t.providers {
+		if t.breaker != nil {
+			if err := t.breaker.allow(p.host()); err != nil {
+				upstreamProviderCounter.Inc(p.name(), "skipped")
+				lastErr = err
+				continue
+			}
+		}
+		preq, cancel := providerRequest(req, len(t.providers)-i)
+		resp, err := p.fetch(preq, path)
+		if t.breaker != nil {
+			// Judged on req: running out of the provider's share of the
+			// deadline is a failure, the caller giving up is not.
+			t.breaker.done(req, p.host(), resp, err)
+		}
+		recordUpstreamHealth(req, p.name(), resp, err)
+		status, failed := retryableUpstream(resp, err)
+		if !failed {
+			// Errors not worth retrying, such as an oversized answer, are
+			// not worth asking another provider either.
+			result := "ok"
+			if err != nil {
+				result = "failed"
+			}
+			upstreamProviderCounter.Inc(p.name(), result)
+			if resp != nil {
+				resp.Body = cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+			} else {
+				cancel()
+			}
+			return resp, err
+		}
+		upstreamProviderCounter.Inc(p.name(), "failed")
+		if i == len(t.providers)-1 || req.Context().Err() != nil {
+			if resp != nil {
+				resp.Body = cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+			} else {
+				cancel()
+			}
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		cancel()
+		lastErr = err
+		slog.WarnContext(req.Context(), "upstream provider failed, falling back",
+			"provider", p.name(), "next", t.providers[i+1].name(), "path", path, "status", status)
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no upstream providers configured")
+	}
+	return nil, lastErr
+}
+
+// providerRequest returns req for one of the left providers still to try:
+// with a deadline, the provider gets an equal share of the time left.
+func providerRequest(req *http.Request, left int) (*http.Request, context.CancelFunc) {
+	deadline, ok := req.Context().Deadline()
+	if !ok || left <= 1 {
+		return req, func() {}
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), time.Until(deadline)/time.Duration(left))
+	return req.WithContext(ctx), cancel
+}
+
+// cancelOnClose releases a provider's deadline once its answer is read.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// v2Provider forwards requests to a FIPE v2 API.
+type v2Provider struct {
+	label string
+	base  string
+	// token sends the subscription token along.
+	token bool
+}
+
+func (p v2Provider) name() string { return p.label }
+
+func (p v2Provider) host() string {
+	u, _ := url.Parse(p.base)
+	return u.Host
+}
+
+func (p v2Provider) fetch(req *http.Request, path string) (*http.Response, error) {
+	u := p.base + path
+	if req.URL.RawQuery != "" {
+		u += "?" + req.URL.RawQuery
+	}
+	out, err := http.NewRequestWithContext(req.Context(), req.Method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	out.Header = req.Header.Clone()
+	if !p.token {
+		out.Header.Del(fipe.TokenHeader)
+	}
+	return upstreamTransport.RoundTrip(out)
+}
+
+// officialProvider translates v2 requests to FIPE's own POST API.
+type officialProvider struct {
+	url string
+
+	mu sync.Mutex
+	// current is the code of the current reference table, fetched at
+	// currentAt.
+	current   string
+	currentAt time.Time
+}
+
+func (p *officialProvider) name() string { return "official" }
+
+func (p *officialProvider) host() string {
+	u, _ := url.Parse(p.url)
+	return u.Host
+}
+
+// officialVehicleTypes are the official type codes and names of the v2
+// vehicle types.
+var officialVehicleTypes = map[string][2]string{
+	"cars":        {"1", "carro"},
+	"motorcycles": {"2", "moto"},
+	"trucks":      {"3", "caminhao"},
+}
+
+// officialItem is an item of the official lists.
+type officialItem struct {
+	Label string      `json:"Label"`
+	Value interface{} `json:"Value"`
+}
+
+func (p *officialProvider) fetch(req *http.Request, path string) (*http.Response, error) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) == 1 && parts[0] == "references" {
+		var tables []struct {
+			Codigo int    `json:"Codigo"`
+			Mes    string `json:"Mes"`
+		}
+		if resp, err := p.post(req, "ConsultarTabelaDeReferencia", url.Values{}, &tables); resp != nil || err != nil {
+			return resp, err
+		}
+		out := make([]fipe.ReferenceTable, len(tables))
+		for i, t := range tables {
+			// "outubro/2026 " in v2 is "outubro de 2026".
+			out[i] = fipe.ReferenceTable{Code: strconv.Itoa(t.Codigo), Month: strings.Replace(strings.TrimSpace(t.Mes), "/", " de ", 1)}
+		}
+		return officialJSON(req, http.StatusOK, out), nil
+	}
+	vehicleType, ok := officialVehicleTypes[parts[0]]
+	if !ok || len(parts) < 2 {
+		return officialJSON(req, http.StatusNotFound, nil), nil
+	}
+	table := req.URL.Query().Get("reference")
+	if table == "" {
+		var err error
+		if table, err = p.currentTable(req); err != nil {
+			return nil, err
+		}
+	}
+	form := url.Values{"codigoTabelaReferencia": {table}, "codigoTipoVeiculo": {vehicleType[0]}}
+	if parts[1] != "brands" {
+		// /{type}/{fipeCode}/years[/{yearId}]
+		if len(parts) < 3 || parts[2] != "years" || len(parts) > 4 {
+			return officialJSON(req, http.StatusNotFound, nil), nil
+		}
+		form.Set("modeloCodigoExterno", parts[1])
+		form.Set("tipoConsulta", "codigo")
+		if len(parts) == 3 {
+			return p.list(req, "ConsultarAnoModeloPeloCodigoFipe", form, "")
+		}
+		return p.price(req, form, vehicleType[1], parts[3])
+	}
+	if len(parts) == 2 {
+		return p.list(req, "ConsultarMarcas", form, "")
+	}
+	form.Set("codigoMarca", parts[2])
+	switch {
+	case len(parts) == 4 && parts[3] == "models":
+		return p.list(req, "ConsultarModelos", form, "Modelos")
+	case len(parts) == 6 && parts[3] == "models" && parts[5] == "years":
+		form.Set("codigoModelo", parts[4])
+		return p.list(req, "ConsultarAnoModelo", form, "")
+	case len(parts) == 7 && parts[3] == "models" && parts[5] == "years":
+		form.Set("codigoModelo", parts[4])
+		form.Set("tipoConsulta", "tradicional")
+		return p.price(req, form, vehicleType[1], parts[6])
+	}
+	return officialJSON(req, http.StatusNotFound, nil), nil
+}
+
+// list answers with the official list of method as a v2 list; field names
+// the member holding the list, "" when the answer is the list itself.
+func (p *officialProvider) list(req *http.Request, method string, form url.Values, field string) (*http.Response, error) {
+	var raw json.RawMessage
+	if resp, err := p.post(req, method, form, &raw); resp != nil || err != nil {
+		return resp, err
+	}
+	if field != "" {
+		var wrapped map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &wrapped); err != nil {
+			return nil, fmt.Errorf("official FIPE %s: %v", method, err)
+		}
+		raw = wrapped[field]
+	}
+	var items []officialItem
+	if err := json.Unmarshal(raw, &items); err != nil {
+		return nil, fmt.Errorf("official FIPE %s: %v", method, err)
+	}
+	out := make([]fipe.Reference, len(items))
+	for i, it := range items {
+		out[i] = fipe.Reference{Code: fmt.Sprint(it.Value), Name: it.Label}
+	}
+	return officialJSON(req, http.StatusOK, out), nil
+}
+
+// price answers with the official price of the year yearID as a v2 price.
+func (p *officialProvider) price(req *http.Request, form url.Values, vehicleType, yearID string) (*http.Response, error) {
+	year, fuel, ok := strings.Cut(yearID, "-")
+	if !ok {
+		return officialJSON(req, http.StatusNotFound, nil), nil
+	}
+	form.Set("anoModelo", year)
+	form.Set("codigoTipoCombustivel", fuel)
+	form.Set("tipoVeiculo", vehicleType)
+	if !form.Has("modeloCodigoExterno") {
+		form.Set("modeloCodigoExterno", "")
+	}
+	var v1 map[string]json.RawMessage
+	if resp, err := p.post(req, "ConsultarValorComTodosParametros", form, &v1); resp != nil || err != nil {
+		return resp, err
+	}
+	pr, err := priceFromCompat(v1)
+	if err != nil {
+		return nil, fmt.Errorf("official FIPE price: %w", err)
+	}
+	pr.ReferenceMonth = strings.TrimSpace(pr.ReferenceMonth)
+	return officialJSON(req, http.StatusOK, pr), nil
+}
+
+// currentTable returns the code of the current reference table.
+func (p *officialProvider) currentTable(req *http.Request) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.current != "" && time.Since(p.currentAt) < officialTableTTL {
+		return p.current, nil
+	}
+	var tables []struct {
+		Codigo int `json:"Codigo"`
+	}
+	resp, err := p.post(req, "ConsultarTabelaDeReferencia", url.Values{}, &tables)
+	if resp != nil {
+		resp.Body.Close()
+		return "", fmt.Errorf("official FIPE reference tables: status %d", resp.StatusCode)
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(tables) == 0 {
+		return "", fmt.Errorf("official FIPE lists no reference table")
+	}
+	p.current, p.currentAt = strconv.Itoa(tables[0].Codigo), time.Now()
+	return p.current, nil
+}
+
+// post calls method and decodes its answer into v. Answers other than a
+// decoded payload are returned as a response: the official status when it
+// is not 200, 404 when FIPE found nothing.
+func (p *officialProvider) post(req *http.Request, method string, form url.Values, v interface{}) (*http.Response, error) {
+	out, err := http.NewRequestWithContext(req.Context(), http.MethodPost, p.url+"/"+method, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	out.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	out.Header.Set("Referer", "https://veiculos.fipe.org.br/")
+	out.Header.Set("User-Agent", req.Header.Get("User-Agent"))
+	resp, err := upstreamTransport.RoundTrip(out)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return officialJSON(req, resp.StatusCode, nil), nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 8<<20))
+	if err != nil {
+		return nil, err
+	}
+	// Lookups that find nothing answer 200 with {"codigo": "0", "erro": "nadaencontrado"}.
+	var failure struct {
+		Erro string `json:"erro"`
+	}
+	if json.Unmarshal(body, &failure) == nil && failure.Erro != "" {
+		return officialJSON(req, http.StatusNotFound, nil), nil
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return nil, fmt.Errorf("official FIPE %s: %v", method, err)
+	}
+	return nil, nil
+}
+
+// officialJSON is a response to req with status and v as JSON body, or an
+// empty body when v is nil.
+func officialJSON(req *http.Request, status int, v interface{}) *http.Response {
+	var b []byte
+	if v != nil {
+		b, _ = json.Marshal(v)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(b)),
+		ContentLength: int64(len(b)),
+		Request:       req,
+	}
+}
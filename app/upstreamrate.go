@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// --- Upstream rate limiting ---
+//
+// The public FIPE API throttles anonymous clients, and a deployment going
+// over its quota gets every replica blocked. GOFIPE_UPSTREAM_RPS
+// (-upstream-rps, default 0 = unlimited) caps the FIPE requests a replica
+// sends per second with a token bucket holding up to GOFIPE_UPSTREAM_BURST
+// (-upstream-burst, default 10) tokens; divide the deployment's quota by
+// its replicas. Retries take tokens too. Requests over the rate are handled
+// by GOFIPE_UPSTREAM_RATE_MODE (-upstream-rate-mode):
+//
+//   - queue (default) delays them until a token is free, unless the wait
+//     would outlast the FIPE request timeout;
+//   - shed fails them at once.
+//
+// Requests refused either way get 503 with a Retry-After header, and are
+// counted in fipe_upstream_rate_limited_total. Tokens are taken once a
+// request holds an upstream slot (see upstream.go), so at most
+// GOFIPE_UPSTREAM_CONCURRENCY requests wait for tokens and interactive
+// requests still go before background work.
+
+// upstreamRateLimitedCounter counts requests over the upstream rate.
+var upstreamRateLimitedCounter = newBudgetedCounterVec(
+	prometheus.CounterOpts{
+		Name: "fipe_upstream_rate_limited_total",
+		Help: "FIPE requests over GOFIPE_UPSTREAM_RPS by priority and action (delayed, shed)",
+	},
+	[]string{"priority", "action"},
+)
+
+func init() {
+	registerBudgeted(upstreamRateLimitedCounter)
+}
+
+// upstreamThrottledError is returned for requests shed by the rate limit.
+type upstreamThrottledError struct {
+	retryAfter time.Duration
+}
+
+func (e *upstreamThrottledError) Error() string {
+	return fmt.Sprintf("FIPE request rate limit reached, retry in %s", e.retryAfter.Round(time.Millisecond))
+}
+
+// upstreamRateLimiter is an http.RoundTripper sending at most rate
+// requests per second through next, in bursts of up to burst.
+type upstreamRateLimiter struct {
+	next  http.RoundTripper
+	rate  float64
+	burst float64
+	shed  bool
+
+	mu sync.Mutex
+	// tokens is the bucket level at last; below zero, the tokens promised
+	// to waiting requests.
+	tokens float64
+	last   time.Time
+}
+
+func newUpstreamRateLimiter(next http.RoundTripper, rate float64, burst int, shed bool) *upstreamRateLimiter {
+	return &upstreamRateLimiter{next: next, rate: rate, burst: float64(burst), shed: shed, tokens: float64(burst), last: time.Now()}
+}
+
+// reserve takes a token and returns how long to wait before using it.
+func (l *upstreamRateLimiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// cancel returns a reserved token that was not used.
+func (l *upstreamRateLimiter) cancel() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens++
+}
+
+func (l *upstreamRateLimiter) RoundTrip(req *http.Request) (*http.Response, error) {
+	wait := l.reserve()
+	if wait == 0 {
+		return l.next.RoundTrip(req)
+	}
+	ctx := req.Context()
+	priority := upstreamPriorityNames[upstreamPriorityOf(ctx)]
+	deadline, ok := ctx.Deadline()
+	if l.shed || (ok && time.Until(deadline) <= wait) {
+		l.cancel()
+		upstreamRateLimitedCounter.Inc(priority, "shed")
+		return nil, &upstreamThrottledError{retryAfter: wait}
+	}
+	upstreamRateLimitedCounter.Inc(priority, "delayed")
+	timer := time.NewTimer(wait)
+	select {
+	case <-ctx.Done():
+		timer.Stop()
+		l.cancel()
+		return nil, ctx.Err()
+	case <-timer.C:
+	}
+	return l.next.RoundTrip(req)
+}
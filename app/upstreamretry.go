@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// --- Upstream retries ---
+//
+// Transient FIPE failures (network errors and timeouts, 429 and 500, 502,
+// 503, 504 answers) are retried up to GOFIPE_UPSTREAM_RETRIES times
+// (-upstream-retries, default 2; 0 disables) before reaching the caller as
+// a 502. The first retry waits GOFIPE_UPSTREAM_RETRY_BACKOFF
+// (-upstream-retry-backoff, default 250ms), doubling after each, with a
+// random jitter of ±50% so replicas do not retry in lockstep; a Retry-After
+// header lengthens the wait. Retries share the FIPE request timeout and
+// stop when the next wait would exceed it. Each retry is counted in
+// fipe_upstream_retries_total by endpoint and the status that caused it.
+
+// upstreamRetriesCounter counts FIPE request retries.
+var upstreamRetriesCounter = newBudgetedCounterVec(
+	prometheus.CounterOpts{
+		Name: "fipe_upstream_retries_total",
+		Help: "Upstream FIPE API requests retried by endpoint and the status that caused the retry (network for timeouts and connection failures)",
+	},
+	[]string{"endpoint", "status"},
+)
+
+func init() {
+	registerBudgeted(upstreamRetriesCounter)
+}
+
+// upstreamRetry is an http.RoundTripper retrying transient failures of
+// idempotent requests with exponential backoff and jitter.
+type upstreamRetry struct {
+	next    http.RoundTripper
+	retries int
+	backoff time.Duration
+}
+
+func (t upstreamRetry) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return t.next.RoundTrip(req)
+	}
+	ctx := req.Context()
+	for attempt := 0; ; attempt++ {
+		resp, err := t.next.RoundTrip(req)
+		status, retryable := retryableUpstream(resp, err)
+		if !retryable || attempt == t.retries || ctx.Err() != nil {
+			return resp, err
+		}
+		d := t.backoff << attempt
+		d = d/2 + rand.N(d)
+		if resp != nil {
+			if after := retryAfter(resp.Header.Get("Retry-After")); after > d {
+				d = after
+			}
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= d {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+		upstreamRetriesCounter.Inc(upstreamEndpoint(req.URL.String()), status)
+		timer := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// retryableUpstream reports whether a FIPE answer is worth retrying, with
+// its status label.
+func retryableUpstream(resp *http.Response, err error) (string, bool) {
+	var throttled *upstreamThrottledError
+	if errors.As(err, &throttled) {
+		// Shed by the rate limit, which retrying would only add to.
+		return "", false
+	}
+	var open *breakerOpenError
+	if errors.As(err, &open) {
+		// Every provider's breaker is open; retrying would fail the same.
+		return "", false
+	}
+	var tooLarge *upstreamTooLargeError
+	if errors.As(err, &tooLarge) {
+		// Refused by the size limit; FIPE would send the same answer again.
+		return "", false
+	}
+	var page *upstreamHTMLError
+	if errors.As(err, &page) {
+		return "html", true
+	}
+	if err != nil {
+		return "network", true
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return strconv.Itoa(resp.StatusCode), true
+	}
+	return "", false
+}
+
+// retryAfter parses a Retry-After header, in seconds or as an HTTP date.
+func retryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if s, err := strconv.Atoi(v); err == nil && s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	if at, err := http.ParseTime(v); err == nil {
+		return time.Until(at)
+	}
+	return 0
+}
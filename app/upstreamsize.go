@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// --- Upstream size limit ---
+//
+// FIPE answers larger than GOFIPE_UPSTREAM_MAX_BYTES (-upstream-max-bytes,
+// default 8 MiB; 0 disables the limit) are refused instead of being
+// buffered into memory and the cache: at once when FIPE announces their
+// size, otherwise as soon as reading passes the limit. Either way the
+// request fails with an *upstreamTooLargeError, so nothing is cached and
+// a streamed list is cut rather than passed on truncated. Like rate-limited
+// requests, refused answers are not retried, do not count against the
+// circuit breaker and do not fall back to another provider. Refused answers
+// are logged and counted in fipe_upstream_oversized_total. The largest
+// FIPE lists are a few hundred KiB.
+
+const defaultUpstreamMaxBytes = 8 << 20
+
+// upstreamMaxBytes is set from Config at startup.
+var upstreamMaxBytes int64 = defaultUpstreamMaxBytes
+
+// upstreamOversizedCounter counts FIPE answers over upstreamMaxBytes.
+var upstreamOversizedCounter = newBudgetedCounterVec(
+	prometheus.CounterOpts{
+		Name: "fipe_upstream_oversized_total",
+		Help: "FIPE answers refused for exceeding GOFIPE_UPSTREAM_MAX_BYTES by endpoint",
+	},
+	[]string{"endpoint"},
+)
+
+func init() {
+	registerBudgeted(upstreamOversizedCounter)
+}
+
+// upstreamTooLargeError is returned for answers over upstreamMaxBytes.
+type upstreamTooLargeError struct {
+	limit int64
+}
+
+func (e *upstreamTooLargeError) Error() string {
+	return fmt.Sprintf("FIPE answer exceeds %d bytes", e.limit)
+}
+
+// upstreamSizeGuard is an http.RoundTripper refusing answers of next over
+// upstreamMaxBytes.
+type upstreamSizeGuard struct {
+	next http.RoundTripper
+}
+
+func (g upstreamSizeGuard) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := g.next.RoundTrip(req)
+	limit := upstreamMaxBytes
+	if err != nil || limit <= 0 {
+		return resp, err
+	}
+	url := req.URL.String()
+	if resp.ContentLength > limit {
+		resp.Body.Close()
+		return nil, oversizedUpstream(url, limit, resp.ContentLength)
+	}
+	resp.Body = &limitedBody{
+		Reader: io.LimitReader(resp.Body, limit+1),
+		body:   resp.Body,
+		url:    url,
+		limit:  limit,
+	}
+	return resp, nil
+}
+
+// limitedBody fails reads going past limit.
+type limitedBody struct {
+	io.Reader
+	body  io.Closer
+	url   string
+	limit int64
+	n     int64
+	// err is set once the limit was passed.
+	err error
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	n, err := b.Reader.Read(p)
+	b.n += int64(n)
+	if b.n > b.limit {
+		b.err = oversizedUpstream(b.url, b.limit, -1)
+		return n - int(b.n-b.limit), b.err
+	}
+	return n, err
+}
+
+func (b *limitedBody) Close() error {
+	return b.body.Close()
+}
+
+// oversizedUpstream records an answer of size bytes (-1 when unknown) over
+// limit from url and returns its error.
+func oversizedUpstream(url string, limit, size int64) error {
+	upstreamOversizedCounter.Inc(upstreamEndpoint(url))
+	slog.Warn("upstream answer too large, refused", "upstream_url", url, "limit_bytes", limit, "size_bytes", size)
+	return &upstreamTooLargeError{limit: limit}
+}
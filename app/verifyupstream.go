@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"time"
+
+	"gofipe/pkg/fipe"
+)
+
+// --- Upstream contract check ---
+//
+// "gofipe verify-upstream" runs live checks against the FIPE API and exits
+// non-zero when one fails, so a scheduled canary job catches upstream API
+// changes before users do. It walks the API the way the app does: the
+// reference tables, the brands of each vehicle type, then the models,
+// years and price of the first car brand, the lookup by the FIPE code of
+// that price and its price in the previous table. Each check verifies the
+// fields the app reads are present with the expected JSON types, that
+// lists are not empty, and that prices and reference months parse. Checks
+// whose input is missing are skipped. The report goes to stdout:
+//
+//	PASS references         36 tables, newest outubro de 2026 (212ms)
+//	FAIL price              field "price": "R$ -" is not a price (98ms)
+//	SKIP fipe code          needs price
+//	1 of 9 checks failed
+//
+// The exit status is 0 when every check passed, 1 otherwise and 2 for
+// invalid flags. The usual flags apply (-fipe-base-url, -http-timeout);
+// requests are neither cached nor retried.
+
+// errVerifySkipped marks a check whose input an earlier check did not get.
+var errVerifySkipped = errors.New("skipped")
+
+// upstreamVerifier holds what earlier checks learned for the later ones.
+type upstreamVerifier struct {
+	client *fipe.Client
+	refs   []map[string]interface{}
+	// brand, model and year are the car the lookup checks walk.
+	brand, model, year string
+	price              map[string]interface{}
+}
+
+// verifyCheck is a live check of the upstream contract.
+type verifyCheck struct {
+	name  string
+	needs string
+	run   func(ctx context.Context) (string, error)
+}
+
+// runVerifyUpstream runs the checks with args as flags, writes the report
+// to out and returns the exit status.
+func runVerifyUpstream(args []string, out io.Writer) int {
+	cfg, err := loadConfig(args)
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+		return 2
+	}
+	c := fipe.NewClient(cfg.FipeBaseURL)
+	c.HTTPClient.Timeout = cfg.HTTPTimeout
+	c.Token = cfg.FipeToken
+	// Check what FIPE sends, not what the client makes of it.
+	c.Raw = true
+	v := &upstreamVerifier{client: c}
+
+	fmt.Fprintf(out, "verifying %s\n", cfg.FipeBaseURL)
+	checks := v.checks()
+	failed := 0
+	for _, check := range checks {
+		start := time.Now()
+		detail, err := check.run(context.Background())
+		took := time.Since(start).Round(time.Millisecond)
+		switch {
+		case errors.Is(err, errVerifySkipped):
+			fmt.Fprintf(out, "SKIP %-18s needs %s\n", check.name, check.needs)
+		case err != nil:
+			failed++
+			fmt.Fprintf(out, "FAIL %-18s %v (%s)\n", check.name, err, took)
+		default:
+			fmt.Fprintf(out, "PASS %-18s %s (%s)\n", check.name, detail, took)
+		}
+	}
+	if failed > 0 {
+		fmt.Fprintf(out, "%d of %d checks failed\n", failed, len(checks))
+		return 1
+	}
+	fmt.Fprintf(out, "all %d checks passed\n", len(checks))
+	return 0
+}
+
+// checks lists the checks in running order.
+func (v *upstreamVerifier) checks() []verifyCheck {
+	checks := []verifyCheck{{"references", "", v.checkReferences}}
+	for _, vehicleType := range []string{"cars", "motorcycles", "trucks"} {
+		checks = append(checks, verifyCheck{"brands/" + vehicleType, "", func(ctx context.Context) (string, error) {
+			return v.checkBrands(ctx, vehicleType)
+		}})
+	}
+	return append(checks,
+		verifyCheck{"models", "brands/cars", v.checkModels},
+		verifyCheck{"years", "models", v.checkYears},
+		verifyCheck{"price", "years", v.checkPrice},
+		verifyCheck{"fipe code", "price", v.checkFipeCode},
+		verifyCheck{"past reference", "references and years", v.checkPastReference},
+	)
+}
+
+func (v *upstreamVerifier) checkReferences(ctx context.Context) (string, error) {
+	refs, err := v.list(ctx, "/references", "code", "month")
+	if err != nil {
+		return "", err
+	}
+	newest := refs[0]["month"].(string)
+	if _, _, ok := parseReferenceMonth(newest); !ok {
+		return "", fmt.Errorf("reference month %q does not parse", newest)
+	}
+	v.refs = refs
+	return fmt.Sprintf("%d tables, newest %s", len(refs), newest), nil
+}
+
+func (v *upstreamVerifier) checkBrands(ctx context.Context, vehicleType string) (string, error) {
+	brands, err := v.list(ctx, "/"+vehicleType+"/brands", "code", "name")
+	if err != nil {
+		return "", err
+	}
+	if vehicleType == "cars" {
+		v.brand = brands[0]["code"].(string)
+	}
+	return fmt.Sprintf("%d brands", len(brands)), nil
+}
+
+func (v *upstreamVerifier) checkModels(ctx context.Context) (string, error) {
+	if v.brand == "" {
+		return "", errVerifySkipped
+	}
+	models, err := v.list(ctx, "/cars/brands/"+v.brand+"/models", "code", "name")
+	if err != nil {
+		return "", err
+	}
+	v.model = models[0]["code"].(string)
+	return fmt.Sprintf("%d models of brand %s", len(models), v.brand), nil
+}
+
+func (v *upstreamVerifier) checkYears(ctx context.Context) (string, error) {
+	if v.model == "" {
+		return "", errVerifySkipped
+	}
+	years, err := v.list(ctx, v.yearsPath(), "code", "name")
+	if err != nil {
+		return "", err
+	}
+	v.year = years[0]["code"].(string)
+	return fmt.Sprintf("%d years of model %s", len(years), v.model), nil
+}
+
+func (v *upstreamVerifier) checkPrice(ctx context.Context) (string, error) {
+	if v.year == "" {
+		return "", errVerifySkipped
+	}
+	price, err := v.priceAt(ctx, v.yearsPath()+"/"+v.year)
+	if err != nil {
+		return "", err
+	}
+	v.price = price
+	return fmt.Sprintf("%s %s, %s", price["codeFipe"], price["price"], price["referenceMonth"]), nil
+}
+
+func (v *upstreamVerifier) checkFipeCode(ctx context.Context) (string, error) {
+	if v.price == nil {
+		return "", errVerifySkipped
+	}
+	code := v.price["codeFipe"].(string)
+	years, err := v.list(ctx, "/cars/"+code+"/years", "code", "name")
+	if err != nil {
+		return "", err
+	}
+	if !slices.ContainsFunc(years, func(y map[string]interface{}) bool { return y["code"] == v.year }) {
+		return "", fmt.Errorf("years of %s lack %s", code, v.year)
+	}
+	price, err := v.priceAt(ctx, "/cars/"+code+"/years/"+v.year)
+	if err != nil {
+		return "", err
+	}
+	if price["price"] != v.price["price"] {
+		return "", fmt.Errorf("price by code %s differs from %s", price["price"], v.price["price"])
+	}
+	return fmt.Sprintf("%d years of %s", len(years), code), nil
+}
+
+func (v *upstreamVerifier) checkPastReference(ctx context.Context) (string, error) {
+	if len(v.refs) < 2 || v.year == "" {
+		return "", errVerifySkipped
+	}
+	past := v.refs[1]
+	price, err := v.priceAt(ctx, v.yearsPath()+"/"+v.year+"?reference="+past["code"].(string))
+	if err != nil {
+		return "", err
+	}
+	if price["referenceMonth"] != past["month"] {
+		return "", fmt.Errorf("table %s answered for %s, want %s", past["code"], price["referenceMonth"], past["month"])
+	}
+	return fmt.Sprintf("%s in %s", price["price"], past["month"]), nil
+}
+
+// yearsPath is the path of the years list of the car being walked.
+func (v *upstreamVerifier) yearsPath() string {
+	return "/cars/brands/" + v.brand + "/models/" + v.model + "/years"
+}
+
+// list fetches a non-empty JSON list whose items have the non-empty
+// string fields given.
+func (v *upstreamVerifier) list(ctx context.Context, path string, fields ...string) ([]map[string]interface{}, error) {
+	data, err := v.client.Get(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	var items []map[string]interface{}
+	if err := json.Unmarshal(data, &items); err != nil {
+		return nil, fmt.Errorf("%s is not a JSON list of objects: %v", path, err)
+	}
+	if len(items) == 0 {
+		return nil, fmt.Errorf("%s is empty", path)
+	}
+	for i, item := range items {
+		for _, f := range fields {
+			if s, _ := item[f].(string); s == "" {
+				return nil, fmt.Errorf("%s item %d: field %q missing or not a string", path, i, f)
+			}
+		}
+	}
+	return items, nil
+}
+
+// priceFields are the fields of a FIPE price and their JSON types.
+var priceFields = []struct{ name, kind string }{
+	{"price", "string"},
+	{"brand", "string"},
+	{"model", "string"},
+	{"modelYear", "number"},
+	{"fuel", "string"},
+	{"codeFipe", "string"},
+	{"referenceMonth", "string"},
+	{"vehicleType", "number"},
+	{"acronymFuel", "string"},
+}
+
+// priceAt fetches the price at path and checks its fields.
+func (v *upstreamVerifier) priceAt(ctx context.Context, path string) (map[string]interface{}, error) {
+	data, err := v.client.Get(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	var price map[string]interface{}
+	if err := json.Unmarshal(data, &price); err != nil {
+		return nil, fmt.Errorf("%s is not a JSON object: %v", path, err)
+	}
+	for _, f := range priceFields {
+		ok := false
+		switch f.kind {
+		case "string":
+			_, ok = price[f.name].(string)
+		case "number":
+			_, ok = price[f.name].(float64)
+		}
+		if !ok {
+			return nil, fmt.Errorf("field %q missing or not a %s", f.name, f.kind)
+		}
+	}
+	if n, err := fipe.ParsePrice(price["price"].(string)); err != nil || n <= 0 {
+		return nil, fmt.Errorf("field \"price\": %q is not a price", price["price"])
+	}
+	if _, _, ok := parseReferenceMonth(price["referenceMonth"].(string)); !ok {
+		return nil, fmt.Errorf("field \"referenceMonth\": %q does not parse", price["referenceMonth"])
+	}
+	if !fipe.ValidCode(price["codeFipe"].(string)) {
+		return nil, fmt.Errorf("field \"codeFipe\": %q is not a FIPE code", price["codeFipe"])
+	}
+	return price, nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// --- Voice intents ---
+//
+// POST /api/voice/intent maps the slots of a voice assistant intent (Alexa
+// skill, Google Assistant action, ...) to a spoken answer, so a voice app
+// only needs a thin adapter forwarding its slots:
+//
+//	{"intent": "GetVehiclePrice", "locale": "pt-BR",
+//	 "slots": {"vehicleType": "", "brand": "Chevrolet", "model": "Onix", "year": "2019"}}
+//
+// Slots are resolved like chatbot messages (see resolveVehicle), except
+// that without a brand only the brands whose models are cached are
+// searched, so one intent cannot fetch every brand's models from FIPE. The
+// answer carries plain speech, SSML, a display card and whether the session
+// should end; a missing model asks for it again instead of failing. Each
+// client IP may send GOFIPE_VOICE_LIMIT_RPM intents per minute (default
+// 30), unless it sends one of the GOFIPE_API_KEYS, as adapters forwarding
+// many users from a few addresses should.
+
+const (
+	voiceIntentPrice     = "GetVehiclePrice"
+	defaultVoiceLimitRPM = 30
+)
+
+// voicePhrases holds the spoken templates of one locale.
+type voicePhrases struct {
+	Price, AskModel, NotFound, YearNotFound, Unavailable, Help, Currency string
+}
+
+var voiceLocalePhrases = map[string]voicePhrases{
+	"pt-BR": {
+		Price:        "%s %s, ano %s, vale %s na tabela FIPE de %s.",
+		AskModel:     "Qual é o modelo do veículo?",
+		NotFound:     "Não encontrei esse veículo na tabela FIPE.",
+		YearNotFound: "Não encontrei o %s do ano %s na tabela FIPE.",
+		Unavailable:  "A tabela FIPE está indisponível no momento. Tente novamente mais tarde.",
+		Help:         "Diga a marca, o modelo e o ano, por exemplo: quanto vale um Onix 2019?",
+		Currency:     "reais",
+	},
+	"en-US": {
+		Price:        "The %s %s, year %s, is worth %s in the FIPE table of %s.",
+		AskModel:     "Which vehicle model?",
+		NotFound:     "I could not find that vehicle in the FIPE table.",
+		YearNotFound: "I could not find the %s from %s in the FIPE table.",
+		Unavailable:  "The FIPE table is unavailable right now. Please try again later.",
+		Help:         "Say the brand, model and year, for example: how much is an Onix 2019?",
+		Currency:     "Brazilian reais",
+	},
+}
+
+// voiceIntentsCounter counts voice intents by result.
+var voiceIntentsCounter = newBudgetedCounterVec(
+	prometheus.CounterOpts{
+		Name: "fipe_voice_intents_total",
+		Help: "Voice intents by result (answered, reprompt, help, not_found, error, limited)",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	registerBudgeted(voiceIntentsCounter)
+}
+
+// VoiceRequest is the body of POST /api/voice/intent.
+type VoiceRequest struct {
+	Intent string            `json:"intent"`
+	Locale string            `json:"locale"`
+	Slots  map[string]string `json:"slots"`
+}
+
+// VoiceCard is the text shown on devices with a screen.
+type VoiceCard struct {
+	Title string `json:"title"`
+	Text  string `json:"text"`
+}
+
+// VoiceVehicle identifies the resolved vehicle.
+type VoiceVehicle struct {
+	VehicleType string `json:"vehicleType"`
+	BrandID     string `json:"brandId"`
+	ModelID     string `json:"modelId"`
+	YearID      string `json:"yearId"`
+	URL         string `json:"url"`
+}
+
+// VoiceResponse is the answer of POST /api/voice/intent.
+type VoiceResponse struct {
+	Status     string        `json:"status"`
+	Speech     string        `json:"speech"`
+	SSML       string        `json:"ssml"`
+	EndSession bool          `json:"endSession"`
+	Card       *VoiceCard    `json:"card,omitempty"`
+	Vehicle    *VoiceVehicle `json:"vehicle,omitempty"`
+}
+
+// voiceAnswer builds a response whose SSML is the escaped speech.
+func voiceAnswer(status, speech string, endSession bool) VoiceResponse {
+	return VoiceResponse{
+		Status:     status,
+		Speech:     speech,
+		SSML:       "<speak>" + html.EscapeString(speech) + "</speak>",
+		EndSession: endSession,
+	}
+}
+
+// spokenAmount formats a price for speech, dropping zero cents.
+func spokenAmount(v float64, l Locale, p voicePhrases) string {
+	s := l.FormatNumber(v)
+	s = strings.TrimSuffix(s, l.DecimalSep+"00")
+	return s + " " + p.Currency
+}
+
+// answerVoiceIntent resolves the intent slots and builds the spoken answer.
+func answerVoiceIntent(r *http.Request, req VoiceRequest, l Locale) VoiceResponse {
+	p := voiceLocalePhrases[l.Tag]
+	if req.Intent != voiceIntentPrice {
+		return voiceAnswer("help", p.Help, false)
+	}
+	if strings.TrimSpace(req.Slots["model"]) == "" {
+		return voiceAnswer("reprompt", p.AskModel, false)
+	}
+
+	q := parseVehicleQuery(strings.Join([]string{req.Slots["vehicleType"], req.Slots["brand"], req.Slots["model"], req.Slots["year"]}, " "))
+	q.CachedModelsOnly = true
+	if _, ok := vehicleTypes[req.Slots["vehicleType"]]; ok {
+		q.VehicleType = req.Slots["vehicleType"]
+	}
+	v, pr, err := lookupVehiclePrice(r.Context(), q)
+	f, perr := pr.Value()
+	switch {
+	case errors.Is(err, errVehicleNotFound):
+		return voiceAnswer("not_found", p.NotFound, true)
+	case errors.Is(err, errYearNotFound):
+		return voiceAnswer("not_found", fmt.Sprintf(p.YearNotFound, v.ModelName, q.Year), true)
+	case err != nil || perr != nil:
+		slog.ErrorContext(r.Context(), "voice intent lookup failed", "error", errors.Join(err, perr))
+		return voiceAnswer("error", p.Unavailable, true)
+	}
+
+	ref := pr.ReferenceMonth
+	if month, year, ok := parseReferenceMonth(ref); ok {
+		ref = l.FormatMonth(month, year)
+	}
+	year, _, _ := strings.Cut(v.YearID, "-")
+	if year == zeroKmYear {
+		year = "0 km"
+	}
+	resp := voiceAnswer("answered", fmt.Sprintf(p.Price, pr.Brand, pr.Model, year, spokenAmount(f, l, p), ref), true)
+	// Read the amount as a number instead of digit by digit.
+	amount := "<say-as interpret-as=\"cardinal\">" + strconv.FormatFloat(math.Round(f), 'f', 0, 64) + "</say-as> " + p.Currency
+	resp.SSML = "<speak>" + fmt.Sprintf(p.Price, html.EscapeString(pr.Brand), html.EscapeString(pr.Model), year, amount, html.EscapeString(ref)) + "</speak>"
+	resp.Card = &VoiceCard{
+		Title: pr.Brand + " " + pr.Model,
+		Text:  fmt.Sprintf("%s · %s · %s", v.YearName, l.FormatBRL(f), ref),
+	}
+	path := vehiclePath(v.VehicleType, v.BrandID, v.ModelID, v.YearID)
+	resp.Vehicle = &VoiceVehicle{VehicleType: v.VehicleType, BrandID: v.BrandID, ModelID: v.ModelID, YearID: v.YearID, URL: absoluteURL(path)}
+	return resp
+}
+
+// voiceIntents serves POST /api/voice/intent.
+type voiceIntents struct {
+	limiter *clientPolicy
+}
+
+// newVoiceIntents reads GOFIPE_VOICE_LIMIT_RPM.
+func newVoiceIntents() (*voiceIntents, error) {
+	limit := defaultVoiceLimitRPM
+	if v := os.Getenv("GOFIPE_VOICE_LIMIT_RPM"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("GOFIPE_VOICE_LIMIT_RPM must be a positive integer")
+		}
+		limit = n
+	}
+	return &voiceIntents{limiter: &clientPolicy{limitRPM: limit, windows: map[string]rateWindow{}}}, nil
+}
+
+// ServeHTTP implements http.Handler.
+func (v *voiceIntents) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	recordHTTPRequest("/api/voice/intent", r.Method)
+	if _, ok := apiKeyName(r); !ok {
+		if ok, retry := v.limiter.allow(clientIP(r), time.Now()); !ok {
+			voiceIntentsCounter.Inc("limited")
+			writeRetryLater(w, http.StatusTooManyRequests, "too many requests", time.Duration(retry)*time.Second, nil)
+			return
+		}
+	}
+	var req VoiceRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16<<10)).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	l, err := lookupLocale(req.Locale)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := answerVoiceIntent(r, req, l)
+	voiceIntentsCounter.Inc(resp.Status)
+	b, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
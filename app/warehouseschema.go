@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// --- Warehouse export schema ---
+//
+// The columns exported to ClickHouse and BigQuery form a versioned schema,
+// so downstream pipelines can rely on them: every row carries the
+// schema_version it was written with, and the schema only ever grows.
+// Adding a column means appending it to warehouseSchema with Since set to a
+// new warehouseSchemaVersion, appending the matching field to warehouseRow,
+// and recording the fingerprint of the new version in
+// warehouseSchemaReleases. Renaming, retyping, reordering or removing a
+// released column changes the fingerprint of its version, and
+// checkWarehouseSchema stops the server at startup. Both sinks ignore
+// columns the target table does not have yet, so gofipe can be upgraded
+// before the tables are altered.
+
+// warehouseSchemaVersion is the version of the rows exported.
+const warehouseSchemaVersion = 1
+
+// warehouseColumn is a column of the export schema.
+type warehouseColumn struct {
+	Name string
+	// Type is the BigQuery type: STRING, INT64, FLOAT64, DATE or TIMESTAMP.
+	Type     string
+	Nullable bool
+	// Since is the schema version that added the column.
+	Since int
+}
+
+// warehouseSchema lists the exported columns in warehouseRow order.
+var warehouseSchema = []warehouseColumn{
+	{"schema_version", "INT64", false, 1},
+	{"vehicle_type", "STRING", false, 1},
+	{"brand_id", "STRING", false, 1},
+	{"model_id", "STRING", false, 1},
+	{"year_id", "STRING", false, 1},
+	{"reference_code", "STRING", false, 1},
+	{"reference_month", "DATE", true, 1},
+	{"fipe_code", "STRING", false, 1},
+	{"brand", "STRING", false, 1},
+	{"model", "STRING", false, 1},
+	{"model_year", "INT64", false, 1},
+	{"fuel", "STRING", false, 1},
+	{"price", "FLOAT64", true, 1},
+	{"collected_at", "TIMESTAMP", false, 1},
+}
+
+// warehouseSchemaReleases maps each released schema version to the
+// fingerprint of its columns. Entries are never changed once released.
+var warehouseSchemaReleases = map[int]string{
+	1: "73fc9691645e9c9b",
+}
+
+// warehouseGoTypes are the warehouseRow field types of each column type.
+var warehouseGoTypes = map[string]reflect.Type{
+	"STRING":    reflect.TypeFor[string](),
+	"INT64":     reflect.TypeFor[int](),
+	"FLOAT64":   reflect.TypeFor[float64](),
+	"DATE":      reflect.TypeFor[string](),
+	"TIMESTAMP": reflect.TypeFor[string](),
+}
+
+func init() {
+	if err := checkWarehouseSchema(); err != nil {
+		panic("warehouse export schema: " + err.Error())
+	}
+}
+
+// warehouseSchemaFingerprint hashes the columns of schema version v.
+func warehouseSchemaFingerprint(v int) string {
+	h := sha256.New()
+	for _, c := range warehouseSchema {
+		if c.Since <= v {
+			fmt.Fprintf(h, "%s %s %t\n", c.Name, c.Type, c.Nullable)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// checkWarehouseSchema verifies that the schema only grew since its
+// released versions and that warehouseRow matches it.
+func checkWarehouseSchema() error {
+	since := 1
+	for _, c := range warehouseSchema {
+		if c.Since < since || c.Since > warehouseSchemaVersion {
+			return fmt.Errorf("column %s: new columns go last, with Since between %d and %d", c.Name, since, warehouseSchemaVersion)
+		}
+		since = c.Since
+	}
+	for v := 1; v <= warehouseSchemaVersion; v++ {
+		want, ok := warehouseSchemaReleases[v]
+		if !ok {
+			return fmt.Errorf("version %d has no recorded fingerprint (%s)", v, warehouseSchemaFingerprint(v))
+		}
+		if got := warehouseSchemaFingerprint(v); got != want {
+			return fmt.Errorf("columns of released version %d changed (fingerprint %s, want %s); only append columns", v, got, want)
+		}
+	}
+	row := reflect.TypeFor[warehouseRow]()
+	if row.NumField() != len(warehouseSchema) {
+		return fmt.Errorf("warehouseRow has %d fields for %d columns", row.NumField(), len(warehouseSchema))
+	}
+	for i, c := range warehouseSchema {
+		f := row.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		want := warehouseGoTypes[c.Type]
+		if c.Nullable {
+			want = reflect.PointerTo(want)
+		}
+		if name != c.Name || f.Type != want {
+			return fmt.Errorf("warehouseRow field %s (%s %s) does not match column %s (%s)", f.Name, name, f.Type, c.Name, want)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"gofipe/pkg/fipe"
+)
+
+// --- Watchlist ---
+//
+// API key holders register the vehicles they track under /api/watchlist,
+// kept in the history store (GOFIPE_HISTORY_DB) per key name:
+//
+//   - POST   /api/watchlist with {"type", "brandId", "modelId", "yearId"}
+//     adds a vehicle (201, or 200 when already listed). Vehicles unknown to
+//     FIPE get 404.
+//   - GET    /api/watchlist lists the caller's vehicles, oldest first.
+//   - DELETE /api/watchlist?type=&brandId=&modelId=&yearId= removes one
+//     (204, or 404 when not listed).
+//
+// Watched vehicles of every key join GOFIPE_HISTORY_WATCH in the history
+// collector, which also keeps their brand, model and year lists cached. A
+// new vehicle is collected right away. The routes are registered only when
+// both API keys and the history store are configured.
+
+// maxWatchlistVehicles bounds the vehicles watched per API key.
+const maxWatchlistVehicles = 100
+
+// WatchlistEntry is a watched vehicle of /api/watchlist.
+type WatchlistEntry struct {
+	watchedVehicle
+	AddedAt time.Time `json:"addedAt"`
+}
+
+// addWatch adds v to the watchlist of owner, reporting whether it is new.
+func (s *historyStore) addWatch(ctx context.Context, owner string, v watchedVehicle) (bool, error) {
+	res, err := s.db.ExecContext(ctx, s.rebind(`INSERT INTO watchlist
+		(owner, vehicle_type, brand_id, model_id, year_id, added_at)
+		VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING`),
+		owner, v.Type, v.BrandID, v.ModelID, v.YearID, appClock.Now().Unix())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// removeWatch removes v from the watchlist of owner, reporting whether it was listed.
+func (s *historyStore) removeWatch(ctx context.Context, owner string, v watchedVehicle) (bool, error) {
+	res, err := s.db.ExecContext(ctx, s.rebind(`DELETE FROM watchlist
+		WHERE owner = ? AND vehicle_type = ? AND brand_id = ? AND model_id = ? AND year_id = ?`),
+		owner, v.Type, v.BrandID, v.ModelID, v.YearID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// watches lists the watchlist of owner, oldest first.
+func (s *historyStore) watches(ctx context.Context, owner string) ([]WatchlistEntry, error) {
+	rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT vehicle_type, brand_id, model_id, year_id, added_at
+		FROM watchlist WHERE owner = ? ORDER BY added_at, vehicle_type, brand_id, model_id, year_id`), owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []WatchlistEntry{}
+	for rows.Next() {
+		var e WatchlistEntry
+		var added int64
+		if err := rows.Scan(&e.Type, &e.BrandID, &e.ModelID, &e.YearID, &added); err != nil {
+			return nil, err
+		}
+		e.AddedAt = time.Unix(added, 0).UTC()
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+// watchedVehicles lists the vehicles watched by any owner.
+func (s *historyStore) watchedVehicles(ctx context.Context) ([]watchedVehicle, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT DISTINCT vehicle_type, brand_id, model_id, year_id FROM watchlist`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []watchedVehicle
+	for rows.Next() {
+		var v watchedVehicle
+		if err := rows.Scan(&v.Type, &v.BrandID, &v.ModelID, &v.YearID); err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, rows.Err()
+}
+
+// mergeWatched returns a followed by the vehicles of b it does not list.
+func mergeWatched(a, b []watchedVehicle) []watchedVehicle {
+	seen := make(map[watchedVehicle]bool, len(a))
+	out := make([]watchedVehicle, 0, len(a)+len(b))
+	for _, list := range [][]watchedVehicle{a, b} {
+		for _, v := range list {
+			if !seen[v] {
+				seen[v] = true
+				out = append(out, v)
+			}
+		}
+	}
+	return out
+}
+
+// handleWatchlist serves /api/watchlist for the caller's API key.
+func handleWatchlist(w http.ResponseWriter, r *http.Request) {
+	recordHTTPRequest("/api/watchlist", r.Method)
+	owner, _ := apiKeyName(r)
+	switch r.Method {
+	case http.MethodGet:
+		entries, err := historyDB.watches(r.Context(), owner)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "watchlist query failed", "error", err)
+			http.Error(w, "watchlist unavailable", http.StatusInternalServerError)
+			return
+		}
+		b, _ := json.Marshal(map[string]interface{}{"watchlist": entries})
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	case http.MethodPost:
+		addWatchlistVehicle(w, r, owner)
+	case http.MethodDelete:
+		q := r.URL.Query()
+		v := watchedVehicle{Type: q.Get("type"), BrandID: q.Get("brandId"), ModelID: q.Get("modelId"), YearID: q.Get("yearId")}
+		if err := v.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		removed, err := historyDB.removeWatch(r.Context(), owner, v)
+		switch {
+		case err != nil:
+			slog.ErrorContext(r.Context(), "watchlist query failed", "error", err)
+			http.Error(w, "watchlist unavailable", http.StatusInternalServerError)
+		case !removed:
+			http.Error(w, "vehicle not in the watchlist", http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
+
+// addWatchlistVehicle serves POST /api/watchlist.
+func addWatchlistVehicle(w http.ResponseWriter, r *http.Request, owner string) {
+	var v watchedVehicle
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16<<10)).Decode(&v); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if err := v.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	entries, err := historyDB.watches(r.Context(), owner)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "watchlist query failed", "error", err)
+		http.Error(w, "watchlist unavailable", http.StatusInternalServerError)
+		return
+	}
+	for _, e := range entries {
+		if e.watchedVehicle == v {
+			writeWatchlistEntry(w, http.StatusOK, e)
+			return
+		}
+	}
+	if len(entries) >= maxWatchlistVehicles {
+		http.Error(w, fmt.Sprintf("watchlist is limited to %d vehicles", maxWatchlistVehicles), http.StatusConflict)
+		return
+	}
+
+	// Only vehicles FIPE knows are accepted; the lookup also caches the years list.
+	years, err := fipeClient.Years(r.Context(), v.Type, v.BrandID, v.ModelID)
+	var se *fipe.StatusError
+	switch {
+	case errors.As(err, &se) && se.StatusCode == http.StatusNotFound:
+		http.Error(w, "vehicle not found", http.StatusNotFound)
+		return
+	case err != nil:
+		writeUpstreamError(w, err)
+		return
+	}
+	if !yearListed(years, v.YearID) {
+		http.Error(w, "vehicle not found", http.StatusNotFound)
+		return
+	}
+
+	added, err := historyDB.addWatch(r.Context(), owner, v)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "watchlist query failed", "error", err)
+		http.Error(w, "watchlist unavailable", http.StatusInternalServerError)
+		return
+	}
+	if added {
+		go func() {
+			ctx := withUpstreamPriority(context.Background(), upstreamBackground)
+			if err := historyDB.collect(ctx, []watchedVehicle{v}, nil); err != nil {
+				slog.Error("history collector failed", "error", err)
+			}
+		}()
+	}
+	writeWatchlistEntry(w, http.StatusCreated, WatchlistEntry{watchedVehicle: v, AddedAt: appClock.Now().UTC().Truncate(time.Second)})
+}
+
+// yearListed reports whether yearID is one of years.
+func yearListed(years []fipe.Reference, yearID string) bool {
+	for _, y := range years {
+		if y.Code == yearID {
+			return true
+		}
+	}
+	return false
+}
+
+// writeWatchlistEntry writes e as JSON with status.
+func writeWatchlistEntry(w http.ResponseWriter, status int, e WatchlistEntry) {
+	b, _ := json.Marshal(e)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// registerWatchlistEndpoints adds /api/watchlist, /api/alerts and
+// /api/baskets when API keys and the history store are configured.
+func registerWatchlistEndpoints(mux *http.ServeMux) {
+	if len(apiKeys) == 0 || historyDB == nil {
+		return
+	}
+	mux.HandleFunc("GET /api/watchlist", requireAPIKey(handleWatchlist))
+	mux.HandleFunc("POST /api/watchlist", requireAPIKey(handleWatchlist))
+	mux.HandleFunc("DELETE /api/watchlist", requireAPIKey(handleWatchlist))
+	mux.HandleFunc("GET /api/alerts", requireAPIKey(handleAlerts))
+	mux.HandleFunc("POST /api/alerts", requireAPIKey(handleAlerts))
+	mux.HandleFunc("DELETE /api/alerts", requireAPIKey(handleAlerts))
+	mux.HandleFunc("GET /api/baskets", requireAPIKey(handleBaskets))
+	mux.HandleFunc("GET /api/baskets/{name}", requireAPIKey(handleBasket))
+	mux.HandleFunc("PUT /api/baskets/{name}", requireAPIKey(handleBasket))
+	mux.HandleFunc("DELETE /api/baskets/{name}", requireAPIKey(handleBasket))
+}
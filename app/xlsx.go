@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+
+	"gofipe/pkg/fipe"
+)
+
+// --- Excel export ---
+//
+// GET /api/export/xlsx returns the price history of the vehicles listed
+// in vehicles (type/brandId/modelId/yearId, comma-separated, at most
+// maxXLSXVehicles) as an Excel workbook, for dealership users who live in
+// Excel: one vehicle exports its history, several a comparison. Each
+// vehicle gets a sheet named after it with the CSV export's columns,
+// oldest month first, prices as numbers formatted in reais (Excel applies
+// the reader's separators), and a line chart of the price next to the
+// table. months (default 12, max 24) and includeSuspect work as in
+// /api/priceHistory. The workbook is sent as an attachment.
+//
+// An export costs up to maxXLSXVehicles times 24 FIPE lookups, and the
+// PDF report a price history too, so each client IP may ask for
+// GOFIPE_EXPORT_LIMIT_RPM documents per minute (default 10) across both
+// and gets 429 beyond that; one of the GOFIPE_API_KEYS in X-API-Key lifts
+// the limit.
+
+const (
+	maxXLSXVehicles       = 10
+	defaultExportLimitRPM = 10
+)
+
+// xlsxContentType is the media type of Excel workbooks.
+const xlsxContentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+// newExportLimit reads GOFIPE_EXPORT_LIMIT_RPM and returns the middleware
+// limiting the document exports it wraps, sharing one budget per client IP.
+func newExportLimit() (func(http.HandlerFunc) http.HandlerFunc, error) {
+	limit := defaultExportLimitRPM
+	if v := os.Getenv("GOFIPE_EXPORT_LIMIT_RPM"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("GOFIPE_EXPORT_LIMIT_RPM must be a positive integer")
+		}
+		limit = n
+	}
+	limiter := &clientPolicy{limitRPM: limit, windows: map[string]rateWindow{}}
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := apiKeyName(r); !ok {
+				if ok, retry := limiter.allow(clientIP(r), time.Now()); !ok {
+					writeRetryLater(w, http.StatusTooManyRequests, "too many exports", time.Duration(retry)*time.Second, nil)
+					return
+				}
+			}
+			next(w, r)
+		}
+	}, nil
+}
+
+// handleXLSXExport serves GET /api/export/xlsx.
+func handleXLSXExport(w http.ResponseWriter, r *http.Request) {
+	recordHTTPRequest("/api/export/xlsx", r.Method)
+	q := r.URL.Query()
+	vehicles, err := parseWatchedVehicles(q.Get("vehicles"))
+	if err != nil {
+		http.Error(w, "vehicles: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(vehicles) == 0 || len(vehicles) > maxXLSXVehicles {
+		http.Error(w, fmt.Sprintf("vehicles must list 1 to %d vehicles as type/brandId/modelId/yearId", maxXLSXVehicles), http.StatusBadRequest)
+		return
+	}
+	months, err := strconv.Atoi(q.Get("months"))
+	if err != nil || months <= 0 {
+		months = defaultHistoryMonths
+	}
+	months = min(months, maxHistoryMonths)
+	includeSuspect := q.Get("includeSuspect") == "true"
+
+	histories := make([][]fipe.Price, len(vehicles))
+	errs := make([]error, len(vehicles))
+	var wg sync.WaitGroup
+	for i, v := range vehicles {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			histories[i], errs[i] = priceHistory(r.Context(), v.Type, v.BrandID, v.ModelID, v.YearID, months, includeSuspect)
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			writeUpstreamError(w, err)
+			return
+		}
+	}
+
+	f, err := historyWorkbook(histories)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "build xlsx export failed", "error", err)
+		http.Error(w, "export failed", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	name := "fipe-history-" + vehicles[0].ModelID + "-" + vehicles[0].YearID
+	if len(vehicles) > 1 {
+		name = "fipe-comparison"
+	}
+	w.Header().Set("Content-Type", xlsxContentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + ".xlsx"}))
+	if _, err := f.WriteTo(w); err != nil {
+		slog.ErrorContext(r.Context(), "write xlsx export failed", "error", err)
+	}
+}
+
+// historyWorkbook builds a workbook with a sheet and chart per history,
+// each newest first as returned by priceHistory.
+func historyWorkbook(histories [][]fipe.Price) (*excelize.File, error) {
+	f := excelize.NewFile()
+	moneyFormat := `"R$" #,##0.00`
+	money, err := f.NewStyle(&excelize.Style{CustomNumFmt: &moneyFormat})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	bold, err := f.NewStyle(&excelize.Style{Font: &excelize.Font{Bold: true}})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	used := map[string]bool{}
+	for i, history := range histories {
+		sheet := xlsxSheetName(history, i, used)
+		if i == 0 {
+			err = f.SetSheetName("Sheet1", sheet)
+		} else {
+			_, err = f.NewSheet(sheet)
+		}
+		if err == nil {
+			err = writeHistorySheet(f, sheet, history, money, bold)
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// writeHistorySheet fills sheet with history, oldest month first, and
+// charts its prices.
+func writeHistorySheet(f *excelize.File, sheet string, history []fipe.Price, money, bold int) error {
+	header := csvColumns
+	if err := f.SetSheetRow(sheet, "A1", &header); err != nil {
+		return err
+	}
+	if err := f.SetCellStyle(sheet, "A1", "H1", bold); err != nil {
+		return err
+	}
+	for i := range history {
+		pr := history[len(history)-1-i]
+		var value interface{}
+		if v, err := pr.Value(); err == nil {
+			value = v
+		}
+		row := []interface{}{pr.ReferenceMonth, pr.Brand, pr.Model, pr.ModelYear, pr.Fuel, pr.CodeFipe, value, "BRL"}
+		if err := f.SetSheetRow(sheet, fmt.Sprintf("A%d", i+2), &row); err != nil {
+			return err
+		}
+	}
+	if err := f.SetColWidth(sheet, "A", "H", 16); err != nil {
+		return err
+	}
+	if len(history) == 0 {
+		return nil
+	}
+	last := len(history) + 1
+	if err := f.SetCellStyle(sheet, "G2", fmt.Sprintf("G%d", last), money); err != nil {
+		return err
+	}
+	ref := "'" + strings.ReplaceAll(sheet, "'", "''") + "'"
+	return f.AddChart(sheet, "J2", &excelize.Chart{
+		Type: excelize.Line,
+		Series: []excelize.ChartSeries{{
+			Name:       ref + "!$G$1",
+			Categories: fmt.Sprintf("%s!$A$2:$A$%d", ref, last),
+			Values:     fmt.Sprintf("%s!$G$2:$G$%d", ref, last),
+		}},
+		Title:  excelize.ChartTitle{Paragraph: []excelize.RichTextRun{{Text: sheet}}},
+		Legend: excelize.ChartLegend{Position: "none"},
+	})
+}
+
+// xlsxSheetName names the sheet of the i-th history after its vehicle,
+// within Excel's 31 characters and unique among used.
+func xlsxSheetName(history []fipe.Price, i int, used map[string]bool) string {
+	name := fmt.Sprintf("Vehicle %d", i+1)
+	if len(history) > 0 {
+		pr := history[0]
+		label := strings.Map(func(r rune) rune {
+			if strings.ContainsRune(`:\/?*[]`, r) {
+				return ' '
+			}
+			return r
+		}, fmt.Sprintf("%s %s %d", pr.Brand, pr.Model, pr.ModelYear))
+		if label = strings.Trim(strings.Join(strings.Fields(label), " "), "'"); label != "" {
+			name = label
+		}
+	}
+	base := []rune(name)
+	if len(base) > 31 {
+		base = base[:31]
+	}
+	name = string(base)
+	// Excel compares sheet names case-insensitively.
+	for n := 2; used[strings.ToLower(name)]; n++ {
+		suffix := fmt.Sprintf(" (%d)", n)
+		name = string(base[:min(len(base), 31-len(suffix))]) + suffix
+	}
+	used[strings.ToLower(name)] = true
+	return name
+}